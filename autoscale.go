@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	autoscale    = flag.Bool("autoscale", false, "instead of a fixed number of workers, start with one and keep doubling them for as long as that makes the reads faster, backing off to the best count when it stops helping or when reads start failing; the count chosen is printed and recorded in the summary. Can't be combined with --workers; storages given workers by --rules keep them")
+	autoscaleMax = flag.Int("autoscale-max", 64, "the most workers --autoscale will try")
+)
+
+// Tuning for the autoscaler.
+const (
+	autoscaleWindow   = 10 * time.Second // how long to measure each worker count
+	autoscaleMinBlobs = 20               // fewer blobs than this in a window is too few to judge
+	autoscaleGain     = 1.1              // more workers must be this much faster to be worth it
+	autoscaleErrors   = 0.02             // more workers mustn't fail this much more often
+)
+
+// An autoscaler picks how many of a verifier's workers may read at once.
+//
+// The verifier starts --autoscale-max workers, and each waits its turn (see
+// enter and leave) while the limit is below that. The autoscaler measures the
+// throughput at each limit for a while, and doubles the limit for as long as
+// that makes reads at least autoscaleGain times faster without failing more
+// often. Once it stops helping, the limit goes back to the best one seen, and
+// stays there: more workers than that only add contention, be it seeks on a
+// hard drive or throttling by a cloud provider.
+//
+// A nil *autoscaler lets every worker read at once.
+type autoscaler struct {
+	prefix string
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+	max    int
+
+	// What was read since start, at the current limit.
+	start    time.Time
+	blobs    int
+	failures int
+	bytes    int64
+
+	best     int     // the best limit so far
+	bestRate float64 // its throughput, in bytes per second
+	bestErrs float64 // and its rate of failed reads
+	settled  bool
+}
+
+// newAutoscaler returns an autoscaler for the verifier of the storage at
+// prefix, or nil if --autoscale isn't set. Its waiters give up when ctx is
+// done.
+func newAutoscaler(ctx context.Context, prefix string) *autoscaler {
+	if !*autoscale {
+		return nil
+	}
+	a := &autoscaler{prefix: prefix, limit: 1, max: *autoscaleMax, start: time.Now()}
+	a.cond = sync.NewCond(&a.mu)
+	go func() {
+		<-ctx.Done()
+		a.mu.Lock()
+		a.cond.Broadcast()
+		a.mu.Unlock()
+	}()
+	return a
+}
+
+// checkAutoscale checks --autoscale and --autoscale-max before the run.
+func checkAutoscale() error {
+	if !*autoscale {
+		return nil
+	}
+	if flagWasSet("workers") {
+		return fmt.Errorf("--autoscale picks the number of workers itself, so it can't be combined with --workers")
+	}
+	if *autoscaleMax < 1 {
+		return fmt.Errorf("--autoscale-max must be positive")
+	}
+	return nil
+}
+
+// enter waits until one more worker may read.
+func (a *autoscaler) enter(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.active >= a.limit && ctx.Err() == nil {
+		a.cond.Wait()
+	}
+	a.active++
+}
+
+// leave lets the next worker in, once one is done reading.
+func (a *autoscaler) leave() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	a.cond.Broadcast()
+}
+
+// observe records that a worker read a blob of size bytes, which failed
+// verification if failed is set.
+func (a *autoscaler) observe(size uint32, failed bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.blobs++
+	a.bytes += int64(size)
+	if failed {
+		a.failures++
+	}
+	if elapsed := time.Since(a.start); !a.settled && elapsed >= autoscaleWindow && a.blobs >= autoscaleMinBlobs {
+		a.adjust(float64(a.bytes)/elapsed.Seconds(), float64(a.failures)/float64(a.blobs))
+		a.start, a.blobs, a.failures, a.bytes = time.Now(), 0, 0, 0
+		a.cond.Broadcast()
+	}
+}
+
+// adjust judges the current limit by the throughput and error rate it got,
+// and picks the next one. a.mu must be held.
+func (a *autoscaler) adjust(rate, errs float64) {
+	if a.best == 0 || (rate >= autoscaleGain*a.bestRate && errs <= a.bestErrs+autoscaleErrors) {
+		a.best, a.bestRate, a.bestErrs = a.limit, rate, errs
+		if a.limit < a.max {
+			a.limit *= 2
+			if a.limit > a.max {
+				a.limit = a.max
+			}
+			return
+		}
+	}
+	a.limit, a.settled = a.best, true
+	fmt.Printf("%v: autoscaling settled on %v worker%v (%v/s)\n", a.prefix, a.best, plural(a.best), humanBytes(int64(a.bestRate)))
+}
+
+// workers returns the number of workers chosen, and whether the autoscaler
+// settled on it; if not, it's the number it was trying when the run ended.
+func (a *autoscaler) workers() (int, bool) {
+	if a == nil {
+		return 0, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.settled {
+		return a.best, true
+	}
+	return a.limit, false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"go4.org/jsonconfig"
+)
+
+// diskpackedFileRE matches the pack files of a diskpacked storage.
+var diskpackedFileRE = regexp.MustCompile(`^pack-[0-9]{5}\.blobs$`)
+
+// bareDirConfig makes up a config for verifying dir, a copy of a blob
+// directory (like an rsync'd backup) that has no server config of its own,
+// by recognizing which storage wrote it:
+//
+//   - diskpacked: pack-00000.blobs files, with their index;
+//   - blobpacked, as perkeep sets it up for a local blobPath with
+//     packRelated: loose blobs in the localdisk layout, packed ones in the
+//     localdisk layout under "packed", and packed/packindex.leveldb (or
+//     .kv) as the meta index;
+//   - localdisk: just the localdisk layout.
+//
+// It also returns a description of what it found.
+func bareDirConfig(dir string) (*LowLevelConfig, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && diskpackedFileRE.MatchString(e.Name()) {
+			return &LowLevelConfig{Prefixes: map[string]StorageConfig{
+				"/bs/": {StorageHandler: "diskpacked", StorageHandlerArgs: jsonconfig.Obj{"path": dir}},
+			}}, "a diskpacked storage", nil
+		}
+	}
+	packed := filepath.Join(dir, "packed")
+	if index, typ, ok := packIndex(packed); ok {
+		return &LowLevelConfig{Prefixes: map[string]StorageConfig{
+			"/bs-loose/":  {StorageHandler: "filesystem", StorageHandlerArgs: jsonconfig.Obj{"path": dir}},
+			"/bs-packed/": {StorageHandler: "filesystem", StorageHandlerArgs: jsonconfig.Obj{"path": packed}},
+			"/bs/": {StorageHandler: "blobpacked", StorageHandlerArgs: jsonconfig.Obj{
+				"smallBlobs": "/bs-loose/",
+				"largeBlobs": "/bs-packed/",
+				"metaIndex":  map[string]interface{}{"type": typ, "file": index},
+			}},
+		}}, "a blobpacked storage (loose blobs, packed blobs in packed/, and " + filepath.Base(index) + ")", nil
+	}
+	if dirs, err := subdirs(dir, hashDirRE); err == nil && len(dirs) > 0 {
+		return &LowLevelConfig{Prefixes: map[string]StorageConfig{
+			"/bs/": {StorageHandler: "filesystem", StorageHandlerArgs: jsonconfig.Obj{"path": dir}},
+		}}, "a localdisk storage", nil
+	}
+	return nil, "", fmt.Errorf("%v doesn't look like a blob directory: it has no localdisk layout (like sha224/ab/cd/...), pack-*.blobs files, or packed/packindex", dir)
+}
+
+// packIndex returns the blobpacked meta index in dir, and its sorted type.
+func packIndex(dir string) (file, typ string, ok bool) {
+	for _, idx := range []struct{ name, typ string }{
+		{"packindex.leveldb", "leveldb"},
+		{"packindex.kv", "kv"},
+	} {
+		path := filepath.Join(dir, idx.name)
+		if _, err := os.Stat(path); err == nil {
+			return path, idx.typ, true
+		}
+	}
+	return "", "", false
+}
+
+// isDir reports whether path is a directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
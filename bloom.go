@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	bloomOut     = flag.String("bloom-out", "", "after the run, write a bloom filter of the blobs found to this file: a compact stand-in for --manifest-out (about 1.8 bytes a blob at the default --bloom-fp) for a later --approx-expect on another machine")
+	bloomFP      = flag.Float64("bloom-fp", 0.001, "the false positive rate of the --bloom-out filter: the chance that it claims to hold a blob that it doesn't. Lower rates make bigger filters")
+	approxExpect = flag.String("approx-expect", "", "a bloom filter of blobs that should be in the store (as written by --bloom-out), like --expect but without the full list: report how many of them are certainly missing, and how many more could hide behind the filter's false positives")
+)
+
+// bloomMagic starts a bloom filter file. It is followed by, in big-endian:
+//
+//	uint32 schema version
+//	uint64 how many blobs were added
+//	uint64 how many bits the filter has
+//	uint32 how many bits each blob sets
+//	float64 the false positive rate it was sized for
+//
+// and then the bits.
+const bloomMagic = "pkvbloom"
+
+// bloomHeaderSize is the size of the header, magic included.
+const bloomHeaderSize = len(bloomMagic) + 4 + 8 + 8 + 4 + 8
+
+// maxBloomHashes is the most bits a blob may set: what the lowest
+// --bloom-fp, minBloomFP, needs, with room to spare.
+const maxBloomHashes = 64
+
+// minBloomFP is the lowest --bloom-fp.
+const minBloomFP = 1e-15
+
+// A bloomFilter is a set of blob refs that can say for certain that a ref
+// isn't in it, but only probably that one is.
+type bloomFilter struct {
+	count  uint64 // refs added
+	hashes uint32 // bits set per ref
+	fp     float64
+	bits   []byte
+}
+
+// newBloomFilter returns a filter sized for n refs with false positive
+// rate fp.
+func newBloomFilter(n int, fp float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{hashes: uint32(k), fp: fp, bits: make([]byte, (int(m)+7)/8)}
+}
+
+// positions calls fn with the bits that br sets, by double hashing.
+func (f *bloomFilter) positions(br blob.Ref, fn func(bit uint64)) {
+	h1, h2 := fnv.New64a(), fnv.New64()
+	io.WriteString(h1, br.String())
+	io.WriteString(h2, br.String())
+	a, b := h1.Sum64(), h2.Sum64()|1
+	m := uint64(len(f.bits)) * 8
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		fn((a + i*b) % m)
+	}
+}
+
+func (f *bloomFilter) add(br blob.Ref) {
+	f.count++
+	f.positions(br, func(bit uint64) { f.bits[bit/8] |= 1 << (bit % 8) })
+}
+
+// has reports whether br is probably in the filter.
+func (f *bloomFilter) has(br blob.Ref) bool {
+	in := true
+	f.positions(br, func(bit uint64) {
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			in = false
+		}
+	})
+	return in
+}
+
+// writeBloomFilter writes a filter of the refs seen by the run described by
+// s to path. It must be called after s.finish.
+func writeBloomFilter(path string, s *Summary) error {
+	bf := newBloomFilter(len(s.seen), *bloomFP)
+	for _, sr := range s.seen {
+		bf.add(sr.Ref)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString(bloomMagic)
+	for _, v := range []interface{}{uint32(bloomSchema), bf.count, uint64(len(bf.bits)) * 8, bf.hashes, bf.fp} {
+		binary.Write(w, binary.BigEndian, v)
+	}
+	w.Write(bf.bits)
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readBloomFilter reads a filter written by writeBloomFilter.
+func readBloomFilter(path string) (*bloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != bloomMagic {
+		return nil, fmt.Errorf("%v is not a bloom filter written by --bloom-out", path)
+	}
+	var (
+		version uint32
+		bits    uint64
+		bf      bloomFilter
+	)
+	for _, v := range []interface{}{&version, &bf.count, &bits, &bf.hashes, &bf.fp} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, fmt.Errorf("%v: truncated header", path)
+		}
+	}
+	if err := checkSchema("bloom filter", path, int(version), bloomSchema); err != nil {
+		return nil, err
+	}
+	// The header mustn't be trusted with how much to allocate, or how
+	// long to loop, for every blob: the bits must be all of the rest of
+	// the file, and the bits set per blob a sane number.
+	if bits == 0 || bits%8 != 0 || bf.hashes == 0 || bf.hashes > maxBloomHashes {
+		return nil, fmt.Errorf("%v: corrupt header", path)
+	}
+	if want := fi.Size() - int64(bloomHeaderSize); want < 0 || bits/8 != uint64(want) {
+		return nil, fmt.Errorf("%v: the header says the filter has %v bytes, but %v follow it", path, bits/8, want)
+	}
+	bf.bits = make([]byte, bits/8)
+	if _, err := io.ReadFull(r, bf.bits); err != nil {
+		return nil, fmt.Errorf("%v: truncated: %v", path, err)
+	}
+	return &bf, nil
+}
+
+// approxManifest is what --approx-expect found.
+type approxManifest struct {
+	Expected int `json:"expected"` // blobs in the filter
+	Matched  int `json:"matched"`  // blobs found that the filter probably has
+
+	// Missing is how many of the expected blobs are certainly missing:
+	// even if every match was real, there weren't enough of them.
+	Missing int `json:"missing"`
+
+	// Hidden is about how many more could be missing, hidden by false
+	// positives among the matches.
+	Hidden int `json:"hidden"`
+}
+
+// checkApproxManifest compares the blobs seen during the run with the
+// filter bf, sets s.ApproxExpect, and reports what it found. It must be
+// called after finish.
+//
+// Unlike an --expect manifest, a filter can't be narrowed down to the blobs
+// that a partial run meant to verify, so a run that left some out (by
+// --exclude-ref-prefix, say, or --deadline) isn't checked at all.
+func (s *Summary) checkApproxManifest(bf *bloomFilter) {
+	if !s.Coverage.Complete {
+		fmt.Println("not checking --approx-expect, since this run did not verify the whole store, and the blobs it left out would look missing")
+		return
+	}
+	am := &approxManifest{Expected: int(bf.count)}
+	for _, sr := range s.seen {
+		if bf.has(sr.Ref) {
+			am.Matched++
+		}
+	}
+	if am.Matched < am.Expected {
+		am.Missing = am.Expected - am.Matched
+	}
+	// Each blob found that the filter doesn't really hold matched it with
+	// probability bf.fp, and each such false match can stand in for a
+	// missing one. There are about this many of them:
+	extra := len(s.seen) - (am.Expected - am.Missing)
+	am.Hidden = int(math.Ceil(float64(extra) * bf.fp))
+	if am.Hidden > am.Expected-am.Missing {
+		am.Hidden = am.Expected - am.Missing
+	}
+	s.ApproxExpect = am
+
+	switch {
+	case am.Missing > 0:
+		fmt.Printf("MISSING BLOBS: at least %v of the %v blob%v in the --approx-expect filter %v not found", humanCount(am.Missing), humanCount(am.Expected), plural(am.Expected), wasWere(am.Missing))
+		if s.Status == "clean" {
+			s.Status = "missing"
+		}
+	default:
+		fmt.Printf("every one of the %v blob%v in the --approx-expect filter was probably found", humanCount(am.Expected), plural(am.Expected))
+	}
+	if am.Hidden > 0 {
+		fmt.Printf(" (up to about %v more could be missing, hidden by the filter's %v false positive rate; only --expect can say which)", humanCount(am.Hidden), percent(bf.fp))
+	}
+	fmt.Println()
+}
+
+// checkBloomFlags checks --bloom-out, --bloom-fp, and --approx-expect before
+// the run.
+func checkBloomFlags() error {
+	if *bloomFP < minBloomFP || *bloomFP >= 1 {
+		return fmt.Errorf("--bloom-fp must be between %v and 1, like 0.001", minBloomFP)
+	}
+	if *approxExpect != "" && (*shardFlag != "" || *skipVerified != "" || *tier != "both") {
+		return fmt.Errorf("--approx-expect can't be combined with --shard, --skip-verified, or --tier, since the blobs left out would look missing")
+	}
+	if *approxExpect != "" && *proxycacheMode == "cache" {
+		return fmt.Errorf("--approx-expect can't be combined with --proxycache=cache, since the blobs the cache doesn't hold would look missing")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilterRoundTrip(t *testing.T) {
+	var contents []string
+	for i := 0; i < 2000; i++ {
+		contents = append(contents, fmt.Sprint(i))
+	}
+	for _, n := range []int{0, 1, 1000} {
+		path := filepath.Join(t.TempDir(), "bloom")
+		if err := writeBloomFilter(path, &Summary{seen: sizedRefs(contents[:n]...)}); err != nil {
+			t.Fatal(err)
+		}
+		bf, err := readBloomFilter(path)
+		if err != nil {
+			t.Fatalf("%v blobs: %v", n, err)
+		}
+		if bf.count != uint64(n) || bf.fp != *bloomFP {
+			t.Errorf("%v blobs: read back count %v and fp %v, want %v and %v", n, bf.count, bf.fp, n, *bloomFP)
+		}
+		for _, sr := range sizedRefs(contents[:n]...) {
+			if !bf.has(sr.Ref) {
+				t.Errorf("%v blobs: the filter doesn't have %v", n, sr.Ref)
+			}
+		}
+		if n < 1000 {
+			continue // too small a filter for its rate to hold
+		}
+		// At the default rate of 1 in 1000, the 1000 blobs that weren't
+		// added should give very few false positives.
+		fps := 0
+		for _, sr := range sizedRefs(contents[n:]...) {
+			if bf.has(sr.Ref) {
+				fps++
+			}
+		}
+		if fps > 10 {
+			t.Errorf("%v blobs: %v false positives", n, fps)
+		}
+	}
+}
+
+func TestReadBloomFilterCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good")
+	if err := writeBloomFilter(good, &Summary{seen: sizedRefs("foo", "bar")}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The offsets of the header fields after the magic.
+	const (
+		versionAt = len(bloomMagic)
+		bitsAt    = versionAt + 4 + 8
+		hashesAt  = bitsAt + 8
+	)
+	tests := []struct {
+		name   string
+		mangle func([]byte) []byte
+	}{
+		{"empty", func([]byte) []byte { return nil }},
+		{"bad magic", func(b []byte) []byte { b[0] = 'x'; return b }},
+		{"truncated header", func(b []byte) []byte { return b[:bitsAt] }},
+		{"truncated bits", func(b []byte) []byte { return b[:len(b)-1] }},
+		{"extra bits", func(b []byte) []byte { return append(b, 0) }},
+		{"newer version", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[versionAt:], bloomSchema+1)
+			return b
+		}},
+		{"huge bit count", func(b []byte) []byte {
+			binary.BigEndian.PutUint64(b[bitsAt:], 1<<62)
+			return b
+		}},
+		{"no hashes", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[hashesAt:], 0)
+			return b
+		}},
+		{"too many hashes", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[hashesAt:], maxBloomHashes+1)
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(path, tt.mangle(append([]byte(nil), data...)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readBloomFilter(path); err == nil {
+			t.Errorf("%v: read the filter without an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// A capability is an optional interface that a storage may implement, and
+// what pk-verify does with it.
+type capability struct {
+	name     string // the interface
+	has      func(blobserver.Storage) bool
+	features string // what pk-verify can do with it
+	without  string // what pk-verify does instead
+}
+
+var capabilities = []capability{
+	{
+		name:     "blobserver.BlobStreamer",
+		has:      func(sto blobserver.Storage) bool { _, ok := sto.(blobserver.BlobStreamer); return ok },
+		features: "full runs stream the blobs, the fast path",
+		without:  "full runs enumerate the blobs and fetch them one by one",
+	},
+	{
+		name:     "blob.SubFetcher",
+		has:      func(sto blobserver.Storage) bool { _, ok := sto.(blob.SubFetcher); return ok },
+		features: "blobs over --huge-blob-size are read a --window-size at a time with ranged reads",
+		without:  "blobs over --huge-blob-size are hashed as one fetch streams them",
+	},
+	{
+		name:     "blobserver.Generationer",
+		has:      func(sto blobserver.Storage) bool { _, ok := sto.(blobserver.Generationer); return ok },
+		features: "its generation is recorded, so a wiped and recreated storage is noticed",
+		without:  "a wiped and recreated storage can only be noticed by its missing blobs",
+	},
+	{
+		name:     "blobserver.BlobRemover",
+		has:      func(sto blobserver.Storage) bool { _, ok := sto.(blobserver.BlobRemover); return ok },
+		features: "\"pk-verify repair\" can quarantine and restore its bad copies (if the storage really allows removing blobs)",
+		without:  "\"pk-verify repair\" can only report its bad copies",
+	},
+}
+
+// capabilitiesMain implements "pk-verify capabilities", which loads every
+// storage in the config and says which of the optional interfaces it
+// supports, and so which of pk-verify's features work on it. It answers
+// "why is this run so slow?" and "why didn't repair remove that?" before
+// they're asked.
+func capabilitiesMain(args []string) {
+	fs := flag.NewFlagSet("capabilities", flag.ExitOnError)
+	fs.Usage = func() {
+		stderrf("Usage: %v capabilities <path to perkeep server config file>\n", os.Args[0])
+		stderrln()
+		stderrln("Loads every storage in the config, the way a run would, and prints which optional interfaces each one supports, and which pk-verify features are available for it as a result. No blobs are read.")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	conf := loadConfig(fs.Arg(0))
+	ld := NewLoader(conf)
+
+	failed := 0
+	for i, prefix := range sortedConfigPrefixes(conf) {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%v (%v)\n", prefix, conf.describe(prefix))
+		sto, err := ld.GetStorage(prefix)
+		if err != nil {
+			fmt.Printf("\tcould not be loaded: %v\n", err)
+			failed++
+			continue
+		}
+		for _, c := range capabilities {
+			if c.has(sto) {
+				fmt.Printf("\t+ %v: %v\n", c.name, c.features)
+			} else {
+				fmt.Printf("\t- %v: %v\n", c.name, c.without)
+			}
+		}
+		for _, note := range capabilityNotes(conf, prefix) {
+			fmt.Printf("\t* %v\n", note)
+		}
+	}
+	if failed > 0 {
+		stderrf("pk-verify: %v storage%v could not be loaded\n", failed, plural(failed))
+		os.Exit(1)
+	}
+}
+
+// capabilityNotes returns what else pk-verify can do with the storage at
+// prefix, because of its handler rather than its interfaces.
+func capabilityNotes(conf *LowLevelConfig, prefix string) []string {
+	var notes []string
+	if root, ok := localdiskRoot(conf, prefix); ok {
+		notes = append(notes, fmt.Sprintf("--walk reads its blob files in %v directly, with --verify-cache and --walk-order", root))
+	}
+	sc := conf.Prefixes[prefix]
+	switch sc.StorageHandler {
+	case "replica":
+		backends, _ := sc.StorageHandlerArgs["backends"].([]interface{})
+		if len(backends) >= 2 {
+			notes = append(notes, fmt.Sprintf("--compare-replicas can compare its %v replicas", len(backends)))
+		}
+	case "blobpacked":
+		notes = append(notes, "--tier can verify its loose blobs or its packed zip files on their own")
+	}
+	if _, ok := cacheHandlers[sc.StorageHandler]; ok {
+		notes = append(notes, "--proxycache picks which side of it to verify")
+	}
+	if mediaHandlers[sc.StorageHandler] {
+		notes = append(notes, "it can be verified on read-only media, with --read-only-media")
+	}
+	return notes
+}
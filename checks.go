@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+)
+
+var checksFlag = flag.String("checks", "hash", fmt.Sprintf("comma-separated checks to run on the contents of every blob; one of them has to be \"hash\". Available: %v", strings.Join(pkverify.CheckNames(), ", ")))
+
+// loadChecks returns the checks named in names, a list like --checks takes.
+func loadChecks(names string) ([]pkverify.Check, error) {
+	var (
+		checks  []pkverify.Check
+		seen    = map[string]bool{}
+		hasHash bool
+	)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		c, err := pkverify.NewCheck(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checks: %w (available: %v)", err, strings.Join(pkverify.CheckNames(), ", "))
+		}
+		if name == "hash" {
+			hasHash = true
+		}
+		checks = append(checks, c)
+	}
+	if !hasHash {
+		return nil, fmt.Errorf("invalid checks %q: the \"hash\" check can't be left out", names)
+	}
+	return checks, nil
+}
+
+// blobChecks returns the checks v runs on every blob.
+func (v *verifier) blobChecks() []pkverify.Check {
+	if len(v.checks) == 0 {
+		return []pkverify.Check{pkverify.Hash}
+	}
+	return v.checks
+}
+
+// onlyHash reports whether the hash check is the only one v runs, so that
+// blobs can be checked however is quickest.
+func (v *verifier) onlyHash() bool {
+	return len(v.checks) <= 1
+}
+
+// checkStore runs the store phase of each verifier's checks, once every
+// blob has been through them, and reports the problems found.
+func checkStore(ctx context.Context, verifiers []*verifier, s *Summary, found *findings) {
+	for _, v := range verifiers {
+		for _, c := range v.checks {
+			for _, p := range c.Store(ctx) {
+				s.CheckProblems = append(s.CheckProblems, fmt.Sprintf("%v: %v", c.Name(), p))
+			}
+		}
+	}
+	for _, p := range s.CheckProblems {
+		found.report("check problem: %v", p)
+	}
+	if n := len(s.CheckProblems); n > 0 {
+		fmt.Printf("CHECKS FAILED: found %v problem%v with the store as a whole, listed %v.\n", n, plural(n), found.where())
+	}
+}
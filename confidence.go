@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var confidenceLevel = flag.Float64("confidence", 99, "for runs that verify a sample of the store (like one --shard), the confidence, as a percentage, of the bound printed on how much of the whole store is corrupt")
+
+// A confidence bounds how much of a population is bad, from a sample of it
+// that was picked without regard to whether its members are bad: with
+// confidence Level, fewer than Bound of the population is.
+type confidence struct {
+	Level      float64 `json:"level"`      // like 0.99
+	Sample     int     `json:"sample"`     // how many were checked
+	Bad        int     `json:"bad"`        // how many of those were bad
+	Population int     `json:"population"` // how many there are (maybe estimated)
+	Bound      float64 `json:"bound"`      // the upper bound on the fraction that is bad
+}
+
+// checkConfidence checks --confidence before the run.
+func checkConfidence() error {
+	if *confidenceLevel <= 0 || *confidenceLevel >= 100 {
+		return fmt.Errorf("--confidence must be a percentage between 0 and 100, like 99")
+	}
+	return nil
+}
+
+// newConfidence bounds the fraction of population that is bad, at
+// --confidence, when bad of a sample of n were. It returns nil for an empty
+// sample, which says nothing.
+//
+// The bound is the one-sided Clopper-Pearson bound: the highest fraction
+// that would still give as few as bad bad ones with more than 1 - Level
+// probability. It treats the sample as drawn with replacement, which errs on
+// the side of a higher bound when the sample is a big part of the
+// population.
+func newConfidence(n, bad, population int) *confidence {
+	if n <= 0 {
+		return nil
+	}
+	level := *confidenceLevel / 100
+	c := &confidence{Level: level, Sample: n, Bad: bad, Population: population, Bound: 1}
+	if bad >= n {
+		return c
+	}
+	lo, hi := float64(bad)/float64(n), 1.0
+	for i := 0; i < 60; i++ {
+		mid := (lo + hi) / 2
+		if binomialCDF(bad, n, mid) > 1-level {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	c.Bound = hi
+	return c
+}
+
+// binomialCDF returns the probability of at most k successes in n trials
+// that each succeed with probability p.
+func binomialCDF(k, n int, p float64) float64 {
+	if p <= 0 {
+		return 1
+	}
+	if p >= 1 {
+		if k >= n {
+			return 1
+		}
+		return 0
+	}
+	lnN, _ := math.Lgamma(float64(n + 1))
+	var sum float64
+	for i := 0; i <= k; i++ {
+		lnI, _ := math.Lgamma(float64(i + 1))
+		lnNI, _ := math.Lgamma(float64(n - i + 1))
+		sum += math.Exp(lnN - lnI - lnNI + float64(i)*math.Log(p) + float64(n-i)*math.Log1p(-p))
+	}
+	return math.Min(sum, 1)
+}
+
+// describe says what the bound means, for a population described by of,
+// like "the 2M blobs in the store".
+func (c *confidence) describe(of string) string {
+	return fmt.Sprintf("with %v confidence, fewer than %v of %v are bad (%v of the %v checked %v)",
+		percent(c.Level), percent(c.Bound), of, humanCount(c.Bad), humanCount(c.Sample), wasWere(c.Bad))
+}
+
+// percent formats the fraction f as a percentage with two significant
+// digits, without resorting to exponents for tiny ones.
+func percent(f float64) string {
+	p := 100 * f
+	if p == 0 || p >= 10 {
+		return strconv.FormatFloat(math.Round(p*10)/10, 'f', -1, 64) + "%"
+	}
+	decimals := 1 - int(math.Floor(math.Log10(p)))
+	return strconv.FormatFloat(p, 'f', decimals, 64) + "%"
+}
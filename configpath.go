@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// defaultConfigPath returns where Perkeep keeps its server config unless
+// told otherwise, the same way perkeepd finds it: in $PERKEEP_CONFIG_DIR (or
+// the older $CAMLI_CONFIG_DIR) if set, and otherwise in %APPDATA%\Perkeep on
+// Windows and $XDG_CONFIG_HOME/perkeep or ~/.config/perkeep elsewhere. It
+// returns "" if there's no telling.
+func defaultConfigPath() string {
+	dir := os.Getenv("PERKEEP_CONFIG_DIR")
+	if dir == "" {
+		dir = os.Getenv("CAMLI_CONFIG_DIR")
+	}
+	if dir == "" && runtime.GOOS == "windows" {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			dir = filepath.Join(appData, "Perkeep")
+		}
+	}
+	if dir == "" {
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			dir = filepath.Join(xdg, "perkeep")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".config", "perkeep")
+		}
+	}
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "server-config.json")
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// enableTerminalEscapes is a no-op: terminals outside Windows handle the
+// progress line's escape sequences as is.
+func enableTerminalEscapes() {}
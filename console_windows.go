@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// enableVirtualTerminalProcessing is the console mode flag that makes the
+// console handle ANSI escape sequences.
+const enableVirtualTerminalProcessing = 0x4
+
+// enableTerminalEscapes makes the Windows console handle the escape
+// sequences that the progress line uses (like erasing the line), which it
+// otherwise prints as is. Consoles too old to know the flag just keep
+// printing them.
+func enableTerminalEscapes() {
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		h := syscall.Handle(f.Fd())
+		var mode uint32
+		if err := syscall.GetConsoleMode(h, &mode); err != nil {
+			continue // not a console
+		}
+		procSetConsoleMode.Call(uintptr(h), uintptr(mode|enableVirtualTerminalProcessing))
+	}
+}
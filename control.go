@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var controlSocket = flag.String("control-socket", "", "while running, listen on this Unix socket for commands (status, pause, resume, rate, stop) from \"pk-verify ctl\" or scripts. With \"pk-verify daemon\", give it among the flags for each run")
+
+// The control protocol is one command per connection: a line with the
+// command, answered with lines of text, after which the connection is
+// closed. An answer that starts with "error: " means the command failed.
+// The commands are:
+//
+//	status         the same status as SIGUSR1 prints
+//	pause          pause the run, once the blobs being read are done
+//	resume         resume a paused run
+//	rate [<rate>]  show, or change, the --max-read-rate ("off" for none)
+//	stop           finish the blobs being read, then stop the run as if
+//	               interrupted, with a summary of what it did
+//
+// The socket is only as private as the directory it is in.
+
+// serveControl listens on --control-socket, if set, and carries out the
+// commands that come in, for as long as the process runs.
+func serveControl(limit *byteLimiter) error {
+	if *controlSocket == "" {
+		return nil
+	}
+	// A socket left behind by a run that crashed would be in the way.
+	if fi, err := os.Lstat(*controlSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if _, err := net.Dial("unix", *controlSocket); err == nil {
+			return fmt.Errorf("%v is in use by another run", *controlSocket)
+		}
+		os.Remove(*controlSocket)
+	}
+	ln, err := net.Listen("unix", *controlSocket)
+	if err != nil {
+		return err
+	}
+	atExit(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(conn, limit)
+		}
+	}()
+	return nil
+}
+
+func handleControl(conn net.Conn, limit *byteLimiter) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	for _, answer := range controlCommand(strings.Fields(line), limit) {
+		fmt.Fprintln(conn, answer)
+	}
+}
+
+// controlCommand carries out one control command, and returns its answer.
+func controlCommand(args []string, limit *byteLimiter) []string {
+	if len(args) == 0 {
+		return []string{"error: no command"}
+	}
+	switch cmd := args[0]; {
+	case cmd == "status" && len(args) == 1:
+		return statusLines()
+	case cmd == "pause" && len(args) == 1:
+		if !runPause.pause() {
+			return []string{"already paused"}
+		}
+		stderrln("pk-verify: pausing once the blobs being read now are done, as asked on the control socket")
+		return []string{"pausing once the blobs being read now are done"}
+	case cmd == "resume" && len(args) == 1:
+		d, ok := runPause.resume()
+		if !ok {
+			return []string{"not paused"}
+		}
+		stderrf("pk-verify: resuming after a pause of %v, as asked on the control socket\n", humanDuration(d))
+		return []string{fmt.Sprintf("resumed after a pause of %v", humanDuration(d))}
+	case cmd == "rate" && len(args) <= 2:
+		if len(args) == 2 {
+			rate := 0.0
+			if args[1] != "off" {
+				var err error
+				if rate, err = parseRate(args[1]); err != nil {
+					return []string{"error: " + err.Error()}
+				}
+			}
+			limit.setRate(rate)
+			stderrf("pk-verify: %v, as asked on the control socket\n", describeRate(rate))
+		}
+		return []string{describeRate(limit.currentRate())}
+	case cmd == "stop" && len(args) == 1:
+		stderrln("pk-verify: stopping once the blobs being read now are done, as asked on the control socket")
+		go stopAfterCurrent()
+		return []string{"stopping once the blobs being read now are done"}
+	}
+	return []string{fmt.Sprintf("error: unknown command %q", strings.Join(args, " "))}
+}
+
+func describeRate(rate float64) string {
+	if rate == 0 {
+		return "no read rate limit"
+	}
+	return fmt.Sprintf("reading at most %v/s", humanBytes(int64(rate)))
+}
+
+// stopAfterCurrent stops the run once the blobs being read are done: it
+// pauses it, so that no more are started, and when the workers are all
+// idle, stops it as an interrupt would. The workers still waiting to start
+// on a blob (at the pause, for --autoscale, or for --auto-throttle) then give up
+// on it without reading it; see verifyWith.
+func stopAfterCurrent() {
+	runPause.pause()
+	for readingNow() > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	stopRun()
+}
+
+// ctlMain implements "pk-verify ctl", which sends a command to a run's
+// --control-socket and prints the answer.
+func ctlMain(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	fs.Usage = func() {
+		stderrf("Usage: %v ctl <control socket> status|pause|resume|rate [<rate>|off]|stop\n", os.Args[0])
+		stderrln()
+		stderrln("Sends a command to the run listening on the --control-socket, and prints its answer.")
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	answer, err := sendControl(fs.Arg(0), strings.Join(fs.Args()[1:], " "))
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	failed := false
+	for _, line := range answer {
+		if strings.HasPrefix(line, "error: ") {
+			failed = true
+			stderrf("pk-verify: %v\n", strings.TrimPrefix(line, "error: "))
+			continue
+		}
+		fmt.Println(line)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// sendControl sends the command cmd to the run listening on the control
+// socket, and returns the lines of its answer.
+func sendControl(socket, cmd string) ([]string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return nil, err
+	}
+	var answer []string
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		answer = append(answer, sc.Text())
+	}
+	if err := sc.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return answer, nil
+}
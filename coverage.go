@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"perkeep.org/pkg/blob"
+)
+
+// coverage describes how much of the store a run actually verified, so that
+// a run that was interrupted, sharded, or otherwise cut down can't be
+// mistaken for a full verification.
+type coverage struct {
+	// Complete is set when the run verified every blob in every storage
+	// it set out to verify. If not, Gaps says why.
+	Complete bool     `json:"complete"`
+	Gaps     []string `json:"gaps,omitempty"`
+
+	// The storage prefixes that were verified all the way through, only
+	// partly (because the run stopped while verifying them), and not at
+	// all.
+	PrefixesDone    []string `json:"prefixesDone"`
+	PrefixesPartial []string `json:"prefixesPartial,omitempty"`
+	PrefixesSkipped []string `json:"prefixesSkipped,omitempty"`
+
+	// RefSpaceBlobs counts the blobs seen by the first hex digit of their
+	// digest. Digests are uniformly distributed, so in a full run these
+	// are all about the same, and a run that only got through part of the
+	// ref space shows up as zeros.
+	RefSpaceBlobs [16]int `json:"refSpaceBlobs"`
+
+	// SizeClasses counts the blobs seen by size.
+	SizeClasses []sizeClass `json:"sizeClasses"`
+}
+
+// A sizeClass counts the blobs whose size is below Max (and at least the
+// previous class's Max).
+type sizeClass struct {
+	Name  string `json:"name"`
+	Max   int64  `json:"maxBytes,omitempty"` // 0 for the last class
+	Blobs int    `json:"blobs"`
+	Bytes int64  `json:"bytes"`
+}
+
+// newSizeClasses returns empty size classes, split where blob sizes tend to
+// mean different things: schema blobs are small, chunks of files are up to
+// a few hundred KB, and anything over 16MB (perkeep's maximum blob size) is
+// a blobpacked zip or something else unusual.
+func newSizeClasses() []sizeClass {
+	return []sizeClass{
+		{Name: "<1KB", Max: 1 << 10},
+		{Name: "1KB-64KB", Max: 64 << 10},
+		{Name: "64KB-1MB", Max: 1 << 20},
+		{Name: "1MB-16MB", Max: 16 << 20},
+		{Name: ">=16MB"},
+	}
+}
+
+// add counts one blob.
+func (c *coverage) add(sr blob.SizedRef) {
+	if d := sr.Ref.Digest(); d != "" {
+		if n, err := strconv.ParseUint(d[:1], 16, 8); err == nil {
+			c.RefSpaceBlobs[n]++
+		}
+	}
+	for i := range c.SizeClasses {
+		sc := &c.SizeClasses[i]
+		if sc.Max == 0 || int64(sr.Size) < sc.Max {
+			sc.Blobs++
+			sc.Bytes += int64(sr.Size)
+			break
+		}
+	}
+}
+
+// gap records a reason the run was not complete.
+func (c *coverage) gap(format string, args ...interface{}) {
+	c.Complete = false
+	c.Gaps = append(c.Gaps, fmt.Sprintf(format, args...))
+}
+
+// computeCoverage fills in s.Coverage. It is called by finish, with the
+// error that stopped the run, if any.
+func (s *Summary) computeCoverage(err error) {
+	c := &coverage{Complete: true, PrefixesDone: []string{}, SizeClasses: newSizeClasses()}
+	s.Coverage = c
+	for _, sr := range s.seen {
+		c.add(sr)
+	}
+	for _, prefix := range s.targets {
+		ps, ok := s.Prefixes[prefix]
+		switch {
+		case ok && ps.done:
+			c.PrefixesDone = append(c.PrefixesDone, prefix)
+		case ok && ps.Deferred > 0:
+			c.PrefixesPartial = append(c.PrefixesPartial, prefix)
+			c.gap("%v blob%v in %v %v left for a later run by --deadline", humanCount(ps.Deferred), plural(ps.Deferred), prefix, wasWere(ps.Deferred))
+		case ok:
+			c.PrefixesPartial = append(c.PrefixesPartial, prefix)
+			c.gap("%v was only partly verified", prefix)
+		default:
+			c.PrefixesSkipped = append(c.PrefixesSkipped, prefix)
+			c.gap("%v was not verified", prefix)
+		}
+	}
+	for _, skip := range s.SkippedPrefixes {
+		c.PrefixesSkipped = append(c.PrefixesSkipped, skip.Prefix)
+		c.gap("%v (%v) could not be loaded: %v", skip.Prefix, skip.Handler, skip.Error)
+	}
+	for _, skip := range s.Skipped {
+		if !skip.Recovered {
+			c.gap("%v could not be read all the way through: %v", skip.Prefix, skip.RecoveryError)
+		}
+	}
+	if err != nil {
+		c.gap("the run stopped early: %v", err)
+	}
+	if s.Shard != nil {
+		c.gap("only shard %v of the ref space was verified", s.Shard)
+	}
+	if s.SkippedVerified != "" {
+		c.gap("the blobs listed in %v were not verified again", s.SkippedVerified)
+	}
+	if s.Exclude != "" {
+		n, bytes := 0, int64(0)
+		for _, ps := range s.Prefixes {
+			n += ps.Excluded
+			bytes += ps.ExcludedBytes
+		}
+		c.gap("%v blob%v (%v) %v skipped by %v", humanCount(n), plural(n), humanBytes(bytes), wasWere(n), s.Exclude)
+	}
+}
+
+// print explains what a partial run left out.
+func (c *coverage) print() {
+	if c.Complete {
+		return
+	}
+	fmt.Println("NOTE: this run did not verify the whole store:")
+	for _, g := range c.Gaps {
+		fmt.Printf("  - %v\n", g)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/rand"
+
+	"perkeep.org/pkg/blob"
+)
+
+var crossCheckHash = flag.Float64("cross-check-hash", 0, "the fraction (0 to 1) of the blobs that pass verification to read again at the end of the run and hash with Go's standard library directly, comparing the result to the ref from scratch; a guard against a bug in the hashing that verification normally relies on")
+
+// independentHashes are the hash functions that blob refs name, as
+// implemented by the standard library, independently of the blob package.
+var independentHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+}
+
+// A hashCrossChecker collects a random sample of the blobs that passed
+// verification, and then checks them again with independentHashes.
+//
+// A nil *hashCrossChecker does nothing.
+type hashCrossChecker struct {
+	rate  float64
+	blobs []sampledBlob
+}
+
+type sampledBlob struct {
+	ref blob.Ref
+	f   blob.Fetcher // where to read it again from
+}
+
+func newHashCrossChecker() (*hashCrossChecker, error) {
+	if *crossCheckHash < 0 || *crossCheckHash > 1 {
+		return nil, fmt.Errorf("--cross-check-hash must be between 0 and 1")
+	}
+	if *crossCheckHash == 0 {
+		return nil, nil
+	}
+	return &hashCrossChecker{rate: *crossCheckHash}, nil
+}
+
+// sample adds the valid blob br, read from f, to the sample, with
+// probability c.rate.
+func (c *hashCrossChecker) sample(br blob.Ref, f blob.Fetcher) {
+	if c == nil || rand.Float64() >= c.rate {
+		return
+	}
+	c.blobs = append(c.blobs, sampledBlob{ref: br, f: f})
+}
+
+// check checks the sampled blobs, records the results in s, and reports any
+// that fail to found. A failure means either that the blob changed between
+// the two reads, or that the normal verification can't be trusted, so the
+// run counts as corrupt either way.
+func (c *hashCrossChecker) check(ctx context.Context, s *Summary, found *findings) {
+	if c == nil || len(c.blobs) == 0 {
+		return
+	}
+	n := len(c.blobs)
+	fmt.Printf("cross-checking the hashes of %v blob%v...\n", n, plural(n))
+	s.HashCrossCheckFailures = []blob.Ref{}
+	for _, b := range c.blobs {
+		newHash, ok := independentHashes[b.ref.HashName()]
+		if !ok {
+			continue
+		}
+		rc, _, err := b.f.Fetch(ctx, b.ref)
+		if err != nil {
+			found.report("could not read blob %v again to cross-check its hash: %v", b.ref, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			found.report("could not read blob %v again to cross-check its hash: %v", b.ref, err)
+			continue
+		}
+		s.HashCrossChecked++
+		h := newHash()
+		h.Write(data)
+		if got := b.ref.HashName() + "-" + hex.EncodeToString(h.Sum(nil)); got != b.ref.String() {
+			s.HashCrossCheckFailures = append(s.HashCrossCheckFailures, b.ref)
+			found.report("blob %v passed verification, but its contents hash to %v", b.ref, got)
+		}
+	}
+	if n := len(s.HashCrossCheckFailures); n > 0 {
+		fmt.Printf("HASH CROSS-CHECK FAILED for %v of %v blob%v, listed %v: either they changed between reads, or verification is not to be trusted\n", n, s.HashCrossChecked, plural(s.HashCrossChecked), found.where())
+		if s.Status == "clean" || s.Status == "missing" {
+			s.Status = "corrupt"
+		}
+	} else {
+		fmt.Printf("cross-checked the hashes of %v blob%v\n", s.HashCrossChecked, plural(s.HashCrossChecked))
+	}
+}
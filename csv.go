@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+
+	"perkeep.org/pkg/blob"
+)
+
+var csvOut = flag.String("csv", "", "write a CSV file with a row for every problem blob (its ref, prefix, error class, size, location on disk, when it was found, and the error) and a summary row at the end, for triaging the findings in a spreadsheet")
+
+// csvHeader names the columns of the --csv file. The summary row puts the
+// run's status in the class column, its total size in the size column, and
+// its counts in the error column.
+var csvHeader = []string{"row", "ref", "prefix", "class", "size", "location", "time", "error"}
+
+// csvProblems collects the rows of the --csv file as problems are found.
+//
+// A nil *csvProblems ignores everything.
+type csvProblems struct {
+	conf *LowLevelConfig
+
+	mu   sync.Mutex
+	rows [][]string
+}
+
+func newCSVProblems(conf *LowLevelConfig) *csvProblems {
+	if *csvOut == "" {
+		return nil
+	}
+	return &csvProblems{conf: conf}
+}
+
+// errorClass sorts the problem with a blob into a few broad kinds, which
+// point at different causes: "corrupt" (the contents don't match the ref),
+// "missing", "read error" (the storage couldn't return it), "transient"
+// (some reads were corrupt, some not), or "changed" (it changed while it was
+// being read).
+func errorClass(r verifyResult) string {
+	switch {
+	case r.raced:
+		return "changed"
+	case r.transient:
+		return "transient"
+	case pkverify.IsFailure(r.err):
+		return "corrupt"
+	case errors.Is(r.err, os.ErrNotExist):
+		return "missing"
+	case isReadError(r.err):
+		return "read error"
+	}
+	return "error"
+}
+
+// add records a problem blob found in the storage at prefix.
+func (c *csvProblems) add(prefix string, r verifyResult) {
+	if c == nil {
+		return
+	}
+	var msg string
+	if r.err != nil {
+		msg = r.err.Error()
+	}
+	row := []string{"blob", r.ref.String(), prefix, errorClass(r), strconv.FormatUint(uint64(r.size), 10),
+		locateBlob(c.conf, prefix, r.ref).path, time.Now().UTC().Format(time.RFC3339), msg}
+	c.mu.Lock()
+	c.rows = append(c.rows, row)
+	c.mu.Unlock()
+}
+
+// addMissing records the blobs that the --expect manifest lists but that
+// weren't found.
+func (c *csvProblems) addMissing(refs []blob.Ref) {
+	if c == nil {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, br := range refs {
+		c.rows = append(c.rows, []string{"blob", br.String(), "", "missing", "", "", now, "listed in " + *expectFile + " but not found"})
+	}
+}
+
+// write writes the --csv file, ending with a summary row for s.
+func (c *csvProblems) write(s *Summary) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := fmt.Sprintf("%v valid, %v invalid, %v transient, %v missing", s.Valid, s.Invalid, s.Transient, len(s.Missing))
+	if s.Error != "" {
+		counts += "; " + s.Error
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvHeader)
+	w.WriteAll(c.rows)
+	w.Write([]string{"summary", s.RunID, strings.Join(s.targets, " "), s.Status, strconv.FormatInt(s.Bytes, 10), "", s.Start.UTC().Format(time.RFC3339), counts})
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*csvOut, s.redact.redact(buf.Bytes()), 0644)
+}
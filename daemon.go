@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// daemonMain implements "pk-verify daemon", which keeps a store verified on
+// a schedule, without any cron glue: a full run every so often, incremental
+// runs in between that verify only the blobs added since the last full run
+// (see --skip-verified), and frequent re-checks of the blobs that failed
+// last time (see --recheck-only), so that a repair is noticed soon after it
+// happens.
+//
+// Each run is a separate pk-verify process, given the flags after the config
+// path, so it behaves (and reports, and records its history) exactly as if
+// it had been run by hand. The daemon remembers when it last did each kind
+// of run in --state-dir, so restarting it doesn't restart the schedule.
+func daemonMain(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	fullEvery := fs.Duration("full-every", 30*24*time.Hour, "how often to verify the whole store")
+	incrementalEvery := fs.Duration("incremental-every", 24*time.Hour, "how often to verify the blobs added since the last full run (0 to disable)")
+	recheckEvery := fs.Duration("recheck-every", time.Hour, "how often to re-check the blobs that failed in the last run (0 to disable)")
+	windowFlag := fs.String("window", "", "only read during these hours of the day, local time, like \"01:00-06:00\" (or \"22:00-06:00\", across midnight): runs only start while the window is open, and a run still going when it closes is paused, with its progress, until it opens again")
+	fs.Usage = func() {
+		stderrf("Usage: %v daemon [daemon flags] <path to perkeep server config file> [flags for each run]\n", os.Args[0])
+		stderrln()
+		stderrln("Runs pk-verify on a schedule: a full run every --full-every, an incremental run every --incremental-every, and a re-check of the last run's failures every --recheck-every, all within the --window, if given. The flags after the config path are passed to every run.")
+		stderrln()
+		stderrln("Daemon flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	configPath, runArgs := fs.Arg(0), fs.Args()[1:]
+	if *fullEvery <= 0 {
+		stderrln("pk-verify: --full-every must be positive")
+		os.Exit(1)
+	}
+	win, err := parseWindow(*windowFlag)
+	if err != nil {
+		stderrf("pk-verify: --window: %v\n", err)
+		os.Exit(1)
+	}
+	// Parse the run flags here too, both to catch mistakes before the
+	// first run and to find out the --state-dir the runs will use.
+	if err := flag.CommandLine.Parse(runArgs); err != nil {
+		os.Exit(1)
+	}
+	if flag.NArg() > 0 {
+		stderrf("pk-verify: unexpected argument %q after the run flags\n", flag.Arg(0))
+		os.Exit(1)
+	}
+	for _, f := range []string{"manifest-out", "skip-verified", "recheck-only"} {
+		if flagWasSet(f) {
+			stderrf("pk-verify: the daemon sets --%v for each run itself\n", f)
+			os.Exit(1)
+		}
+	}
+	if *stateDir == "" {
+		stderrln("pk-verify: the daemon needs a --state-dir to keep its schedule in")
+		os.Exit(1)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	abs, err := filepath.Abs(configPath)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	sched, err := loadSchedule(abs)
+	if err != nil {
+		stderrf("pk-verify: failed to load the schedule: %v\n", err)
+		os.Exit(1)
+	}
+	sched.fullEvery, sched.incrementalEvery, sched.recheckEvery = *fullEvery, *incrementalEvery, *recheckEvery
+	// The window is kept by pausing and resuming runs through their
+	// control socket.
+	socket := *controlSocket
+	if win != nil && socket == "" {
+		socket = strings.TrimSuffix(sched.path, ".schedule") + ".ctl"
+		runArgs = append(runArgs, "--control-socket", socket)
+	}
+	// The --rules schedule applies where the daemon flags don't.
+	rules, err := loadRules()
+	if err != nil {
+		stderrf("pk-verify: failed to load --rules: %v\n", err)
+		os.Exit(1)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	full, incremental, recheck := rules.schedule()
+	if full > 0 && !set["full-every"] {
+		sched.fullEvery = full
+	}
+	if incremental > 0 && !set["incremental-every"] {
+		sched.incrementalEvery = incremental
+	}
+	if recheck > 0 && !set["recheck-every"] {
+		sched.recheckEvery = recheck
+	}
+
+	ctx := interruptContext()
+	for {
+		kind, at := sched.next()
+		if open := win.nextOpen(time.Now()); open.After(at) {
+			at = open
+		}
+		if wait := time.Until(at); wait > 0 {
+			fmt.Printf("%v: next is a %v run, at %v\n", time.Now().Format(time.RFC3339), kind, at.Format(time.RFC3339))
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+		args := append([]string(nil), runArgs...)
+		switch kind {
+		case "full":
+			args = append(args, "--manifest-out", sched.manifest)
+		case "incremental":
+			args = append(args, "--skip-verified", sched.manifest)
+		case "recheck":
+			args = append(args, "--recheck-only")
+		}
+		fmt.Printf("%v: starting a %v run\n", time.Now().Format(time.RFC3339), kind)
+		done := make(chan struct{})
+		go keepInWindow(ctx, win, socket, done)
+		code := runChild(ctx, exe, append(args, abs))
+		close(done)
+		if ctx.Err() != nil {
+			return
+		}
+		switch code {
+		case 0:
+			fmt.Printf("%v: the %v run finished cleanly\n", time.Now().Format(time.RFC3339), kind)
+		case 2:
+			fmt.Printf("%v: the %v run found problems\n", time.Now().Format(time.RFC3339), kind)
+		default:
+			fmt.Printf("%v: the %v run failed (exit status %v)\n", time.Now().Format(time.RFC3339), kind, code)
+		}
+		if err := sched.record(kind, code); err != nil {
+			stderrf("pk-verify: failed to save the schedule: %v\n", err)
+		}
+	}
+}
+
+// runChild runs pk-verify with args, and returns its exit status. If ctx is
+// canceled, the run is interrupted, and allowed to stop cleanly.
+func runChild(ctx context.Context, exe string, args []string) int {
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		return 1
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(os.Interrupt)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return ee.ExitCode()
+		}
+		stderrf("pk-verify: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// flagWasSet reports whether the command-line flag name was set.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// A schedule is when the daemon last did each kind of run against one
+// config. It is stored as a JSON file in --state-dir.
+type schedule struct {
+	SchemaVersion   int       `json:"schemaVersion"`
+	Config          string    `json:"config"`
+	LastFull        time.Time `json:"lastFull"`
+	LastIncremental time.Time `json:"lastIncremental"`
+	LastRecheck     time.Time `json:"lastRecheck"`
+	// FullComplete is whether the last full run finished, so that
+	// its manifest can be trusted by incremental runs.
+	FullComplete bool `json:"fullComplete"`
+
+	path     string
+	manifest string // the last full run's --manifest-out
+
+	fullEvery, incrementalEvery, recheckEvery time.Duration
+}
+
+// loadSchedule loads the schedule for the config at path (which must be
+// absolute), returning an empty one if there isn't one yet.
+func loadSchedule(path string) (*schedule, error) {
+	base := strings.TrimSuffix(historyPath("daemon "+path), ".json")
+	s := &schedule{path: base + ".schedule", manifest: base + ".manifest"}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("%v: %w", s.path, err)
+		}
+		if err := checkSchema("daemon schedule", s.path, s.SchemaVersion, scheduleSchema); err != nil {
+			return nil, err
+		}
+	}
+	s.Config = path
+	return s, nil
+}
+
+// next returns the kind of run that is due next ("full", "incremental", or
+// "recheck"), and when. Full runs take precedence, and an incremental run
+// needs a complete full run to build on.
+func (s *schedule) next() (string, time.Time) {
+	if !s.FullComplete {
+		return "full", s.LastFull.Add(s.recheckOr(s.fullEvery))
+	}
+	kind, at := "full", s.LastFull.Add(s.fullEvery)
+	consider := func(k string, last time.Time, every time.Duration) {
+		if every <= 0 {
+			return
+		}
+		// Anything done since counts as done, so a full run pushes
+		// back the others.
+		if s.LastFull.After(last) {
+			last = s.LastFull
+		}
+		if t := last.Add(every); t.Before(at) {
+			kind, at = k, t
+		}
+	}
+	consider("incremental", s.LastIncremental, s.incrementalEvery)
+	consider("recheck", s.LastRecheck, s.recheckEvery)
+	return kind, at
+}
+
+// recheckOr is how long to wait before trying a full run again after one
+// failed to finish: --recheck-every, if that's sooner than every.
+func (s *schedule) recheckOr(every time.Duration) time.Duration {
+	if s.LastFull.IsZero() {
+		return 0
+	}
+	if s.recheckEvery > 0 && s.recheckEvery < every {
+		return s.recheckEvery
+	}
+	return every
+}
+
+// record notes that a run of the given kind just finished with the exit
+// status code, and saves the schedule.
+func (s *schedule) record(kind string, code int) error {
+	now := time.Now()
+	switch kind {
+	case "full":
+		s.LastFull = now
+		// Exit status 0 means the run finished cleanly, and 2 that it
+		// finished and found problems. Anything else (1, or a crash or
+		// a signal) means it didn't finish, so there is no manifest.
+		s.FullComplete = code == 0 || code == 2
+	case "incremental":
+		s.LastIncremental = now
+	case "recheck":
+		s.LastRecheck = now
+	}
+	s.SchemaVersion = scheduleSchema
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, append(data, '\n'), 0600)
+}
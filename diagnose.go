@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"perkeep.org/pkg/serverinit"
+)
+
+var diagnoseFlag = flag.Bool("diagnose", false, "don't verify anything; instead, print a JSON report of which prefixes in the config pk-verify understands, which it skips, and which it can't handle (and what it would take to handle them)")
+
+// What a build needs in order to include a storage handler that this build
+// doesn't have.
+const (
+	needDefaultBuild = "a build without -tags minimal"
+	needCloudBuild   = "a build without -tags nocloud or minimal"
+)
+
+// perkeepHandlers lists the storage handler types that perkeep has, with
+// their packages under perkeep.org/pkg/blobserver/ and what kind of
+// pk-verify build includes them. A handler with no build listed isn't in
+// any build: supporting it takes a new blank import in handlers.go.
+var perkeepHandlers = map[string]struct{ pkg, build string }{
+	"blobpacked":         {"blobpacked", "any build"},
+	"diskpacked":         {"diskpacked", "any build"},
+	"filesystem":         {"localdisk", "any build"},
+	"memory":             {"memory", "any build"},
+	"cond":               {"cond", needDefaultBuild},
+	"encrypt":            {"encrypt", needDefaultBuild},
+	"overlay":            {"overlay", needDefaultBuild},
+	"proxycache":         {"proxycache", needDefaultBuild},
+	"replica":            {"replica", needDefaultBuild},
+	"shard":              {"shard", needDefaultBuild},
+	"union":              {"union", needDefaultBuild},
+	"azure":              {"azure", needCloudBuild},
+	"b2":                 {"b2", needCloudBuild},
+	"googlecloudstorage": {"google/cloudstorage", needCloudBuild},
+	"googledrive":        {"google/drive", needCloudBuild},
+	"mongo":              {"mongo", needCloudBuild},
+	"remote":             {"remote", needCloudBuild},
+	"s3":                 {"s3", needCloudBuild},
+	"namespace":          {"namespace", ""},
+	"sftp":               {"sftp", ""},
+}
+
+// perkeepSorted lists the sorted key-value store types that perkeep has,
+// with their packages under perkeep.org/pkg/sorted/ and what kind of
+// pk-verify build includes them.
+var perkeepSorted = map[string]struct{ pkg, build string }{
+	"kv":       {"kvfile", "any build"},
+	"leveldb":  {"leveldb", "any build"},
+	"memory":   {"", "any build"},
+	"mongo":    {"mongo", needCloudBuild},
+	"mysql":    {"mysql", needCloudBuild},
+	"postgres": {"postgres", needCloudBuild},
+	"sqlite":   {"sqlite", "a build with cgo and -tags with_sqlite"},
+}
+
+// A diagnosis is what --diagnose reports about a config.
+type diagnosis struct {
+	SchemaVersion int `json:"schemaVersion"`
+
+	Config string `json:"config"`
+	// OK is whether pk-verify can verify the store this config describes:
+	// /bs/ exists, and every storage it needs is understood.
+	OK       bool              `json:"ok"`
+	Error    string            `json:"error,omitempty"` // if the config couldn't be loaded at all
+	Handlers []string          `json:"builtinHandlers"`
+	Prefixes []prefixDiagnosis `json:"prefixes"`
+}
+
+// A prefixDiagnosis is what --diagnose reports about one prefix.
+type prefixDiagnosis struct {
+	Prefix  string `json:"prefix"`
+	Handler string `json:"handler,omitempty"`
+	// Status is "understood", "skipped" (not storage, so not needed),
+	// "unsupported" (storage that this build can't load), or "invalid"
+	// (not in the shape pk-verify expects).
+	Status string `json:"status"`
+	// Needed is whether verifying /bs/ involves this prefix.
+	Needed bool   `json:"needed"`
+	Reason string `json:"reason,omitempty"`
+	// Need says what would make an unsupported handler supported.
+	Need string `json:"need,omitempty"`
+}
+
+// diagnose inspects the config at path, prefix by prefix. Unlike
+// parseLowLevelConfig, it doesn't stop at the first thing it doesn't like.
+func diagnose(path string) *diagnosis {
+	d := &diagnosis{SchemaVersion: diagnosisSchema, Config: path, Handlers: builtinHandlerNames()}
+	config, err := serverinit.LoadFile(path)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	var prefixes map[string]interface{}
+	low := map[string]interface{}(config.LowLevelJSONConfig())
+	if p, ok := low["prefixes"].(map[string]interface{}); ok {
+		prefixes = p
+	} else {
+		d.Error = "the low-level config has no \"prefixes\" object"
+		return d
+	}
+
+	var names []string
+	for prefix := range prefixes {
+		names = append(names, prefix)
+	}
+	sort.Strings(names)
+	byPrefix := make(map[string]*prefixDiagnosis)
+	for _, prefix := range names {
+		pd := diagnosePrefix(prefix, prefixes[prefix])
+		d.Prefixes = append(d.Prefixes, pd)
+	}
+	for i := range d.Prefixes {
+		byPrefix[d.Prefixes[i].Prefix] = &d.Prefixes[i]
+	}
+
+	// Mark what /bs/ needs, by following the prefixes that each storage's
+	// arguments mention.
+	var mark func(prefix string)
+	mark = func(prefix string) {
+		pd, ok := byPrefix[prefix]
+		if !ok || pd.Needed {
+			return
+		}
+		pd.Needed = true
+		h, _ := prefixes[prefix].(map[string]interface{})
+		args, _ := h["handlerArgs"].(map[string]interface{})
+		for _, ref := range mentionedPrefixes(args, byPrefix) {
+			mark(ref)
+		}
+	}
+	mark("/bs/")
+
+	_, haveBS := byPrefix["/bs/"]
+	d.OK = haveBS
+	if !haveBS {
+		d.Error = "there is no /bs/ prefix, the main blob storage"
+	}
+	for _, pd := range d.Prefixes {
+		if pd.Needed && pd.Status != "understood" {
+			d.OK = false
+		}
+	}
+	return d
+}
+
+// diagnosePrefix inspects one entry of the low-level config's prefixes.
+func diagnosePrefix(prefix string, v interface{}) prefixDiagnosis {
+	pd := prefixDiagnosis{Prefix: prefix}
+	if strings.HasPrefix(prefix, "_") {
+		pd.Status, pd.Reason = "skipped", "a comment"
+		return pd
+	}
+	h, ok := v.(map[string]interface{})
+	if !ok {
+		pd.Status, pd.Reason = "invalid", "not a JSON object"
+		return pd
+	}
+	name, ok := h["handler"].(string)
+	if !ok {
+		pd.Status, pd.Reason = "invalid", "no \"handler\" string"
+		return pd
+	}
+	pd.Handler = name
+	args, argsOK := h["handlerArgs"].(map[string]interface{})
+
+	storage := strings.TrimPrefix(name, "storage-")
+	switch {
+	case name == "sync":
+		from, _ := args["from"].(string)
+		to, _ := args["to"].(string)
+		if from == "" || to == "" {
+			pd.Status, pd.Reason = "invalid", "a sync handler needs \"from\" and \"to\" arguments"
+			return pd
+		}
+		pd.Status = "understood"
+	case storage == name:
+		pd.Status, pd.Reason = "skipped", "not a storage handler"
+	case !argsOK:
+		pd.Status, pd.Reason = "invalid", "no \"handlerArgs\" object"
+	case builtinHandlers[storage]:
+		pd.Status = "understood"
+		for _, key := range sortedArgKeys(args) {
+			typ, _ := args[key].(map[string]interface{})["type"].(string)
+			if builtinSorted[typ] {
+				continue
+			}
+			pd.Status = "unsupported"
+			info, known := perkeepSorted[typ]
+			if !known {
+				pd.Reason = fmt.Sprintf("its %q is a %q sorted key-value store, which pk-verify doesn't know of", key, typ)
+				break
+			}
+			pd.Reason = fmt.Sprintf("its %q is a %q sorted key-value store, which this build of pk-verify leaves out", key, typ)
+			pd.Need = info.build
+			break
+		}
+	default:
+		pd.Status = "unsupported"
+		info, known := perkeepHandlers[storage]
+		switch {
+		case !known:
+			pd.Reason = fmt.Sprintf("%q is not a storage handler that pk-verify knows of", storage)
+		case info.build == "":
+			pd.Reason = "no build of pk-verify includes this handler"
+			pd.Need = fmt.Sprintf("a blank import of perkeep.org/pkg/blobserver/%v in handlers.go", info.pkg)
+		default:
+			pd.Reason = "this build of pk-verify leaves out this handler"
+			pd.Need = info.build
+		}
+	}
+	return pd
+}
+
+// sortedArgKeys returns the keys of the handler arguments args that
+// configure sorted key-value stores (like "metaIndex"), in order: the ones
+// whose values are objects with a "type".
+func sortedArgKeys(args map[string]interface{}) []string {
+	var keys []string
+	for key, v := range args {
+		if obj, ok := v.(map[string]interface{}); ok {
+			if _, ok := obj["type"].(string); ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mentionedPrefixes returns the prefixes in known that appear as strings
+// anywhere in v, like conf.referencedPrefixes does for a parsed config.
+func mentionedPrefixes(v interface{}, known map[string]*prefixDiagnosis) []string {
+	var found []string
+	switch v := v.(type) {
+	case string:
+		if _, ok := known[v]; ok {
+			found = append(found, v)
+		}
+	case []interface{}:
+		for _, e := range v {
+			found = append(found, mentionedPrefixes(e, known)...)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			found = append(found, mentionedPrefixes(e, known)...)
+		}
+	}
+	return found
+}
+
+// print writes the diagnosis as indented JSON to stdout (the real one, even
+// with --porcelain).
+func (d *diagnosis) print() error {
+	data, err := json.MarshalIndent(d, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = dataOut.Write(append(data, '\n'))
+	return err
+}
+
+// explain writes the part of the diagnosis that matters for getting pk-verify
+// to work to stderr, for a human reading an error message.
+func (d *diagnosis) explain() {
+	stderrln()
+	stderrln("Here is what I made of each of the prefixes that /bs/ depends on:")
+	stderrln()
+	for _, pd := range d.Prefixes {
+		if !pd.Needed {
+			continue
+		}
+		if pd.Status == "understood" {
+			stderrf("\t%v (%v): understood\n", pd.Prefix, pd.Handler)
+			continue
+		}
+		stderrf("\t%v (%v): %v: %v", pd.Prefix, pd.Handler, pd.Status, pd.Reason)
+		if pd.Need != "" {
+			stderrf("; needs %v", pd.Need)
+		}
+		stderrln()
+	}
+	stderrln()
+	stderrln("(Run with --diagnose for a machine-readable report on every prefix.)")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"perkeep.org/pkg/blob"
+)
+
+// sortRefs sorts refs and removes duplicates, in place.
+func sortRefs(refs []blob.SizedRef) []blob.SizedRef {
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Ref.Less(refs[j].Ref) })
+	out := refs[:0]
+	for i, sr := range refs {
+		if i > 0 && sr.Ref == refs[i-1].Ref {
+			continue
+		}
+		out = append(out, sr)
+	}
+	return out
+}
+
+// storeDigest computes a digest of the set of blobs in a store: the SHA-256
+// of the sorted list of "<ref> <size>\n" lines, one per distinct blob. refs
+// must already be sorted and deduplicated, as by sortRefs.
+//
+// It depends only on which blobs are present, not on the order they were
+// streamed in or on how the store lays them out, so two stores with the same
+// digest hold exactly the same blobs. Comparing digests is a one-line answer
+// to "are my two copies the same?".
+//
+// The digest is prefixed with "sha256-" so that it looks like (but is not) a
+// blob ref.
+func storeDigest(refs []blob.SizedRef) string {
+	h := sha256.New()
+	for _, sr := range refs {
+		fmt.Fprintf(h, "%v %d\n", sr.Ref, sr.Size)
+	}
+	return fmt.Sprintf("sha256-%x", h.Sum(nil))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var readRate = flag.String("read-rate", "", "with --dry-run, the read rate to base the estimate on (e.g. \"50MB/s\"); by default pk-verify benchmarks a few seconds of reads")
+
+// How much reading the dry run benchmark is allowed to do. It stops at
+// whichever limit it hits first.
+const (
+	benchmarkDuration = 5 * time.Second
+	benchmarkBytes    = 256 << 20
+)
+
+// estimate enumerates the blobs in sto without reading them, and prints what
+// a full verification run would look like: how many blobs, how many bytes, how
+// long it should take, and whether the fast streaming path is available.
+func estimate(ctx context.Context, sto blobserver.Storage) error {
+	var (
+		count int
+		size  int64
+		refs  []blob.Ref // kept only as long as needed for the benchmark
+	)
+	err := blobserver.EnumerateAll(ctx, sto, func(sr blob.SizedRef) error {
+		count++
+		size += int64(sr.Size)
+		if len(refs) < 1000 {
+			refs = append(refs, sr.Ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error while enumerating blobs: %w", err)
+	}
+	fmt.Printf("dry run: found %v blob%v, %v total\n", count, plural(count), humanBytes(size))
+
+	if _, ok := sto.(blobserver.BlobStreamer); ok {
+		fmt.Println("this storage supports blob streaming, so a full run will use the fast streaming path")
+	} else {
+		fmt.Println("this storage does not support blob streaming, so a full run will fetch the blobs one by one, which is slower")
+	}
+
+	var rate float64
+	if *readRate != "" {
+		if rate, err = parseRate(*readRate); err != nil {
+			return fmt.Errorf("--read-rate: %w", err)
+		}
+		fmt.Printf("assuming a read rate of %v/s\n", humanBytes(int64(rate)))
+	} else {
+		var n int
+		var read int64
+		if rate, n, read, err = benchmarkReads(ctx, sto, refs); err != nil {
+			return fmt.Errorf("error while benchmarking reads: %w", err)
+		}
+		if n == 0 {
+			// Nothing to read, so nothing to estimate.
+			return nil
+		}
+		fmt.Printf("benchmarked a read rate of %v/s (%v blob%v, %v)\n", humanBytes(int64(rate)), n, plural(n), humanBytes(read))
+	}
+	if rate > 0 {
+		eta := time.Duration(float64(size) / rate * float64(time.Second))
+		fmt.Printf("estimated duration of a full run: %v\n", eta.Round(time.Second))
+	}
+	return nil
+}
+
+// benchmarkReads reads and hashes blobs from refs until it runs out of refs
+// or hits the benchmark limits, and reports the observed rate in bytes per
+// second, along with how many blobs and bytes it read.
+func benchmarkReads(ctx context.Context, sto blob.Fetcher, refs []blob.Ref) (rate float64, n int, read int64, err error) {
+	start := time.Now()
+	for _, br := range refs {
+		if time.Since(start) > benchmarkDuration || read > benchmarkBytes {
+			break
+		}
+		h := br.Hash()
+		if h == nil {
+			continue
+		}
+		rc, _, err := sto.Fetch(ctx, br)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		m, err := io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		read += m
+		n++
+	}
+	if elapsed := time.Since(start); elapsed > 0 && read > 0 {
+		rate = float64(read) / elapsed.Seconds()
+	}
+	return rate, n, read, nil
+}
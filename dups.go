@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+)
+
+var findDuplicates = flag.Bool("find-duplicates", false, "also fingerprint the contents of every blob with SHA-256, and report blobs that have the same contents under different refs (like the sha1 and sha224 refs of the same data, after a hash migration), with how much space removing the extra copies would free. This needs memory for every blob, and makes streamed blobs go through pk-verify's own hashing")
+
+// A dupFinder collects content fingerprints of blobs, to find the ones
+// stored more than once under different refs. Since a blob's ref is the
+// hash of its contents, that only happens when the refs use different hash
+// functions.
+//
+// A nil *dupFinder does nothing, so callers don't have to check whether
+// --find-duplicates is on.
+type dupFinder struct {
+	mu    sync.Mutex
+	first map[[sha256.Size]byte]blob.SizedRef   // the first blob with each fingerprint
+	more  map[[sha256.Size]byte][]blob.SizedRef // the others, if any
+}
+
+func newDupFinder() *dupFinder {
+	if !*findDuplicates {
+		return nil
+	}
+	return &dupFinder{
+		first: make(map[[sha256.Size]byte]blob.SizedRef),
+		more:  make(map[[sha256.Size]byte][]blob.SizedRef),
+	}
+}
+
+// hasher returns a hash to compute a blob's fingerprint with, or nil if d is
+// nil.
+func (d *dupFinder) hasher() hash.Hash {
+	if d == nil {
+		return nil
+	}
+	return sha256.New()
+}
+
+// add records the fingerprint of the valid blob br, computed with a hash from
+// hasher.
+func (d *dupFinder) add(br blob.Ref, size uint32, fp hash.Hash) {
+	if d == nil {
+		return
+	}
+	var sum [sha256.Size]byte
+	fp.Sum(sum[:0])
+	sr := blob.SizedRef{Ref: br, Size: size}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	first, ok := d.first[sum]
+	if !ok {
+		d.first[sum] = sr
+		return
+	}
+	if first.Ref == br {
+		return // the same blob, seen again (like in another replica)
+	}
+	for _, o := range d.more[sum] {
+		if o.Ref == br {
+			return
+		}
+	}
+	d.more[sum] = append(d.more[sum], sr)
+}
+
+// A duplicateSet is a set of blobs with the same contents.
+type duplicateSet struct {
+	Refs []blob.Ref `json:"refs"`
+	Size uint32     `json:"size"`
+}
+
+// duplicates is what --find-duplicates found.
+type duplicates struct {
+	Sets []duplicateSet `json:"sets"`
+	// Reclaimable is how many bytes keeping just one blob of each set
+	// would free.
+	Reclaimable int64 `json:"reclaimableBytes"`
+}
+
+// result returns the sets of duplicates found, sorted by their first ref, or
+// nil if d is nil.
+func (d *dupFinder) result() *duplicates {
+	if d == nil {
+		return nil
+	}
+	dups := &duplicates{Sets: []duplicateSet{}}
+	for sum, more := range d.more {
+		first := d.first[sum]
+		set := duplicateSet{Refs: []blob.Ref{first.Ref}, Size: first.Size}
+		for _, sr := range more {
+			set.Refs = append(set.Refs, sr.Ref)
+		}
+		sort.Slice(set.Refs, func(i, j int) bool { return set.Refs[i].Less(set.Refs[j]) })
+		dups.Sets = append(dups.Sets, set)
+		dups.Reclaimable += int64(first.Size) * int64(len(more))
+	}
+	sort.Slice(dups.Sets, func(i, j int) bool { return dups.Sets[i].Refs[0].Less(dups.Sets[j].Refs[0]) })
+	return dups
+}
+
+// report lists the duplicates found.
+func (dups *duplicates) report(found *findings) {
+	if dups == nil {
+		return
+	}
+	if len(dups.Sets) == 0 {
+		fmt.Println("found no blobs stored more than once under different refs")
+		return
+	}
+	for _, set := range dups.Sets {
+		found.report("same contents (%v): %v", humanBytes(int64(set.Size)), set.Refs)
+	}
+	n := len(dups.Sets)
+	fmt.Printf("DUPLICATES: %v set%v of blobs with the same contents under different refs, listed %v; keeping one of each would free %v\n", n, plural(n), found.where(), humanBytes(dups.Reclaimable))
+}
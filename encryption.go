@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"go4.org/jsonconfig"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/sorted"
+)
+
+var encryptionSample = flag.Int("encryption-sample", 100, "for \"encrypt\" storages, how many blobs to decrypt and verify through the encryption layer, to check that the key still works; 0 to only check that key material is configured")
+
+// An encrypt storage keeps its blobs encrypted in one storage ("blobs"),
+// and the mapping from each plaintext ref to its ciphertext in another
+// ("meta", also encrypted, and cached in "metaIndex"). The ciphertexts
+// verify fine without the key, since their refs are hashes of the
+// ciphertext, so a run can find every blob intact in a store that nobody can
+// read anymore. checkEncryption checks the part that verification can't:
+// that the key is there, and still decrypts the blobs.
+
+// checkEncryption checks the key material of every encrypt storage that
+// prefixes use, and returns the problems it found.
+func checkEncryption(ctx context.Context, ld *Loader, prefixes []string) []string {
+	conf := ld.conf
+	var problems []string
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		sc := conf.Prefixes[prefix]
+		if sc.StorageHandler != "encrypt" || !usesPrefix(conf, prefixes, prefix) {
+			continue
+		}
+		for _, p := range checkEncryptStorage(ctx, ld, prefix, sc.StorageHandlerArgs) {
+			problems = append(problems, fmt.Sprintf("%v: %v", prefix, p))
+		}
+	}
+	return problems
+}
+
+// checkEncryptStorage checks the encrypt storage at prefix, given its
+// handler arguments.
+func checkEncryptStorage(ctx context.Context, ld *Loader, prefix string, args jsonconfig.Obj) []string {
+	if p := checkKeyMaterial(args); p != "" {
+		return []string{p}
+	}
+	var problems []string
+
+	// Every row of the meta index should point at a ciphertext that the
+	// blob storage has.
+	if metaConf, ok := args["metaIndex"].(map[string]interface{}); ok {
+		kv, err := openSortedReadOnly(jsonconfig.Obj(metaConf))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("can't open the meta index: %v", err))
+		} else {
+			problems = append(problems, checkEncryptMeta(ctx, ld, args, kv.Find("", ""))...)
+			kv.Close()
+		}
+	}
+
+	if *encryptionSample <= 0 {
+		return problems
+	}
+	sto, err := ld.GetStorage(prefix)
+	if err != nil {
+		// Loading an encrypt storage decrypts its meta blobs, so this
+		// is where a wrong key usually shows.
+		return append(problems, fmt.Sprintf("can't open the storage, so its blobs can't be read, even if they are intact: %v", err))
+	}
+	var refs []blob.Ref
+	err = blobserver.EnumerateAll(ctx, sto, func(sr blob.SizedRef) error {
+		refs = append(refs, sr.Ref)
+		if len(refs) >= *encryptionSample {
+			return errEnoughSampled
+		}
+		return nil
+	})
+	if err != nil && err != errEnoughSampled {
+		return append(problems, fmt.Sprintf("can't list the decrypted blobs: %v", err))
+	}
+	fmt.Printf("%v: decrypting %v blob%v to check the key\n", prefix, len(refs), plural(len(refs)))
+	res, err := pkverify.Refs(ctx, sto, refs, nil)
+	switch {
+	case err != nil:
+		problems = append(problems, fmt.Sprintf("blobs don't decrypt: %v", err))
+	case res.Invalid > 0:
+		problems = append(problems, fmt.Sprintf("%v of %v blob%v decrypted to the wrong contents", res.Invalid, len(refs), plural(len(refs))))
+	case len(res.Missing) > 0:
+		problems = append(problems, fmt.Sprintf("%v of %v blob%v listed in the meta index have no ciphertext", len(res.Missing), len(refs), plural(len(refs))))
+	}
+	return problems
+}
+
+// errEnoughSampled stops an enumeration early.
+var errEnoughSampled = errors.New("enough blobs sampled")
+
+// checkKeyMaterial checks that args configure a usable key, and describes
+// what is wrong if not. The encrypt handler has taken its key as a
+// passphrase, as a hex "key", or from a "keyFile".
+func checkKeyMaterial(args jsonconfig.Obj) string {
+	passphrase, _ := args["passphrase"].(string)
+	key, _ := args["key"].(string)
+	keyFile, _ := args["keyFile"].(string)
+	switch {
+	case passphrase != "":
+		return ""
+	case key != "":
+		if b, err := hex.DecodeString(key); err != nil || len(b) == 0 {
+			return "the \"key\" isn't hex, so nothing can be decrypted"
+		}
+		return ""
+	case keyFile != "":
+		fi, err := os.Stat(keyFile)
+		if err != nil {
+			return fmt.Sprintf("the key file is unusable, so nothing can be decrypted: %v", err)
+		}
+		if fi.Size() == 0 {
+			return fmt.Sprintf("the key file %v is empty, so nothing can be decrypted", keyFile)
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			stderrf("pk-verify: WARNING: the key file %v can be read by other users (mode %v)\n", keyFile, fi.Mode().Perm())
+		}
+		return ""
+	}
+	return "no key is configured (no \"passphrase\", \"key\", or \"keyFile\"), so nothing can be decrypted"
+}
+
+// checkEncryptMeta checks that the ciphertexts that the meta index rows
+// from it point at (the refs in their values) exist in the encrypt
+// storage's blob storage. The first problems found are reported.
+func checkEncryptMeta(ctx context.Context, ld *Loader, args jsonconfig.Obj, it sorted.Iterator) []string {
+	const maxReported = 10
+	blobsPrefix, _ := args["blobs"].(string)
+	if blobsPrefix == "" {
+		it.Close()
+		return []string{"the storage has no \"blobs\" argument"}
+	}
+	blobs, err := ld.GetStorage(blobsPrefix)
+	if err != nil {
+		it.Close()
+		return []string{fmt.Sprintf("can't load the blob storage %v: %v", blobsPrefix, err)}
+	}
+	var (
+		problems []string
+		rows     int
+		dangling int
+	)
+	for it.Next() && ctx.Err() == nil {
+		rows++
+		for _, field := range strings.FieldsFunc(it.Value(), func(r rune) bool { return r == '/' || r == '|' || r == ' ' }) {
+			br, ok := blob.Parse(field)
+			if !ok {
+				continue
+			}
+			if _, err := blobserver.StatBlob(ctx, blobs, br); err == os.ErrNotExist {
+				dangling++
+				if dangling <= maxReported {
+					problems = append(problems, fmt.Sprintf("the meta index maps %v to the ciphertext %v, which %v doesn't have", it.Key(), br, blobsPrefix))
+				}
+			}
+		}
+	}
+	if err := it.Close(); err != nil {
+		problems = append(problems, fmt.Sprintf("reading the meta index stopped after %v row%v: %v", rows, plural(rows), err))
+	}
+	if dangling > maxReported {
+		problems = append(problems, fmt.Sprintf("... and %v more missing ciphertexts", dangling-maxReported))
+	}
+	return problems
+}
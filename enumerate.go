@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	"go4.org/syncutil"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// verifyEnumerate verifies all of the blobs in v.sto (except the ones in
+// skip, which may be nil) by enumerating them and
+// fetching each one, with v.workers fetches at once. This works with any
+// storage, but is slower than streaming or walking, since every blob is a
+// separate request; v.limiter keeps those requests from getting throttled by
+// the storage. Like verifyStream, it calls fn with each result from the
+// calling goroutine.
+func (v *verifier) verifyEnumerate(ctx context.Context, skip map[blob.Ref]bool, fn func(verifyResult)) error {
+	refs := make(chan blob.SizedRef)
+	results := make(chan verifyResult)
+
+	var enum syncutil.Group
+	enum.Go(func() error {
+		defer close(refs)
+		return blobserver.EnumerateAll(ctx, v.sto, func(sb blob.SizedRef) error {
+			if skip[sb.Ref] || !v.wants(sb.Ref, sb.Size) {
+				return nil
+			}
+			select {
+			case refs <- sb:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	})
+
+	var fetchers syncutil.Group
+	for i := 0; i < v.workers; i++ {
+		fetchers.Go(func() error {
+			for sb := range refs {
+				results <- v.verifyRef(ctx, sb)
+			}
+			return nil
+		})
+	}
+	go func() {
+		fetchers.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		fn(r)
+	}
+	return enum.Err()
+}
+
+// verifyRef fetches and verifies one enumerated blob.
+func (v *verifier) verifyRef(ctx context.Context, sb blob.SizedRef) verifyResult {
+	r := v.verifyWith(ctx, sb.Ref, sb.Size, func(ctx context.Context) error {
+		if int64(sb.Size) > hugeBlobBytes {
+			return v.verifyRanges(ctx, sb.Ref, sb.Size)
+		}
+		for overloads := 0; ; overloads++ {
+			if err := v.limiter.wait(ctx); err != nil {
+				return err
+			}
+			rc, _, err := v.fetch(ctx, sb.Ref)
+			if isOverloaded(err) && overloads < limiterMaxOverload {
+				v.limiter.overloaded()
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			v.limiter.succeeded()
+			defer rc.Close()
+			return v.verifyReader(sb.Ref, sb.Size, rc)
+		}
+	})
+	v.checkRaced(ctx, &r, nil)
+	return r
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	excludeRefPrefix = flag.String("exclude-ref-prefix", "", "comma-separated ref prefixes (like \"sha1-\", or \"sha224-00,sha224-01\") of blobs to skip. The blobs skipped are counted, and recorded as a gap in the run's coverage")
+	excludeSizeOver  = flag.String("exclude-size-over", "", "skip the blobs bigger than this (like \"100MB\"), say to leave the enormous video blobs alone on a metered connection. The blobs skipped are counted, and recorded as a gap in the run's coverage")
+)
+
+// An exclusion is the blobs that --exclude-ref-prefix and
+// --exclude-size-over leave out of a run.
+//
+// A nil *exclusion excludes nothing.
+type exclusion struct {
+	prefixes []string
+	over     int64 // 0 for no size limit
+}
+
+// parseExclusion parses the exclusion flags, returning nil if there are
+// none.
+func parseExclusion() (*exclusion, error) {
+	x := &exclusion{}
+	for _, p := range strings.Split(*excludeRefPrefix, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			x.prefixes = append(x.prefixes, p)
+		}
+	}
+	if *excludeSizeOver != "" {
+		over, err := parseBytes(*excludeSizeOver)
+		if err != nil {
+			return nil, fmt.Errorf("--exclude-size-over: %w", err)
+		}
+		if over <= 0 {
+			return nil, fmt.Errorf("--exclude-size-over must be positive")
+		}
+		x.over = over
+	}
+	if len(x.prefixes) == 0 && x.over == 0 {
+		return nil, nil
+	}
+	return x, nil
+}
+
+// matches reports whether sr is excluded.
+func (x *exclusion) matches(sr blob.SizedRef) bool {
+	if x == nil {
+		return false
+	}
+	if x.over > 0 && int64(sr.Size) > x.over {
+		return true
+	}
+	ref := sr.Ref.String()
+	for _, p := range x.prefixes {
+		if strings.HasPrefix(ref, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the refs that aren't excluded.
+func (x *exclusion) filter(refs []blob.SizedRef) []blob.SizedRef {
+	if x == nil {
+		return refs
+	}
+	var out []blob.SizedRef
+	for _, sr := range refs {
+		if !x.matches(sr) {
+			out = append(out, sr)
+		}
+	}
+	return out
+}
+
+// String describes the exclusion, for the summary.
+func (x *exclusion) String() string {
+	var parts []string
+	if len(x.prefixes) > 0 {
+		parts = append(parts, "--exclude-ref-prefix="+strings.Join(x.prefixes, ","))
+	}
+	if x.over > 0 {
+		parts = append(parts, "--exclude-size-over="+*excludeSizeOver)
+	}
+	return strings.Join(parts, " ")
+}
+
+// excludedBlobs counts the blobs that a verifier left out because of its
+// exclusion.
+type excludedBlobs struct {
+	mu    sync.Mutex
+	blobs int
+	bytes int64
+}
+
+func (e *excludedBlobs) add(size uint32) {
+	e.mu.Lock()
+	e.blobs++
+	e.bytes += int64(size)
+	e.mu.Unlock()
+}
+
+func (e *excludedBlobs) counts() (int, int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.blobs, e.bytes
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go4.org/jsonconfig"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// The "exec" storage handler verifies storage that perkeep itself can't
+// read, like tape or an in-house object store, through a small adapter
+// program. In the config, it looks like any other storage:
+//
+//	"/bs/": {
+//		"handler": "storage-exec",
+//		"handlerArgs": {
+//			"command": ["/usr/local/bin/tape-adapter", "--drive", "/dev/nst0"]
+//		}
+//	}
+//
+// pk-verify starts the command and speaks to it over its stdin and stdout
+// (its stderr is passed through). Or, with "socket": "/path/to/socket" in
+// place of "command", it connects to an adapter that is already listening
+// on that Unix socket.
+//
+// The protocol is one request at a time, each a line, answered by lines:
+//
+//	enumerate <limit> [<after>]
+//		"<ref> <size>" for up to limit blobs, in ref order, starting
+//		after the ref after (if given); then "end"
+//	stat <ref>
+//		"<ref> <size>", or "missing"
+//	fetch <ref>
+//		"blob <size>", followed by exactly size bytes of the blob's
+//		contents (blobs over Perkeep's 16MB limit are skipped, and
+//		fail); or "missing"
+//
+// Any request can be answered with "error <message>" instead. The adapter
+// doesn't check anything itself: it hands over the bytes it has, and
+// pk-verify hashes them. The storage is read-only.
+func init() {
+	blobserver.RegisterStorageConstructor("exec", newExecStorage)
+	registerHandlers("exec")
+}
+
+type execStorage struct {
+	name string // the command or socket, for errors
+
+	mu   sync.Mutex // one request at a time
+	r    *bufio.Reader
+	w    io.Writer
+	conn io.Closer
+}
+
+func newExecStorage(_ blobserver.Loader, args jsonconfig.Obj) (blobserver.Storage, error) {
+	command := args.OptionalList("command")
+	socket := args.OptionalString("socket", "")
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+	if (len(command) == 0) == (socket == "") {
+		return nil, errors.New(`the exec handler needs one of "command" or "socket"`)
+	}
+	if socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		return &execStorage{name: socket, r: bufio.NewReader(conn), w: conn, conn: conn}, nil
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// The adapter quits when its stdin is closed, which is when pk-verify
+	// exits, at the latest.
+	return &execStorage{name: command[0], r: bufio.NewReader(stdout), w: stdin, conn: stdin}, nil
+}
+
+// request sends a request line and returns the first line of the answer.
+// The caller holds s.mu, and reads the rest of the answer, if any.
+func (s *execStorage) request(format string, args ...interface{}) (string, error) {
+	if _, err := fmt.Fprintf(s.w, format+"\n", args...); err != nil {
+		return "", fmt.Errorf("%v: %w", s.name, err)
+	}
+	return s.readLine()
+}
+
+func (s *execStorage) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", fmt.Errorf("%v: %w", s.name, err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "error ") {
+		return "", fmt.Errorf("%v: %v", s.name, strings.TrimPrefix(line, "error "))
+	}
+	return line, nil
+}
+
+// parseSizedRef parses a "<ref> <size>" line.
+func (s *execStorage) parseSizedRef(line string) (blob.SizedRef, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 2 {
+		br, ok := blob.Parse(fields[0])
+		size, err := strconv.ParseUint(fields[1], 10, 32)
+		if ok && err == nil {
+			return blob.SizedRef{Ref: br, Size: uint32(size)}, nil
+		}
+	}
+	return blob.SizedRef{}, fmt.Errorf("%v: expected \"<ref> <size>\", got %q", s.name, line)
+}
+
+func (s *execStorage) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	defer close(dest)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req := fmt.Sprintf("enumerate %v", limit)
+	if after != "" {
+		req += " " + after
+	}
+	// The rest of the answer has to be read before giving up, whether on
+	// a bad line or a canceled ctx, or the next request would get it.
+	var bad error
+	line, err := s.request("%v", req)
+	for ; err == nil && line != "end"; line, err = s.readLine() {
+		sr, perr := s.parseSizedRef(line)
+		if perr != nil {
+			if bad == nil {
+				bad = perr
+			}
+			continue
+		}
+		if bad == nil && ctx.Err() == nil {
+			select {
+			case dest <- sr:
+			case <-ctx.Done():
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if bad != nil {
+		return bad
+	}
+	return ctx.Err()
+}
+
+func (s *execStorage) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	for _, br := range blobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		line, err := s.request("stat %v", br)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if line == "missing" {
+			continue
+		}
+		sr, err := s.parseSizedRef(line)
+		if err != nil {
+			return err
+		}
+		if err := fn(sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *execStorage) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line, err := s.request("fetch %v", br)
+	if err != nil {
+		return nil, 0, err
+	}
+	if line == "missing" {
+		return nil, 0, os.ErrNotExist
+	}
+	size, err := strconv.ParseUint(strings.TrimPrefix(line, "blob "), 10, 32)
+	if err != nil || !strings.HasPrefix(line, "blob ") {
+		return nil, 0, fmt.Errorf("%v: expected \"blob <size>\", got %q", s.name, line)
+	}
+	if size > pkverify.MaxBlobSize {
+		// Skip the contents rather than holding them all in memory; the
+		// next request's answer starts after them.
+		if _, err := io.CopyN(ioutil.Discard, s.r, int64(size)); err != nil {
+			return nil, 0, fmt.Errorf("%v: reading %v: %w", s.name, br, err)
+		}
+		return nil, 0, fmt.Errorf("%v: %v is %v bytes, more than Perkeep's limit of %v", s.name, br, size, pkverify.MaxBlobSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, 0, fmt.Errorf("%v: reading %v: %w", s.name, br, err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), uint32(size), nil
+}
+
+var errExecReadOnly = errors.New("exec storage is read-only")
+
+func (s *execStorage) ReceiveBlob(context.Context, blob.Ref, io.Reader) (blob.SizedRef, error) {
+	return blob.SizedRef{}, errExecReadOnly
+}
+
+func (s *execStorage) RemoveBlobs(context.Context, []blob.Ref) error {
+	return errExecReadOnly
+}
+
+func (s *execStorage) Close() error {
+	return s.conn.Close()
+}
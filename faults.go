@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var simulateFaults = flag.String("simulate-faults", "", "for trying out pk-verify and whatever watches its results (alerts, --hook, the daemon's notifications) without harming real data: make some of the blobs read look bad, as in \"rate=0.001,kind=bitflip|truncate|ioerror\". rate is the fraction of blobs affected, and kind is what happens to them (one of those given, picked per blob): a flipped bit, a missing tail, or a read error. Add seed=<n> to hit the same blobs every time. Nothing is written to the storage; the faults are only in what pk-verify reads, the summary says they were simulated, and the run is kept out of the history, the --verify-cache, and --store-report")
+
+// errSimulated is the read error of --simulate-faults.
+var errSimulated = errors.New("simulated I/O error (--simulate-faults)")
+
+// A faultSpec is a parsed --simulate-faults.
+//
+// A nil *faultSpec injects nothing.
+type faultSpec struct {
+	text  string
+	rate  float64
+	kinds []string
+	seed  uint64
+
+	mu       sync.Mutex
+	injected map[string]int // by kind
+}
+
+// faultKinds are the kinds of fault that --simulate-faults knows.
+var faultKinds = map[string]bool{"bitflip": true, "truncate": true, "ioerror": true}
+
+// parseFaults parses --simulate-faults, returning nil for "".
+func parseFaults(s string) (*faultSpec, error) {
+	if s == "" {
+		return nil, nil
+	}
+	f := &faultSpec{text: s, seed: uint64(time.Now().UnixNano()), injected: map[string]int{}}
+	for _, kv := range strings.Split(s, ",") {
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid --simulate-faults %q: %q isn't key=value", s, kv)
+		}
+		key, value := strings.TrimSpace(kv[:eq]), strings.TrimSpace(kv[eq+1:])
+		switch key {
+		case "rate":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid --simulate-faults %q: rate must be a fraction above 0, like 0.001", s)
+			}
+			f.rate = rate
+		case "kind":
+			for _, k := range strings.Split(value, "|") {
+				if !faultKinds[k] {
+					return nil, fmt.Errorf("invalid --simulate-faults %q: unknown kind %q: must be \"bitflip\", \"truncate\", or \"ioerror\"", s, k)
+				}
+				f.kinds = append(f.kinds, k)
+			}
+		case "seed":
+			seed, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --simulate-faults %q: seed must be a number", s)
+			}
+			f.seed = seed
+		default:
+			return nil, fmt.Errorf("invalid --simulate-faults %q: unknown key %q", s, key)
+		}
+	}
+	if f.rate == 0 {
+		return nil, fmt.Errorf("invalid --simulate-faults %q: it needs a rate", s)
+	}
+	if len(f.kinds) == 0 {
+		f.kinds = []string{"bitflip"}
+	}
+	return f, nil
+}
+
+// fault returns the kind of fault that reads of br get, or "" for none. It
+// is the same every time br is read, the way corruption at rest would be,
+// so --paranoid and --passes don't explain it away.
+func (f *faultSpec) fault(br blob.Ref) string {
+	if f == nil {
+		return ""
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d %v", f.seed, br)
+	n := h.Sum64()
+	if float64(n>>11)/(1<<53) >= f.rate {
+		return ""
+	}
+	return f.kinds[n%uint64(len(f.kinds))]
+}
+
+// apply returns the contents of br, as read into data, with its fault, if
+// it has one.
+func (f *faultSpec) apply(br blob.Ref, data []byte) ([]byte, error) {
+	kind := f.fault(br)
+	if kind == "" {
+		return data, nil
+	}
+	f.mu.Lock()
+	f.injected[kind]++
+	f.mu.Unlock()
+	switch {
+	case kind == "ioerror":
+		return nil, errSimulated
+	case len(data) == 0:
+		return data, nil
+	case kind == "truncate":
+		return data[:len(data)/2], nil
+	}
+	bad := append([]byte(nil), data...)
+	h := fnv.New64()
+	fmt.Fprintf(h, "%d %v", f.seed, br)
+	i := int(h.Sum64() % uint64(len(bad)*8))
+	bad[i/8] ^= 1 << uint(i%8)
+	return bad, nil
+}
+
+// summary describes the faults injected so far, for the summary.
+func (f *faultSpec) summary() *simulatedFaults {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := &simulatedFaults{Spec: f.text, Seed: f.seed, Injected: map[string]int{}}
+	for kind, n := range f.injected {
+		s.Injected[kind] = n
+	}
+	return s
+}
+
+// simulatedFaults records, in the summary, that --simulate-faults made some
+// of the blobs look bad.
+type simulatedFaults struct {
+	Spec     string         `json:"spec"`
+	Seed     uint64         `json:"seed"`
+	Injected map[string]int `json:"injected"` // blob reads, by kind
+}
+
+// wrap returns sto with the faults injected into what is read from it,
+// keeping its ability to stream.
+func (f *faultSpec) wrap(sto blobserver.Storage) blobserver.Storage {
+	if f == nil {
+		return sto
+	}
+	fs := &faultStorage{Storage: sto, faults: f}
+	if bs, ok := sto.(blobserver.BlobStreamer); ok {
+		return &faultStreamer{faultStorage: fs, streamer: bs}
+	}
+	return fs
+}
+
+// A faultStorage is a storage that reads with --simulate-faults.
+type faultStorage struct {
+	blobserver.Storage
+	faults *faultSpec
+}
+
+func (s *faultStorage) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	rc, size, err := s.Storage.Fetch(ctx, br)
+	if err != nil || s.faults.fault(br) == "" {
+		return rc, size, err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	if data, err = s.faults.apply(br, data); err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), size, nil
+}
+
+// A faultStreamer is a faultStorage for a storage that streams.
+type faultStreamer struct {
+	*faultStorage
+	streamer blobserver.BlobStreamer
+}
+
+func (s *faultStreamer) StreamBlobs(ctx context.Context, dest chan<- blobserver.BlobAndToken, contToken string) error {
+	src := make(chan blobserver.BlobAndToken)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.streamer.StreamBlobs(ctx, src, contToken)
+	}()
+	defer close(dest)
+	for b := range src {
+		if s.faults.fault(b.Ref()) != "" {
+			orig := b.Blob
+			b.Blob = blob.NewBlob(orig.Ref(), orig.Size(), func(ctx context.Context) ([]byte, error) {
+				rd, err := orig.ReadAll(ctx)
+				if err != nil {
+					return nil, err
+				}
+				data, err := ioutil.ReadAll(rd)
+				if err != nil {
+					return nil, err
+				}
+				return s.faults.apply(orig.Ref(), data)
+			})
+		}
+		select {
+		case dest <- b:
+		case <-ctx.Done():
+			// Let the streamer finish, so that it doesn't leak.
+			go func() {
+				for range src {
+				}
+			}()
+			return ctx.Err()
+		}
+	}
+	return <-errc
+}
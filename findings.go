@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+var invalidOut = flag.String("invalid-out", "", "write the lines about invalid, missing, and otherwise problematic blobs to this file, instead of to stderr")
+
+// findings is where pk-verify reports problems with individual blobs, like
+// "found invalid blob: <ref>".
+//
+// They don't go to stdout with the progress line, where each one would get
+// partly overwritten by the next "\r" update, and would be mixed into
+// anything that parses stdout. On a terminal, stdout and stderr still end up
+// in the same place, so before each finding the progress line is cleared
+// (it gets redrawn on the next update).
+type findings struct {
+	w      io.Writer
+	file   *os.File  // if writing to --invalid-out
+	redact *redactor // for --invalid-out
+	clear  bool
+}
+
+func openFindings(redact *redactor) (*findings, error) {
+	if *invalidOut == "" {
+		return &findings{
+			w:     os.Stderr,
+			clear: isTerminal(os.Stdout) && isTerminal(os.Stderr),
+		}, nil
+	}
+	f, err := os.Create(*invalidOut)
+	if err != nil {
+		return nil, err
+	}
+	return &findings{w: f, file: f, redact: redact}, nil
+}
+
+// report writes one line about one blob.
+func (fd *findings) report(format string, a ...interface{}) {
+	if fd.clear {
+		fmt.Print("\r\x1b[K")
+	}
+	fd.w.Write(fd.redact.redact([]byte(fmt.Sprintf(format+"\n", a...))))
+}
+
+// where describes where the findings went, to finish the sentence "Their
+// refs are listed ...".
+func (fd *findings) where() string {
+	if fd.file != nil {
+		return "in " + fd.file.Name()
+	}
+	return "above"
+}
+
+func (fd *findings) close() error {
+	if fd.file == nil {
+		return nil
+	}
+	return fd.file.Close()
+}
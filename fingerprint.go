@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+var fingerprintOut = flag.String("fingerprint-out", "", "after the run, write a small fingerprint of the store (its storage generations, first and last refs, blob count, and digest) to this file, for a quick \"pk-verify fingerprint compare\" with another copy")
+
+// A fingerprint is a few facts about a store, small enough to keep next to
+// it, that are enough to tell whether two disks plausibly hold the same
+// store without reading either of them again.
+type fingerprint struct {
+	SchemaVersion int `json:"schemaVersion"`
+
+	RunID string    `json:"runID"`
+	Time  time.Time `json:"time"`
+
+	// Complete is set if the run verified the whole store (see
+	// coverage). Otherwise the counts only cover what it did verify, and
+	// there's no digest.
+	Complete bool `json:"complete"`
+
+	Generations map[string]generation `json:"generations,omitempty"`
+	First       blob.Ref              `json:"first"`
+	Last        blob.Ref              `json:"last"`
+	Count       int                   `json:"count"`
+	Bytes       int64                 `json:"bytes"`
+	Digest      string                `json:"digest,omitempty"`
+}
+
+// writeFingerprint writes the fingerprint of the store verified by the run
+// described by s to path. It must be called after s.finish.
+//
+// Like --manifest-out, it is never redacted (see --redact-refs): the
+// pseudonyms are keyed differently on each machine, so redacted digests and
+// refs could never match another copy's.
+func writeFingerprint(path string, s *Summary) error {
+	fp := fingerprint{
+		SchemaVersion: fingerprintSchema,
+		RunID:         s.RunID,
+		Time:          s.Start,
+		Complete:      s.Coverage.Complete,
+		Generations:   s.Generations,
+		Count:         len(s.seen),
+		Bytes:         s.Bytes,
+		Digest:        s.Digest,
+	}
+	if n := len(s.seen); n > 0 {
+		fp.First, fp.Last = s.seen[0].Ref, s.seen[n-1].Ref
+	}
+	data, err := json.MarshalIndent(fp, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func readFingerprint(path string) (*fingerprint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fp fingerprint
+	if err := json.Unmarshal(data, &fp); err != nil {
+		return nil, fmt.Errorf("%v is not a --fingerprint-out file: %v", path, err)
+	}
+	if err := checkSchema("fingerprint", path, fp.SchemaVersion, fingerprintSchema); err != nil {
+		return nil, err
+	}
+	return &fp, nil
+}
+
+// fingerprintMain implements "pk-verify fingerprint compare", which compares
+// the --fingerprint-out files of two stores.
+func fingerprintMain(args []string) {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	fs.Usage = func() {
+		stderrf("Usage: %v fingerprint compare <fingerprint file> <fingerprint file>\n", os.Args[0])
+		stderrln()
+		stderrln("Tells whether the two stores that the --fingerprint-out files were written for plausibly hold the same blobs, before committing to a full comparison. Exits with status 2 if they don't.")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 3 || fs.Arg(0) != "compare" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	a, err := readFingerprint(fs.Arg(1))
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	b, err := readFingerprint(fs.Arg(2))
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	same, notes := compareFingerprints(a, b)
+	for _, n := range notes {
+		fmt.Println(n)
+	}
+	if !same {
+		os.Exit(2)
+	}
+}
+
+// compareFingerprints says whether the stores that a and b were written for
+// plausibly hold the same blobs, and why.
+//
+// If both runs were complete, their digests settle it. Otherwise it's down
+// to the counts and the first and last refs, which can't prove two stores
+// the same but are very unlikely to match by chance. Shared storage
+// generations are noted, but don't count either way: a copy of a disk
+// keeps its generations even once it has drifted, and replicas are
+// initialized separately even when they're perfectly in sync.
+func compareFingerprints(a, b *fingerprint) (same bool, notes []string) {
+	var shared []string
+	for prefix, g := range a.Generations {
+		for _, h := range b.Generations {
+			if g.Random == h.Random {
+				shared = append(shared, prefix)
+				break
+			}
+		}
+	}
+	sort.Strings(shared)
+	for _, prefix := range shared {
+		notes = append(notes, fmt.Sprintf("both have the storage generation of %v (%v), so one is a copy of the other", prefix, a.Generations[prefix].Random))
+	}
+
+	if a.Complete && b.Complete && a.Digest != "" && b.Digest != "" {
+		if a.Digest == b.Digest {
+			notes = append(notes, fmt.Sprintf("SAME: both hold the same %v blob%v (store digest %v)", humanCount(a.Count), plural(a.Count), a.Digest))
+			return true, notes
+		}
+		notes = append(notes, fmt.Sprintf("DIFFERENT: the stores hold different blobs (%v blob%v, %v, vs. %v blob%v, %v)", humanCount(a.Count), plural(a.Count), humanBytes(a.Bytes), humanCount(b.Count), plural(b.Count), humanBytes(b.Bytes)))
+		return false, notes
+	}
+
+	var diffs []string
+	if a.Count != b.Count {
+		diffs = append(diffs, fmt.Sprintf("%v vs. %v blobs", humanCount(a.Count), humanCount(b.Count)))
+	}
+	if a.Bytes != b.Bytes {
+		diffs = append(diffs, fmt.Sprintf("%v vs. %v", humanBytes(a.Bytes), humanBytes(b.Bytes)))
+	}
+	if a.First != b.First {
+		diffs = append(diffs, fmt.Sprintf("first blob %v vs. %v", a.First, b.First))
+	}
+	if a.Last != b.Last {
+		diffs = append(diffs, fmt.Sprintf("last blob %v vs. %v", a.Last, b.Last))
+	}
+	partial := "one of the runs"
+	if !a.Complete && !b.Complete {
+		partial = "both runs"
+	}
+	if len(diffs) > 0 {
+		for _, d := range diffs {
+			notes = append(notes, "differs: "+d)
+		}
+		notes = append(notes, fmt.Sprintf("PROBABLY DIFFERENT, although %v only verified part of the store", partial))
+		return false, notes
+	}
+	notes = append(notes, fmt.Sprintf("PLAUSIBLY THE SAME: the same %v blob%v, %v, from %v to %v; but %v only verified part of the store, so there is no digest to be sure", humanCount(a.Count), plural(a.Count), humanBytes(a.Bytes), a.First, a.Last, partial))
+	return true, notes
+}
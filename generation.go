@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"perkeep.org/pkg/blobserver"
+)
+
+// A generation identifies one incarnation of a storage. Storages that support
+// it (blobserver.Generationer) record a random value and a timestamp when they
+// are first initialized, and keep them until the storage is reset, so a
+// changed generation means the storage was wiped and recreated.
+type generation struct {
+	Init   time.Time `json:"init"`
+	Random string    `json:"random"`
+}
+
+// replicaInitSkew is how far apart the initialization times of storages that
+// are supposed to hold the same blobs can be before it looks suspicious.
+const replicaInitSkew = 24 * time.Hour
+
+// loadGenerations returns the generations of all of the storages that ld has
+// loaded, and that support generations. It also loads the ends of any sync
+// handlers in the config, since whether they match is what matters most.
+// Problems are returned as warnings rather than errors: this is all
+// advisory.
+func loadGenerations(ld *Loader) (map[string]generation, []string) {
+	var warnings []string
+	for _, sync := range ld.conf.Syncs {
+		for _, prefix := range []string{sync.From, sync.To} {
+			if _, ok := ld.conf.Prefixes[prefix]; !ok {
+				continue
+			}
+			if _, err := ld.GetStorage(prefix); err != nil {
+				warnings = append(warnings, fmt.Sprintf("could not load %v to check its generation: %v", prefix, err))
+			}
+		}
+	}
+	gens := map[string]generation{}
+	for prefix, sto := range ld.loaded() {
+		g, ok := sto.(blobserver.Generationer)
+		if !ok {
+			continue
+		}
+		init, random, err := g.StorageGeneration()
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("could not read the generation of %v: %v", prefix, err))
+			continue
+		}
+		gens[prefix] = generation{Init: init, Random: random}
+	}
+	return gens, warnings
+}
+
+// checkGenerations looks for generations that suggest a storage was wiped
+// and recreated: replicas or sync targets that were initialized long after
+// their siblings. (Generations that changed since the previous run are
+// checked by checkStoreIdentity.)
+func checkGenerations(conf *LowLevelConfig, gens map[string]generation) []string {
+	var warnings []string
+	for _, group := range mirrorGroups(conf) {
+		var oldest string
+		for _, prefix := range group {
+			if _, ok := gens[prefix]; ok && (oldest == "" || gens[prefix].Init.Before(gens[oldest].Init)) {
+				oldest = prefix
+			}
+		}
+		for _, prefix := range group {
+			g, ok := gens[prefix]
+			if !ok || prefix == oldest || g.Init.Sub(gens[oldest].Init) <= replicaInitSkew {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("%v was initialized %v, long after %v (%v), which it is supposed to mirror: it may have been wiped and recreated, and may be missing blobs",
+				prefix, g.Init.Format(time.RFC3339), oldest, gens[oldest].Init.Format(time.RFC3339)))
+		}
+	}
+	return warnings
+}
+
+// mirrorGroups returns the groups of storage prefixes that are supposed to
+// hold the same blobs: the backends of each replica storage, and the source
+// and destination of each sync.
+func mirrorGroups(conf *LowLevelConfig) [][]string {
+	var groups [][]string
+	for _, sc := range conf.Prefixes {
+		if sc.StorageHandler == "replica" {
+			var backends []string
+			list, _ := sc.StorageHandlerArgs["backends"].([]interface{})
+			for _, b := range list {
+				if s, ok := b.(string); ok {
+					backends = append(backends, s)
+				}
+			}
+			groups = append(groups, backends)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return fmt.Sprint(groups[i]) < fmt.Sprint(groups[j]) })
+	for _, sync := range conf.Syncs {
+		groups = append(groups, []string{sync.From, sync.To})
+	}
+	return groups
+}
+
+// sortedPrefixes returns the prefixes in gens, in order.
+func sortedPrefixes(gens map[string]generation) []string {
+	var prefixes []string
+	for prefix := range gens {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
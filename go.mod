@@ -3,6 +3,7 @@ module github.com/jeremyschlatter/pk-verify
 go 1.15
 
 require (
+	github.com/syndtr/goleveldb v0.0.0-20180608030153-db3ee9ee8931
 	go4.org v0.0.0-20190218023631-ce4c26f7be8e
 	perkeep.org v0.0.0-20200917224458-f2e7add71bf7
 )
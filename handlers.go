@@ -0,0 +1,61 @@
+package main
+
+// The storage and sorted backends that pk-verify can load are the ones whose
+// packages are linked in, since each one registers itself from an init
+// function. This file and its siblings do that linking. By default, every
+// backend is included; build tags trim the list for smaller binaries:
+//
+//	nocloud: leave out the cloud and network backends (S3, GCS, B2, ...)
+//	minimal: only local disk storage, and none of the wrapping handlers
+//	         (replica, cond, encrypt, ...) except blobpacked
+//
+// and one adds to it:
+//
+//	with_sqlite: the SQLite sorted backend, which needs cgo
+
+import (
+	"sort"
+
+	_ "perkeep.org/pkg/blobserver/blobpacked"
+	_ "perkeep.org/pkg/blobserver/diskpacked"
+	_ "perkeep.org/pkg/blobserver/localdisk"
+	_ "perkeep.org/pkg/blobserver/memory"
+
+	_ "perkeep.org/pkg/sorted/kvfile"
+	_ "perkeep.org/pkg/sorted/leveldb"
+)
+
+// builtinHandlers is the set of storage handler types (without the
+// "storage-" prefix) compiled into this binary.
+var builtinHandlers = map[string]bool{}
+
+func registerHandlers(types ...string) {
+	for _, typ := range types {
+		builtinHandlers[typ] = true
+	}
+}
+
+// builtinSorted is the set of sorted key-value store types (the "type" of a
+// metaIndex, say) compiled into this binary.
+var builtinSorted = map[string]bool{}
+
+func registerSorted(types ...string) {
+	for _, typ := range types {
+		builtinSorted[typ] = true
+	}
+}
+
+func init() {
+	registerHandlers("blobpacked", "diskpacked", "filesystem", "memory")
+	registerSorted("kv", "leveldb", "memory")
+}
+
+// builtinHandlerNames returns the names in builtinHandlers, sorted.
+func builtinHandlerNames() []string {
+	var names []string
+	for name := range builtinHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,23 @@
+//go:build !nocloud && !minimal
+// +build !nocloud,!minimal
+
+package main
+
+import (
+	_ "perkeep.org/pkg/blobserver/azure"
+	_ "perkeep.org/pkg/blobserver/b2"
+	_ "perkeep.org/pkg/blobserver/google/cloudstorage"
+	_ "perkeep.org/pkg/blobserver/google/drive"
+	_ "perkeep.org/pkg/blobserver/mongo"
+	_ "perkeep.org/pkg/blobserver/remote"
+	_ "perkeep.org/pkg/blobserver/s3"
+
+	_ "perkeep.org/pkg/sorted/mongo"
+	_ "perkeep.org/pkg/sorted/mysql"
+	_ "perkeep.org/pkg/sorted/postgres"
+)
+
+func init() {
+	registerHandlers("azure", "b2", "googlecloudstorage", "googledrive", "mongo", "remote", "s3")
+	registerSorted("mongo", "mysql", "postgres")
+}
@@ -0,0 +1,15 @@
+//go:build cgo && with_sqlite
+// +build cgo,with_sqlite
+
+package main
+
+// SQLite needs cgo, and perkeep's sqlite package only builds with the
+// with_sqlite tag, so pk-verify follows suit.
+
+import (
+	_ "perkeep.org/pkg/sorted/sqlite"
+)
+
+func init() {
+	registerSorted("sqlite")
+}
@@ -0,0 +1,18 @@
+//go:build !minimal
+// +build !minimal
+
+package main
+
+import (
+	_ "perkeep.org/pkg/blobserver/cond"
+	_ "perkeep.org/pkg/blobserver/encrypt"
+	_ "perkeep.org/pkg/blobserver/overlay"
+	_ "perkeep.org/pkg/blobserver/proxycache"
+	_ "perkeep.org/pkg/blobserver/replica"
+	_ "perkeep.org/pkg/blobserver/shard"
+	_ "perkeep.org/pkg/blobserver/union"
+)
+
+func init() {
+	registerHandlers("cond", "encrypt", "overlay", "proxycache", "replica", "shard", "union")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+)
+
+var hashBenchFlag = flag.Bool("hash-bench", false, "before verifying, measure how fast this machine can hash, on one core and with all of the workers, and afterwards say whether hashing or reading was the bottleneck")
+
+// hashBenchDuration is how long each hash function is benchmarked for, in
+// each of the two modes.
+const hashBenchDuration = 500 * time.Millisecond
+
+// The hash functions that blob refs use, fastest implementations first.
+// crypto/sha256 and crypto/sha1 use the CPU's SHA extensions (or AVX2) when
+// it has them, which is as fast as hashing gets without a GPU.
+var benchHashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha224", sha256.New224},
+	{"sha1", sha1.New},
+}
+
+// A hashBench is the measured throughput of one hash function, in bytes per
+// second.
+type hashBench struct {
+	name     string
+	perCore  float64
+	parallel float64 // with workers goroutines hashing at once
+	workers  int
+}
+
+// benchmarkHashes measures each of benchHashes, and prints the results.
+func benchmarkHashes(workers int) []hashBench {
+	buf := make([]byte, 1<<20)
+	for i := range buf {
+		buf[i] = byte(i * 7)
+	}
+	var results []hashBench
+	for _, bh := range benchHashes {
+		b := hashBench{
+			name:     bh.name,
+			perCore:  hashRate(bh.new, buf, 1),
+			parallel: hashRate(bh.new, buf, workers),
+			workers:  workers,
+		}
+		fmt.Printf("hash benchmark: %v at %v/s on one core, %v/s with %v worker%v\n", b.name, humanBytes(int64(b.perCore)), humanBytes(int64(b.parallel)), workers, plural(workers))
+		results = append(results, b)
+	}
+	return results
+}
+
+// hashRate hashes buf over and over with n goroutines for hashBenchDuration,
+// and returns the total rate in bytes per second.
+func hashRate(newHash func() hash.Hash, buf []byte, n int) float64 {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int64
+	)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := newHash()
+			var done int64
+			for time.Since(start) < hashBenchDuration {
+				h.Write(buf)
+				done += int64(len(buf))
+			}
+			mu.Lock()
+			total += done
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return float64(total) / time.Since(start).Seconds()
+}
+
+// reportBottleneck compares the rate a run achieved with the hash benchmark,
+// and says which one held it back.
+// seconds is how long the run took.
+func reportBottleneck(bench []hashBench, bytes int64, seconds float64) {
+	if len(bench) == 0 || seconds <= 0 || bytes == 0 {
+		return
+	}
+	rate := float64(bytes) / seconds
+	limit := bench[0].parallel // the default hash, which most blobs use
+	fmt.Printf("verified at %v/s; hashing alone could go %v/s\n", humanBytes(int64(rate)), humanBytes(int64(limit)))
+	if rate > 0.8*limit {
+		fmt.Println("hashing, not I/O, was the bottleneck: more workers (or more cores) would help more than faster storage")
+	} else {
+		fmt.Println("I/O, not hashing, was the bottleneck")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"perkeep.org/pkg/blob"
+)
+
+// health boils the results of a run down to one answer, for people who
+// don't want to interpret every counter:
+//
+//   - "OK": every blob verified, and nothing else looked wrong.
+//   - "DEGRADED": the blobs that were read are intact, but something
+//     needs attention: blobs are missing, reads failed intermittently
+//     or got much slower, the indexes or replicas disagree with the
+//     blobs, or the run didn't cover the whole store.
+//   - "CORRUPT": blobs are damaged.
+//   - "UNKNOWN": the run failed before it could say.
+type health struct {
+	Grade string `json:"grade"`
+
+	// Score is the percentage of the blobs checked that were found
+	// intact (counting expected but missing blobs as checked), rounded
+	// down, so that it is only 100 when none were lost.
+	Score int `json:"score"`
+
+	// Reasons says why the grade isn't "OK".
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// grade works out the health of the store from the finished summary s, and
+// the warnings found before the run (like storages that look recreated).
+func (s *Summary) grade(conf *LowLevelConfig, warnings []string) *health {
+	h := &health{Grade: "OK"}
+	degraded := func(format string, a ...interface{}) {
+		if h.Grade == "OK" {
+			h.Grade = "DEGRADED"
+		}
+		h.Reasons = append(h.Reasons, fmt.Sprintf(format, a...))
+	}
+	corrupt := func(format string, a ...interface{}) {
+		h.Grade = "CORRUPT"
+		h.Reasons = append(h.Reasons, fmt.Sprintf(format, a...))
+	}
+
+	ignored := s.ignoredInvalid()
+	bad := s.Invalid - ignored
+	if bad > 0 {
+		corrupt("%v blob%v failed verification", bad, plural(bad))
+	}
+	if n := len(s.WholeRefMismatches); n > 0 {
+		corrupt("%v file%v don't rebuild to their recorded contents", n, plural(n))
+	}
+	if n := len(s.BadZipMembers); n > 0 {
+		corrupt("%v blob%v packed in intact zips %v corrupt", n, plural(n), isAre(n))
+	}
+	if n := len(s.HashCrossCheckFailures); n > 0 {
+		corrupt("%v blob%v failed the independent hash cross-check", n, plural(n))
+	}
+	if s.ApproxExpect != nil && s.ApproxExpect.Missing > 0 {
+		n := s.ApproxExpect.Missing
+		degraded("at least %v blob%v in the --approx-expect filter %v missing", n, plural(n), isAre(n))
+	}
+	if n := len(s.Missing); n > 0 {
+		degraded("%v expected blob%v %v missing", n, plural(n), isAre(n))
+	}
+	if s.Transient > 0 {
+		degraded("%v blob%v failed only some reads, a sign of failing hardware", s.Transient, plural(s.Transient))
+	}
+	if n := len(s.PackingProblems); n > 0 {
+		degraded("blobpacked's meta index has %v problem%v", n, plural(n))
+	}
+	if n := len(s.Suspicions); n > 0 {
+		degraded("--sanity found %v suspicious thing%v in blobpacked zips", n, plural(n))
+	}
+	if n := len(s.EncryptionProblems); n > 0 {
+		degraded("the encryption keys have %v problem%v, so blobs can't be decrypted", n, plural(n))
+	}
+	if n := len(s.CheckProblems); n > 0 {
+		degraded("the checks found %v problem%v with the store", n, plural(n))
+	}
+	if s.Throughput != nil && s.Throughput.Regressed {
+		degraded("reads were %.0f%% slower than in the previous run", -100*s.Throughput.Change)
+	}
+	if s.Reconciliation != nil && s.Reconciliation.Problem {
+		degraded("the server and the store disagree about which blobs exist")
+	}
+	if n := len(s.ReplicaDivergences); n > 0 {
+		degraded("replicas returned wrong or no contents for %v blob%v that another replica has intact", n, plural(n))
+	}
+	for _, lag := range s.replicaLag(conf) {
+		degraded("%v", lag)
+	}
+	for _, w := range warnings {
+		degraded("%v", w)
+	}
+	if s.Coverage != nil && !s.Coverage.Complete {
+		degraded("the run didn't cover the whole store")
+	}
+	if s.Status == "error" {
+		h.Grade = "UNKNOWN"
+		h.Reasons = append([]string{"the run failed: " + s.Error}, h.Reasons...)
+	}
+
+	checked := s.Valid + s.Invalid - ignored + len(s.Missing)
+	h.Score = 100
+	if checked > 0 {
+		h.Score = 100 * s.Valid / checked
+	}
+	return h
+}
+
+// ignoredInvalid returns how many of the invalid blobs are ignored by
+// --ignore-refs. (s.Ignored also holds the ignored missing ones.)
+func (s *Summary) ignoredInvalid() int {
+	invalid := make(map[blob.Ref]bool, len(s.InvalidRefs))
+	for _, br := range s.InvalidRefs {
+		invalid[br] = true
+	}
+	n := 0
+	for _, br := range s.Ignored {
+		if invalid[br] {
+			n++
+		}
+	}
+	return n
+}
+
+// replicaLag compares the blob counts of storages that are supposed to
+// mirror each other (see mirrorGroups), among those that were verified all
+// the way through, and describes the ones that are behind. conf may be nil,
+// for summaries merged from several runs, which can't say.
+func (s *Summary) replicaLag(conf *LowLevelConfig) []string {
+	if conf == nil {
+		return nil
+	}
+	var lags []string
+	for _, group := range mirrorGroups(conf) {
+		most, mostPrefix := -1, ""
+		for _, prefix := range group {
+			if ps, ok := s.Prefixes[prefix]; ok && ps.done && ps.Valid+ps.Invalid > most {
+				most, mostPrefix = ps.Valid+ps.Invalid, prefix
+			}
+		}
+		for _, prefix := range group {
+			ps, ok := s.Prefixes[prefix]
+			if !ok || !ps.done || prefix == mostPrefix {
+				continue
+			}
+			if n := ps.Valid + ps.Invalid; n < most {
+				lags = append(lags, fmt.Sprintf("%v has %v fewer blob%v than %v, which it mirrors", prefix, most-n, plural(most-n), mostPrefix))
+			}
+		}
+	}
+	return lags
+}
+
+// print prints the grade, as the last line of a run.
+func (h *health) print() {
+	if h.Grade == "OK" {
+		fmt.Printf("health: OK (%v%%)\n", h.Score)
+		return
+	}
+	fmt.Printf("health: %v (%v%%): %v\n", h.Grade, h.Score, strings.Join(h.Reasons, "; "))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var heatmapFlag = flag.Bool("heatmap", false, "print a table of the mean read latency and errors of each ref shard (the first byte of the digest, like the directory shards of a \"filesystem\" storage), for each storage; the hot spots are listed either way")
+
+// minShardBlobs is how many blobs a shard needs before its latency counts
+// for anything.
+const minShardBlobs = 5
+
+// A latencyHeatmap breaks a storage's read latency and errors down by ref
+// shard: the first two hex digits of the digest. Blobs are spread evenly
+// over the shards, so on healthy storage they all look about the same. One
+// that doesn't points at a region of a disk (for storages that shard their
+// directories that way) or a key prefix of a cloud bucket that is in
+// trouble.
+type latencyHeatmap struct {
+	Shards map[string]*shardStat `json:"shards"`
+}
+
+type shardStat struct {
+	Blobs  int     `json:"blobs"`
+	Errors int     `json:"errors"`
+	MeanMs float64 `json:"meanMs"`
+}
+
+// shardOf returns the shard of the blob whose digest is digest, or "" if it
+// is too short to have one.
+func shardOf(digest string) string {
+	if len(digest) < 2 {
+		return ""
+	}
+	return strings.ToLower(digest[:2])
+}
+
+// add records one verification.
+func (h *latencyHeatmap) add(r verifyResult) {
+	shard := shardOf(r.ref.Digest())
+	if shard == "" {
+		return
+	}
+	if h.Shards == nil {
+		h.Shards = map[string]*shardStat{}
+	}
+	st, ok := h.Shards[shard]
+	if !ok {
+		st = &shardStat{}
+		h.Shards[shard] = st
+	}
+	// A running mean, so the heatmap stays the same size however many
+	// blobs there are.
+	st.Blobs++
+	st.MeanMs += (millis(r.duration) - st.MeanMs) / float64(st.Blobs)
+	if r.err != nil {
+		st.Errors++
+	}
+}
+
+// merge adds the shards of o (which may be nil) to h.
+func (h *latencyHeatmap) merge(o *latencyHeatmap) {
+	if o == nil {
+		return
+	}
+	if h.Shards == nil {
+		h.Shards = map[string]*shardStat{}
+	}
+	for shard, ost := range o.Shards {
+		st, ok := h.Shards[shard]
+		if !ok {
+			st = &shardStat{}
+			h.Shards[shard] = st
+		}
+		n := st.Blobs + ost.Blobs
+		if n > 0 {
+			st.MeanMs = (st.MeanMs*float64(st.Blobs) + ost.MeanMs*float64(ost.Blobs)) / float64(n)
+		}
+		st.Blobs = n
+		st.Errors += ost.Errors
+	}
+}
+
+// typicalMs returns the median of the shards' mean latencies.
+func (h *latencyHeatmap) typicalMs() float64 {
+	var means []float64
+	for _, st := range h.Shards {
+		if st.Blobs >= minShardBlobs {
+			means = append(means, st.MeanMs)
+		}
+	}
+	if len(means) == 0 {
+		return 0
+	}
+	sort.Float64s(means)
+	return means[len(means)/2]
+}
+
+// hotSpots describes the shards that are much slower than the rest (at
+// least 3 times the typical latency), or that had errors, worst first.
+func (h *latencyHeatmap) hotSpots() []string {
+	typical := h.typicalMs()
+	var shards []string
+	for shard, st := range h.Shards {
+		if st.Errors > 0 || (typical > 0 && st.Blobs >= minShardBlobs && st.MeanMs >= 3*typical) {
+			shards = append(shards, shard)
+		}
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		a, b := h.Shards[shards[i]], h.Shards[shards[j]]
+		if a.Errors != b.Errors {
+			return a.Errors > b.Errors
+		}
+		return a.MeanMs > b.MeanMs
+	})
+	var spots []string
+	for _, shard := range shards {
+		st := h.Shards[shard]
+		spots = append(spots, fmt.Sprintf("shard %v: %v blob%v, mean %.1fms (typical %.1fms), %v error%v", shard, st.Blobs, plural(st.Blobs), st.MeanMs, typical, st.Errors, plural(st.Errors)))
+	}
+	return spots
+}
+
+// heatChars shade the cells of the printed heatmap by how many times the
+// typical latency they are: under 1.5, 2, 4, 8, and more.
+var heatChars = []struct {
+	max float64
+	c   byte
+}{{1.5, '.'}, {2, ':'}, {4, 'o'}, {8, 'O'}, {0, '#'}}
+
+// print prints the heatmap as a 16x16 table, with a row for each first hex
+// digit of the digest and a column for each second one.
+func (h *latencyHeatmap) print(prefix string) {
+	typical := h.typicalMs()
+	fmt.Printf("%v: read latency by ref shard (. typical %.1fms, : 1.5x, o 2x, O 4x, # 8x or more, X errors, blank no blobs)\n", prefix, typical)
+	const hex = "0123456789abcdef"
+	fmt.Printf("     %v\n", strings.Join(strings.Split(hex, ""), " "))
+	for _, row := range hex {
+		line := []byte(fmt.Sprintf("  %cx", row))
+		for _, col := range hex {
+			c := byte(' ')
+			if st, ok := h.Shards[string(row)+string(col)]; ok {
+				switch {
+				case st.Errors > 0:
+					c = 'X'
+				case typical == 0:
+					c = '.'
+				default:
+					for _, hc := range heatChars {
+						if hc.max == 0 || st.MeanMs < hc.max*typical {
+							c = hc.c
+							break
+						}
+					}
+				}
+			}
+			line = append(line, ' ', c)
+		}
+		fmt.Println(string(line))
+	}
+}
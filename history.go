@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+var recheckOnly = flag.Bool("recheck-only", false, "only re-check the blobs that failed in the last recorded run (see --state-dir), and exit: with status 2 if any of them still fail")
+
+var stateDir = flag.String("state-dir", defaultStateDir(), "directory where pk-verify remembers the results of previous runs (set to \"\" to disable)")
+
+// maxRuns is how many runs a history remembers.
+const maxRuns = 100
+
+// defaultStateDir returns the default --state-dir: %LOCALAPPDATA%\pk-verify
+// on Windows, and $XDG_STATE_HOME/pk-verify or ~/.local/state/pk-verify
+// elsewhere.
+func defaultStateDir() string {
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "pk-verify")
+		}
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "pk-verify")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "pk-verify")
+	}
+	return ""
+}
+
+// A history is what pk-verify remembers about previous runs against one
+// store. It is stored as a JSON file in --state-dir.
+type history struct {
+	SchemaVersion int `json:"schemaVersion"`
+
+	Config string      `json:"config"`
+	Store  string      `json:"store,omitempty"` // see storeIdentity
+	Runs   []runRecord `json:"runs"`            // oldest first
+
+	path string
+	key  []byte // from --state-key, to encrypt the file with
+}
+
+// runRecord is the part of a Summary that a history remembers.
+type runRecord struct {
+	RunID       string     `json:"runID"`
+	Start       time.Time  `json:"start"`
+	Duration    float64    `json:"durationSeconds"`
+	Status      string     `json:"status"`
+	Valid       int        `json:"valid"`
+	Invalid     int        `json:"invalid"`
+	Bytes       int64      `json:"bytes"`
+	InvalidRefs []blob.Ref `json:"invalidRefs"`
+	Digest      string     `json:"digest,omitempty"`
+
+	// InvalidByPrefix breaks InvalidRefs down by the storage they failed
+	// in, so that they are checked again there. Runs recorded before it
+	// was don't have it.
+	InvalidByPrefix map[string][]blob.Ref `json:"invalidByPrefix,omitempty"`
+
+	// Incremental is set for runs that skipped the blobs verified by an
+	// earlier one (see --skip-verified), whose failures therefore still
+	// stand.
+	Incremental bool `json:"incremental,omitempty"`
+
+	Generations map[string]generation `json:"generations,omitempty"`
+	Owners      map[string]string     `json:"owners,omitempty"`
+	Resources   *resourceUsage        `json:"resources,omitempty"`
+}
+
+// loadHistory loads the history for a store, returning an empty history if
+// there isn't one yet. It returns nil if --state-dir is disabled.
+//
+// Histories are kept by store, not by config file, so that moving or
+// renaming the config doesn't lose them: store is the store's identity (see
+// storeIdentity), or "" if it doesn't have one, in which case the config's
+// path stands in. If there is no history under that name, loadHistory looks
+// for one to carry on from: one kept under the config's path (as older
+// versions of pk-verify did), or one whose last run saw any of the same
+// storage generations gens (the store was moved).
+func loadHistory(configPath, store string, gens map[string]generation) (*history, error) {
+	if *stateDir == "" {
+		return nil, nil
+	}
+	abs, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+	name := store
+	if name == "" {
+		name = abs
+	}
+	key, err := loadStateKey()
+	if err != nil {
+		return nil, err
+	}
+	h, err := readHistory(historyPath(name), key)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil && name != abs {
+		if h, err = readHistory(historyPath(abs), key); err != nil {
+			return nil, err
+		}
+	}
+	if h == nil {
+		h = findMovedHistory(key, gens)
+	}
+	if h == nil {
+		h = &history{}
+	}
+	h.Config, h.Store, h.path, h.key = abs, store, historyPath(name), key
+	return h, nil
+}
+
+// historyPath returns the file that the history named name is kept in.
+func historyPath(name string) string {
+	return filepath.Join(*stateDir, fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:16]+".json")
+}
+
+// readHistory reads the history file at path, returning nil if it doesn't
+// exist.
+func readHistory(path string, key []byte) (*history, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = openState(key, data); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	h := new(history)
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if err := checkSchema("history", path, h.SchemaVersion, historySchema); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// findMovedHistory looks through --state-dir for a history whose last run
+// saw one of the storage generations in gens. Generations are random, so a
+// match means it's the same storage, wherever it lives now.
+func findMovedHistory(key []byte, gens map[string]generation) *history {
+	if len(gens) == 0 {
+		return nil
+	}
+	current := make(map[string]bool)
+	for _, g := range gens {
+		current[g.Random] = true
+	}
+	paths, _ := filepath.Glob(filepath.Join(*stateDir, "*.json"))
+	for _, path := range paths {
+		h, err := readHistory(path, key)
+		if err != nil || h == nil {
+			continue
+		}
+		if last := h.last(); last != nil {
+			for _, g := range last.Generations {
+				if current[g.Random] {
+					fmt.Printf("picked up the history of previous runs from %v (the store seems to have moved)\n", path)
+					return h
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// last returns the most recent run, or nil if there are none.
+func (h *history) last() *runRecord {
+	if h == nil || len(h.Runs) == 0 {
+		return nil
+	}
+	return &h.Runs[len(h.Runs)-1]
+}
+
+// record adds the results of a run to the history and saves it.
+func (h *history) record(s *Summary) error {
+	if h == nil {
+		return nil
+	}
+	var byPrefix map[string][]blob.Ref
+	for prefix, ps := range s.Prefixes {
+		if len(ps.InvalidRefs) == 0 {
+			continue
+		}
+		if byPrefix == nil {
+			byPrefix = map[string][]blob.Ref{}
+		}
+		byPrefix[prefix] = ps.InvalidRefs
+	}
+	h.Runs = append(h.Runs, runRecord{
+		RunID:       s.RunID,
+		Start:       s.Start,
+		Duration:    s.Duration,
+		Status:      s.Status,
+		Valid:       s.Valid,
+		Invalid:     s.Invalid,
+		Bytes:       s.Bytes,
+		InvalidRefs: s.InvalidRefs,
+		Digest:      s.Digest,
+		Generations: s.Generations,
+		Owners:      s.Owners,
+		Resources:   s.Resources,
+
+		InvalidByPrefix: byPrefix,
+		Incremental:     s.SkippedVerified != "",
+	})
+	if len(h.Runs) > maxRuns {
+		h.Runs = h.Runs[len(h.Runs)-maxRuns:]
+	}
+	return h.save()
+}
+
+// save writes the history to its file, atomically, so that a crash can't
+// leave a half-written history behind.
+func (h *history) save() error {
+	h.SchemaVersion = historySchema
+	data, err := json.MarshalIndent(h, "", "\t")
+	if err != nil {
+		return err
+	}
+	if data, err = sealState(h.key, append(data, '\n')); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), ".history-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), h.path)
+}
+
+// recentFailures returns the blobs that failed in the last run, by the
+// prefix they failed in ("" for runs recorded without that), and when that
+// run started. When the last run was incremental, it only read the blobs
+// added since the one before, so the failures of the runs before it, back
+// to the last full one, are included too.
+func (h *history) recentFailures() (map[string][]blob.Ref, time.Time) {
+	if h == nil || len(h.Runs) == 0 {
+		return nil, time.Time{}
+	}
+	failed := map[string][]blob.Ref{}
+	seen := map[string]map[blob.Ref]bool{}
+	var since time.Time
+	for i := len(h.Runs) - 1; i >= 0; i-- {
+		run := h.Runs[i]
+		since = run.Start
+		byPrefix := run.InvalidByPrefix
+		if byPrefix == nil && len(run.InvalidRefs) > 0 {
+			byPrefix = map[string][]blob.Ref{"": run.InvalidRefs}
+		}
+		for prefix, refs := range byPrefix {
+			if seen[prefix] == nil {
+				seen[prefix] = map[blob.Ref]bool{}
+			}
+			for _, br := range refs {
+				if !seen[prefix][br] {
+					seen[prefix][br] = true
+					failed[prefix] = append(failed[prefix], br)
+				}
+			}
+		}
+		if !run.Incremental {
+			break
+		}
+	}
+	return failed, since
+}
+
+// recheckPrevious re-verifies the blobs that failed in the last recorded run
+// (see recentFailures), before the full run starts, so that after a repair
+// attempt the user finds out right away whether it worked. Each is checked
+// in the storage it failed in, by its verifier in verifiers; for runs
+// recorded without that, in the storage that def verifies. It returns how
+// many still fail.
+func recheckPrevious(ctx context.Context, verifiers map[string]*verifier, def *verifier, h *history) int {
+	byPrefix, since := h.recentFailures()
+	n := 0
+	for _, refs := range byPrefix {
+		n += len(refs)
+	}
+	if n == 0 {
+		return 0
+	}
+	which := "the last run"
+	if !since.Equal(h.last().Start) {
+		which = "the runs since the last full one"
+	}
+	fmt.Printf("re-checking the %v blob%v that failed in %v (%v) first:\n", n, plural(n), which, since.Format(time.RFC3339))
+	var prefixes []string
+	for prefix := range byPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	still := 0
+	for _, prefix := range prefixes {
+		v, in := verifiers[prefix], " in "+prefix
+		if prefix == "" {
+			v, in = def, ""
+		}
+		for _, br := range byPrefix[prefix] {
+			if v == nil {
+				fmt.Printf("  not checked:   %v%v, which this run doesn't verify\n", br, in)
+				continue
+			}
+			if err := v.verifyFetch(ctx, br); err != nil {
+				still++
+				fmt.Printf("  still invalid: %v%v (%v)\n", br, in, err)
+			} else {
+				fmt.Printf("  now valid:     %v%v\n", br, in)
+			}
+		}
+	}
+	if *recheckOnly {
+		fmt.Printf("%v of %v previously failed blob%v %v still failing\n", still, n, plural(n), isAre(still))
+	} else {
+		fmt.Printf("%v of %v previously failed blob%v %v still failing; continuing with the full run\n", still, n, plural(n), isAre(still))
+	}
+	return still
+}
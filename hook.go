@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"perkeep.org/pkg/blob"
+)
+
+var onInvalid = flag.String("on-invalid", "", "run this shell command for every invalid blob found, with PK_VERIFY_REF, PK_VERIFY_PREFIX, PK_VERIFY_ERROR, and, when the blob is a file on a local disk, PK_VERIFY_PATH, PK_VERIFY_OFFSET (of the blob in that file), and PK_VERIFY_DEVICE set; for example, to save the output of smartctl for the device, and see whether corruption lines up with failing sectors")
+
+// A blobLocation is where on disk a blob is stored, as far as pk-verify can
+// tell.
+type blobLocation struct {
+	path   string
+	offset int64  // of the blob's contents in path
+	device string // the block device path is on, like /dev/sda1, if known
+}
+
+// locateBlob finds where the blob br in the storage at prefix is stored on
+// disk, if it's in a localdisk storage. It returns a zero blobLocation if it
+// can't tell.
+func locateBlob(conf *LowLevelConfig, prefix string, br blob.Ref) blobLocation {
+	sc := conf.Prefixes[prefix]
+	if sc.StorageHandler != "filesystem" {
+		return blobLocation{}
+	}
+	root, _ := sc.StorageHandlerArgs["path"].(string)
+	path := localdiskPath(root, br)
+	if root == "" || path == "" {
+		return blobLocation{}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return blobLocation{}
+	}
+	return blobLocation{path: path, device: fileDevice(path)}
+}
+
+// runInvalidHook runs the --on-invalid command for the invalid blob in r,
+// which was found in the storage at prefix. The command's output goes to
+// stderr, and if it fails, that is reported but doesn't stop the run.
+func runInvalidHook(ctx context.Context, conf *LowLevelConfig, prefix string, r verifyResult) {
+	if *onInvalid == "" {
+		return
+	}
+	loc := locateBlob(conf, prefix, r.ref)
+	cmd := shellCommand(ctx, *onInvalid)
+	var offset string
+	if loc.path != "" {
+		offset = strconv.FormatInt(loc.offset, 10)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"PK_VERIFY_REF="+r.ref.String(),
+		"PK_VERIFY_PREFIX="+prefix,
+		"PK_VERIFY_ERROR="+r.err.Error(),
+		"PK_VERIFY_PATH="+loc.path,
+		"PK_VERIFY_OFFSET="+offset,
+		"PK_VERIFY_DEVICE="+loc.device,
+	)
+	if err := cmd.Run(); err != nil {
+		stderrf("pk-verify: --on-invalid command failed for %v: %v\n", r.ref, err)
+	}
+}
+
+// deviceName returns the name to report for the device with the given
+// major and minor numbers, when there's nothing better to go on.
+func deviceName(major, minor uint64) string {
+	return fmt.Sprintf("%d:%d", major, minor)
+}
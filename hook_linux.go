@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// fileDevice returns the block device that the file at path is on, like
+// /dev/sda1, found by matching its device number against the mounts in
+// /proc/self/mountinfo. If the device isn't a /dev node (like for a network
+// filesystem), it returns the device number as "major:minor".
+func fileDevice(path string) string {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return ""
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	name := deviceName(major, minor)
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return name
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// id parent major:minor root mountpoint options ... - fstype source superoptions
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[2] != name {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) && strings.HasPrefix(fields[i+2], "/dev/") {
+				return fields[i+2]
+			}
+		}
+	}
+	return name
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// fileDevice returns the block device that the file at path is on. Only
+// Linux is supported.
+func fileDevice(path string) string {
+	return ""
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+
+	"perkeep.org/pkg/blob"
+)
+
+var ignoreRefs = flag.String("ignore-refs", "", "a file of refs (one per line) that are known to be corrupt or missing; they are still reported, but don't cause a non-zero exit status")
+
+// loadIgnoreRefs reads the --ignore-refs file, if there is one.
+func loadIgnoreRefs() (map[blob.Ref]bool, error) {
+	if *ignoreRefs == "" {
+		return nil, nil
+	}
+	refs, err := readManifest(*ignoreRefs)
+	if err != nil {
+		return nil, err
+	}
+	ignore := make(map[blob.Ref]bool, len(refs))
+	for _, sr := range refs {
+		ignore[sr.Ref] = true
+	}
+	return ignore, nil
+}
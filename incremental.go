@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+
+	"perkeep.org/pkg/blob"
+)
+
+var skipVerified = flag.String("skip-verified", "", "a manifest from an earlier run's --manifest-out; the blobs it lists are not verified again, so that only the blobs added since then are. Streamed storages still read them (and then skip them), so this saves the most with --walk and with enumerated storages")
+
+// loadVerified loads the --skip-verified manifest, returning nil if there
+// isn't one.
+func loadVerified() (map[blob.Ref]bool, error) {
+	if *skipVerified == "" {
+		return nil, nil
+	}
+	refs, err := readManifest(*skipVerified)
+	if err != nil {
+		return nil, err
+	}
+	verified := make(map[blob.Ref]bool, len(refs))
+	for _, sr := range refs {
+		verified[sr.Ref] = true
+	}
+	return verified, nil
+}
+
+// wants reports whether v should verify br, which is size bytes: whether it
+// is in v's shard, isn't excluded (which is counted), and wasn't already
+// verified by an earlier run.
+func (v *verifier) wants(br blob.Ref, size uint32) bool {
+	if !v.shard.contains(br) {
+		return false
+	}
+	if v.exclude.matches(blob.SizedRef{Ref: br, Size: size}) {
+		v.excluded.add(size)
+		return false
+	}
+	return !v.verified[br]
+}
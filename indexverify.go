@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go4.org/jsonconfig"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// indexMetaPrefix starts the index rows that record every blob the index
+// has seen:
+//
+//	meta:<blob ref> -> <size>|<MIME type>
+const indexMetaPrefix = "meta:"
+
+// indexVerifyMain implements "pk-verify index-verify", which checks the
+// Perkeep index instead of the blobs: that every row of its sorted key-value
+// store can be read back, in order, and (with --sample) that a sample of the
+// blobs it knows about are really in its blob source, with the size it
+// recorded. A corrupt index breaks search and the web UI as thoroughly as
+// corrupt blobs would, even though it can always be rebuilt from them.
+//
+// The index is opened read-only (see openSortedReadOnly), so this can run
+// while the Perkeep server is using it, though a copy of an index that is
+// being written to may not be consistent.
+func indexVerifyMain(args []string) {
+	fs := flag.NewFlagSet("index-verify", flag.ExitOnError)
+	sample := fs.Int("sample", 100, "how many of the blobs the index knows about to look up in its blob source (0 to skip)")
+	fs.Float64Var(confidenceLevel, "confidence", *confidenceLevel, "the confidence, as a percentage, of the bound printed on how many of the blobs the index knows about are missing from its blob source, from the ones looked up")
+	fs.Usage = func() {
+		stderrf("Usage: %v index-verify [flags] <path to perkeep server config file>\n", os.Args[0])
+		stderrln()
+		stderrln("Reads every row of the index storages in the config, checking that the backend can read them all back in order, and cross-checks a sample of them against the blobs. The index is only ever read, so this is safe while the Perkeep server is running.")
+		stderrln()
+		stderrln("Flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := checkConfidence(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	conf := loadConfig(fs.Arg(0))
+	ctx := interruptContext()
+	ld := NewLoader(conf)
+
+	var problems []string
+	checked := 0
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		sc := conf.Prefixes[prefix]
+		if sc.StorageHandler != "index" {
+			continue
+		}
+		checked++
+		fmt.Printf("%v: reading the index\n", prefix)
+		p, err := verifyIndex(ctx, ld, sc.StorageHandlerArgs, *sample)
+		if err != nil {
+			stderrf("pk-verify: in %v: %v\n", prefix, err)
+			os.Exit(1)
+		}
+		for _, msg := range p {
+			problems = append(problems, fmt.Sprintf("%v: %v", prefix, msg))
+		}
+	}
+	if checked == 0 {
+		stderrln("pk-verify: the config has no index")
+		os.Exit(1)
+	}
+	for _, p := range problems {
+		stderrf("index problem: %v\n", p)
+	}
+	if n := len(problems); n > 0 {
+		fmt.Printf("INDEX CORRUPTION DETECTED: found %v problem%v. Reindexing (perkeepd -reindex) rebuilds the index from the blobs.\n", n, plural(n))
+		os.Exit(2)
+	}
+	fmt.Println("the index is consistent")
+}
+
+// verifyIndex checks one index, given its handler arguments, and returns the
+// problems it found.
+func verifyIndex(ctx context.Context, ld *Loader, args jsonconfig.Obj, sample int) ([]string, error) {
+	kvConf, _ := args["storage"].(map[string]interface{})
+	source, _ := args["blobSource"].(string)
+	if kvConf == nil {
+		return nil, fmt.Errorf("the index needs a \"storage\" argument")
+	}
+	kv, err := openSortedReadOnly(jsonconfig.Obj(kvConf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the index: %w", err)
+	}
+	defer kv.Close()
+
+	var (
+		problems []string
+		rows     int
+		bytes    int64
+		kinds    = map[string]int{} // rows by the part of the key before ":"
+		prev     string
+		metas    []blob.SizedRef // a uniform sample of the meta rows
+		seenMeta int
+	)
+	it := kv.Find("", "")
+	for it.Next() {
+		if ctx.Err() != nil {
+			break
+		}
+		key, value := it.Key(), it.Value()
+		rows++
+		bytes += int64(len(key) + len(value))
+		if rows > 1 && key <= prev {
+			problems = append(problems, fmt.Sprintf("row %q came back after %q, out of order", key, prev))
+		}
+		prev = key
+		kind := key
+		if i := strings.Index(key, ":"); i >= 0 {
+			kind = key[:i]
+		}
+		kinds[kind]++
+
+		if !strings.HasPrefix(key, indexMetaPrefix) {
+			continue
+		}
+		br, ok := blob.Parse(strings.TrimPrefix(key, indexMetaPrefix))
+		fields := strings.SplitN(value, "|", 2)
+		size, err := strconv.ParseUint(fields[0], 10, 32)
+		if !ok || err != nil {
+			problems = append(problems, fmt.Sprintf("malformed row %q -> %q", key, value))
+			continue
+		}
+		// Reservoir sampling, to pick sample rows evenly from
+		// however many there turn out to be.
+		seenMeta++
+		sr := blob.SizedRef{Ref: br, Size: uint32(size)}
+		if len(metas) < sample {
+			metas = append(metas, sr)
+		} else if j := rand.Intn(seenMeta); j < sample {
+			metas[j] = sr
+		}
+	}
+	if err := it.Close(); err != nil {
+		problems = append(problems, fmt.Sprintf("reading stopped after %v row%v: %v", rows, plural(rows), err))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("read %v row%v (%v)\n", rows, plural(rows), humanBytes(bytes))
+	var names []string
+	for kind := range kinds {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+	for _, kind := range names {
+		fmt.Printf("  %-20v %v\n", kind, kinds[kind])
+	}
+
+	if len(metas) == 0 {
+		return problems, nil
+	}
+	if source == "" {
+		return nil, fmt.Errorf("the index needs a \"blobSource\" argument to cross-check against")
+	}
+	sto, err := ld.GetStorage(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the index's blob source: %w", err)
+	}
+	fmt.Printf("looking up %v of the %v blob%v the index knows about in %v\n", len(metas), seenMeta, plural(seenMeta), source)
+	bad := 0
+	for _, sr := range metas {
+		got, err := blobserver.StatBlob(ctx, sto, sr.Ref)
+		switch {
+		case err == os.ErrNotExist:
+			bad++
+			problems = append(problems, fmt.Sprintf("the index knows blob %v, but %v doesn't have it", sr.Ref, source))
+		case err != nil:
+			return nil, fmt.Errorf("failed to look up %v: %w", sr.Ref, err)
+		case got.Size != sr.Size:
+			bad++
+			problems = append(problems, fmt.Sprintf("the index says blob %v is %v bytes, but %v has %v bytes", sr.Ref, sr.Size, source, got.Size))
+		}
+	}
+	if c := newConfidence(len(metas), bad, seenMeta); len(metas) < seenMeta {
+		fmt.Println(c.describe(fmt.Sprintf("the %v blobs the index knows about", humanCount(seenMeta))))
+	}
+	return problems, nil
+}
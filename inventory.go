@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+
+	"perkeep.org/pkg/blob"
+)
+
+var inventoryFlag = flag.Bool("inventory", false, "sniff the content type of every blob that isn't a schema blob from its first bytes, and report how many blobs and bytes of each type (JPEG, MP4, PDF, ...) the store holds. Only the first chunk of a file starts with anything recognizable, so the rest count as \"application/octet-stream\". This makes streamed blobs go through pk-verify's own hashing")
+
+// sniffLen is how much of a blob http.DetectContentType looks at.
+const sniffLen = 512
+
+// inventory is a pkverify.Check that never fails, and instead counts the
+// blobs by content type.
+type inventory struct {
+	mu     sync.Mutex
+	byType map[string]*inventoryEntry
+}
+
+// inventoryEntry counts the blobs of one content type.
+type inventoryEntry struct {
+	Type  string `json:"type"`
+	Blobs int    `json:"blobs"`
+	Bytes int64  `json:"bytes"`
+}
+
+func newInventory() *inventory {
+	if !*inventoryFlag {
+		return nil
+	}
+	return &inventory{byType: map[string]*inventoryEntry{}}
+}
+
+func (inv *inventory) Name() string                       { return "inventory" }
+func (inv *inventory) Store(ctx context.Context) []string { return nil }
+
+func (inv *inventory) Blob(br blob.Ref, size uint32) pkverify.BlobCheck {
+	return &sniffer{inv: inv, size: size}
+}
+
+// sniffer keeps the first bytes of a blob, to sniff its type from.
+type sniffer struct {
+	inv  *inventory
+	size uint32
+	head []byte
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if n := sniffLen - len(s.head); n > 0 {
+		s.head = append(s.head, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (s *sniffer) Result() error {
+	if looksLikeSchema(s.head) {
+		return nil
+	}
+	typ := http.DetectContentType(s.head)
+	if i := strings.Index(typ, ";"); i >= 0 {
+		typ = typ[:i] // like "; charset=utf-8"
+	}
+	s.inv.mu.Lock()
+	defer s.inv.mu.Unlock()
+	e, ok := s.inv.byType[typ]
+	if !ok {
+		e = &inventoryEntry{Type: typ}
+		s.inv.byType[typ] = e
+	}
+	e.Blobs++
+	e.Bytes += int64(s.size)
+	return nil
+}
+
+// result returns the counts, biggest first.
+func (inv *inventory) result() []inventoryEntry {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	var entries []inventoryEntry
+	for _, e := range inv.byType {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Bytes != entries[j].Bytes {
+			return entries[i].Bytes > entries[j].Bytes
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	return entries
+}
+
+// printInventory prints the counts from --inventory.
+func printInventory(entries []inventoryEntry) {
+	fmt.Println("content of the blobs that aren't schema blobs:")
+	for _, e := range entries {
+		fmt.Printf("  %-28v %9v blob%v %12v\n", e.Type, e.Blobs, plural(e.Blobs), humanBytes(e.Bytes))
+	}
+}
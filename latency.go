@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// numWorst is how many of the slowest blobs a latencyTracker remembers.
+const numWorst = 10
+
+// latencyTracker records how long each blob took to read and verify.
+//
+// Slow reads are worth knowing about even when every hash matches: a disk
+// that needs several retries to read a sector still returns the right bytes,
+// right up until it doesn't.
+type latencyTracker struct {
+	samples []time.Duration
+	worst   []slowBlob // slowest first
+}
+
+// latencyStats is a summary of a latencyTracker, for the final report.
+type latencyStats struct {
+	P50   float64    `json:"p50Ms"`
+	P95   float64    `json:"p95Ms"`
+	P99   float64    `json:"p99Ms"`
+	Max   float64    `json:"maxMs"`
+	Worst []slowBlob `json:"worst"`
+}
+
+type slowBlob struct {
+	Ref    blob.Ref `json:"ref"`
+	Size   uint32   `json:"size"`
+	Millis float64  `json:"ms"`
+}
+
+func (t *latencyTracker) add(br blob.Ref, size uint32, d time.Duration) {
+	t.samples = append(t.samples, d)
+	t.noteWorst(slowBlob{Ref: br, Size: size, Millis: millis(d)})
+}
+
+// noteWorst adds b to t.worst if it is among the slowest.
+func (t *latencyTracker) noteWorst(b slowBlob) {
+	ms := b.Millis
+	if len(t.worst) == numWorst && ms <= t.worst[numWorst-1].Millis {
+		return
+	}
+	i := sort.Search(len(t.worst), func(i int) bool { return t.worst[i].Millis < ms })
+	t.worst = append(t.worst, slowBlob{})
+	copy(t.worst[i+1:], t.worst[i:])
+	t.worst[i] = b
+	if len(t.worst) > numWorst {
+		t.worst = t.worst[:numWorst]
+	}
+}
+
+// merge adds the samples from o to t.
+func (t *latencyTracker) merge(o *latencyTracker) {
+	t.samples = append(t.samples, o.samples...)
+	for _, w := range o.worst {
+		t.noteWorst(w)
+	}
+}
+
+// stats returns the percentiles and worst offenders, or nil if there are no
+// samples.
+func (t *latencyTracker) stats() *latencyStats {
+	if len(t.samples) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), t.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	pct := func(p float64) float64 {
+		return millis(sorted[int(p*float64(len(sorted)-1))])
+	}
+	return &latencyStats{
+		P50:   pct(0.50),
+		P95:   pct(0.95),
+		P99:   pct(0.99),
+		Max:   millis(sorted[len(sorted)-1]),
+		Worst: append([]slowBlob(nil), t.worst...),
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (ls *latencyStats) print() {
+	fmt.Printf("read+verify latency per blob: p50 %.1fms, p95 %.1fms, p99 %.1fms, max %.1fms\n", ls.P50, ls.P95, ls.P99, ls.Max)
+	if len(ls.Worst) > 0 {
+		fmt.Println("slowest blobs:")
+		for _, w := range ls.Worst {
+			fmt.Printf("  %9.1fms  %v (%v)\n", w.Millis, w.Ref, humanBytes(int64(w.Size)))
+		}
+	}
+}
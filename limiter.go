@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var fetchRate = flag.Float64("fetch-rate", 0, "when fetching blobs one by one (for storages that can't stream), start at most this many fetches per second, on top of the --workers limit on fetches at once; 0 means no limit. Either way, pk-verify backs off when the storage says it is overloaded (HTTP 429 or 5xx)")
+
+// Tuning for the fetch limiter.
+const (
+	limiterBurst       = 10              // fetches that can start at once after a lull
+	limiterMinRate     = 1.0             // never slow down below this many fetches per second
+	limiterMinBackoff  = time.Second     // first pause after an overload
+	limiterMaxBackoff  = time.Minute     // longest pause after an overload
+	limiterMaxOverload = 10              // give up on a blob after this many overloads in a row
+	limiterWindow      = 5 * time.Second // how far back the observed rate looks
+)
+
+// A fetchLimiter paces the fetches of the enumerate+fetch path with a token
+// bucket, so that verifying a cloud storage uses the network fully without
+// getting throttled by the provider.
+//
+// When a fetch is refused because the storage is overloaded, everyone pauses
+// (doubling the pause each time it happens again) and the rate is halved.
+// Successful fetches then raise the rate again, by about one fetch per second
+// every second, up to --fetch-rate. That's the same additive-increase,
+// multiplicative-decrease that TCP uses, and it settles just under whatever
+// the provider allows.
+//
+// A nil *fetchLimiter never waits.
+type fetchLimiter struct {
+	mu      sync.Mutex
+	max     float64 // --fetch-rate, or 0 for no limit
+	rate    float64 // current tokens per second, or 0 for no limit
+	tokens  float64
+	last    time.Time // when tokens was last topped up
+	backoff time.Duration
+	until   time.Time   // no fetches start before this
+	recent  []time.Time // fetch start times within limiterWindow
+}
+
+func newFetchLimiter() *fetchLimiter {
+	return &fetchLimiter{max: *fetchRate, rate: *fetchRate, tokens: limiterBurst, last: time.Now()}
+}
+
+// wait blocks until a fetch may start.
+func (l *fetchLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		var d time.Duration
+		switch {
+		case now.Before(l.until):
+			d = l.until.Sub(now)
+		case l.rate == 0:
+			l.started(now)
+			l.mu.Unlock()
+			return nil
+		default:
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > limiterBurst {
+				l.tokens = limiterBurst
+			}
+			l.last = now
+			if l.tokens >= 1 {
+				l.tokens--
+				l.started(now)
+				l.mu.Unlock()
+				return nil
+			}
+			d = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		}
+		l.mu.Unlock()
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// started notes that a fetch started at now, to keep track of the rate that
+// is actually being achieved. l.mu must be held.
+func (l *fetchLimiter) started(now time.Time) {
+	l.recent = append(l.recent, now)
+	i := 0
+	for i < len(l.recent) && now.Sub(l.recent[i]) > limiterWindow {
+		i++
+	}
+	l.recent = l.recent[i:]
+}
+
+// overloaded records that the storage refused a fetch because it was
+// overloaded.
+func (l *fetchLimiter) overloaded() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		// Unlimited so far, so start from what was getting through.
+		l.rate = float64(len(l.recent)) / limiterWindow.Seconds()
+	}
+	l.rate /= 2
+	if l.rate < limiterMinRate {
+		l.rate = limiterMinRate
+	}
+	l.tokens = 0
+	l.backoff *= 2
+	if l.backoff < limiterMinBackoff {
+		l.backoff = limiterMinBackoff
+	}
+	if l.backoff > limiterMaxBackoff {
+		l.backoff = limiterMaxBackoff
+	}
+	l.until = time.Now().Add(l.backoff)
+}
+
+// succeeded records a fetch that the storage accepted.
+func (l *fetchLimiter) succeeded() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.backoff = 0
+	if l.rate == 0 {
+		return
+	}
+	l.rate += 1 / l.rate
+	if l.max > 0 && l.rate > l.max {
+		l.rate = l.max
+	}
+}
+
+// isOverloaded reports whether err looks like a storage saying it is
+// overloaded, rather than a real failure. Some storage handlers' errors carry
+// the HTTP status code (see statusCoder); for the rest, this goes by the
+// error text. Fetch errors usually include the blob's ref, so a status code
+// in the text only counts next to words like "HTTP" or "status", never as a
+// bare run of digits.
+func isOverloaded(err error) bool {
+	if err == nil {
+		return false
+	}
+	var sc statusCoder
+	if errors.As(err, &sc) {
+		return overloadedStatus(sc.StatusCode())
+	}
+	msg := err.Error()
+	for _, s := range []string{
+		"Too Many Requests", "SlowDown", "rateLimitExceeded", "Service Unavailable", "ServerBusy",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	for _, m := range overloadStatusPattern.FindAllStringSubmatch(msg, -1) {
+		code, _ := strconv.Atoi(m[1])
+		if overloadedStatus(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// A statusCoder is an error that knows the HTTP status code of the response
+// it came from, like the S3 handler's.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// overloadStatusPattern matches an HTTP status code as storage handlers
+// spell it in their errors: "HTTP 503", "HTTP/1.1 503", "status 503",
+// "status code: 503", "StatusCode: 503", or "Error 503" (Google's).
+var overloadStatusPattern = regexp.MustCompile(`\b(?:HTTP(?:/\d(?:\.\d)?)?|[Ss]tatus(?: ?[Cc]ode)?|Error)[:=]? ?(\d{3})\b`)
+
+// overloadedStatus reports whether an HTTP status code means the server is
+// overloaded: 429, or a 5xx a retry can fix.
+func overloadedStatus(code int) bool {
+	switch code {
+	case 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
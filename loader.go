@@ -22,6 +22,10 @@ type Loader struct {
 	mu   sync.Mutex
 	sto  map[string]blobserver.Storage
 	conf *LowLevelConfig
+
+	redirects map[string]string // prefixes to load another prefix in place of
+
+	overrides map[string]blobserver.StorageConstructor // by handler, used in place of the registered one
 }
 
 var _ blobserver.Loader = (*Loader)(nil)
@@ -61,10 +65,60 @@ func (ld *Loader) SetStorage(prefix string, s blobserver.Storage) {
 	ld.sto[prefix] = s
 }
 
-func (ld *Loader) GetStorage(prefix string) (blobserver.Storage, error) {
+// redirect makes GetStorage(from) return the storage at to instead.
+func (ld *Loader) redirect(from, to string) {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	if ld.redirects == nil {
+		ld.redirects = make(map[string]string)
+	}
+	ld.redirects[from] = to
+}
+
+// override makes the storages with the given handler be created by ctor,
+// instead of the handler's own constructor.
+func (ld *Loader) override(handler string, ctor blobserver.StorageConstructor) {
 	ld.mu.Lock()
 	defer ld.mu.Unlock()
+	if ld.overrides == nil {
+		ld.overrides = make(map[string]blobserver.StorageConstructor)
+	}
+	ld.overrides[handler] = ctor
+}
+
+func (ld *Loader) GetStorage(prefix string) (blobserver.Storage, error) {
+	return ld.getStorage(prefix, nil, new(*storageError))
+}
+
+// A chainLoader is the Loader as seen by the handler of one storage being
+// created, so that the storages it loads in turn know what they are being
+// loaded for. Each call to Loader.GetStorage gets its own, so that calls
+// made at the same time don't mix up their chains.
+type chainLoader struct {
+	*Loader
+	chain   []string       // prefixes being created, outermost first
+	failure **storageError // the first failure in this chain, if any
+}
+
+func (cl *chainLoader) GetStorage(prefix string) (blobserver.Storage, error) {
+	return cl.Loader.getStorage(prefix, cl.chain, cl.failure)
+}
+
+// getStorage returns the storage at prefix, creating it if need be, as part
+// of creating the storages in chain. failure holds the first failure in the
+// chain: since that is the deepest one, it is the most informative, and
+// the handlers above it tend to just pass it along, sometimes with less
+// context than it started with, so it is what every storage in the chain
+// fails with. Failures aren't remembered past the chain; a later call tries
+// again.
+func (ld *Loader) getStorage(prefix string, chain []string, failure **storageError) (blobserver.Storage, error) {
+	ld.mu.Lock()
+	if to, ok := ld.redirects[prefix]; ok {
+		ld.mu.Unlock()
+		return ld.getStorage(to, chain, failure)
+	}
 	if bs, ok := ld.sto[prefix]; ok {
+		ld.mu.Unlock()
 		return bs, nil
 	}
 	if ld.sto == nil {
@@ -72,12 +126,43 @@ func (ld *Loader) GetStorage(prefix string) (blobserver.Storage, error) {
 	}
 	stoConf, ok := ld.conf.Prefixes[prefix]
 	if !ok {
+		ld.mu.Unlock()
 		return nil, fmt.Errorf("no storage configuration found for this prefix: %q", prefix)
 	}
-	sto, err := blobserver.CreateStorage(stoConf.StorageHandler, ld, stoConf.StorageHandlerArgs)
+	ctor := ld.overrides[stoConf.StorageHandler]
+	// Creating the storage may recursively call GetStorage for the
+	// storages it wraps, so don't hold the lock while doing it.
+	ld.mu.Unlock()
+
+	chain = append(chain[:len(chain):len(chain)], prefix)
+	sub := &chainLoader{Loader: ld, chain: chain, failure: failure}
+	var sto blobserver.Storage
+	var err error
+	if ctor != nil {
+		sto, err = ctor(sub, stoConf.StorageHandlerArgs)
+	} else {
+		sto, err = createStorage(stoConf.StorageHandler, sub, stoConf.StorageHandlerArgs)
+	}
+
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
 	if err != nil {
-		return nil, err
+		if *failure == nil {
+			*failure = &storageError{conf: ld.conf, chain: chain, err: err}
+		}
+		return nil, *failure
 	}
 	ld.sto[prefix] = sto
 	return sto, nil
 }
+
+// loaded returns the storages that have been initialized so far, by prefix.
+func (ld *Loader) loaded() map[string]blobserver.Storage {
+	ld.mu.Lock()
+	defer ld.mu.Unlock()
+	m := make(map[string]blobserver.Storage, len(ld.sto))
+	for prefix, sto := range ld.sto {
+		m[prefix] = sto
+	}
+	return m
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"go4.org/jsonconfig"
+)
+
+var onLockedIndex = flag.String("on-locked-index", "direct", "what to do when a blobpacked meta index is locked, because the Perkeep server is running: \"direct\" (verify the loose and packed blobs directly, which doesn't need the index), \"copy\" (verify through a private copy of the index; a copy taken while the server writes to it may be inconsistent), or \"fail\"")
+
+// A blobpacked storage opens its meta index (usually a LevelDB database)
+// for writing, and LevelDB allows only one process to do that at a time. So
+// while the Perkeep server is running, pk-verify can't load the blobpacked
+// storage itself, and would fail with an opaque locking error. Instead, it
+// checks up front, and works around the lock as --on-locked-index says.
+
+// handleLockedIndexes checks the meta index of every blobpacked storage that
+// prefixes use, and when one is locked, works around it. It returns the
+// config and prefixes to use instead.
+func handleLockedIndexes(conf *LowLevelConfig, prefixes []string) (*LowLevelConfig, []string, error) {
+	var locked []string
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		sc := conf.Prefixes[prefix]
+		if sc.StorageHandler != "blobpacked" || !usesPrefix(conf, prefixes, prefix) {
+			continue
+		}
+		metaConf, _ := sc.StorageHandlerArgs["metaIndex"].(map[string]interface{})
+		if metaConf == nil || !indexLocked(metaConf) {
+			continue
+		}
+		locked = append(locked, prefix)
+	}
+	if len(locked) == 0 {
+		return conf, prefixes, nil
+	}
+
+	for _, prefix := range locked {
+		stderrf("pk-verify: the meta index of the blobpacked storage at %v is locked; is the Perkeep server running?\n", prefix)
+	}
+	switch *onLockedIndex {
+	case "fail":
+		return nil, nil, fmt.Errorf("stop the Perkeep server, or see --on-locked-index for ways around the lock")
+	case "copy":
+		return copyLockedIndexes(conf, prefixes, locked)
+	case "direct":
+		return verifyAroundIndexes(conf, prefixes, locked)
+	}
+	return nil, nil, fmt.Errorf("invalid --on-locked-index %q: must be \"direct\", \"copy\", or \"fail\"", *onLockedIndex)
+}
+
+// indexLocked reports whether the sorted key-value store described by
+// kvConf is a LevelDB database that another process has open for writing.
+// It only opens the database read-only, which takes a shared lock and
+// changes nothing, not even creating it when it's missing. Other kinds of
+// index have no read-only way to check, so they are left for loading the
+// storage to report on.
+func indexLocked(kvConf map[string]interface{}) bool {
+	typ, _ := kvConf["type"].(string)
+	file, _ := kvConf["file"].(string)
+	if typ != "leveldb" || file == "" {
+		return false
+	}
+	db, err := leveldb.OpenFile(file, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return isLockError(err)
+	}
+	db.Close()
+	return false
+}
+
+// usesPrefix reports whether prefix is one of prefixes, or is used by one of
+// them.
+func usesPrefix(conf *LowLevelConfig, prefixes []string, prefix string) bool {
+	for _, p := range prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	seen := map[string]bool{}
+	var walk func(p string) bool
+	walk = func(p string) bool {
+		if seen[p] {
+			return false
+		}
+		seen[p] = true
+		for _, ref := range conf.referencedPrefixes(p) {
+			if ref == prefix || walk(ref) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range prefixes {
+		if walk(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyAroundIndexes replaces the locked blobpacked storages in prefixes
+// with their loose and packed storages. That verifies every blob, just the
+// packed ones as the zips they're in. It only works for blobpacked storages
+// that are targets themselves, not ones used by other storages.
+func verifyAroundIndexes(conf *LowLevelConfig, prefixes, locked []string) (*LowLevelConfig, []string, error) {
+	isLocked := map[string]bool{}
+	for _, prefix := range locked {
+		isLocked[prefix] = true
+	}
+	var direct []string
+	for _, p := range prefixes {
+		if !isLocked[p] {
+			direct = append(direct, p)
+			continue
+		}
+		args := conf.Prefixes[p].StorageHandlerArgs
+		small, _ := args["smallBlobs"].(string)
+		large, _ := args["largeBlobs"].(string)
+		if small == "" || large == "" {
+			return nil, nil, fmt.Errorf("the blobpacked storage at %v needs \"smallBlobs\" and \"largeBlobs\" arguments", p)
+		}
+		fmt.Printf("%v: verifying its loose blobs (%v) and packed zips (%v) directly instead\n", p, small, large)
+		direct = append(direct, small, large)
+		delete(isLocked, p)
+	}
+	for prefix := range isLocked {
+		return nil, nil, fmt.Errorf("the locked blobpacked storage at %v is used by another storage, so it can't be verified around; stop the Perkeep server, or use --on-locked-index=copy", prefix)
+	}
+	return conf, direct, nil
+}
+
+// copyLockedIndexes copies the locked meta indexes to a temporary directory
+// (removed when pk-verify exits), and returns a copy of conf that uses the
+// copies.
+func copyLockedIndexes(conf *LowLevelConfig, prefixes, locked []string) (*LowLevelConfig, []string, error) {
+	tmp, err := ioutil.TempDir("", "pk-verify-index-")
+	if err != nil {
+		return nil, nil, err
+	}
+	atExit(func() { os.RemoveAll(tmp) })
+	copied := &LowLevelConfig{
+		Prefixes: make(map[string]StorageConfig, len(conf.Prefixes)),
+		Syncs:    conf.Syncs,
+	}
+	for prefix, sc := range conf.Prefixes {
+		copied.Prefixes[prefix] = sc
+	}
+	for i, prefix := range locked {
+		sc := conf.Prefixes[prefix]
+		metaConf := copyObj(sc.StorageHandlerArgs["metaIndex"].(map[string]interface{}))
+		file, _ := metaConf["file"].(string)
+		if file == "" {
+			return nil, nil, fmt.Errorf("can't copy the meta index of %v: it isn't a local file", prefix)
+		}
+		dst := filepath.Join(tmp, fmt.Sprintf("%d-%v", i, filepath.Base(file)))
+		if err := copyIndex(file, dst); err != nil {
+			return nil, nil, fmt.Errorf("failed to copy the meta index of %v: %w", prefix, err)
+		}
+		fmt.Printf("%v: using a copy of its meta index, taken now\n", prefix)
+		metaConf["file"] = dst
+		args := copyObj(sc.StorageHandlerArgs)
+		args["metaIndex"] = map[string]interface{}(metaConf)
+		copied.Prefixes[prefix] = StorageConfig{StorageHandler: sc.StorageHandler, StorageHandlerArgs: args}
+	}
+	return copied, prefixes, nil
+}
+
+// copyIndex copies the index at src, which is a file or (for LevelDB) a
+// directory of files, to dst, leaving out the lock file.
+func copyIndex(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return copyFile(src, dst)
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if fi.IsDir() || fi.Name() == "LOCK" {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyObj returns a shallow copy of obj, since opening a sorted key-value
+// store or a storage records which arguments were used in the arguments
+// themselves.
+func copyObj(obj map[string]interface{}) jsonconfig.Obj {
+	c := make(jsonconfig.Obj, len(obj))
+	for k, v := range obj {
+		c[k] = v
+	}
+	return c
+}
+
+// isLockError reports whether err is a failure to lock a database that
+// another process has open: EWOULDBLOCK from flock on Unix, or a sharing
+// violation on Windows. Other errors that merely mention locks (or blocks,
+// like LevelDB's "corrupted block") aren't.
+func isLockError(err error) bool {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "resource temporarily unavailable") ||
+		strings.Contains(msg, "being used by another process")
+}
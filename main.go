@@ -13,20 +13,18 @@
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"go4.org/jsonconfig"
-	"go4.org/syncutil"
 
+	"perkeep.org/pkg/blob"
 	"perkeep.org/pkg/blobserver"
 	"perkeep.org/pkg/serverinit"
-
-	_ "perkeep.org/pkg/blobserver/blobpacked"
-
-	_ "perkeep.org/pkg/sorted/leveldb"
 )
 
 // LowLevelConfig and StorageConfig represent part of a Perkeep
@@ -105,14 +103,26 @@ import (
 // In the example above, note that the "handler" field from the json is called
 // "StorageHandler" in the Go struct, and that the "storage-" prefix is removed
 // in the Go struct.
+//
+// Besides storage, the only other handlers I keep are "sync" handlers, which
+// copy blobs from one storage prefix to another, and which are recorded in
+// Syncs, and the "jsonsign" handler, whose key signs the --store-report.
 type (
 	LowLevelConfig struct {
 		Prefixes map[string]StorageConfig
+		Syncs    []SyncConfig
+		Signing  *SigningConfig
 	}
 	StorageConfig struct {
 		StorageHandler     string
 		StorageHandlerArgs jsonconfig.Obj
 	}
+	SyncConfig struct {
+		From, To string
+	}
+	SigningConfig struct {
+		KeyID, SecretRing string
+	}
 )
 
 // deleteUnknownFields deletes unknown fields, which has the effect of
@@ -144,6 +154,26 @@ func parseLowLevelConfig(obj jsonconfig.Obj) (*LowLevelConfig, error) {
 				StorageHandler:     storageName,
 				StorageHandlerArgs: handler.RequiredObject("handlerArgs"),
 			}
+		} else if name == "sync" {
+			args := handler.RequiredObject("handlerArgs")
+			result.Syncs = append(result.Syncs, SyncConfig{
+				From: args.RequiredString("from"),
+				To:   args.RequiredString("to"),
+			})
+			deleteUnknownFields(args)
+			if err := args.Validate(); err != nil {
+				return nil, fmt.Errorf("In prefixes[%q].handlerArgs: %w", prefix, err)
+			}
+		} else if name == "jsonsign" {
+			args := handler.RequiredObject("handlerArgs")
+			result.Signing = &SigningConfig{
+				KeyID:      args.RequiredString("keyId"),
+				SecretRing: args.OptionalString("secretRing", ""),
+			}
+			deleteUnknownFields(args)
+			if err := args.Validate(); err != nil {
+				return nil, fmt.Errorf("In prefixes[%q].handlerArgs: %w", prefix, err)
+			}
 		} else {
 			deleteUnknownFields(handler)
 		}
@@ -161,90 +191,947 @@ func parseLowLevelConfig(obj jsonconfig.Obj) (*LowLevelConfig, error) {
 	return result, nil
 }
 
+var dryRun = flag.Bool("dry-run", false, "only enumerate the blobs (no content reads), and print their count, total size, and an estimate of how long a full run would take")
+
+func usage() {
+	stderrf("Usage: %v [flags] [<path to perkeep server config file, or a directory of blobs>]\n", os.Args[0])
+	stderrln()
+	stderrf("       %v merge [flags] <summary or manifest file>...\n", os.Args[0])
+	stderrf("       %v repair [flags] <path to perkeep server config file> <summary file>\n", os.Args[0])
+	stderrf("       %v recheck <path to perkeep server config file> <summary file>\n", os.Args[0])
+	stderrf("       %v daemon [daemon flags] <path to perkeep server config file> [flags]\n", os.Args[0])
+	stderrf("       %v index-verify [flags] <path to perkeep server config file>\n", os.Args[0])
+	stderrf("       %v capabilities <path to perkeep server config file>\n", os.Args[0])
+	stderrf("       %v fingerprint compare <fingerprint file> <fingerprint file>\n", os.Args[0])
+	stderrf("       %v ctl <control socket> <command>\n", os.Args[0])
+	stderrln()
+	stderrf("Example: %v ~/.config/perkeep/server-config.json\n", os.Args[0])
+	stderrln()
+	if path := defaultConfigPath(); path != "" {
+		stderrf("Without a path, the config is Perkeep's default, %v.\n", path)
+		stderrln()
+	}
+	stderrln("Flags:")
+	flag.PrintDefaults()
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "merge":
+			mergeMain(os.Args[2:])
+			return
+		case "repair":
+			repairMain(os.Args[2:])
+			return
+		case "recheck":
+			recheckMain(os.Args[2:])
+			return
+		case "daemon":
+			daemonMain(os.Args[2:])
+			return
+		case "index-verify":
+			indexVerifyMain(os.Args[2:])
+			return
+		case "capabilities":
+			capabilitiesMain(os.Args[2:])
+			return
+		case "fingerprint":
+			fingerprintMain(os.Args[2:])
+			return
+		case "ctl":
+			ctlMain(os.Args[2:])
+			return
+		}
+	}
+
 	// Check arguments.
-	if len(os.Args) != 2 {
-		stderrf("Usage: %v <path to perkeep server config file>\n", os.Args[0])
-		stderrln()
-		stderrf("Example: %v ~/.config/perkeep/server-config.json\n", os.Args[0])
-		os.Exit(1)
+	flag.Usage = usage
+	flag.Parse()
+	var configPath string
+	switch flag.NArg() {
+	case 0:
+		// No config given: use Perkeep's own, if it's where
+		// perkeepd would look.
+		if configPath = defaultConfigPath(); configPath == "" || !fileExists(configPath) {
+			usage()
+			exit(1)
+		}
+	case 1:
+		configPath = flag.Arg(0)
+	default:
+		usage()
+		exit(1)
+	}
+	setupPorcelain()
+	enableTerminalEscapes()
+	if flag.NArg() == 0 {
+		fmt.Printf("using the server config at %v\n", configPath)
+	}
+
+	ctx := interruptContext()
+	watchStatusSignal()
+	watchPauseSignal()
+
+	rules, err := loadRules()
+	if err != nil {
+		stderrf("pk-verify: failed to load --rules: %v\n", err)
+		exit(1)
+	}
+
+	if *diagnoseFlag {
+		d := diagnose(configPath)
+		if err := d.print(); err != nil {
+			stderrf("pk-verify: failed to write the diagnosis: %v\n", err)
+			exit(1)
+		}
+		if !d.OK {
+			exit(1)
+		}
+		return
 	}
 
 	// Parse config and find the handler for /bs/, the main blob handler.
-	config, err := serverinit.LoadFile(os.Args[1])
+	lowLevelConfig := loadConfig(configPath)
+
+	// Read local blob directories from snapshots, if asked to. The
+	// config as written still identifies the store.
+	storeConfig := lowLevelConfig
+	lowLevelConfig, err = takeSnapshots(ctx, lowLevelConfig)
 	if err != nil {
 		stderrf("pk-verify: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
-	lowLevelConfig, err := parseLowLevelConfig(config.LowLevelJSONConfig())
+	defer runExitFuncs()
+
+	// Decide what to verify, and initialize the storage handlers for it.
+	prefixes, err := chooseTargets(lowLevelConfig)
 	if err != nil {
-		stderrln("pk-verify: I do not recognize the format of this server config, and cannot continue :(")
-		stderrln()
-		stderrf("Here's specifically what surprised me in the (low-level expansion of the) config:\n\n\t%v\n", err)
-		os.Exit(1)
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
 	}
-	bs, ok := lowLevelConfig.Prefixes["/bs/"]
-	if !ok {
-		stderrln("pk-verify: I do not recognize the format of this server config, and cannot continue :(")
-		stderrln()
-		stderrln("Specifically, I expect the low-level expansion of the config to contain a \"/bs/\" prefix, and it does not.")
-		os.Exit(1)
+	if *readOnlyMedia != "" {
+		lowLevelConfig, err = setupReadOnlyMedia(lowLevelConfig, prefixes)
+	} else {
+		lowLevelConfig, prefixes, err = handleLockedIndexes(lowLevelConfig, prefixes)
+	}
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkReadable(lowLevelConfig, prefixes); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkRemoteFS(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkStoreReport(lowLevelConfig); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	adjustForNetworkMounts(lowLevelConfig, prefixes)
+	loader := NewLoader(lowLevelConfig)
+	if *readOnlyMedia != "" {
+		loader.override("filesystem", newMediaDisk)
+	}
+	if err := bypassCaches(loader, prefixes); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	var packingProblems []string
+	if *checkPacking {
+		if packingProblems, err = checkBlobpacked(ctx, loader); err != nil {
+			stderrf("pk-verify: %v\n", err)
+			exit(1)
+		}
+	}
+	var suspicions []string
+	if *sanity {
+		if suspicions, err = checkSanity(ctx, loader); err != nil {
+			stderrf("pk-verify: %v\n", err)
+			exit(1)
+		}
+	}
+	targets, skippedPrefixes, err := loadTargets(loader, prefixes)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		if !isDir(configPath) {
+			if d := diagnose(configPath); !d.OK {
+				// Probably a handler that this build doesn't have.
+				d.explain()
+			}
+		}
+		exit(1)
+	}
+	// The store is still the one that was asked for, even if some of it
+	// can't be verified this time.
+	storePrefixes := prefixes
+	prefixes = targetPrefixes(targets)
+	faults, err := parseFaults(*simulateFaults)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if faults != nil {
+		stderrf("pk-verify: SIMULATING FAULTS (%v, seed %v): some blobs will look bad that aren't; nothing is written to the storage\n", faults.text, faults.seed)
+		for i := range targets {
+			targets[i].sto = faults.wrap(targets[i].sto)
+		}
+	}
+	if *dryRun {
+		for _, t := range targets {
+			if len(targets) > 1 {
+				fmt.Printf("%v (%v):\n", t.prefix, t.handler)
+			}
+			if err := estimate(ctx, t.sto); err != nil {
+				stderrf("pk-verify: %v\n", err)
+				exit(1)
+			}
+		}
+		return
+	}
+
+	if *spotCheck != "" {
+		root, ok := blob.Parse(*spotCheck)
+		if !ok {
+			stderrf("pk-verify: invalid --spot-check ref %q\n", *spotCheck)
+			exit(1)
+		}
+		c := &spotChecker{sto: targets[0].sto}
+		c.check(ctx, root)
+		if c.problems() {
+			exit(2)
+		}
+		return
+	}
+
+	if *queryFlag != "" && *rootFlag != "" {
+		stderrln("pk-verify: --query and --root can't be used together")
+		exit(1)
+	}
+	if *queryFlag != "" || *rootFlag != "" {
+		prof, err := chooseProfile(lowLevelConfig, targets[0].prefix)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			exit(1)
+		}
+		verify := verifyQuery
+		if *rootFlag != "" {
+			verify = verifyRoot
+		}
+		ok, err := verify(ctx, targets[0].sto, prof.workers)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			exit(1)
+		}
+		if !ok {
+			exit(2)
+		}
+		return
+	}
+
+	if *statOnly {
+		ok, err := runStatOnly(ctx, lowLevelConfig, targets)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			exit(1)
+		}
+		if !ok {
+			exit(2)
+		}
+		return
+	}
+
+	encryptionProblems := checkEncryption(ctx, loader, prefixes)
+
+	// Pick the fastest way to read all of the blobs.
+	for i, t := range targets {
+		if err := targets[i].chooseMethod(lowLevelConfig); err != nil {
+			stderrf("pk-verify: %v\n", err)
+			exit(1)
+		}
+		if *compareReplicas && lowLevelConfig.Prefixes[t.prefix].StorageHandler == "replica" {
+			if *strategy != "auto" && *strategy != "enumerate" {
+				stderrf("pk-verify: %v: --compare-replicas fetches every blob one by one, so it can't be combined with --strategy=%v\n", t.prefix, *strategy)
+				exit(1)
+			}
+			fmt.Printf("%v: reading every blob from two of its replicas at once, and comparing them\n", t.prefix)
+			targets[i].method = "enumerate"
+			continue
+		}
+		fmt.Printf("%v: reading by %v: %v\n", t.prefix, targets[i].method, targets[i].why)
+	}
+
+	if err := checkRefsOut(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+
+	// Load the manifest of expected blobs up front, so that a typo in its
+	// path doesn't waste a whole run.
+	var expected []blob.SizedRef
+	if *expectFile != "" {
+		if expected, err = readManifest(*expectFile); err != nil {
+			stderrf("pk-verify: failed to read --expect manifest: %v\n", err)
+			exit(1)
+		}
 	}
 
-	// Initialize the storage handler for bs. (Note that this may
-	// recursively initialize other handlers that bs uses).
-	sto, err := blobserver.CreateStorage(bs.StorageHandler, NewLoader(lowLevelConfig), bs.StorageHandlerArgs)
+	var approx *bloomFilter
+	if *approxExpect != "" {
+		if approx, err = readBloomFilter(*approxExpect); err != nil {
+			stderrf("pk-verify: failed to read --approx-expect filter: %v\n", err)
+			exit(1)
+		}
+	}
+
+	verified, err := loadVerified()
 	if err != nil {
-		stderrf("pk-verify: failed to load blob storage: %v\n", err)
-		os.Exit(1)
+		stderrf("pk-verify: failed to read --skip-verified manifest: %v\n", err)
+		exit(1)
+	}
+	if verified != nil && expected != nil {
+		stderrln("pk-verify: --expect can't be combined with --skip-verified, since the skipped blobs would look missing")
+		exit(1)
+	}
+	if expected != nil && *tier != "both" {
+		stderrln("pk-verify: --expect can't be combined with --tier, since the blobs in the other tier would look missing")
+		exit(1)
+	}
+	if expected != nil && *proxycacheMode == "cache" {
+		stderrln("pk-verify: --expect can't be combined with --proxycache=cache, since the blobs the cache doesn't hold would look missing")
+		exit(1)
 	}
 
-	// Make sure we have a blob streaming interface.
-	// We want to read these blobs fast.
-	streamer, ok := sto.(blobserver.BlobStreamer)
-	if !ok {
-		stderrf("pk-verify does not support the %q blobserver. :(\n", bs.StorageHandler)
-		stderrln()
-		stderrln("I can only handle blobservers that implement BlobStreamer (that is, blobservers that allow a fast interface to streaming the contents of all blobs).")
-		os.Exit(1)
+	cache, err := loadVerifyCache()
+	if err != nil {
+		stderrf("pk-verify: failed to read --verify-cache: %v\n", err)
+		exit(1)
+	}
+
+	ignore, err := loadIgnoreRefs()
+	if err != nil {
+		stderrf("pk-verify: failed to read --ignore-refs: %v\n", err)
+		exit(1)
+	}
+
+	if *passes < 1 {
+		stderrln("pk-verify: --passes must be at least 1")
+		exit(1)
+	}
+	switch *walkOrder {
+	case "ref", "oldest", "newest":
+	default:
+		stderrf("pk-verify: invalid --walk-order %q: must be \"ref\", \"oldest\", or \"newest\"\n", *walkOrder)
+		exit(1)
+	}
+	if err := checkPriority(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkStalePriority(targets); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkBloomFlags(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkConfidence(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkAutoscale(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := checkUnits(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := parseRangeFlags(); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+
+	shard, err := parseShard(*shardFlag)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	expected = shard.filter(expected)
+	exclude, err := parseExclusion()
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	expected = exclude.filter(expected)
+
+	// Load what we know about previous runs against this store, and check
+	// for storages that look like they were wiped and recreated.
+	gens, warnings := loadGenerations(loader)
+	hist, err := loadHistory(configPath, storeIdentity(storeConfig, storePrefixes, gens), gens)
+	if err != nil {
+		stderrf("pk-verify: failed to load the history of previous runs: %v\n", err)
+		exit(1)
+	}
+	owners := storeOwners(storeConfig, storePrefixes)
+	changes := checkStoreIdentity(gens, loader.loaded(), owners, hist.last())
+	if err := warnStoreChanged(changes, hist.last()); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	warnings = append(warnings, checkGenerations(lowLevelConfig, gens)...)
+	for _, prefix := range sortedPrefixes(gens) {
+		fmt.Printf("%v: storage generation %v, initialized %v\n", prefix, gens[prefix].Random, gens[prefix].Init.Format(time.RFC3339))
+	}
+	for _, w := range warnings {
+		stderrf("pk-verify: WARNING: %v\n", w)
+	}
+	// The changes were printed above already, in a way that stands out;
+	// they still count against the run's health.
+	warnings = append(warnings, changes...)
+
+	// Pick how many blobs to verify at once, based on what kind of
+	// storage they live on.
+	verifiers := make([]*verifier, len(targets))
+	dups := newDupFinder()
+	migration := newMigrationCheck()
+	inv := newInventory()
+	crossCheck, err := newHashCrossChecker()
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	for i, t := range targets {
+		prof, err := chooseProfile(lowLevelConfig, t.prefix)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			exit(1)
+		}
+		var scale *autoscaler
+		if n := rules.workers(lowLevelConfig, t.prefix); n > 0 {
+			prof.workers = n
+		} else if scale = newAutoscaler(ctx, t.prefix); scale != nil {
+			prof.workers = *autoscaleMax
+		}
+		checks, err := rules.checks(lowLevelConfig, t.prefix)
+		if err != nil {
+			stderrf("pk-verify: %v: %v\n", t.prefix, err)
+			exit(1)
+		}
+		if inv != nil {
+			checks = append(checks, inv)
+		}
+		if scale != nil {
+			fmt.Printf("%v: autoscaling from 1 worker up to %v\n", t.prefix, prof.workers)
+		} else {
+			fmt.Printf("%v: using the %q profile: %v worker%v\n", t.prefix, prof.name, prof.workers, plural(prof.workers))
+		}
+		verifiers[i] = &verifier{sto: t.sto, workers: prof.workers, throttle: newThrottle(), scale: scale, shard: shard, verified: verified, exclude: exclude, dups: dups, migration: migration, checks: checks, paranoid: *paranoid}
+		verifiers[i].adjustForMount(lowLevelConfig, t.prefix)
+		verifiers[i].diagnose = stallDiagnostics(lowLevelConfig, t.prefix)
+		verifiers[i].activity = newActivity()
+		if verifiers[i].replicas, err = newReplicaCompare(loader, lowLevelConfig, t.prefix); err != nil {
+			stderrf("pk-verify: %v: %v\n", t.prefix, err)
+			exit(1)
+		}
+		if t.method == "enumerate" {
+			verifiers[i].limiter = newFetchLimiter()
+		}
+		if t.method == "walk" {
+			verifiers[i].cache = cache
+		}
+	}
+	var hashBench []hashBench
+	if *hashBenchFlag {
+		most := 0
+		for _, v := range verifiers {
+			if v.workers > most {
+				most = v.workers
+			}
+		}
+		hashBench = benchmarkHashes(most)
+	}
+	var wholeRefs *wholeRefChecker
+	if *checkWholeRefs {
+		wholeRefs = &wholeRefChecker{}
+		for _, v := range verifiers {
+			v.inspect = wholeRefs.inspector(v.sto)
+		}
+	}
+	var members *zipMemberHasher
+	if *zipMembers {
+		large := largeBlobsPrefixes(lowLevelConfig)
+		for i, t := range targets {
+			if !large[t.prefix] {
+				continue
+			}
+			if members == nil {
+				members = newZipMemberHasher()
+			}
+			verifiers[i].members = members
+		}
+		if members == nil {
+			stderrln("pk-verify: WARNING: --zip-members does nothing unless the zips of a blobpacked storage are verified (see --tier and --all)")
+		}
+	}
+	byPrefix := make(map[string]*verifier, len(targets))
+	for i, t := range targets {
+		byPrefix[t.prefix] = verifiers[i]
+	}
+	still := recheckPrevious(ctx, byPrefix, verifiers[0], hist)
+	if *recheckOnly {
+		if still > 0 {
+			exit(2)
+		}
+		return
+	}
+
+	redact, err := newRedactor()
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	found, err := openFindings(redact)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
 	}
 
+	problems := newCSVProblems(lowLevelConfig)
+
 	// The centerpiece: verify all of the blobs.
-	blobs := make(chan blobserver.BlobAndToken)
-	var wg syncutil.Group
-	wg.Go(func() error {
-		return streamer.StreamBlobs(context.Background(), blobs, "")
+	summary := newSummary()
+	fmt.Printf("run %v, started %v\n", summary.RunID, summary.Start.Format(time.RFC3339))
+	if shard != nil {
+		fmt.Printf("verifying only shard %v of the ref space\n", shard)
+	}
+	summary.ignore = ignore
+	summary.redact = redact
+	summary.Shard = shard
+	if exclude != nil {
+		summary.Exclude = exclude.String()
+		fmt.Printf("skipping the blobs matching %v\n", summary.Exclude)
+	}
+	if verified != nil {
+		summary.SkippedVerified = *skipVerified
+		fmt.Printf("skipping the %v blob%v already verified in %v\n", len(verified), plural(len(verified)), *skipVerified)
+	}
+	summary.Generations = gens
+	summary.Owners = owners
+	summary.targets = prefixes
+	summary.SkippedPrefixes = skippedPrefixes
+	// Verify the targets, --parallel-prefixes at a time. Reports from
+	// targets running at once take turns, since they share found,
+	// crossCheck, and the summary.
+	readLimit, err := newByteLimiter()
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		exit(1)
+	}
+	if err := serveControl(readLimit); err != nil {
+		stderrf("pk-verify: failed to listen on --control-socket: %v\n", err)
+		exit(1)
+	}
+	parallel := len(targets) > 1 && *parallelPrefixes != 1
+	var progs *progressGroup
+	if parallel {
+		progs = &progressGroup{}
+	}
+	var runDeadline time.Time
+	if *deadline > 0 {
+		runDeadline = summary.Start.Add(*deadline)
+	}
+	pss := make([]*PrefixSummary, len(targets))
+	cacheOf, origin := proxiedCache(lowLevelConfig)
+	for i, t := range targets {
+		pss[i] = summary.prefix(t.prefix, t.handler)
+		if t.prefix == cacheOf {
+			pss[i].CacheOf = origin
+		}
+	}
+	var reportMu sync.Mutex
+	streamErr := forEachTarget(len(targets), func(i int) error {
+		t := targets[i]
+		if len(targets) > 1 {
+			fmt.Printf("verifying %v (%v)\n", t.prefix, t.handler)
+		}
+		ps := pss[i]
+		var prog *progress
+		if parallel {
+			prog = progs.add(t.prefix)
+		} else {
+			prog = newProgress()
+		}
+		showStatus(t.prefix, verifiers[i].workers, prog, verifiers[i].activity)
+		var space *refSpace
+		if *priorityFlag == "" && (t.method != "walk" || *walkOrder == "ref") {
+			space = newRefSpace(lowLevelConfig, t.prefix)
+		}
+		var last blob.Ref
+		report := func(r verifyResult) {
+			if r.interrupted {
+				// The run was stopped before the blob could be
+				// verified; it's left for the next run.
+				return
+			}
+			readLimit.wait(ctx, r.size)
+			reportMu.Lock()
+			defer reportMu.Unlock()
+			if r.raced {
+				found.report("blob changed while it was being read, will re-check it at the end: %v", r.ref)
+				ps.Raced = append(ps.Raced, r.ref)
+				problems.add(t.prefix, r)
+				return
+			}
+			ps.add(r)
+			last = r.ref
+			if space != nil {
+				prog.setPosition(space.position(r.ref))
+			}
+			switch {
+			case r.err == nil:
+				crossCheck.sample(r.ref, t.sto)
+			case r.transient:
+				found.report("blob failed verification on %v of %v reads: %v", r.failures, r.passes, r.ref)
+				problems.add(t.prefix, r)
+			case ignore[r.ref]:
+				found.report("found invalid blob: %v (ignored)", r.ref)
+				problems.add(t.prefix, r)
+			default:
+				found.report("found invalid blob: %v", r.ref)
+				problems.add(t.prefix, r)
+				runInvalidHook(ctx, lowLevelConfig, t.prefix, r)
+			}
+			prog.update(ps.Valid, ps.Invalid, ps.Bytes)
+		}
+		var err error
+		switch {
+		case *priorityFlag != "":
+			fmt.Printf("%v: listing the blobs to verify them in --priority=%v order\n", t.prefix, *priorityFlag)
+			ps.Deferred, err = verifiers[i].verifyPrioritized(ctx, t.walkRoot, runDeadline, report)
+		case t.method == "walk":
+			fmt.Printf("%v: reading blob files directly from %v\n", t.prefix, t.walkRoot)
+			err = verifiers[i].verifyWalk(ctx, t.walkRoot, report)
+		case t.method == "stream":
+			err = verifiers[i].verifyStream(ctx, t.sto.(blobserver.BlobStreamer), report)
+		default:
+			err = verifiers[i].verifyEnumerate(ctx, nil, report)
+		}
+		if err != nil && *softFail {
+			err = fmt.Errorf("in %v (%v): %w", t.prefix, lowLevelConfig.describe(t.prefix), err)
+			skip := verifiers[i].recoverFrom(ctx, t.prefix, t.method, ps, last, err, report)
+			reportMu.Lock()
+			summary.Skipped = append(summary.Skipped, skip)
+			reportMu.Unlock()
+			err = nil
+			if !skip.Recovered {
+				prog.stop()
+				return nil
+			}
+		}
+		prog.stop()
+		if err != nil {
+			return fmt.Errorf("in %v (%v): %w", t.prefix, lowLevelConfig.describe(t.prefix), err)
+		}
+		if n := len(ps.Raced); n > 0 {
+			fmt.Printf("%v: re-checking the %v blob%v that changed while being read\n", t.prefix, n, plural(n))
+			if gone := verifiers[i].recheckRaced(ctx, ps.Raced, report); gone > 0 {
+				fmt.Printf("%v: %v of them %v removed during the run\n", t.prefix, gone, wasWere(gone))
+			}
+		}
+		if ps.Excluded, ps.ExcludedBytes = verifiers[i].excluded.counts(); ps.Excluded > 0 {
+			fmt.Printf("%v: skipped %v excluded blob%v (%v)\n", t.prefix, humanCount(ps.Excluded), plural(ps.Excluded), humanBytes(ps.ExcludedBytes))
+		}
+		if n, settled := verifiers[i].scale.workers(); n > 0 {
+			ps.Workers = n
+			if !settled {
+				fmt.Printf("%v: finished while autoscaling was still trying %v worker%v, before it could settle\n", t.prefix, n, plural(n))
+			}
+		}
+		if ps.Deferred > 0 {
+			fmt.Printf("%v: reached the --deadline with %v blob%v left to verify\n", t.prefix, humanCount(ps.Deferred), plural(ps.Deferred))
+		} else {
+			ps.done = true
+		}
+		if len(targets) > 1 {
+			fmt.Printf("%v: %v valid blob%v, %v invalid blob%v\n", t.prefix, humanCount(ps.Valid), plural(ps.Valid), humanCount(ps.Invalid), plural(ps.Invalid))
+		}
+		return nil
 	})
-	var valid, invalid int
-	for blob := range blobs {
-		if blob.ValidContents(context.Background()) == nil {
-			valid++
+	summary.finish(streamErr)
+	switch {
+	case summary.Invalid == 0 && summary.Coverage.Complete:
+		fmt.Printf("verified all %v blobs\n", humanCount(summary.Valid))
+	case summary.Invalid == 0:
+		fmt.Printf("verified %v blobs, all valid\n", humanCount(summary.Valid))
+	default:
+		fmt.Printf("CORRUPTION DETECTED: %v of %v blobs failed validation. Their refs are listed %v.\n", humanCount(summary.Invalid), humanCount(summary.Valid+summary.Invalid), found.where())
+	}
+	if summary.Cached > 0 {
+		fmt.Printf("(%v of them %v unchanged since an earlier run verified them, and %v not read again)\n", humanCount(summary.Cached), wasWere(summary.Cached), wasWere(summary.Cached))
+	}
+	if shard != nil && shard.Count > 1 {
+		// Shards are picked by digest, which has nothing to do with
+		// whether a blob is corrupt, so a shard is a fair sample of the
+		// whole store.
+		n := summary.Valid + summary.Invalid
+		if summary.Confidence = newConfidence(n, summary.Invalid, n*shard.Count); summary.Confidence != nil {
+			fmt.Printf("as a sample of the whole store: %v\n", summary.Confidence.describe(fmt.Sprintf("its roughly %v blobs", humanCount(summary.Confidence.Population))))
+		}
+	}
+	// Nothing that later runs go by may remember the faults simulated by
+	// this one as real: not the --verify-cache, the history, or a
+	// --store-report.
+	if faults == nil {
+		if err := cache.save(summary.Coverage.Complete); err != nil {
+			stderrf("pk-verify: failed to save --verify-cache: %v\n", err)
+		}
+	}
+	summary.Coverage.print()
+	if summary.Latency != nil {
+		summary.Latency.print()
+	}
+	for _, prefix := range summary.sortedPrefixes() {
+		h := summary.Prefixes[prefix].Heatmap
+		if h == nil {
+			continue
+		}
+		if *heatmapFlag {
+			h.print(prefix)
+		}
+		for _, spot := range h.hotSpots() {
+			fmt.Printf("%v: hot spot: %v\n", prefix, spot)
+		}
+	}
+	if summary.Digest != "" {
+		fmt.Println("store digest:", summary.Digest)
+	}
+	reportBottleneck(hashBench, summary.Bytes, summary.Duration)
+	if streamErr == nil {
+		compareThroughput(summary, hist)
+	}
+	if wholeRefs != nil && streamErr == nil {
+		wholeRefs.check(ctx, summary, found)
+	}
+	members.finish(summary, found)
+	crossCheck.check(ctx, summary, found)
+	if streamErr == nil {
+		checkStore(ctx, verifiers, summary, found)
+	}
+	if streamErr == nil && summary.SkippedVerified == "" {
+		if err := reconcileWithServer(ctx, summary, found); err != nil {
+			stderrf("pk-verify: %v\n", err)
+		}
+	}
+	if inv != nil {
+		summary.Inventory = inv.result()
+		printInventory(summary.Inventory)
+	}
+	if dups != nil && streamErr == nil {
+		summary.Duplicates = dups.result()
+		summary.Duplicates.report(found)
+	}
+	if migration != nil && streamErr == nil {
+		summary.Migration = migration.result(summary, expected)
+		summary.Migration.report(migration, found)
+	}
+	for _, v := range verifiers {
+		summary.ReplicaDivergences = append(summary.ReplicaDivergences, v.replicas.result()...)
+	}
+	reportReplicaDivergences(summary.ReplicaDivergences, found)
+	if *checkPacking {
+		summary.PackingProblems = packingProblems
+		for _, p := range packingProblems {
+			found.report("blobpacked bookkeeping: %v", p)
+		}
+		if n := len(packingProblems); n > 0 {
+			fmt.Printf("BLOBPACKED BOOKKEEPING: found %v problem%v, listed %v.\n", n, plural(n), found.where())
 		} else {
-			invalid++
-			fmt.Println("found invalid blob:", blob.Ref())
+			fmt.Println("blobpacked bookkeeping is consistent")
+		}
+	}
+	if *sanity {
+		summary.Suspicions = suspicions
+		for _, s := range suspicions {
+			found.report("suspicious: %v", s)
+		}
+		if n := len(suspicions); n > 0 {
+			fmt.Printf("SUSPICIOUS: found %v thing%v wrong with blobpacked zips whose hashes match, listed %v.\n", n, plural(n), found.where())
+		}
+	}
+	summary.EncryptionProblems = encryptionProblems
+	for _, p := range encryptionProblems {
+		found.report("encryption: %v", p)
+	}
+	if n := len(encryptionProblems); n > 0 {
+		fmt.Printf("ENCRYPTION KEY PROBLEMS: found %v, listed %v. However intact the encrypted blobs are, they can't be read without a working key.\n", n, found.where())
+	}
+	if expected != nil {
+		summary.checkManifest(expected)
+		for _, br := range summary.Missing {
+			found.report("missing blob: %v", br)
+		}
+		problems.addMissing(summary.Missing)
+		for _, br := range summary.Unlisted {
+			found.report("unlisted blob: %v", br)
+		}
+		if len(summary.Missing) > 0 {
+			fmt.Printf("MISSING BLOBS: %v of the %v blob%v in the manifest %v not found. Their refs are listed %v.\n", len(summary.Missing), len(expected), plural(len(expected)), wasWere(len(summary.Missing)), found.where())
+		}
+		if len(summary.Unlisted) > 0 {
+			fmt.Printf("found %v blob%v that the manifest does not list\n", len(summary.Unlisted), plural(len(summary.Unlisted)))
+		}
+	}
+	if approx != nil && streamErr == nil {
+		summary.checkApproxManifest(approx)
+	}
+	if len(summary.Ignored) > 0 {
+		fmt.Printf("%v of the problem blob%v %v listed in --ignore-refs, and will not cause a failing exit status.\n", len(summary.Ignored), plural(len(summary.Ignored)), wasWere(len(summary.Ignored)))
+	}
+	if summary.Transient > 0 {
+		fmt.Printf("WARNING: %v blob%v failed verification on some reads but %v valid on others (refs listed %v).\n", summary.Transient, plural(summary.Transient), wasWere(summary.Transient), found.where())
+		fmt.Println("That points to errors in flight (RAM, cables, controllers) rather than corruption of the stored data.")
+	}
+	if summary.SimulatedFaults = faults.summary(); summary.SimulatedFaults != nil {
+		n := 0
+		for _, k := range summary.SimulatedFaults.Injected {
+			n += k
+		}
+		fmt.Printf("SIMULATED: %v of the blob reads above had faults injected by --simulate-faults; none of them are real\n", humanCount(n))
+	}
+	summary.Resources = measureResources(summary)
+	summary.Resources.print()
+	summary.Health = summary.grade(lowLevelConfig, warnings)
+	if err := found.close(); err != nil {
+		stderrf("pk-verify: failed to write --invalid-out: %v\n", err)
+		exit(1)
+	}
+	if *manifestOut != "" && streamErr == nil {
+		if err := writeManifest(*manifestOut, summary); err != nil {
+			stderrf("pk-verify: failed to write manifest: %v\n", err)
+			exit(1)
+		}
+	}
+	if *bloomOut != "" && streamErr == nil {
+		if err := writeBloomFilter(*bloomOut, summary); err != nil {
+			stderrf("pk-verify: failed to write --bloom-out: %v\n", err)
+			exit(1)
+		}
+	}
+	if *fingerprintOut != "" && streamErr == nil {
+		if err := writeFingerprint(*fingerprintOut, summary); err != nil {
+			stderrf("pk-verify: failed to write --fingerprint-out: %v\n", err)
+			exit(1)
+		}
+	}
+	if err := problems.write(summary); err != nil {
+		stderrf("pk-verify: failed to write --csv: %v\n", err)
+		exit(1)
+	}
+	if *refsOut != "" {
+		if err := writeRefsOut(summary, expected); err != nil {
+			stderrf("pk-verify: failed to write --refs-out: %v\n", err)
+			exit(1)
+		}
+	}
+	switch {
+	case faults == nil:
+		if err := hist.record(summary); err != nil {
+			stderrf("pk-verify: failed to save the history of this run: %v\n", err)
+		}
+	case hist != nil:
+		fmt.Println("not saving this run in the history, since its faults were simulated")
+	}
+	if *summaryOut != "" {
+		if err := summary.writeFile(*summaryOut); err != nil {
+			stderrf("pk-verify: failed to write summary: %v\n", err)
+			exit(1)
+		}
+	}
+	if porcelainSummary() {
+		if err := summary.writeFile("-"); err != nil {
+			stderrf("pk-verify: failed to write summary: %v\n", err)
+			exit(1)
 		}
-		if invalid == 0 {
-			fmt.Printf(" verified %v blob%v...\r", valid, plural(valid))
+	}
+	if *readOnlyMedia != "" {
+		if dir, err := writeMediaReport(summary, lowLevelConfig); err != nil {
+			stderrf("pk-verify: failed to write the --read-only-media report: %v\n", err)
 		} else {
-			fmt.Printf(" %v invalid blob%v, %v valid blob%v\r", invalid, plural(invalid), valid, plural(valid))
+			fmt.Printf("wrote the report to keep with the media to %v\n", dir)
 		}
 	}
-	if invalid == 0 {
-		fmt.Printf("verified all %v blobs\n", valid)
-	} else {
-		fmt.Printf("CORRUPTION DETECTED: %v of %v blobs failed validation. Their refs are listed above.\n", invalid, valid+invalid)
+	if *storeReport != "" && streamErr == nil {
+		if faults != nil {
+			fmt.Printf("not uploading the report into %v, since its faults were simulated\n", *storeReport)
+		} else if summary.Status != "clean" && sameStorage(lowLevelConfig, *storeReport, summary.targets) {
+			fmt.Printf("not uploading the report into %v, since the run wasn't clean\n", *storeReport)
+		} else if pn, err := writeStoreReport(ctx, NewLoader(storeConfig), storeConfig, summary); err != nil {
+			stderrf("pk-verify: failed to upload --store-report: %v\n", err)
+		} else {
+			fmt.Printf("uploaded the report into %v, as permanode %v\n", *storeReport, pn)
+		}
 	}
+	rules.notify(ctx, summary)
+	summary.Health.print()
 
 	// Final error handling: check if there were any failures in the
 	// blob streaming implementation.
-	if err := wg.Err(); err != nil {
-		stderrf("pk-verify: error while streaming blobs: %v\n", err)
-		os.Exit(1)
+	if streamErr != nil {
+		stderrf("pk-verify: error while streaming blobs: %v\n", streamErr)
+		exit(1)
 	}
 
-	if invalid > 0 {
-		os.Exit(2)
+	if summary.Status == "error" {
+		exit(1)
+	}
+	if summary.Status == "corrupt" || summary.Status == "missing" {
+		exit(2)
+	}
+}
+
+// loadConfig loads the server config at path and parses its low-level
+// expansion, exiting with an explanation if it isn't something pk-verify
+// understands. If path is a directory of blobs instead, it makes up a config
+// for it; see bareDirConfig.
+func loadConfig(path string) *LowLevelConfig {
+	if isDir(path) {
+		conf, what, err := bareDirConfig(path)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%v is a blob directory rather than a server config; verifying it as %v\n", path, what)
+		return conf
+	}
+	config, err := serverinit.LoadFile(path)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	lowLevelConfig, err := parseLowLevelConfig(config.LowLevelJSONConfig())
+	if err != nil {
+		stderrln("pk-verify: I do not recognize the format of this server config, and cannot continue :(")
+		stderrln()
+		stderrf("Here's specifically what surprised me in the (low-level expansion of the) config:\n\n\t%v\n", err)
+		diagnose(path).explain()
+		os.Exit(1)
+	}
+	if _, ok := lowLevelConfig.Prefixes["/bs/"]; !ok {
+		stderrln("pk-verify: I do not recognize the format of this server config, and cannot continue :(")
+		stderrln()
+		stderrln("Specifically, I expect the low-level expansion of the config to contain a \"/bs/\" prefix, and it does not.")
+		os.Exit(1)
 	}
+	if err := normalizeSortedConfigs(lowLevelConfig); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	return lowLevelConfig
 }
 
 func plural(n int) string {
@@ -254,6 +1141,34 @@ func plural(n int) string {
 	return "s"
 }
 
+func isAre(n int) string {
+	if n == 1 {
+		return "is"
+	}
+	return "are"
+}
+
+func itThey(n int) string {
+	if n == 1 {
+		return "it"
+	}
+	return "they"
+}
+
+func wasWere(n int) string {
+	if n == 1 {
+		return "was"
+	}
+	return "were"
+}
+
+func hasHave(n int) string {
+	if n == 1 {
+		return "has"
+	}
+	return "have"
+}
+
 func stderrf(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 }
@@ -261,3 +1176,39 @@ func stderrf(format string, a ...interface{}) {
 func stderrln(a ...interface{}) {
 	fmt.Fprintln(os.Stderr, a...)
 }
+
+var (
+	exitMu    sync.Mutex
+	exitFuncs []func()
+)
+
+// atExit registers fn to be called by exit, for cleanups that must happen
+// however the run ends.
+func atExit(fn func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	exitFuncs = append(exitFuncs, fn)
+}
+
+// runExitFuncs runs the functions registered with atExit, most recent
+// first. Each runs once, even if a second interrupt calls exit while the
+// run is already exiting.
+func runExitFuncs() {
+	for {
+		exitMu.Lock()
+		if len(exitFuncs) == 0 {
+			exitMu.Unlock()
+			return
+		}
+		fn := exitFuncs[len(exitFuncs)-1]
+		exitFuncs = exitFuncs[:len(exitFuncs)-1]
+		exitMu.Unlock()
+		fn()
+	}
+}
+
+// exit is os.Exit, but runs the functions registered with atExit first.
+func exit(code int) {
+	runExitFuncs()
+	os.Exit(code)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	manifestOut = flag.String("manifest-out", "", "write the list of blobs found (\"<ref> <size>\" per line) to this file, for use with a later --expect")
+	expectFile  = flag.String("expect", "", "a manifest file of blobs that should be in the store (as written by --manifest-out, or just one ref per line); report any that are missing, and any blobs found that it doesn't list")
+)
+
+// readManifest reads a manifest file: one blob ref per line, optionally
+// followed by whitespace and the blob's size. Blank lines and lines starting
+// with "#" are ignored. Sizes of 0 mean "unknown".
+func readManifest(path string) ([]blob.SizedRef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var refs []blob.SizedRef
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if v, ok := parseSchemaLine(sc.Text()); ok {
+			if err := checkSchema("manifest", path, v, manifestSchema); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		br, ok := blob.Parse(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("%v:%d: invalid blob ref %q", path, line, fields[0])
+		}
+		sr := blob.SizedRef{Ref: br}
+		if len(fields) > 1 {
+			size, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%v:%d: invalid size %q", path, line, fields[1])
+			}
+			sr.Size = uint32(size)
+		}
+		refs = append(refs, sr)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return sortRefs(refs), nil
+}
+
+// writeManifest writes the refs seen by the run described by s to path, in
+// the format readManifest reads. It must be called after s.finish.
+func writeManifest(path string, s *Summary) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, schemaLine(manifestSchema))
+	fmt.Fprintf(w, "%v%v, started %v", manifestRunPrefix, s.RunID, s.Start.Format(time.RFC3339))
+	if s.Shard != nil {
+		fmt.Fprintf(w, ", shard %v", s.Shard)
+	}
+	fmt.Fprintln(w)
+	for _, sr := range s.seen {
+		fmt.Fprintf(w, "%v %d\n", sr.Ref, sr.Size)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// manifestRunPrefix starts the comment line of a manifest that says which
+// run wrote it.
+const manifestRunPrefix = "# pk-verify run "
+
+// manifestRunID returns the ID of the run that wrote the manifest data, or
+// "" if it doesn't say (it wasn't written by --manifest-out).
+func manifestRunID(data []byte) string {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if strings.HasPrefix(line, manifestRunPrefix) {
+			id := strings.TrimPrefix(line, manifestRunPrefix)
+			if i := strings.Index(id, ","); i >= 0 {
+				id = id[:i]
+			}
+			return id
+		}
+	}
+	return ""
+}
+
+// checkManifest compares the blobs seen during the run with the expected
+// ones, filling in s.Missing and s.Unlisted. It must be called after finish.
+//
+// It leaves them nil, and says so, when some prefix wasn't verified all the
+// way through (it was skipped, left for later by --deadline, or the run
+// stopped early): the blobs left unread would look missing. The blobs left
+// out by --shard and --exclude-* don't count, since they're filtered out of
+// expected too.
+func (s *Summary) checkManifest(expected []blob.SizedRef) {
+	if c := s.Coverage; s.Error != "" || len(c.PrefixesPartial) > 0 || len(c.PrefixesSkipped) > 0 {
+		fmt.Println("not checking --expect, since this run did not verify the whole store, and the blobs it left out would look missing")
+		return
+	}
+	s.Missing, s.Unlisted = []blob.Ref{}, []blob.Ref{}
+	i, j := 0, 0
+	for i < len(expected) || j < len(s.seen) {
+		switch {
+		case j == len(s.seen) || (i < len(expected) && expected[i].Ref.Less(s.seen[j].Ref)):
+			s.Missing = append(s.Missing, expected[i].Ref)
+			i++
+		case i == len(expected) || s.seen[j].Ref.Less(expected[i].Ref):
+			s.Unlisted = append(s.Unlisted, s.seen[j].Ref)
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	missing := 0
+	for _, br := range s.Missing {
+		if s.ignore[br] {
+			s.Ignored = append(s.Ignored, br)
+		} else {
+			missing++
+		}
+	}
+	if missing > 0 && s.Status == "clean" {
+		s.Status = "missing"
+	}
+}
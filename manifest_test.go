@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+func sizedRefs(contents ...string) []blob.SizedRef {
+	var srs []blob.SizedRef
+	for _, c := range contents {
+		srs = append(srs, blob.SizedRef{Ref: blob.RefFromString(c), Size: uint32(len(c))})
+	}
+	return sortRefs(srs)
+}
+
+func refList(contents ...string) []blob.Ref {
+	brs := []blob.Ref{}
+	for _, sr := range sizedRefs(contents...) {
+		brs = append(brs, sr.Ref)
+	}
+	return brs
+}
+
+func TestCheckManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []string
+		seen     []string
+		ignore   []string
+		coverage coverage
+		err      string
+		missing  []blob.Ref
+		unlisted []blob.Ref
+		status   string
+	}{
+		{
+			name:     "all there",
+			expected: []string{"foo", "bar"},
+			seen:     []string{"foo", "bar"},
+			missing:  refList(),
+			unlisted: refList(),
+			status:   "clean",
+		},
+		{
+			name:     "missing and unlisted",
+			expected: []string{"foo", "bar", "baz"},
+			seen:     []string{"foo", "quux"},
+			missing:  refList("bar", "baz"),
+			unlisted: refList("quux"),
+			status:   "missing",
+		},
+		{
+			name:     "missing but ignored",
+			expected: []string{"foo", "bar"},
+			seen:     []string{"foo"},
+			ignore:   []string{"bar"},
+			missing:  refList("bar"),
+			unlisted: refList(),
+			status:   "clean",
+		},
+		{
+			name:     "empty manifest",
+			seen:     []string{"foo"},
+			missing:  refList(),
+			unlisted: refList("foo"),
+			status:   "clean",
+		},
+		{
+			name:     "deferred by --deadline",
+			expected: []string{"foo", "bar"},
+			seen:     []string{"foo"},
+			coverage: coverage{PrefixesPartial: []string{"/bs/"}},
+			status:   "clean",
+		},
+		{
+			name:     "prefix skipped",
+			expected: []string{"foo", "bar"},
+			seen:     []string{"foo"},
+			coverage: coverage{PrefixesSkipped: []string{"/bs-b/"}},
+			status:   "clean",
+		},
+		{
+			name:     "stopped early",
+			expected: []string{"foo", "bar"},
+			seen:     []string{"foo"},
+			err:      "context canceled",
+			status:   "clean",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Summary{
+				Status:   "clean",
+				Error:    tt.err,
+				Coverage: &tt.coverage,
+				seen:     sizedRefs(tt.seen...),
+				ignore:   map[blob.Ref]bool{},
+			}
+			for _, br := range refList(tt.ignore...) {
+				s.ignore[br] = true
+			}
+			s.checkManifest(sizedRefs(tt.expected...))
+			if !reflect.DeepEqual(s.Missing, tt.missing) {
+				t.Errorf("Missing = %v, want %v", s.Missing, tt.missing)
+			}
+			if !reflect.DeepEqual(s.Unlisted, tt.unlisted) {
+				t.Errorf("Unlisted = %v, want %v", s.Unlisted, tt.unlisted)
+			}
+			if s.Status != tt.status {
+				t.Errorf("Status = %q, want %q", s.Status, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go4.org/jsonconfig"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var readOnlyMedia = flag.String("read-only-media", "", "verify a store on read-only media (a burned disc, a write-blocked USB drive) without writing anything to it: blob directories are read by pk-verify itself rather than through Perkeep's handlers (which create files as they start up), meta indexes are read from copies, and everything pk-verify keeps, from the history of runs to --state-dir, goes in this directory instead, which must be somewhere else. At the end, a report to archive along with the media (summary, manifest, and fingerprint) is written to a subdirectory of it")
+
+// The Perkeep handlers for local storage all write as they start up: the
+// localdisk handler checks that it can create files in its root, and creates
+// a GENERATION.dat if there is none; blobpacked opens its meta index for
+// writing; diskpacked opens its pack files for writing. On read-only media
+// they fail, and on write-blocked media they may leave things half-written.
+// So with --read-only-media, pk-verify reads localdisk storages itself (see
+// mediaDisk), copies the meta indexes, and refuses the storages it can't
+// read without their handler.
+
+// mediaHandlers are the storage handlers whose storage lives in local files
+// that pk-verify can read on read-only media.
+var mediaHandlers = map[string]bool{
+	"filesystem": true,
+	"blobpacked": true,
+}
+
+// setupReadOnlyMedia checks that the store at prefixes can be verified
+// with --read-only-media, points --state-dir at the media directory, and
+// returns the config to use instead of conf, with every meta index copied.
+func setupReadOnlyMedia(conf *LowLevelConfig, prefixes []string) (*LowLevelConfig, error) {
+	dir, err := filepath.Abs(*readOnlyMedia)
+	if err != nil {
+		return nil, err
+	}
+	if flagWasSet("state-dir") && *stateDir != *readOnlyMedia {
+		return nil, fmt.Errorf("--read-only-media keeps its state in %v, so it can't be combined with --state-dir", *readOnlyMedia)
+	}
+	*stateDir = dir
+	*walkFlag = true
+
+	for _, leaf := range conf.leafPrefixes(prefixes) {
+		if h := conf.Prefixes[leaf].StorageHandler; localPathArgs[h] != nil && !mediaHandlers[h] {
+			return nil, fmt.Errorf("%v: the %q storage can't be read without writing to it, so it can't be verified with --read-only-media; copy it off the media first", leaf, h)
+		}
+	}
+	var blobpacked []string
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		if conf.Prefixes[prefix].StorageHandler == "blobpacked" && usesPrefix(conf, prefixes, prefix) {
+			blobpacked = append(blobpacked, prefix)
+		}
+	}
+
+	// Nothing pk-verify writes may land on the media.
+	media := mediaPaths(conf, prefixes)
+	outputs := []struct{ flag, path string }{
+		{"--read-only-media", dir},
+		{"--summary-out", *summaryOut},
+		{"--manifest-out", *manifestOut},
+		{"--fingerprint-out", *fingerprintOut},
+		{"--bloom-out", *bloomOut},
+		{"--invalid-out", *invalidOut},
+		{"--csv", *csvOut},
+		{"--refs-out", *refsOut},
+		{"--verify-cache", *verifyCacheFile},
+		{"--control-socket", *controlSocket},
+	}
+	for _, out := range outputs {
+		if out.path == "" || out.path == "-" {
+			continue
+		}
+		if on := onMedia(out.path, media); on != "" {
+			return nil, fmt.Errorf("%v=%v is on the read-only media (in %v)", out.flag, out.path, on)
+		}
+	}
+	if *storeReport != "" && sameStorage(conf, *storeReport, prefixes) {
+		return nil, fmt.Errorf("--store-report=%v would write to the read-only media", *storeReport)
+	}
+	if err := checkWritable(dir, 0); err != nil {
+		return nil, fmt.Errorf("--read-only-media: %w", err)
+	}
+	fmt.Printf("read-only media: keeping state in %v, and writing nothing to %v\n", dir, strings.Join(media, ", "))
+	if len(blobpacked) == 0 {
+		return conf, nil
+	}
+	conf, _, err = copyLockedIndexes(conf, prefixes, blobpacked)
+	return conf, err
+}
+
+// localPathArgs are, for the storage handlers that keep their storage in
+// local files, the handler arguments that say where.
+var localPathArgs = map[string][]string{
+	"filesystem": {"path"},
+	"diskpacked": {"path"},
+	"blobpacked": {"metaIndex"},
+}
+
+// mediaPaths returns the local files and directories that the storages at
+// prefixes, and the storages they use, keep their blobs and indexes in.
+func mediaPaths(conf *LowLevelConfig, prefixes []string) []string {
+	seen := map[string]bool{}
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		if !usesPrefix(conf, prefixes, prefix) {
+			continue
+		}
+		sc := conf.Prefixes[prefix]
+		for _, arg := range localPathArgs[sc.StorageHandler] {
+			path, _ := sc.StorageHandlerArgs[arg].(string)
+			if kv, ok := sc.StorageHandlerArgs[arg].(map[string]interface{}); ok {
+				path, _ = kv["file"].(string)
+			}
+			if abs, err := filepath.Abs(path); path != "" && err == nil {
+				seen[abs] = true
+			}
+		}
+	}
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// onMedia returns which of media path is in, or "".
+func onMedia(path string, media []string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for _, m := range media {
+		rel, err := filepath.Rel(m, abs)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return m
+		}
+	}
+	return ""
+}
+
+// writeMediaReport writes the report of the run described by s into a new
+// directory under the --read-only-media directory, named after the run, and
+// returns it. The report is meant to be kept with the media, so it only
+// holds plain files that don't need pk-verify's state to make sense:
+//
+//	summary.json      the --summary-out of the run
+//	manifest.txt      the blobs found, for a later --expect
+//	fingerprint.json  for "pk-verify fingerprint compare" with a copy
+//	README.txt        what the media held, and how to check it again
+//
+// It must be called after s.grade.
+func writeMediaReport(s *Summary, conf *LowLevelConfig) (string, error) {
+	dir := filepath.Join(*stateDir, "report-"+s.RunID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := s.writeFile(filepath.Join(dir, "summary.json")); err != nil {
+		return "", err
+	}
+	if err := writeManifest(filepath.Join(dir, "manifest.txt"), s); err != nil {
+		return "", err
+	}
+	if err := writeFingerprint(filepath.Join(dir, "fingerprint.json"), s); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "pk-verify run %v, started %v, took %v\n\n", s.RunID, s.Start.Format(time.RFC3339), humanDuration(time.Duration(s.Duration*float64(time.Second))))
+	fmt.Fprintf(&b, "status: %v\n", s.Status)
+	if s.Health != nil {
+		fmt.Fprintf(&b, "health: %v\n", s.Health.Grade)
+	}
+	fmt.Fprintf(&b, "blobs: %v valid, %v invalid, %v in all\n", s.Valid, s.Invalid, humanBytes(s.Bytes))
+	if s.Digest != "" {
+		fmt.Fprintf(&b, "store digest: %v\n", s.Digest)
+	}
+	fmt.Fprintln(&b, "\nstorages verified:")
+	for _, prefix := range s.targets {
+		fmt.Fprintf(&b, "\t%v (%v)\n", prefix, conf.describe(prefix))
+	}
+	for _, prefix := range sortedPrefixes(s.Generations) {
+		fmt.Fprintf(&b, "\t%v: storage generation %v\n", prefix, s.Generations[prefix].Random)
+	}
+	fmt.Fprintln(&b, "\nTo check the media again later, against what it held at this run:")
+	fmt.Fprintln(&b, "\n\tpk-verify --read-only-media=<state dir> --expect=manifest.txt --fingerprint-out=now.json <media>")
+	fmt.Fprintln(&b, "\tpk-verify fingerprint compare fingerprint.json now.json")
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.txt"), []byte(b.String()), 0644); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// errMediaReadOnly is returned by writes to a mediaDisk.
+var errMediaReadOnly = errors.New("opened read-only by pk-verify, for --read-only-media")
+
+// A mediaDisk reads a localdisk storage the way the localdisk handler
+// would, without writing anything, for --read-only-media.
+type mediaDisk struct {
+	root string
+}
+
+func newMediaDisk(_ blobserver.Loader, args jsonconfig.Obj) (blobserver.Storage, error) {
+	root := args.RequiredString("path")
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", root)
+	}
+	return &mediaDisk{root: root}, nil
+}
+
+func (d *mediaDisk) EnumerateBlobs(ctx context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	defer close(dest)
+	dirs, err := shardDirs(d.root)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		// A leaf directory holds the refs that start with
+		// "<hash>-<first><second>"; skip the ones before after.
+		first := filepath.Dir(dir)
+		start := filepath.Base(filepath.Dir(first)) + "-" + filepath.Base(first) + filepath.Base(dir)
+		if len(after) >= len(start) && start < after[:len(start)] {
+			continue
+		}
+		files, err := listBlobFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.ref.String() <= after {
+				continue
+			}
+			select {
+			case dest <- blob.SizedRef{Ref: f.ref, Size: f.size}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if limit--; limit == 0 {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (d *mediaDisk) StatBlobs(ctx context.Context, blobs []blob.Ref, fn func(blob.SizedRef) error) error {
+	for _, br := range blobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := localdiskPath(d.root, br)
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(blob.SizedRef{Ref: br, Size: uint32(fi.Size())}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *mediaDisk) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	path := localdiskPath(d.root, br)
+	if path == "" {
+		return nil, 0, os.ErrNotExist
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, uint32(fi.Size()), nil
+}
+
+func (d *mediaDisk) ReceiveBlob(context.Context, blob.Ref, io.Reader) (blob.SizedRef, error) {
+	return blob.SizedRef{}, errMediaReadOnly
+}
+
+func (d *mediaDisk) RemoveBlobs(context.Context, []blob.Ref) error {
+	return errMediaReadOnly
+}
+
+// StorageGeneration reads the generation that the localdisk handler keeps
+// in GENERATION.dat: its contents are the random part, and its modification
+// time is when the storage was initialized.
+func (d *mediaDisk) StorageGeneration() (time.Time, string, error) {
+	path := filepath.Join(d.root, "GENERATION.dat")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return fi.ModTime(), strings.TrimSpace(string(data)), nil
+}
+
+func (d *mediaDisk) ResetStorageGeneration() error {
+	return errMediaReadOnly
+}
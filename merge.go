@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// mergeMain implements "pk-verify merge", which combines the outputs of
+// several sharded runs (see --shard) into one report, as if a single run had
+// verified the whole store.
+//
+// Its arguments are --summary-out files, which say what each shard covered
+// and found, and optionally --manifest-out files, whose union becomes the
+// merged manifest and, if there is one from each of the runs merged and no
+// others, the store digest. The two kinds are told apart by their contents.
+func mergeMain(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	summaryOut := fs.String("summary-out", "", "write the merged JSON summary to this file")
+	manifestOut := fs.String("manifest-out", "", "write the union of the manifests to this file")
+	fs.Usage = func() {
+		stderrf("Usage: %v merge [flags] <summary or manifest file>...\n", os.Args[0])
+		stderrln()
+		stderrln("Combines the --summary-out (and optionally --manifest-out) files of sharded runs into a single report, and checks that the shards cover the whole ref space, with no gaps or overlaps.")
+		stderrln()
+		stderrln("Flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var (
+		summaries     []*Summary
+		names         []string
+		manifests     [][]blob.SizedRef
+		manifestNames []string
+		manifestRuns  []string
+	)
+	for _, path := range fs.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			os.Exit(1)
+		}
+		if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			refs, err := readManifest(path)
+			if err != nil {
+				stderrf("pk-verify: %v\n", err)
+				os.Exit(1)
+			}
+			manifests = append(manifests, refs)
+			manifestNames = append(manifestNames, path)
+			manifestRuns = append(manifestRuns, manifestRunID(data))
+			continue
+		}
+		s, err := parseSummary(path, data)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			os.Exit(1)
+		}
+		summaries = append(summaries, s)
+		names = append(names, path)
+	}
+	if len(summaries) == 0 {
+		stderrln("pk-verify: merge needs at least one summary file, to know what the shards covered")
+		os.Exit(1)
+	}
+
+	merged, problems := mergeSummaries(summaries, names)
+	if manifests != nil {
+		for _, refs := range manifests {
+			merged.seen = append(merged.seen, refs...)
+		}
+		merged.seen = sortRefs(merged.seen)
+		gaps := manifestGaps(summaries, names, manifestRuns, manifestNames)
+		for _, g := range gaps {
+			stderrf("pk-verify: %v\n", g)
+		}
+		switch {
+		case len(gaps) > 0:
+			fmt.Println("no store digest, since the manifests aren't exactly those of the runs merged")
+		case merged.Status != "error":
+			merged.Digest = storeDigest(merged.seen)
+		}
+	}
+
+	fmt.Printf("merged %v run%v: %v valid blob%v, %v invalid blob%v\n", len(summaries), plural(len(summaries)), merged.Valid, plural(merged.Valid), merged.Invalid, plural(merged.Invalid))
+	for _, p := range problems {
+		stderrf("pk-verify: %v\n", p)
+	}
+	if len(merged.InvalidRefs) > 0 {
+		fmt.Println("CORRUPTION DETECTED. Invalid blobs:")
+		for _, br := range merged.InvalidRefs {
+			fmt.Println(" ", br)
+		}
+	}
+	if len(merged.Missing) > 0 {
+		fmt.Printf("MISSING BLOBS: %v blob%v from the manifest %v not found\n", len(merged.Missing), plural(len(merged.Missing)), wasWere(len(merged.Missing)))
+	}
+	merged.Coverage.print()
+	if merged.Digest != "" {
+		fmt.Println("store digest:", merged.Digest)
+	}
+	fmt.Println("status:", merged.Status)
+	merged.Health = merged.grade(nil, nil)
+
+	if *manifestOut != "" {
+		if manifests == nil {
+			stderrln("pk-verify: --manifest-out needs manifest files to merge")
+			os.Exit(1)
+		}
+		if err := writeManifest(*manifestOut, merged); err != nil {
+			stderrf("pk-verify: failed to write manifest: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *summaryOut != "" {
+		if err := merged.writeFile(*summaryOut); err != nil {
+			stderrf("pk-verify: failed to write summary: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	merged.Health.print()
+
+	switch merged.Status {
+	case "error":
+		os.Exit(1)
+	case "corrupt", "missing":
+		os.Exit(2)
+	}
+}
+
+// manifestGaps returns what keeps the union of the manifests, whose runs are
+// runs, from being the manifest of the merged summaries: summaries without
+// a manifest, and manifests from none of the runs merged (or that don't say
+// what run they're from). names and manifestNames are the files they came
+// from.
+func manifestGaps(summaries []*Summary, names, runs, manifestNames []string) []string {
+	var gaps []string
+	have := make(map[string]bool, len(runs))
+	for i, id := range runs {
+		if id == "" {
+			gaps = append(gaps, fmt.Sprintf("%v: the manifest doesn't say what run wrote it", manifestNames[i]))
+			continue
+		}
+		have[id] = true
+	}
+	merging := make(map[string]bool, len(summaries))
+	for i, s := range summaries {
+		merging[s.RunID] = true
+		if !have[s.RunID] {
+			gaps = append(gaps, fmt.Sprintf("%v: no manifest from run %v", names[i], s.RunID))
+		}
+	}
+	for i, id := range runs {
+		if id != "" && !merging[id] {
+			gaps = append(gaps, fmt.Sprintf("%v: the manifest is from run %v, which isn't being merged", manifestNames[i], id))
+		}
+	}
+	return gaps
+}
+
+// mergeSummaries adds up the results of several runs. names are the files
+// the summaries came from, for error messages. It returns the problems that
+// make the merged result untrustworthy (which also set its status to
+// "error"), like gaps between the shards.
+func mergeSummaries(summaries []*Summary, names []string) (*Summary, []string) {
+	merged := &Summary{
+		RunID:       newRunID(),
+		InvalidRefs: []blob.Ref{},
+		Prefixes:    map[string]*PrefixSummary{},
+	}
+	var (
+		problems []string
+		end      time.Time
+		worst    latencyTracker
+	)
+	for i, s := range summaries {
+		if merged.Start.IsZero() || s.Start.Before(merged.Start) {
+			merged.Start = s.Start
+		}
+		if e := s.Start.Add(time.Duration(s.Duration * float64(time.Second))); e.After(end) {
+			end = e
+		}
+		if s.Status == "error" {
+			problems = append(problems, fmt.Sprintf("%v: run did not complete: %v", names[i], s.Error))
+		}
+		merged.Valid += s.Valid
+		merged.Invalid += s.Invalid
+		merged.Transient += s.Transient
+		merged.Cached += s.Cached
+		merged.Bytes += s.Bytes
+		merged.InvalidRefs = append(merged.InvalidRefs, s.InvalidRefs...)
+		merged.Missing = append(merged.Missing, s.Missing...)
+		merged.Unlisted = append(merged.Unlisted, s.Unlisted...)
+		merged.Ignored = append(merged.Ignored, s.Ignored...)
+		merged.Skipped = append(merged.Skipped, s.Skipped...)
+		merged.WholeRefsChecked += s.WholeRefsChecked
+		merged.WholeRefMismatches = append(merged.WholeRefMismatches, s.WholeRefMismatches...)
+		merged.ZipMembersChecked += s.ZipMembersChecked
+		merged.BadZipMembers = append(merged.BadZipMembers, s.BadZipMembers...)
+		merged.Latency = mergeLatency(merged.Latency, s.Latency, &worst)
+		for prefix, g := range s.Generations {
+			if prev, ok := merged.Generations[prefix]; ok && prev.Random != g.Random {
+				problems = append(problems, fmt.Sprintf("%v: %v is storage generation %v, but other runs saw generation %v; the runs were not verifying the same store", names[i], prefix, g.Random, prev.Random))
+				continue
+			}
+			if merged.Generations == nil {
+				merged.Generations = map[string]generation{}
+			}
+			merged.Generations[prefix] = g
+		}
+		for prefix, ps := range s.Prefixes {
+			mps := merged.prefix(prefix, ps.Handler)
+			mps.Valid += ps.Valid
+			mps.Invalid += ps.Invalid
+			mps.Transient += ps.Transient
+			mps.Cached += ps.Cached
+			mps.Excluded += ps.Excluded
+			mps.ExcludedBytes += ps.ExcludedBytes
+			mps.Deferred += ps.Deferred
+			mps.Bytes += ps.Bytes
+			mps.CacheOf = ps.CacheOf
+			mps.InvalidRefs = append(mps.InvalidRefs, ps.InvalidRefs...)
+			mps.TransientRefs = append(mps.TransientRefs, ps.TransientRefs...)
+			mps.Raced = append(mps.Raced, ps.Raced...)
+			if ps.Heatmap != nil {
+				if mps.Heatmap == nil {
+					mps.Heatmap = &latencyHeatmap{}
+				}
+				mps.Heatmap.merge(ps.Heatmap)
+			}
+		}
+	}
+	merged.Duration = end.Sub(merged.Start).Seconds()
+	for _, refs := range []*[]blob.Ref{&merged.InvalidRefs, &merged.Missing, &merged.Unlisted, &merged.Ignored, &merged.WholeRefMismatches} {
+		sort.Slice(*refs, func(i, j int) bool { return (*refs)[i].Less((*refs)[j]) })
+	}
+
+	problems = append(problems, checkCoverage(summaries, names)...)
+	merged.Coverage = mergeCoverage(summaries, names, problems)
+	merged.Status = "clean"
+	for _, s := range summaries {
+		if s.Status == "corrupt" || (s.Status == "missing" && merged.Status == "clean") {
+			merged.Status = s.Status
+		}
+	}
+	if len(problems) > 0 {
+		merged.Status = "error"
+		merged.Error = strings.Join(problems, "; ")
+	}
+	return merged, problems
+}
+
+// mergeLatency combines the latency stats of two runs. Percentiles can't be
+// combined exactly without the samples, so the merged ones are the highest of
+// the runs': an upper bound. worst accumulates the slowest blobs across
+// calls.
+func mergeLatency(a, b *latencyStats, worst *latencyTracker) *latencyStats {
+	if b == nil {
+		return a
+	}
+	for _, w := range b.Worst {
+		worst.noteWorst(w)
+	}
+	if a == nil {
+		a = &latencyStats{}
+	}
+	max := func(x, y float64) float64 {
+		if x > y {
+			return x
+		}
+		return y
+	}
+	return &latencyStats{
+		P50:   max(a.P50, b.P50),
+		P95:   max(a.P95, b.P95),
+		P99:   max(a.P99, b.P99),
+		Max:   max(a.Max, b.Max),
+		Worst: append([]slowBlob(nil), worst.worst...),
+	}
+}
+
+// checkCoverage checks that the shards of the runs add up to the whole ref
+// space, exactly once. A run without a shard covers all of it.
+func checkCoverage(summaries []*Summary, names []string) []string {
+	type span struct {
+		start, end, count int // [start/count, end/count)
+		name              string
+	}
+	spans := make([]span, len(summaries))
+	for i, s := range summaries {
+		start, end, count := s.Shard.bounds()
+		spans[i] = span{start, end, count, names[i]}
+	}
+	// a/b < c/d iff a*d < c*b, for positive b and d.
+	less := func(a, b, c, d int) bool { return a*d < c*b }
+	sort.Slice(spans, func(i, j int) bool {
+		return less(spans[i].start, spans[i].count, spans[j].start, spans[j].count)
+	})
+	pct := func(n, d int) string { return fmt.Sprintf("%.4g%%", 100*float64(n)/float64(d)) }
+
+	var problems []string
+	pos, posCount := 0, 1 // how far the shards so far reach
+	for _, sp := range spans {
+		switch {
+		case less(pos, posCount, sp.start, sp.count):
+			problems = append(problems, fmt.Sprintf("no run covered the ref space from %v to %v", pct(pos, posCount), pct(sp.start, sp.count)))
+		case less(sp.start, sp.count, pos, posCount):
+			end, endCount := pos, posCount
+			if less(sp.end, sp.count, pos, posCount) {
+				end, endCount = sp.end, sp.count
+			}
+			problems = append(problems, fmt.Sprintf("%v overlaps another run, from %v to %v of the ref space", sp.name, pct(sp.start, sp.count), pct(end, endCount)))
+		}
+		if less(pos, posCount, sp.end, sp.count) {
+			pos, posCount = sp.end, sp.count
+		}
+	}
+	if pos < posCount {
+		problems = append(problems, fmt.Sprintf("no run covered the ref space from %v to 100%%", pct(pos, posCount)))
+	}
+	return problems
+}
+
+// mergeCoverage adds up the coverage of several runs. Shards don't count as
+// gaps, since checkCoverage has checked that they add up; problems are the
+// ones found while merging.
+func mergeCoverage(summaries []*Summary, names []string, problems []string) *coverage {
+	c := &coverage{Complete: true, PrefixesDone: []string{}, SizeClasses: newSizeClasses()}
+	done := map[string]bool{}
+	for i, s := range summaries {
+		sc := s.Coverage
+		if sc == nil {
+			c.gap("%v does not say what it covered", names[i])
+			continue
+		}
+		for j, n := range sc.RefSpaceBlobs {
+			c.RefSpaceBlobs[j] += n
+		}
+		for j := range sc.SizeClasses {
+			if j < len(c.SizeClasses) {
+				c.SizeClasses[j].Blobs += sc.SizeClasses[j].Blobs
+				c.SizeClasses[j].Bytes += sc.SizeClasses[j].Bytes
+			}
+		}
+		for _, p := range sc.PrefixesDone {
+			if !done[p] {
+				done[p] = true
+				c.PrefixesDone = append(c.PrefixesDone, p)
+			}
+		}
+		for _, p := range sc.PrefixesPartial {
+			c.PrefixesPartial = append(c.PrefixesPartial, p)
+			c.gap("%v: %v was only partly verified", names[i], p)
+		}
+		for _, p := range sc.PrefixesSkipped {
+			c.PrefixesSkipped = append(c.PrefixesSkipped, p)
+			c.gap("%v: %v was not verified", names[i], p)
+		}
+		if s.Exclude != "" {
+			c.gap("%v: the blobs matching %v were skipped", names[i], s.Exclude)
+		}
+	}
+	for _, p := range problems {
+		c.gap("%v", p)
+	}
+	sort.Strings(c.PrefixesDone)
+	return c
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCheckCoverage(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards []string // one run per shard, "" for a whole-store run
+		want   []string
+	}{
+		{
+			name:   "whole store",
+			shards: []string{""},
+		},
+		{
+			name:   "all shards",
+			shards: []string{"2/3", "1/3", "3/3"},
+		},
+		{
+			name:   "shards of different counts",
+			shards: []string{"1/2", "3/4", "4/4"},
+		},
+		{
+			name: "no runs",
+			want: []string{"no run covered the ref space from 0% to 100%"},
+		},
+		{
+			name:   "missing the last shard",
+			shards: []string{"1/2"},
+			want:   []string{"no run covered the ref space from 50% to 100%"},
+		},
+		{
+			name:   "missing a middle shard",
+			shards: []string{"1/3", "3/3"},
+			want:   []string{"no run covered the ref space from 33.33% to 66.67%"},
+		},
+		{
+			name:   "shard overlapping a whole-store run",
+			shards: []string{"", "2/4"},
+			want:   []string{"run 2 overlaps another run, from 25% to 50% of the ref space"},
+		},
+		{
+			name:   "shard overlapping the end",
+			shards: []string{"1/1", "2/2"},
+			want:   []string{"run 2 overlaps another run, from 50% to 100% of the ref space"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				summaries []*Summary
+				names     []string
+			)
+			for i, s := range tt.shards {
+				sh, err := parseShard(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				summaries = append(summaries, &Summary{Shard: sh})
+				names = append(names, fmt.Sprintf("run %v", i+1))
+			}
+			if got := checkCoverage(summaries, names); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+)
+
+var checkMigration = flag.Bool("check-migration", false, "for a store partway through a hash migration (like from sha1 to sha224), check that every blob with a legacy ref has a copy under its modern ref, in the store or in the --expect manifest, and report how far along the migration is. This makes streamed blobs go through pk-verify's own hashing")
+
+// modernHash is the name of the hash that perkeep uses for new blobs. Blobs
+// with refs of any other hash are legacy.
+var modernHash = blob.RefFromHash(blob.NewHash()).HashName()
+
+// A migrationCheck works out the modern ref of every legacy blob that is
+// read, so that the run can tell at the end which of them have a modern copy.
+//
+// A nil *migrationCheck does nothing.
+type migrationCheck struct {
+	mu     sync.Mutex
+	modern map[blob.Ref]blob.Ref // legacy ref -> modern ref of the same contents
+}
+
+func newMigrationCheck() *migrationCheck {
+	if !*checkMigration {
+		return nil
+	}
+	return &migrationCheck{modern: make(map[blob.Ref]blob.Ref)}
+}
+
+// hasher returns a hash to compute br's modern ref with, or nil if br isn't
+// legacy (or m is nil).
+func (m *migrationCheck) hasher(br blob.Ref) hash.Hash {
+	if m == nil || br.HashName() == modernHash {
+		return nil
+	}
+	return blob.NewHash()
+}
+
+// add records the modern ref of the valid legacy blob br, computed with a
+// hash from hasher.
+func (m *migrationCheck) add(br blob.Ref, h hash.Hash) {
+	if m == nil || h == nil {
+		return
+	}
+	m.mu.Lock()
+	m.modern[br] = blob.RefFromHash(h)
+	m.mu.Unlock()
+}
+
+// migrationCoverage is how far along a hash migration is, as far as the run
+// could tell.
+type migrationCoverage struct {
+	// Legacy is how many blobs with legacy refs the run saw, and
+	// LegacyBytes how big they are.
+	Legacy      int   `json:"legacy"`
+	LegacyBytes int64 `json:"legacyBytes"`
+
+	// Migrated is how many of them have a modern copy in the store, and
+	// Recorded how many more have one listed in the --expect manifest
+	// (say, in another storage that wasn't verified this time).
+	Migrated int `json:"migrated"`
+	Recorded int `json:"recorded"`
+
+	// Unmigrated lists the legacy blobs that have no modern copy.
+	Unmigrated      []blob.Ref `json:"unmigrated"`
+	UnmigratedBytes int64      `json:"unmigratedBytes"`
+
+	// Unread is how many legacy blobs weren't read (because they were
+	// invalid, skipped by --verify-cache, or too big to read whole), so
+	// their modern refs are unknown.
+	Unread int `json:"unread,omitempty"`
+
+	// SafeToDrop is set when every legacy blob has a modern copy, and
+	// the run covered the whole store, so there are no others.
+	SafeToDrop bool `json:"safeToDrop"`
+}
+
+// result works out the migration coverage of the run described by s, which
+// must have finished. expected is the --expect manifest, or nil.
+func (m *migrationCheck) result(s *Summary, expected []blob.SizedRef) *migrationCoverage {
+	if m == nil {
+		return nil
+	}
+	// Only a modern copy that verified counts: a corrupt one, or one that
+	// only verified some of the time, is no reason to drop the original.
+	bad := make(map[blob.Ref]bool, len(s.InvalidRefs))
+	for _, br := range s.InvalidRefs {
+		bad[br] = true
+	}
+	for _, ps := range s.Prefixes {
+		for _, br := range ps.TransientRefs {
+			bad[br] = true
+		}
+	}
+	present := make(map[blob.Ref]bool, len(s.seen))
+	for _, sr := range s.seen {
+		if !bad[sr.Ref] {
+			present[sr.Ref] = true
+		}
+	}
+	recorded := make(map[blob.Ref]bool, len(expected))
+	for _, sr := range expected {
+		recorded[sr.Ref] = true
+	}
+	c := &migrationCoverage{Unmigrated: []blob.Ref{}}
+	for _, sr := range s.seen {
+		if sr.Ref.HashName() == modernHash {
+			continue
+		}
+		c.Legacy++
+		c.LegacyBytes += int64(sr.Size)
+		modern, ok := m.modern[sr.Ref]
+		switch {
+		case !ok:
+			c.Unread++
+		case present[modern]:
+			c.Migrated++
+		case recorded[modern]:
+			c.Recorded++
+		default:
+			c.Unmigrated = append(c.Unmigrated, sr.Ref)
+			c.UnmigratedBytes += int64(sr.Size)
+		}
+	}
+	sort.Slice(c.Unmigrated, func(i, j int) bool { return c.Unmigrated[i].Less(c.Unmigrated[j]) })
+	c.SafeToDrop = len(c.Unmigrated) == 0 && c.Unread == 0 && s.Coverage.Complete
+	return c
+}
+
+// report prints the migration coverage, and lists the legacy blobs without
+// a modern copy.
+func (c *migrationCoverage) report(m *migrationCheck, found *findings) {
+	if c == nil {
+		return
+	}
+	if c.Legacy == 0 {
+		fmt.Printf("hash migration: found no blobs with refs other than %v\n", modernHash)
+		return
+	}
+	for _, br := range c.Unmigrated {
+		found.report("no %v copy of %v (it would be %v)", modernHash, br, m.modern[br])
+	}
+	copied := c.Migrated + c.Recorded
+	fmt.Printf("hash migration: %v of %v legacy blob%v (%v) have a %v copy (%.1f%%)", humanCount(copied), humanCount(c.Legacy), plural(c.Legacy), humanBytes(c.LegacyBytes), modernHash, 100*float64(copied)/float64(c.Legacy))
+	if c.Recorded > 0 {
+		fmt.Printf(", %v of them only listed in --expect", humanCount(c.Recorded))
+	}
+	fmt.Println()
+	if n := len(c.Unmigrated); n > 0 {
+		fmt.Printf("%v legacy blob%v (%v) %v no %v copy yet, listed %v\n", humanCount(n), plural(n), humanBytes(c.UnmigratedBytes), hasHave(n), modernHash, found.where())
+	}
+	if c.Unread > 0 {
+		fmt.Printf("%v legacy blob%v %v not read, so whether %v %v been copied is unknown\n", humanCount(c.Unread), plural(c.Unread), wasWere(c.Unread), itThey(c.Unread), hasHave(c.Unread))
+	}
+	if c.SafeToDrop {
+		fmt.Printf("every legacy blob has a %v copy, so the legacy blobs can be dropped\n", modernHash)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+)
+
+// Blob directories on network and FUSE mounts (NFS, SMB, sshfs, pk-mount,
+// ...) routinely fail reads that would succeed a moment later, which would
+// otherwise look like corruption. When a target is on one, pk-verify reads
+// it more gently: fewer workers (the "network" profile, picked by
+// detectProfile), a re-read of every blob that fails (as with --paranoid),
+// and retries of failed reads (not just timed-out ones), each unless the
+// corresponding flag was given. With --remote-fs, every local storage counts
+// as being on that kind of mount, with the workers, timeouts, and retries
+// tuned for it; see remoteFSTunings. Only the targets on such mounts are
+// read this way; the others, in the same run, are read as usual.
+
+// networkMounts returns the local storages under prefixes whose directories
+// are on network or FUSE mounts, mapped to the kind of mount.
+func networkMounts(conf *LowLevelConfig, prefixes []string) map[string]string {
+	mounts := map[string]string{}
+	for _, leaf := range conf.leafPrefixes(prefixes) {
+		if kind := conf.mountKind(leaf); kind != "" {
+			mounts[leaf] = kind
+		}
+	}
+	return mounts
+}
+
+// mountKind returns the kind of network or FUSE mount that the directory of
+// the local storage at prefix is on, or "" if it isn't on one (or isn't a
+// local storage).
+func (conf *LowLevelConfig) mountKind(prefix string) string {
+	sc := conf.Prefixes[prefix]
+	root, _ := sc.StorageHandlerArgs["path"].(string)
+	if !snapshotHandlers[sc.StorageHandler] || root == "" {
+		return ""
+	}
+	if *remoteFS != "" {
+		return *remoteFS
+	}
+	return networkFSType(root)
+}
+
+// adjustForNetworkMounts warns about the targets that are on network mounts.
+// How the blobs of those targets are read is adjusted by adjustForMount.
+func adjustForNetworkMounts(conf *LowLevelConfig, prefixes []string) {
+	mounts := networkMounts(conf, prefixes)
+	if len(mounts) == 0 {
+		return
+	}
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		if kind, ok := mounts[prefix]; ok {
+			stderrf("pk-verify: WARNING: %v (%v) is on a %v mount, where reads can fail transiently; failed reads will be retried and re-read before a blob is called corrupt\n", prefix, conf.describe(prefix), kind)
+		}
+	}
+}
+
+// adjustForMount makes v, the verifier of the target at prefix, read gently
+// if the target is on a network mount, as far as the flags allow: it re-reads
+// the blobs that fail (as with --paranoid), and retries reads that fail with
+// an I/O error, not just ones that time out. On a --remote-fs mount, it also
+// uses the timeouts and retries tuned for it; if the target spans several
+// such mounts, the most patient of each.
+func (v *verifier) adjustForMount(conf *LowLevelConfig, prefix string) {
+	mounts := networkMounts(conf, []string{prefix})
+	if len(mounts) == 0 {
+		return
+	}
+	for _, kind := range mounts {
+		lim := remoteFSLimits(kind)
+		switch {
+		case lim == nil:
+		case v.tuned == nil:
+			v.tuned = lim
+		default:
+			if lim.retries > v.tuned.retries {
+				v.tuned.retries = lim.retries
+			}
+			if lim.fetchTimeout > v.tuned.fetchTimeout {
+				v.tuned.fetchTimeout = lim.fetchTimeout
+			}
+			if lim.streamTimeout > v.tuned.streamTimeout {
+				v.tuned.streamTimeout = lim.streamTimeout
+			}
+		}
+	}
+	if !flagWasSet("paranoid") {
+		v.paranoid = true
+	}
+	if !flagWasSet("retries") {
+		v.retryReadErrors = true
+	}
+}
+
+// isReadError reports whether err is a failure to read a blob, as opposed
+// to the blob's contents being wrong or the blob not being there.
+func isReadError(err error) bool {
+	return err != nil && !pkverify.IsFailure(err) && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,40 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// networkFSTypes maps the names of network filesystems, from statfs(2), to
+// how pk-verify refers to them. FUSE filesystems go by various names, all
+// containing "fuse".
+var networkFSTypes = map[string]string{
+	"nfs":    "NFS",
+	"smbfs":  "SMB",
+	"cifs":   "CIFS",
+	"afpfs":  "AFP",
+	"webdav": "WebDAV",
+}
+
+// networkFSType returns the kind of network or FUSE filesystem that dir is
+// on, or "" if it's a local one.
+func networkFSType(dir string) string {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return ""
+	}
+	var name strings.Builder
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name.WriteByte(byte(c))
+	}
+	if strings.Contains(name.String(), "fuse") {
+		return "FUSE"
+	}
+	return networkFSTypes[name.String()]
+}
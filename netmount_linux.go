@@ -0,0 +1,27 @@
+package main
+
+import "syscall"
+
+// networkFSTypes maps the filesystem magic numbers of network and FUSE
+// filesystems, from statfs(2), to their names.
+var networkFSTypes = map[uint32]string{
+	0x6969:     "NFS",
+	0x517b:     "SMB",
+	0xff534d42: "CIFS",
+	0xfe534d42: "SMB2",
+	0x65735546: "FUSE",
+	0x00c36400: "Ceph",
+	0x01021997: "9P",
+	0x5346414f: "AFS",
+	0x0bd00bd0: "Lustre",
+}
+
+// networkFSType returns the kind of network or FUSE filesystem that dir is
+// on, or "" if it's a local one.
+func networkFSType(dir string) string {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return ""
+	}
+	return networkFSTypes[uint32(st.Type)]
+}
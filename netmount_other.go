@@ -0,0 +1,10 @@
+//go:build !darwin && !freebsd && !linux && !windows
+// +build !darwin,!freebsd,!linux,!windows
+
+package main
+
+// networkFSType returns the kind of network or FUSE filesystem that dir is
+// on. It's only supported on some systems, and elsewhere returns "".
+func networkFSType(dir string) string {
+	return ""
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDriveType = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW")
+
+// driveRemote is what GetDriveTypeW returns for a network drive.
+const driveRemote = 4
+
+// networkFSType returns "SMB" if dir is on a network share, either by UNC
+// path (\\server\share\...) or on a mapped network drive, and "" otherwise.
+// Windows doesn't say what protocol a share speaks, but it's nearly always
+// SMB.
+func networkFSType(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	vol := filepath.VolumeName(abs)
+	if strings.HasPrefix(vol, `\\`) {
+		return "SMB"
+	}
+	if vol == "" {
+		return ""
+	}
+	p, err := syscall.UTF16PtrFromString(vol + `\`)
+	if err != nil {
+		return ""
+	}
+	if r, _, _ := procGetDriveType.Call(uintptr(unsafe.Pointer(p))); r == driveRemote {
+		return "SMB"
+	}
+	return ""
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"go4.org/jsonconfig"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var checkPacking = flag.Bool("check-packing", false, "for blobpacked storages, check the bookkeeping between the loose blobs, the packed zips, and the meta index: that no blob is both loose and packed, that no loose blob is over the size at which it would have been packed, that every zip holds exactly the blobs the meta index maps to it, and that every zip the meta index points at exists")
+
+// The layout of a blobpacked storage, as far as checkPacking is concerned:
+//
+// Blobs start out loose, in smallBlobs. Once blobpacked has all of the
+// chunks of a file, it packs them (and the file's schema blobs) into a zip in
+// largeBlobs, records each packed blob in the meta index as
+//
+//	b:<blob ref> -> <size> <zip ref> <offset in zip>
+//
+// and deletes the loose copies. Each zip describes its own contents in a
+// manifest member; schema blobs are also stored as members of their own.
+//
+// Only files of at least packThreshold bytes are packed; smaller ones, and
+// blobs that aren't part of a file, stay loose. So a loose blob that is
+// itself that big is a chunk of a file that should have been packed, and a
+// blob that is both loose and packed is one whose loose copy should have
+// been deleted.
+const (
+	packThreshold    = 512 << 10
+	packMetaPrefix   = "b:"
+	packManifestName = "camlistore/camlistore-pack-manifest.json"
+	packMemberDir    = "camlistore/"
+	packMemberSuffix = ".json"
+	maxPackedZipSize = 32 << 20
+)
+
+// packManifest is the part of a blobpacked zip manifest that checkPacking
+// needs.
+type packManifest struct {
+	DataBlobs []struct {
+		Ref  blob.Ref `json:"blobRef"`
+		Size uint32   `json:"size"`
+	} `json:"dataBlobs"`
+}
+
+// checkBlobpacked checks the bookkeeping of every blobpacked storage in the
+// config, and returns the problems it found.
+//
+// It runs before anything else loads the blobpacked storages themselves,
+// because they lock their meta index while they're open, and then it would
+// have to be copied (see openSortedReadOnly).
+func checkBlobpacked(ctx context.Context, ld *Loader) ([]string, error) {
+	var problems []string
+	for _, prefix := range sortedConfigPrefixes(ld.conf) {
+		sc := ld.conf.Prefixes[prefix]
+		if sc.StorageHandler != "blobpacked" {
+			continue
+		}
+		fmt.Printf("%v: checking blobpacked bookkeeping\n", prefix)
+		p, err := checkPacked(ctx, ld, sc.StorageHandlerArgs)
+		if err != nil {
+			return nil, fmt.Errorf("in %v: %w", prefix, err)
+		}
+		for _, msg := range p {
+			problems = append(problems, fmt.Sprintf("%v: %v", prefix, msg))
+		}
+	}
+	return problems, nil
+}
+
+// checkPacked checks one blobpacked storage, given its handler arguments.
+func checkPacked(ctx context.Context, ld *Loader, args jsonconfig.Obj) ([]string, error) {
+	small, _ := args["smallBlobs"].(string)
+	large, _ := args["largeBlobs"].(string)
+	metaConf, _ := args["metaIndex"].(map[string]interface{})
+	if small == "" || large == "" || metaConf == nil {
+		return nil, fmt.Errorf("blobpacked needs \"smallBlobs\", \"largeBlobs\", and \"metaIndex\" arguments")
+	}
+	smallSto, err := ld.GetStorage(small)
+	if err != nil {
+		return nil, err
+	}
+	largeSto, err := ld.GetStorage(large)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the meta index into memory, and close it right away so that
+	// the blobpacked storage can open it later.
+	meta, err := openSortedReadOnly(jsonconfig.Obj(metaConf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the meta index: %w", err)
+	}
+	packed := make(map[blob.Ref]blob.Ref) // blob -> zip
+	var problems []string
+	it := meta.Find(packMetaPrefix, "b;")
+	for it.Next() {
+		br, ok := blob.Parse(strings.TrimPrefix(it.Key(), packMetaPrefix))
+		fields := strings.Fields(it.Value())
+		var zipRef blob.Ref
+		if len(fields) == 3 {
+			zipRef, _ = blob.Parse(fields[1])
+		}
+		if !ok || !zipRef.Valid() {
+			problems = append(problems, fmt.Sprintf("malformed meta index row %q -> %q", it.Key(), it.Value()))
+			continue
+		}
+		packed[br] = zipRef
+	}
+	err = it.Close()
+	if cerr := meta.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the meta index: %w", err)
+	}
+
+	// Loose blobs that are also packed, or that should have been.
+	err = blobserver.EnumerateAll(ctx, smallSto, func(sb blob.SizedRef) error {
+		switch zipRef, ok := packed[sb.Ref]; {
+		case ok:
+			problems = append(problems, fmt.Sprintf("blob %v is loose in %v, but also packed in zip %v", sb.Ref, small, zipRef))
+		case sb.Size >= packThreshold:
+			problems = append(problems, fmt.Sprintf("blob %v is loose in %v, but at %v it is over the %v packing threshold, so its file should have been packed", sb.Ref, small, humanBytes(int64(sb.Size)), humanBytes(packThreshold)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the loose blobs in %v: %w", small, err)
+	}
+
+	// Zips that hold blobs the meta index doesn't map to them.
+	zips := make(map[blob.Ref]bool)
+	err = blobserver.EnumerateAll(ctx, largeSto, func(sb blob.SizedRef) error {
+		zips[sb.Ref] = true
+		members, err := packedMembers(ctx, largeSto, sb.Ref)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("zip %v: %v", sb.Ref, err))
+			return nil
+		}
+		for _, br := range members {
+			switch zipRef, ok := packed[br]; {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("zip %v holds blob %v, but the meta index doesn't know it is packed", sb.Ref, br))
+			case zipRef != sb.Ref:
+				problems = append(problems, fmt.Sprintf("zip %v holds blob %v, but the meta index maps it to zip %v", sb.Ref, br, zipRef))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the zips in %v: %w", large, err)
+	}
+
+	// Zips that the meta index points at but that don't exist. The blobs
+	// in them can't be read at all, so this is the serious one.
+	lost := make(map[blob.Ref]int)
+	for _, zipRef := range packed {
+		if !zips[zipRef] {
+			lost[zipRef]++
+		}
+	}
+	var lostZips []blob.Ref
+	for zipRef := range lost {
+		lostZips = append(lostZips, zipRef)
+	}
+	sort.Slice(lostZips, func(i, j int) bool { return lostZips[i].Less(lostZips[j]) })
+	for _, zipRef := range lostZips {
+		n := lost[zipRef]
+		problems = append(problems, fmt.Sprintf("the meta index maps %v blob%v to zip %v, which is not in %v, so %v %v unreadable", n, plural(n), zipRef, large, itThey(n), isAre(n)))
+	}
+	return problems, nil
+}
+
+// packedMembers returns the refs of the blobs packed in the zip zipRef.
+func packedMembers(ctx context.Context, f blob.Fetcher, zipRef blob.Ref) ([]blob.Ref, error) {
+	rc, size, err := f.Fetch(ctx, zipRef)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if size > maxPackedZipSize {
+		return nil, fmt.Errorf("too big (%v) to be a blobpacked zip", humanBytes(int64(size)))
+	}
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a valid zip: %v", err)
+	}
+	var members []blob.Ref
+	var manifest *packManifest
+	for _, zf := range zr.File {
+		if zf.Name == packManifestName {
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, err
+			}
+			manifest = new(packManifest)
+			err = json.NewDecoder(rc).Decode(manifest)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("bad manifest: %v", err)
+			}
+			continue
+		}
+		if dir, name := path.Split(zf.Name); dir == packMemberDir && strings.HasSuffix(name, packMemberSuffix) {
+			if br, ok := blob.Parse(strings.TrimSuffix(name, packMemberSuffix)); ok {
+				members = append(members, br)
+			}
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("no %v member", packManifestName)
+	}
+	for _, db := range manifest.DataBlobs {
+		members = append(members, db.Ref)
+	}
+	return members, nil
+}
+
+// sortedConfigPrefixes returns the storage prefixes in conf, sorted.
+func sortedConfigPrefixes(conf *LowLevelConfig) []string {
+	var prefixes []string
+	for prefix := range conf.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	allFlag          = flag.Bool("all", false, "verify every storage behind /bs/ separately (each replica, both tiers of a blobpacked storage, both sides of a proxycache, and so on), instead of reading through /bs/")
+	parallelPrefixes = flag.Int("parallel-prefixes", 1, "when verifying more than one storage prefix (see --all, --tier, and --proxycache), verify this many at once; 0 means all of them. Worth it when they don't share a bottleneck, like two different disks")
+	maxReadRate      = flag.String("max-read-rate", "", "read at most this many bytes per second in total (e.g. \"100MB/s\"), across all of the storage prefixes being verified; by default there is no limit")
+)
+
+// forEachTarget calls verify for each of the n targets, --parallel-prefixes
+// at a time, and returns the first error by target order. When they run one
+// at a time, it stops at the first error, like a plain loop would; when they
+// run at once, the others are independent, so they carry on.
+func forEachTarget(n int, verify func(i int) error) error {
+	at := *parallelPrefixes
+	if at <= 0 || at > n {
+		at = n
+	}
+	if at <= 1 {
+		for i := 0; i < n; i++ {
+			if err := verify(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	errs := make([]error, n)
+	sem := make(chan struct{}, at)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = verify(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A byteLimiter holds the total read rate down to --max-read-rate, shared
+// by every verifier. It's applied after each blob is read, rather than
+// before, since the size of a blob isn't always known until then; the
+// verifiers' workers then block behind the late ones, which evens out over
+// more than a few blobs.
+//
+// The rate can be changed while running (see --control-socket). A nil
+// *byteLimiter never waits, and neither does one with a rate of 0.
+type byteLimiter struct {
+	mu   sync.Mutex
+	rate float64   // bytes per second
+	next time.Time // when the bytes reserved so far will have been "spent"
+}
+
+func newByteLimiter() (*byteLimiter, error) {
+	l := &byteLimiter{}
+	if *maxReadRate == "" {
+		return l, nil
+	}
+	rate, err := parseRate(*maxReadRate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --max-read-rate: %v", err)
+	}
+	l.rate = rate
+	return l, nil
+}
+
+// setRate changes the rate; 0 means no limit.
+func (l *byteLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.next = time.Time{}
+	l.mu.Unlock()
+}
+
+// currentRate returns the rate, or 0 if there is no limit.
+func (l *byteLimiter) currentRate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// wait blocks until n more bytes fit under the rate.
+func (l *byteLimiter) wait(ctx context.Context, n uint32) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// A progressGroup shows the progress of several prefixes being verified at
+// once. On a terminal, they share one status line, with a part for each
+// prefix still being verified; elsewhere, each one logs its own lines,
+// labeled with its prefix.
+type progressGroup struct {
+	mu      sync.Mutex
+	members []*progress
+}
+
+// add starts tracking the progress of verifying prefix.
+func (g *progressGroup) add(prefix string) *progress {
+	p := newProgress()
+	p.label = prefix
+	p.group = g
+	g.mu.Lock()
+	g.members = append(g.members, p)
+	g.mu.Unlock()
+	return p
+}
+
+// render rewrites the shared status line.
+func (g *progressGroup) render() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var parts []string
+	for _, p := range g.members {
+		select {
+		case <-p.done:
+			continue
+		default:
+		}
+		p.mu.Lock()
+		parts = append(parts, fmt.Sprintf("%v %v ok, %v bad (%v/s)", p.label, humanCount(p.valid), humanCount(p.invalid), humanBytes(int64(p.rate))))
+		p.mu.Unlock()
+	}
+	fmt.Printf("\r\x1b[K %v\r", strings.Join(parts, " | "))
+}
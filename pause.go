@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// A pauseGate lets a run be paused partway, to give the disks back to
+// something else for a while, and resumed later, without losing its place.
+//
+// Pausing doesn't interrupt anything: the blobs being read are finished,
+// and then each worker waits at the gate before starting on another. The
+// streams and enumerations feeding the workers back up and wait too. (The
+// --stream-timeout doesn't count time spent waiting for the workers, so a
+// paused stream isn't restarted.)
+type pauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed on resume; nil while running
+	since   time.Time     // when the pause began
+}
+
+// runPause is the gate that every verifier waits at.
+var runPause pauseGate
+
+// pause pauses the run, if it isn't already, and reports whether it did.
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	g.since = time.Now()
+	return true
+}
+
+// resume resumes the run, if it is paused, and returns how long it was.
+func (g *pauseGate) resume() (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		return 0, false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	return time.Since(g.since), true
+}
+
+// paused reports whether the run is paused, and since when.
+func (g *pauseGate) paused() (bool, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil, g.since
+}
+
+// wait blocks while the run is paused.
+func (g *pauseGate) wait(ctx context.Context) {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	}
+}
+
+// togglePause pauses the run if it is running, and resumes it if it is
+// paused, and says which.
+func togglePause() {
+	if runPause.pause() {
+		stderrln("pk-verify: pausing once the blobs being read now are done; send SIGUSR2 again to resume")
+		return
+	}
+	if d, ok := runPause.resume(); ok {
+		stderrf("pk-verify: resuming after a pause of %v\n", humanDuration(d))
+	}
+}
+
+// watchPauseSignal pauses and resumes the run each time the process gets
+// SIGUSR2 (where there is one).
+func watchPauseSignal() {
+	if len(pauseSignals) == 0 {
+		return
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, pauseSignals...)
+	go func() {
+		for range sigc {
+			togglePause()
+		}
+	}()
+}
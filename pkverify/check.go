@@ -0,0 +1,207 @@
+package pkverify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// A Check is one thing to check about the blobs in a store. Checks have two
+// phases: each blob is checked as it is read (see Blob), and then, once all
+// of them have been, the store as a whole (see Store), for checks that need
+// to see every blob first.
+type Check interface {
+	// Name identifies the check, like "hash".
+	Name() string
+
+	// Blob starts checking the blob br, which its storage says is size
+	// bytes. The blob's contents are written to the returned BlobCheck,
+	// which then reports the result. Blob may be called concurrently.
+	Blob(br blob.Ref, size uint32) BlobCheck
+
+	// Store is called once after every blob has been checked, and
+	// returns the problems found with the store as a whole.
+	Store(ctx context.Context) []string
+}
+
+// A BlobCheck checks the contents of one blob, which are written to it.
+type BlobCheck interface {
+	io.Writer
+
+	// Result returns nil if the contents written so far pass the check,
+	// or else an error describing the problem.
+	Result() error
+}
+
+// Hash is the basic check: that a blob's contents hash to its ref. It fails
+// with blobserver.ErrCorruptBlob.
+var Hash Check = hashCheck{}
+
+type hashCheck struct{}
+
+func (hashCheck) Name() string                       { return "hash" }
+func (hashCheck) Store(ctx context.Context) []string { return nil }
+
+func (hashCheck) Blob(br blob.Ref, size uint32) BlobCheck {
+	return &hashBlobCheck{br: br, h: br.Hash()}
+}
+
+type hashBlobCheck struct {
+	br blob.Ref
+	h  hash.Hash // nil if br's hash function isn't supported
+}
+
+func (c *hashBlobCheck) Write(p []byte) (int, error) {
+	if c.h == nil {
+		return len(p), nil
+	}
+	return c.h.Write(p)
+}
+
+func (c *hashBlobCheck) Result() error {
+	if c.h == nil {
+		return fmt.Errorf("unsupported hash function in blob ref %v", c.br)
+	}
+	if !c.br.HashMatches(c.h) {
+		return blobserver.ErrCorruptBlob
+	}
+	return nil
+}
+
+// MaxBlobSize is the biggest blob Perkeep stores.
+const MaxBlobSize = 16 << 20
+
+// sizeCheck checks that each blob is as big as its storage says it is, and
+// no bigger than Perkeep allows.
+type sizeCheck struct{}
+
+func (sizeCheck) Name() string                       { return "size" }
+func (sizeCheck) Store(ctx context.Context) []string { return nil }
+
+func (sizeCheck) Blob(br blob.Ref, size uint32) BlobCheck {
+	return &sizeBlobCheck{size: size}
+}
+
+type sizeBlobCheck struct {
+	size uint32
+	read int64
+}
+
+func (c *sizeBlobCheck) Write(p []byte) (int, error) {
+	c.read += int64(len(p))
+	return len(p), nil
+}
+
+func (c *sizeBlobCheck) Result() error {
+	switch {
+	case c.read != int64(c.size):
+		return fmt.Errorf("the storage says the blob is %v bytes, but %v were read", c.size, c.read)
+	case c.read > MaxBlobSize:
+		return fmt.Errorf("the blob is %v bytes, more than Perkeep's limit of %v", c.read, MaxBlobSize)
+	}
+	return nil
+}
+
+// A CheckError is a blob failing a check other than Hash. (A blob failing
+// the Hash check is blobserver.ErrCorruptBlob, as elsewhere in Perkeep.)
+type CheckError struct {
+	Check string // the check's name
+	Err   error
+}
+
+func (e *CheckError) Error() string { return fmt.Sprintf("failed the %v check: %v", e.Check, e.Err) }
+func (e *CheckError) Unwrap() error { return e.Err }
+
+// IsFailure reports whether err, from a BlobCheck that Combine returned, is
+// the blob failing a check, as opposed to a failure to read it.
+func IsFailure(err error) bool {
+	var ce *CheckError
+	return err == blobserver.ErrCorruptBlob || errors.As(err, &ce)
+}
+
+// Combine returns a BlobCheck that runs the checks on the blob br together.
+// Its result is the first failure, in the order of checks.
+func Combine(br blob.Ref, size uint32, checks []Check) BlobCheck {
+	c := &combined{}
+	var ws []io.Writer
+	for _, check := range checks {
+		bc := check.Blob(br, size)
+		c.names = append(c.names, check.Name())
+		c.checks = append(c.checks, bc)
+		ws = append(ws, bc)
+	}
+	c.w = io.MultiWriter(ws...)
+	return c
+}
+
+type combined struct {
+	w      io.Writer
+	names  []string
+	checks []BlobCheck
+}
+
+func (c *combined) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (c *combined) Result() error {
+	for i, bc := range c.checks {
+		err := bc.Result()
+		switch {
+		case err == nil:
+		case err == blobserver.ErrCorruptBlob:
+			return err
+		default:
+			return &CheckError{Check: c.names[i], Err: err}
+		}
+	}
+	return nil
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]func() Check{
+		"hash": func() Check { return Hash },
+		"size": func() Check { return sizeCheck{} },
+	}
+)
+
+// Register makes a check available by name, to NewCheck (and so to
+// pk-verify's --checks flag). newCheck is called for each verification that
+// uses the check, so that checks with a Store phase start afresh.
+func Register(name string, newCheck func() Check) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic("pkverify: Register called twice for check " + name)
+	}
+	registry[name] = newCheck
+}
+
+// NewCheck returns a new instance of the check registered as name.
+func NewCheck(name string) (Check, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	newCheck, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown check %q", name)
+	}
+	return newCheck(), nil
+}
+
+// CheckNames returns the names of the registered checks, sorted.
+func CheckNames() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
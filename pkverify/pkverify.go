@@ -0,0 +1,190 @@
+// Package pkverify checks that the blobs in a Perkeep blob storage are
+// intact: that the contents of each one hash to its ref.
+//
+// It is the basic check of the pk-verify command, without any of the parts
+// that need a Perkeep server config. That makes it usable against storages
+// created in process, like the in-memory storage that tests of blob
+// pipelines tend to use:
+//
+//	sto := memory.NewStorage()
+//	// ... run the code under test, which writes to sto ...
+//	res, err := pkverify.Storage(ctx, sto, nil)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	if !res.OK() {
+//		t.Errorf("corrupt blobs: %v; missing blobs: %v", res.InvalidRefs, res.Missing)
+//	}
+package pkverify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"go4.org/syncutil"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// Options tune a verification. A nil *Options means the defaults.
+type Options struct {
+	// Workers is how many blobs to read and verify at once. The default
+	// is 4.
+	Workers int
+
+	// Checks are the checks to run. The default is just Hash. Failures
+	// of any of them count the blob as invalid, and the problems their
+	// Store phases find are in Result.Problems.
+	Checks []Check
+}
+
+func (o *Options) checks() []Check {
+	if o == nil || len(o.Checks) == 0 {
+		return []Check{Hash}
+	}
+	return o.Checks
+}
+
+func (o *Options) workers() int {
+	if o == nil || o.Workers <= 0 {
+		return 4
+	}
+	return o.Workers
+}
+
+// Result is the outcome of a verification.
+type Result struct {
+	Valid   int
+	Invalid int
+	Bytes   int64 // in all of the blobs read
+
+	// InvalidRefs lists the blobs whose contents don't match their refs,
+	// and Missing the blobs that were asked for (or enumerated) but
+	// could not be found. Both are sorted.
+	InvalidRefs []blob.Ref
+	Missing     []blob.Ref
+
+	// Problems are the problems that the checks found with the store as
+	// a whole.
+	Problems []string
+}
+
+// OK reports whether every blob was found and valid, and the store had no
+// problems.
+func (r *Result) OK() bool {
+	return r.Invalid == 0 && len(r.Missing) == 0 && len(r.Problems) == 0
+}
+
+// Storage verifies every blob in sto.
+func Storage(ctx context.Context, sto blobserver.Storage, opts *Options) (*Result, error) {
+	refs := make(chan blob.Ref)
+	var enum syncutil.Group
+	enum.Go(func() error {
+		defer close(refs)
+		return blobserver.EnumerateAll(ctx, sto, func(sb blob.SizedRef) error {
+			select {
+			case refs <- sb.Ref:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	})
+	res, err := verifyAll(ctx, sto, refs, opts)
+	if eerr := enum.Err(); eerr != nil {
+		return res, fmt.Errorf("failed to enumerate blobs: %w", eerr)
+	}
+	return res, err
+}
+
+// Refs verifies the blobs refs, read from f.
+func Refs(ctx context.Context, f blob.Fetcher, refs []blob.Ref, opts *Options) (*Result, error) {
+	ch := make(chan blob.Ref)
+	go func() {
+		defer close(ch)
+		for _, br := range refs {
+			select {
+			case ch <- br:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return verifyAll(ctx, f, ch, opts)
+}
+
+// Blob verifies the blob br, read from f, with the Hash check. It returns
+// blobserver.ErrCorruptBlob if the contents don't match br, and
+// os.ErrNotExist if f doesn't have it.
+func Blob(ctx context.Context, f blob.Fetcher, br blob.Ref) (size uint32, err error) {
+	return blobChecks(ctx, f, br, []Check{Hash})
+}
+
+// blobChecks runs checks on the blob br, read from f.
+func blobChecks(ctx context.Context, f blob.Fetcher, br blob.Ref, checks []Check) (size uint32, err error) {
+	rc, size, err := f.Fetch(ctx, br)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	bc := Combine(br, size, checks)
+	if _, err := io.Copy(bc, rc); err != nil {
+		return size, err
+	}
+	return size, bc.Result()
+}
+
+// verifyAll verifies the blobs from refs, read from f, with opts.workers()
+// at once. If reading a blob fails (other than because it's missing), it
+// returns the first such error, after verifying the rest.
+func verifyAll(ctx context.Context, f blob.Fetcher, refs <-chan blob.Ref, opts *Options) (*Result, error) {
+	var (
+		res     = &Result{InvalidRefs: []blob.Ref{}}
+		mu      sync.Mutex
+		readErr error
+		wg      sync.WaitGroup
+	)
+	checks := opts.checks()
+	for i := 0; i < opts.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for br := range refs {
+				size, err := blobChecks(ctx, f, br, checks)
+				mu.Lock()
+				switch {
+				case err == nil:
+					res.Valid++
+					res.Bytes += int64(size)
+				case err == os.ErrNotExist:
+					res.Missing = append(res.Missing, br)
+				case IsFailure(err):
+					res.Invalid++
+					res.Bytes += int64(size)
+					res.InvalidRefs = append(res.InvalidRefs, br)
+				case readErr == nil:
+					readErr = fmt.Errorf("failed to read %v: %w", br, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, c := range checks {
+		for _, p := range c.Store(ctx) {
+			res.Problems = append(res.Problems, fmt.Sprintf("%v: %v", c.Name(), p))
+		}
+	}
+	for _, refs := range [][]blob.Ref{res.InvalidRefs, res.Missing} {
+		sort.Slice(refs, func(i, j int) bool { return refs[i].Less(refs[j]) })
+	}
+	if readErr != nil {
+		return res, readErr
+	}
+	return res, ctx.Err()
+}
@@ -0,0 +1,145 @@
+package pkverify
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/blobserver/memory"
+)
+
+// corrupting is a memory storage that serves the wrong contents, of the
+// right size, for the blobs in bad.
+type corrupting struct {
+	*memory.Storage
+	bad map[blob.Ref]bool
+}
+
+func (s corrupting) Fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	rc, size, err := s.Storage.Fetch(ctx, br)
+	if err != nil || !s.bad[br] {
+		return rc, size, err
+	}
+	rc.Close()
+	return ioutil.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), int(size)))), size, nil
+}
+
+func refs(contents ...string) []blob.Ref {
+	var brs []blob.Ref
+	for _, c := range contents {
+		brs = append(brs, blob.RefFromString(c))
+	}
+	sort.Slice(brs, func(i, j int) bool { return brs[i].Less(brs[j]) })
+	return brs
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  []string // contents of the blobs in the storage
+		corrupt []string // the stored blobs to serve wrong contents for
+		verify  []string // the blobs to verify with Refs; nil means Storage
+		want    Result
+	}{
+		{
+			name:   "empty",
+			stored: nil,
+			want:   Result{InvalidRefs: []blob.Ref{}},
+		},
+		{
+			name:   "valid",
+			stored: []string{"foo", "quux"},
+			want:   Result{Valid: 2, Bytes: 7, InvalidRefs: []blob.Ref{}},
+		},
+		{
+			name:    "corrupt",
+			stored:  []string{"foo", "quux", "hello"},
+			corrupt: []string{"quux", "hello"},
+			want:    Result{Valid: 1, Invalid: 2, Bytes: 12, InvalidRefs: refs("quux", "hello")},
+		},
+		{
+			name:   "missing",
+			stored: []string{"foo"},
+			verify: []string{"foo", "bar", "baz"},
+			want:   Result{Valid: 1, Bytes: 3, InvalidRefs: []blob.Ref{}, Missing: refs("bar", "baz")},
+		},
+		{
+			name:    "all three",
+			stored:  []string{"foo", "quux"},
+			corrupt: []string{"quux"},
+			verify:  []string{"foo", "quux", "bar"},
+			want:    Result{Valid: 1, Invalid: 1, Bytes: 7, InvalidRefs: refs("quux"), Missing: refs("bar")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			sto := corrupting{memory.NewStorage(), map[blob.Ref]bool{}}
+			for _, c := range tt.stored {
+				if _, err := blobserver.Receive(ctx, sto, blob.RefFromString(c), strings.NewReader(c)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, br := range refs(tt.corrupt...) {
+				sto.bad[br] = true
+			}
+			var (
+				res *Result
+				err error
+			)
+			if tt.verify == nil {
+				res, err = Storage(ctx, sto, nil)
+			} else {
+				res, err = Refs(ctx, sto, refs(tt.verify...), &Options{Workers: 2})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*res, tt.want) {
+				t.Errorf("got %+v, want %+v", *res, tt.want)
+			}
+			if ok := tt.want.Invalid == 0 && len(tt.want.Missing) == 0; res.OK() != ok {
+				t.Errorf("OK() = %v, want %v", res.OK(), ok)
+			}
+		})
+	}
+}
+
+func TestBlob(t *testing.T) {
+	ctx := context.Background()
+	sto := corrupting{memory.NewStorage(), map[blob.Ref]bool{}}
+	for _, c := range []string{"foo", "quux"} {
+		if _, err := blobserver.Receive(ctx, sto, blob.RefFromString(c), strings.NewReader(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sto.bad[blob.RefFromString("quux")] = true
+
+	tests := []struct {
+		contents string
+		size     uint32
+		err      error
+		failure  bool // IsFailure(err)
+	}{
+		{"foo", 3, nil, false},
+		{"quux", 4, blobserver.ErrCorruptBlob, true},
+		{"bar", 0, os.ErrNotExist, false},
+	}
+	for _, tt := range tests {
+		size, err := Blob(ctx, sto, blob.RefFromString(tt.contents))
+		if size != tt.size || err != tt.err {
+			t.Errorf("Blob(%q) = %v, %v; want %v, %v", tt.contents, size, err, tt.size, tt.err)
+		}
+		if IsFailure(err) != tt.failure {
+			t.Errorf("IsFailure(%v) = %v, want %v", err, IsFailure(err), tt.failure)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+var porcelain = flag.Bool("porcelain", false, "keep stdout for data: everything meant for people (progress, findings, results) goes to stderr, and stdout only gets what --refs-out - and --summary-out - ask for, or, if neither does, the JSON summary (or, with --diagnose, the diagnosis). For pipelines like \"pk-verify --porcelain --refs-out - config.json | sort > refs.txt\"")
+
+// dataOut is where the outputs named "-" go: the real stdout, even with
+// --porcelain.
+var dataOut = os.Stdout
+
+// setupPorcelain sends everything printed to stdout to stderr instead, for
+// --porcelain, keeping the real stdout as dataOut. Since it swaps os.Stdout
+// itself, human output doesn't need to know about --porcelain at all.
+func setupPorcelain() {
+	if !*porcelain {
+		return
+	}
+	dataOut = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// porcelainSummary reports whether the JSON summary should go to stdout at
+// the end of a --porcelain run, because nothing else was asked to.
+func porcelainSummary() bool {
+	return *porcelain && *refsOut != "-" && *summaryOut != "-"
+}
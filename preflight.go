@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// The preflight checks catch the problems that would otherwise only show up
+// partway through a run, like a blob root that pk-verify isn't allowed to
+// read, or a full disk where repair wants to quarantine blobs, and turn them
+// into a clear error before any work is done.
+
+// checkReadable checks that pk-verify can list the localdisk storages under
+// prefixes, along with the hash directories in their roots (see
+// localdiskRoot).
+func checkReadable(conf *LowLevelConfig, prefixes []string) error {
+	for _, leaf := range conf.leafPrefixes(prefixes) {
+		sc := conf.Prefixes[leaf]
+		if sc.StorageHandler != "filesystem" {
+			continue
+		}
+		root, _ := sc.StorageHandlerArgs["path"].(string)
+		if root == "" {
+			continue
+		}
+		dirs, err := subdirs(root, hashDirRE)
+		if err != nil {
+			return fmt.Errorf("%v: can't read the blob root: %w", leaf, describeAccess(err))
+		}
+		for _, dir := range dirs {
+			if _, err := ioutil.ReadDir(dir); err != nil {
+				return fmt.Errorf("%v: can't read the blob directories: %w", leaf, describeAccess(err))
+			}
+		}
+	}
+	return nil
+}
+
+// checkWritable checks that files can be created in dir (creating dir if
+// need be), and that its filesystem has at least need bytes free.
+func checkWritable(dir string, need int64) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return describeAccess(err)
+	}
+	f, err := ioutil.TempFile(dir, ".pk-verify-preflight-*")
+	if err != nil {
+		return describeAccess(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if free, ok := freeSpace(dir); ok && free < need {
+		return fmt.Errorf("%v has only %v free, and needs %v", dir, humanBytes(free), humanBytes(need))
+	}
+	return nil
+}
+
+// describeAccess adds a hint to permission errors.
+func describeAccess(err error) error {
+	if !os.IsPermission(err) {
+		return err
+	}
+	return fmt.Errorf("%w (pk-verify needs the same access to the storage as the Perkeep server; is it running as the same user?)", err)
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !freebsd && !linux && !windows
+// +build !darwin,!freebsd,!linux,!windows
+
+package main
+
+import "os"
+
+// freeSpace returns how many bytes are available to pk-verify on the
+// filesystem that dir is on. It's only supported on some systems.
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
+
+// fileOwner describes who owns the file fi describes. It's only supported on
+// some systems.
+func fileOwner(fi os.FileInfo) (string, bool) {
+	return "", false
+}
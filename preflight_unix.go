@@ -0,0 +1,29 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// freeSpace returns how many bytes are available to pk-verify on the
+// filesystem that dir is on.
+func freeSpace(dir string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
+
+// fileOwner describes who owns the file fi describes.
+func fileOwner(fi os.FileInfo) (string, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("uid %v, gid %v", st.Uid, st.Gid), true
+}
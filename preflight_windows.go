@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns how many bytes are available to pk-verify on the volume
+// that dir is on.
+func freeSpace(dir string) (int64, bool) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, false
+	}
+	var avail uint64
+	if r, _, _ := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0); r == 0 {
+		return 0, false
+	}
+	return int64(avail), true
+}
+
+// fileOwner describes who owns the file fi describes. Windows owners are
+// security descriptors, which pk-verify doesn't read.
+func fileOwner(fi os.FileInfo) (string, bool) {
+	return "", false
+}
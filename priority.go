@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"go4.org/syncutil"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var (
+	priorityFlag = flag.String("priority", "", "verify the blobs in order of need rather than in the order the storage lists them: \"stale\" (the ones never verified first, then the ones verified longest ago, as --verify-cache remembers; only for storages whose blob files are read directly), \"largest\" or \"smallest\" (the same, with ties broken by size). Every blob is listed before any is verified, and streamed storages are read one blob at a time instead. Most useful with --deadline")
+	deadline     = flag.Duration("deadline", 0, "with --priority, stop starting new blobs this long after the run started, and leave the rest for a later run, so that a run with a fixed window of time spends it on the blobs that need it most. The run ends normally, with the blobs left over noted as a gap in its coverage")
+)
+
+// checkPriority checks --priority and --deadline before the run.
+func checkPriority() error {
+	switch *priorityFlag {
+	case "", "stale", "largest", "smallest":
+	default:
+		return fmt.Errorf("invalid --priority %q: must be \"stale\", \"largest\", or \"smallest\"", *priorityFlag)
+	}
+	if *deadline < 0 {
+		return fmt.Errorf("--deadline can't be negative")
+	}
+	if *deadline > 0 && *priorityFlag == "" {
+		return fmt.Errorf("--deadline needs --priority, to say which blobs to verify before it")
+	}
+	if *priorityFlag != "" && *walkOrder != "ref" {
+		return fmt.Errorf("--priority and --walk-order can't be used together")
+	}
+	return nil
+}
+
+// checkStalePriority checks that --priority=stale has something to go by
+// for each of the targets: only --verify-cache knows when blobs last
+// verified, and only for storages whose blob files are read directly.
+func checkStalePriority(targets []target) error {
+	if *priorityFlag != "stale" {
+		return nil
+	}
+	if *verifyCacheFile == "" {
+		return fmt.Errorf("--priority=stale needs --verify-cache, which remembers when each blob last verified")
+	}
+	for _, t := range targets {
+		if t.method != "walk" {
+			return fmt.Errorf("--priority=stale can't order the blobs of %v, which is read by %v: --verify-cache only remembers blob files read directly", t.prefix, t.method)
+		}
+	}
+	return nil
+}
+
+// A queuedBlob is a blob waiting its turn in a prioritized run.
+type queuedBlob struct {
+	sb   blob.SizedRef
+	file *blobFile // if the blob was found by walking a localdisk storage
+	last int64     // when it last verified (Unix time), or 0 if never
+}
+
+// prioritize sorts q by --priority: the blobs never verified first, then the
+// ones verified longest ago, then (for "largest" and "smallest") by size,
+// then by ref.
+func prioritize(q []queuedBlob) {
+	sort.Slice(q, func(i, j int) bool {
+		a, b := q[i], q[j]
+		if a.last != b.last {
+			return a.last < b.last
+		}
+		if a.sb.Size != b.sb.Size {
+			switch *priorityFlag {
+			case "largest":
+				return a.sb.Size > b.sb.Size
+			case "smallest":
+				return a.sb.Size < b.sb.Size
+			}
+		}
+		return a.sb.Ref.Less(b.sb.Ref)
+	})
+}
+
+// verifyPrioritized verifies the blobs in v's shard of v.sto (or, if root
+// isn't "", of the localdisk storage at root) in --priority order, with
+// v.workers at once. It's a scheduling layer over the other ways of reading
+// a storage: it lists every blob first, then reads them one at a time, by
+// walking or fetching. If by is after the zero time, no blob is started
+// after it, and the blobs left over are returned. Like verifyStream, it calls
+// fn with each result from the calling goroutine.
+func (v *verifier) verifyPrioritized(ctx context.Context, root string, by time.Time, fn func(verifyResult)) (deferred int, err error) {
+	var q []queuedBlob
+	if root != "" {
+		dirs, err := shardDirs(root)
+		if err != nil {
+			return 0, err
+		}
+		files, err := listAllBlobFiles(dirs, v.workers)
+		if err != nil {
+			return 0, err
+		}
+		for i := range files {
+			f := &files[i]
+			if v.wants(f.ref, f.size) {
+				q = append(q, queuedBlob{sb: blob.SizedRef{Ref: f.ref, Size: f.size}, file: f, last: v.cache.lastVerified(*f)})
+			}
+		}
+	} else {
+		if v.limiter == nil {
+			v.limiter = newFetchLimiter()
+		}
+		err := blobserver.EnumerateAll(ctx, v.sto, func(sb blob.SizedRef) error {
+			if v.wants(sb.Ref, sb.Size) {
+				q = append(q, queuedBlob{sb: sb})
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	prioritize(q)
+
+	queue := make(chan queuedBlob)
+	results := make(chan verifyResult)
+	go func() {
+		defer close(queue)
+		for _, b := range q {
+			// Past the deadline, only the blobs that don't need
+			// reading (see --verify-cache) are let through.
+			if !by.IsZero() && time.Now().After(by) && (b.file == nil || !v.cache.fresh(*b.file)) {
+				deferred++
+				continue
+			}
+			select {
+			case queue <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var readers syncutil.Group
+	for i := 0; i < v.workers; i++ {
+		readers.Go(func() error {
+			for b := range queue {
+				if b.file != nil {
+					results <- v.verifyFileCached(ctx, *b.file)
+				} else {
+					results <- v.verifyRef(ctx, b.sb)
+				}
+			}
+			return nil
+		})
+	}
+	go func() {
+		readers.Wait()
+		close(results)
+	}()
+	for r := range results {
+		fn(r)
+	}
+	return deferred, ctx.Err()
+}
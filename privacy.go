@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	redactRefs   = flag.Bool("redact-refs", false, "replace blob refs in --summary-out and --invalid-out with opaque pseudonyms, for reports that leave the machine. The same ref always gets the same pseudonym (keyed by a secret kept in --state-dir), so reports can still be compared with each other; --manifest-out and --fingerprint-out are never redacted, since refs are their whole point")
+	stateKeyFile = flag.String("state-key", "", "a file holding a 32-byte key (raw, or as 64 hex digits) to encrypt the history files in --state-dir with")
+)
+
+// refPattern matches blob refs in text.
+var refPattern = regexp.MustCompile(`\bsha[0-9]+-[0-9a-f]{8,}\b`)
+
+// A redactor replaces blob refs with pseudonyms: the first 16 hex digits of
+// an HMAC of the ref. Blob refs can say a lot about what's stored (anyone
+// with a copy of a file can check whether you have it too), and pseudonyms
+// don't, while still telling reports apart.
+//
+// A nil *redactor leaves everything as it is.
+type redactor struct {
+	key []byte
+}
+
+// newRedactor returns the redactor for this run, or nil if --redact-refs is
+// off. The key is kept in --state-dir so that pseudonyms are the same from
+// run to run; without a state dir, they are only consistent within a run.
+func newRedactor() (*redactor, error) {
+	if !*redactRefs {
+		return nil, nil
+	}
+	if *stateDir == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return &redactor{key: key}, nil
+	}
+	path := filepath.Join(*stateDir, "redaction.key")
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(*stateDir, 0700); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redaction key: %w", err)
+	}
+	return &redactor{key: key}, nil
+}
+
+// redact replaces every blob ref in data.
+func (r *redactor) redact(data []byte) []byte {
+	if r == nil {
+		return data
+	}
+	return refPattern.ReplaceAllFunc(data, func(ref []byte) []byte {
+		m := hmac.New(sha256.New, r.key)
+		m.Write(ref)
+		return []byte(fmt.Sprintf("redacted-%x", m.Sum(nil)[:8]))
+	})
+}
+
+// encryptedMagic starts every encrypted state file.
+var encryptedMagic = []byte("pk-verify encrypted v1\n")
+
+// loadStateKey reads the --state-key file, if there is one.
+func loadStateKey() ([]byte, error) {
+	if *stateKeyFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(*stateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%v: want 32 bytes, or 64 hex digits", *stateKeyFile)
+	}
+	return key, nil
+}
+
+// sealState encrypts a state file with AES-256-GCM, or returns it as it is
+// if key is nil.
+func sealState(key, data []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	gcm, err := stateCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte(nil), encryptedMagic...), nonce...)
+	return gcm.Seal(out, nonce, data, encryptedMagic), nil
+}
+
+// openState decrypts a state file written by sealState. Unencrypted files
+// are returned as they are, so that turning on --state-key doesn't lose the
+// history so far.
+func openState(key, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	}
+	if key == nil {
+		return nil, errors.New("this file is encrypted; pass --state-key to read it")
+	}
+	gcm, err := stateCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], encryptedMagic)
+	if err != nil {
+		return nil, errors.New("failed to decrypt: wrong --state-key, or the file is damaged")
+	}
+	return plain, nil
+}
+
+func stateCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+var (
+	workersFlag = flag.Int("workers", 0, "number of blobs to read and verify concurrently (default: chosen by --profile)")
+	profileFlag = flag.String("profile", "", "tuning profile to use: "+strings.Join(profileNames(), ", ")+" (default: chosen automatically from the storage handlers in the config)")
+)
+
+// A profile is a set of tuning parameters suited to one kind of storage
+// backend. Spinning disks fall over if you ask them for more than a couple of
+// things at once, while cloud object stores only get fast when you ask them
+// for lots of things at once.
+type profile struct {
+	name    string
+	workers int
+}
+
+var profiles = map[string]profile{
+	"disk":    {name: "disk", workers: 2},
+	"ssd":     {name: "ssd", workers: 8},
+	"cloud":   {name: "cloud", workers: 32},
+	"memory":  {name: "memory", workers: runtime.NumCPU()},
+	"network": {name: "network", workers: 2},
+	"default": {name: "default", workers: 4},
+}
+
+// handlerProfiles maps storage handler types (without the "storage-" prefix)
+// to the profile that suits them. Handlers that only wrap other handlers
+// (blobpacked, replica, cond, ...) are not listed here: they get the profile
+// of whatever they wrap.
+var handlerProfiles = map[string]string{
+	"filesystem":         "disk",
+	"diskpacked":         "disk",
+	"memory":             "memory",
+	"s3":                 "cloud",
+	"googlecloudstorage": "cloud",
+	"googledrive":        "cloud",
+	"b2":                 "cloud",
+	"azure":              "cloud",
+	"remote":             "cloud",
+}
+
+func profileNames() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// chooseProfile picks the tuning profile for the storage at prefix, honoring
+// the --profile and --workers flags.
+func chooseProfile(conf *LowLevelConfig, prefix string) (profile, error) {
+	var p profile
+	if *profileFlag != "" {
+		var ok bool
+		if p, ok = profiles[*profileFlag]; !ok {
+			return profile{}, fmt.Errorf("unknown --profile %q (options are: %v)", *profileFlag, strings.Join(profileNames(), ", "))
+		}
+	} else {
+		p = conf.detectProfile(prefix, map[string]bool{})
+	}
+	if *workersFlag < 0 {
+		return profile{}, fmt.Errorf("--workers must not be negative")
+	}
+	if *workersFlag > 0 {
+		p.workers = *workersFlag
+	}
+	return p, nil
+}
+
+// detectProfile finds the storage handlers that prefix ultimately reads from
+// and returns the most conservative of their profiles, so that e.g. a
+// blobpacked store split across a local disk and S3 is never read faster than
+// the disk can handle.
+func (conf *LowLevelConfig) detectProfile(prefix string, seen map[string]bool) profile {
+	seen[prefix] = true
+	sc, ok := conf.Prefixes[prefix]
+	if !ok {
+		return profiles["default"]
+	}
+	if kind := conf.mountKind(prefix); kind != "" {
+		return remoteFSProfile(kind)
+	}
+	if name, ok := handlerProfiles[sc.StorageHandler]; ok {
+		return profiles[name]
+	}
+	var best profile
+	for _, sub := range conf.referencedPrefixes(prefix) {
+		if seen[sub] {
+			continue
+		}
+		if p := conf.detectProfile(sub, seen); best.workers == 0 || p.workers < best.workers {
+			best = p
+		}
+	}
+	if best.workers == 0 {
+		return profiles["default"]
+	}
+	return best
+}
+
+// referencedPrefixes returns the other storage prefixes that prefix's handler
+// arguments refer to, in sorted order. Wrapping handlers refer to the storage
+// they wrap by prefix (e.g. blobpacked's "smallBlobs": "/bs-loose/"), in
+// various shapes depending on the handler, so this looks for prefix strings
+// anywhere in the arguments rather than knowing about each handler.
+func (conf *LowLevelConfig) referencedPrefixes(prefix string) []string {
+	found := map[string]bool{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			if _, ok := conf.Prefixes[v]; ok && v != prefix {
+				found[v] = true
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(map[string]interface{}(conf.Prefixes[prefix].StorageHandlerArgs))
+	var refs []string
+	for p := range found {
+		refs = append(refs, p)
+	}
+	sort.Strings(refs)
+	return refs
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var progressInterval = flag.Duration("progress-interval", time.Minute, "when stdout is not a terminal, how often to log a line of progress")
+
+// progress reports how far along verification is.
+//
+// On a terminal, it rewrites a single status line in place after every blob.
+// Anywhere else (cron, CI, journald) those carriage returns turn into
+// thousands of garbage lines, or nothing at all until the end, so instead it
+// logs a plain line every --progress-interval, whether or not anything has
+// changed since the last one. That way a stuck run is distinguishable from a
+// slow one.
+type progress struct {
+	tty   bool
+	start time.Time
+	done  chan struct{}
+
+	// label and group are set for prefixes verified in parallel; see
+	// progressGroup.
+	label string
+	group *progressGroup
+
+	mu             sync.Mutex
+	valid, invalid int
+	bytes          int64
+	fraction       float64 // estimated fraction done, or 0 if unknown
+
+	// rate is a smoothed read rate in bytes per second, recalculated
+	// about once a second from the bytes read since rateAt.
+	rate      float64
+	rateAt    time.Time
+	rateBytes int64
+}
+
+// rateSmoothing is the weight of the latest second in the smoothed rate.
+const rateSmoothing = 0.3
+
+func newProgress() *progress {
+	p := &progress{
+		tty:    isTerminal(os.Stdout),
+		start:  time.Now(),
+		rateAt: time.Now(),
+		done:   make(chan struct{}),
+	}
+	if !p.tty && *progressInterval > 0 {
+		go p.keepAlive(*progressInterval)
+	}
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// update records the latest counts.
+func (p *progress) update(valid, invalid int, bytes int64) {
+	p.mu.Lock()
+	p.valid, p.invalid, p.bytes = valid, invalid, bytes
+	if dt := time.Since(p.rateAt).Seconds(); dt >= 1 {
+		r := float64(bytes-p.rateBytes) / dt
+		if p.rate == 0 {
+			p.rate = r
+		} else {
+			p.rate += rateSmoothing * (r - p.rate)
+		}
+		p.rateAt, p.rateBytes = time.Now(), bytes
+	}
+	rate, pct := p.rate, p.percent()
+	p.mu.Unlock()
+	elapsed := humanDuration(time.Since(p.start))
+	if !p.tty {
+		return
+	}
+	if p.group != nil {
+		p.group.render()
+		return
+	}
+	if invalid == 0 {
+		fmt.Printf(" [%v] verified %v blob%v (%v/s)%v...\r", elapsed, humanCount(valid), plural(valid), humanBytes(int64(rate)), pct)
+	} else {
+		fmt.Printf(" [%v] %v invalid blob%v, %v valid blob%v (%v/s)%v\r", elapsed, humanCount(invalid), plural(invalid), humanCount(valid), plural(valid), humanBytes(int64(rate)), pct)
+	}
+}
+
+// setPosition records an estimate of the fraction of the work done. Since
+// blobs are verified concurrently, estimates can arrive out of order; the
+// highest one wins.
+func (p *progress) setPosition(f float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f > p.fraction {
+		p.fraction = f
+	}
+}
+
+// percent formats the estimated fraction done, and the time left at the
+// rate so far, for the progress line, or returns "" if there is no
+// estimate. p.mu must be held.
+func (p *progress) percent() string {
+	if p.fraction == 0 {
+		return ""
+	}
+	left := time.Duration(float64(time.Since(p.start)) * (1 - p.fraction) / p.fraction)
+	return fmt.Sprintf(", ~%.0f%% done, ~%v left", 100*p.fraction, humanDuration(left))
+}
+
+// stop stops the periodic log lines. It must be called before printing the
+// final results.
+func (p *progress) stop() {
+	close(p.done)
+}
+
+func (p *progress) keepAlive(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		p.mu.Lock()
+		valid, invalid, rate, pct := p.valid, p.invalid, p.rate, p.percent()
+		p.mu.Unlock()
+		label := ""
+		if p.label != "" {
+			label = p.label + ": "
+		}
+		if paused, since := runPause.paused(); paused {
+			pct += fmt.Sprintf(" (paused for %v)", humanDuration(time.Since(since)))
+		}
+		fmt.Printf("[%v] %v%v valid blob%v, %v invalid blob%v so far (%v/s)%v\n",
+			humanDuration(time.Since(p.start)), label, humanCount(valid), plural(valid), humanCount(invalid), plural(invalid), humanBytes(int64(rate)), pct)
+	}
+}
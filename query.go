@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var (
+	queryFlag   = flag.String("query", "", "instead of verifying every blob, ask the Perkeep server's search handler for the results of this search expression (like \"tag:taxes\"), and verify exactly the blobs behind them: each permanode, its claims, and its content down to the last chunk")
+	queryServer = flag.String("query-server", "http://localhost:3179", "the URL of the Perkeep server to run --query on")
+	queryAuth   = flag.String("query-auth", "", "\"user:password\" for --query-server, if it needs one")
+)
+
+// searchClient talks to the search handler of a running Perkeep server.
+type searchClient struct {
+	base string // the server's URL
+	root string // the search handler's URL
+}
+
+// newSearchClient finds the search handler of the server at base.
+func newSearchClient(ctx context.Context, base string) (*searchClient, error) {
+	c := &searchClient{base: strings.TrimSuffix(base, "/")}
+	var disco struct {
+		SearchRoot string `json:"searchRoot"`
+	}
+	if err := c.get(ctx, c.base+"/?camli.mode=config", &disco); err != nil {
+		return nil, fmt.Errorf("failed to discover the search handler: %w", err)
+	}
+	if disco.SearchRoot == "" {
+		return nil, fmt.Errorf("the server at %v has no search handler", base)
+	}
+	c.root = c.base + disco.SearchRoot
+	return c, nil
+}
+
+// query runs the search expression expr, and returns the permanodes (or
+// other blobs) it matches, with the camliContent of each one that has it.
+func (c *searchClient) query(ctx context.Context, expr string) (results []blob.Ref, content map[blob.Ref]blob.Ref, err error) {
+	req := map[string]interface{}{
+		"expression": expr,
+		"limit":      -1,
+		"describe":   map[string]interface{}{"depth": 1},
+	}
+	var resp struct {
+		Blobs []struct {
+			Blob blob.Ref `json:"blob"`
+		} `json:"blobs"`
+		Description struct {
+			Meta map[string]struct {
+				Permanode *struct {
+					Attr map[string][]string `json:"attr"`
+				} `json:"permanode"`
+			} `json:"meta"`
+		} `json:"description"`
+	}
+	if err := c.post(ctx, c.root+"camli/search/query", req, &resp); err != nil {
+		return nil, nil, err
+	}
+	content = make(map[blob.Ref]blob.Ref)
+	for _, b := range resp.Blobs {
+		results = append(results, b.Blob)
+		if d, ok := resp.Description.Meta[b.Blob.String()]; ok && d.Permanode != nil {
+			if cc := d.Permanode.Attr["camliContent"]; len(cc) > 0 {
+				if br, ok := blob.Parse(cc[0]); ok {
+					content[b.Blob] = br
+				}
+			}
+		}
+	}
+	return results, content, nil
+}
+
+// claims returns the claims on the permanode perma.
+func (c *searchClient) claims(ctx context.Context, perma blob.Ref) ([]blob.Ref, error) {
+	var resp struct {
+		Claims []struct {
+			Ref blob.Ref `json:"blobref"`
+		} `json:"claims"`
+	}
+	if err := c.get(ctx, c.root+"camli/search/claims?permanode="+url.QueryEscape(perma.String()), &resp); err != nil {
+		return nil, err
+	}
+	var refs []blob.Ref
+	for _, cl := range resp.Claims {
+		refs = append(refs, cl.Ref)
+	}
+	return refs, nil
+}
+
+func (c *searchClient) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return c.do(ctx, req, v)
+}
+
+func (c *searchClient) post(ctx context.Context, u string, body, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(ctx, req, v)
+}
+
+func (c *searchClient) do(ctx context.Context, req *http.Request, v interface{}) error {
+	req = req.WithContext(ctx)
+	setAuth(req, *queryAuth)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", req.URL, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 256<<20)).Decode(v); err != nil {
+		return fmt.Errorf("%v: %v", req.URL, err)
+	}
+	return nil
+}
+
+// verifyQuery verifies the blobs behind the results of --query, read from
+// sto, and prints what it found. It reports whether they were all valid.
+func verifyQuery(ctx context.Context, sto blobserver.Storage, workers int) (bool, error) {
+	sc, err := newSearchClient(ctx, *queryServer)
+	if err != nil {
+		return false, err
+	}
+	results, content, err := sc.query(ctx, *queryFlag)
+	if err != nil {
+		return false, fmt.Errorf("failed to run --query: %w", err)
+	}
+	fmt.Printf("the query %q matched %v result%v\n", *queryFlag, len(results), plural(len(results)))
+
+	seen := map[blob.Ref]bool{}
+	var refs []blob.Ref
+	add := func(br blob.Ref) bool {
+		if !br.Valid() || seen[br] {
+			return false
+		}
+		seen[br] = true
+		refs = append(refs, br)
+		return true
+	}
+	for _, br := range results {
+		add(br)
+		claims, err := sc.claims(ctx, br)
+		if err != nil {
+			return false, fmt.Errorf("failed to list the claims on %v: %w", br, err)
+		}
+		for _, cl := range claims {
+			add(cl)
+		}
+		if cc, ok := content[br]; ok {
+			w := &treeWalker{f: sto, add: add}
+			if err := w.walk(ctx, cc); err != nil {
+				return false, err
+			}
+		}
+	}
+	fmt.Printf("verifying the %v blob%v behind them\n", len(refs), plural(len(refs)))
+	res, err := verifyRefList(ctx, sto, refs, workers)
+	if err != nil {
+		return false, err
+	}
+	return res.OK(), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"sync"
+
+	"perkeep.org/pkg/blobserver"
+)
+
+var queueDepth = flag.Int("queue-depth", 64, "maximum number of streamed blobs to hold in memory while they wait to be verified")
+
+// queueBytes caps the total declared size of the blobs waiting in a
+// blobQueue, independently of --queue-depth, so that a run of huge blobs
+// can't use up all of the memory even with a deep queue.
+const queueBytes = 256 << 20
+
+// blobQueue is a FIFO of streamed blobs waiting to be verified, bounded both
+// by count and by total size. It lets the streamer read ahead of the
+// verifiers, but only so far.
+type blobQueue struct {
+	maxItems int
+	maxBytes int64
+
+	mu     sync.Mutex
+	cond   sync.Cond
+	items  []blobserver.BlobAndToken
+	bytes  int64
+	closed bool
+}
+
+func newBlobQueue(maxItems int, maxBytes int64) *blobQueue {
+	if maxItems < 1 {
+		maxItems = 1
+	}
+	q := &blobQueue{maxItems: maxItems, maxBytes: maxBytes}
+	q.cond.L = &q.mu
+	return q
+}
+
+// push adds b to the queue, waiting for room if the queue is full. A blob
+// bigger than the whole byte budget is still let in once the queue is empty,
+// so that it doesn't wait forever.
+func (q *blobQueue) push(b blobserver.BlobAndToken) {
+	size := int64(b.Size())
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) > 0 && (len(q.items) >= q.maxItems || q.bytes+size > q.maxBytes) {
+		q.cond.Wait()
+	}
+	q.items = append(q.items, b)
+	q.bytes += size
+	q.cond.Broadcast()
+}
+
+// close marks the end of the input. Blobs already in the queue can still be
+// popped.
+func (q *blobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// pop removes and returns the oldest blob in the queue, waiting for one if
+// necessary. It returns false once the queue is closed and empty.
+func (q *blobQueue) pop() (blobserver.BlobAndToken, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return blobserver.BlobAndToken{}, false
+	}
+	b := q.items[0]
+	q.items[0] = blobserver.BlobAndToken{}
+	q.items = q.items[1:]
+	q.bytes -= int64(b.Size())
+	q.cond.Broadcast()
+	return b, true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// A Perkeep server may be writing to the storage while pk-verify reads it:
+// packing loose blobs into zips and deleting them, say, or replacing a blob
+// file. A blob that changes or disappears partway through a read fails
+// verification without being corrupt. So when a blob fails, pk-verify
+// checks whether it changed since it was listed, and if so, calls it raced
+// instead of invalid, and verifies it again at the end of the run.
+
+// checkRaced sets r.raced if r failed and its blob changed since it was
+// listed: if f is set, the blob's file was modified, resized, or removed
+// since it was listed; otherwise, the blob is gone from v.sto.
+func (v *verifier) checkRaced(ctx context.Context, r *verifyResult, f *blobFile) {
+	if r.err == nil || r.transient {
+		return
+	}
+	if f != nil {
+		fi, err := os.Stat(f.path)
+		r.raced = err != nil || !fi.ModTime().Equal(f.info.ModTime()) || fi.Size() != f.info.Size()
+		return
+	}
+	_, err := blobserver.StatBlob(ctx, v.sto, r.ref)
+	r.raced = err == os.ErrNotExist
+}
+
+// recheckRaced verifies again the blobs that raced with changes to the
+// storage, calling fn with the result for each one that is still there. This
+// time a failure is a failure. It returns how many are gone.
+func (v *verifier) recheckRaced(ctx context.Context, refs []blob.Ref, fn func(verifyResult)) int {
+	gone := 0
+	for _, br := range refs {
+		sb, err := blobserver.StatBlob(ctx, v.sto, br)
+		if err == os.ErrNotExist {
+			gone++
+			continue
+		}
+		if err != nil {
+			fn(verifyResult{ref: br, err: err, passes: 1, failures: 1})
+			continue
+		}
+		r := v.verifyRef(ctx, sb)
+		r.raced = false
+		fn(r)
+	}
+	return gone
+}
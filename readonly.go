@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"go4.org/jsonconfig"
+
+	"perkeep.org/pkg/sorted"
+)
+
+// errReadOnly is returned by writes to the key-value stores that
+// openSortedReadOnly opens.
+var errReadOnly = errors.New("opened read-only by pk-verify")
+
+// openSortedReadOnly opens the sorted key-value store (like a blobpacked
+// meta index) described by kvConf, in a way that can't change it, even if
+// the Perkeep server has it open at the same time:
+//
+//   - LevelDB databases are opened read-only. LevelDB doesn't let another
+//     process read a database that is open for writing, so if the server has
+//     it open, a copy is opened instead.
+//   - Other stores kept in a local file (like "kv" and "sqlite") are
+//     always copied first, since they have no read-only mode that pk-verify
+//     can ask for.
+//   - Stores on a database server (like MySQL or PostgreSQL) are opened as
+//     usual, and are only read from; the database server takes care of
+//     sharing them.
+//
+// Copies live in a temporary directory, which is removed when the returned
+// store is closed.
+func openSortedReadOnly(kvConf jsonconfig.Obj) (sorted.KeyValue, error) {
+	typ, _ := kvConf["type"].(string)
+	file, _ := kvConf["file"].(string)
+	if file == "" {
+		return sorted.NewKeyValue(copyObj(kvConf))
+	}
+	if typ == "leveldb" {
+		db, err := leveldb.OpenFile(file, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+		if err == nil {
+			return &leveldbReader{db: db}, nil
+		}
+		if !isLockError(err) {
+			return nil, err
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "pk-verify-index-")
+	if err != nil {
+		return nil, err
+	}
+	copied := filepath.Join(tmp, filepath.Base(file))
+	if err := copyIndex(file, copied); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("failed to copy %v: %w", file, err)
+	}
+	if typ == "leveldb" {
+		db, err := leveldb.OpenFile(copied, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+		if err != nil {
+			os.RemoveAll(tmp)
+			return nil, fmt.Errorf("failed to open a copy of %v (it may have changed while being copied): %w", file, err)
+		}
+		return &leveldbReader{db: db, tmp: tmp}, nil
+	}
+	conf := copyObj(kvConf)
+	conf["file"] = copied
+	kv, err := sorted.NewKeyValue(conf)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("failed to open a copy of %v: %w", file, err)
+	}
+	return &copiedKV{KeyValue: kv, tmp: tmp}, nil
+}
+
+// copiedKV is a sorted.KeyValue opened from a temporary copy, which it
+// removes when closed.
+type copiedKV struct {
+	sorted.KeyValue
+	tmp string
+}
+
+func (kv *copiedKV) Close() error {
+	err := kv.KeyValue.Close()
+	os.RemoveAll(kv.tmp)
+	return err
+}
+
+// leveldbReader is a sorted.KeyValue for a LevelDB database opened
+// read-only.
+type leveldbReader struct {
+	db  *leveldb.DB
+	tmp string // if the database is a temporary copy, its directory
+}
+
+func (r *leveldbReader) Get(key string) (string, error) {
+	v, err := r.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return "", sorted.ErrNotFound
+	}
+	return string(v), err
+}
+
+func (r *leveldbReader) Set(key, value string) error              { return errReadOnly }
+func (r *leveldbReader) Delete(key string) error                  { return errReadOnly }
+func (r *leveldbReader) BeginBatch() sorted.BatchMutation         { return sorted.NewBatchMutation() }
+func (r *leveldbReader) CommitBatch(b sorted.BatchMutation) error { return errReadOnly }
+
+func (r *leveldbReader) Find(start, end string) sorted.Iterator {
+	rng := &util.Range{Start: []byte(start)}
+	if end != "" {
+		rng.Limit = []byte(end)
+	}
+	return &leveldbIter{it: r.db.NewIterator(rng, nil)}
+}
+
+func (r *leveldbReader) Close() error {
+	err := r.db.Close()
+	if r.tmp != "" {
+		os.RemoveAll(r.tmp)
+	}
+	return err
+}
+
+type leveldbIter struct {
+	it iterator.Iterator
+}
+
+func (i *leveldbIter) Next() bool         { return i.it.Next() }
+func (i *leveldbIter) Key() string        { return string(i.it.Key()) }
+func (i *leveldbIter) KeyBytes() []byte   { return i.it.Key() }
+func (i *leveldbIter) Value() string      { return string(i.it.Value()) }
+func (i *leveldbIter) ValueBytes() []byte { return i.it.Value() }
+
+func (i *leveldbIter) Close() error {
+	i.it.Release()
+	return i.it.Error()
+}
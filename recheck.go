@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"perkeep.org/pkg/blobserver"
+)
+
+// recheckMain implements "pk-verify recheck", which verifies again just the
+// blobs that a previous run found invalid or missing, as recorded in its
+// --summary-out file, and records the ones that are fine now in the summary
+// file as resolved. That's the usual next step after swapping a cable,
+// restoring files by hand, or fixing a mount, when a whole run would take
+// far longer than the handful of blobs that matter.
+func recheckMain(args []string) {
+	fs := flag.NewFlagSet("recheck", flag.ExitOnError)
+	fs.Usage = func() {
+		stderrf("Usage: %v recheck <path to perkeep server config file> <summary file>\n", os.Args[0])
+		stderrln()
+		stderrln("Verifies again the blobs that the run recorded in a --summary-out file found invalid or missing, and marks the ones that now verify as resolved in that file. Exits with status 2 if any still fail.")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	conf := loadConfig(fs.Arg(0))
+	summaryPath := fs.Arg(1)
+
+	data, err := ioutil.ReadFile(summaryPath)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	s, err := parseSummary(summaryPath, data)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	prefixes, err := chooseTargets(conf)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	findings := repairFindings(s, prefixes[0])
+	if len(findings) == 0 {
+		fmt.Println("nothing to re-check")
+		return
+	}
+
+	ctx := context.Background()
+	ld := NewLoader(conf)
+	n := len(findings)
+	fmt.Printf("re-checking the %v blob%v that %v invalid or missing in run %v (%v):\n", n, plural(n), wasWere(n), s.RunID, s.Start.Format(time.RFC3339))
+	still := 0
+	for _, f := range findings {
+		if err := recheckFinding(ctx, ld, f); err != nil {
+			still++
+			fmt.Printf("  still failing: %v in %v (%v)\n", f.ref, f.prefix, err)
+			continue
+		}
+		fmt.Printf("  now valid:     %v in %v\n", f.ref, f.prefix)
+		s.Resolved = append(s.Resolved, resolution{Ref: f.ref, Action: "rechecked", Time: time.Now()})
+	}
+	fmt.Printf("%v of %v blob%v %v still failing\n", still, n, plural(n), isAre(still))
+	if still < n {
+		saveRepairs(s, summaryPath)
+	}
+	if still > 0 {
+		os.Exit(2)
+	}
+}
+
+// recheckFinding verifies f's blob in the storage it was found (or found
+// missing) in.
+func recheckFinding(ctx context.Context, ld *Loader, f repairFinding) error {
+	sto, err := ld.GetStorage(f.prefix)
+	if err != nil {
+		return err
+	}
+	if f.missing {
+		if _, err := blobserver.StatBlob(ctx, sto, f.ref); err != nil {
+			return fmt.Errorf("still missing: %w", err)
+		}
+	}
+	return (&verifier{sto: sto}).verifyFetch(ctx, f.ref)
+}
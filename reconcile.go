@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	reconcileServer    = flag.String("reconcile-server", "", "the URL of the running Perkeep server for this store (like http://localhost:3179), to list the blobs it serves from /bs/ after the run and compare them with the blobs verification found, flagging the server and the disk disagreeing about what exists")
+	reconcileAuth      = flag.String("reconcile-auth", "", "\"user:password\" for --reconcile-server, if it needs one")
+	reconcileTolerance = flag.Float64("reconcile-tolerance", 0.01, "for --reconcile-server, the fraction of blobs that may be on only one side before it counts as a problem (a live server adds blobs during the run)")
+)
+
+// enumerateBatch is how many blobs to ask the server for at a time.
+const enumerateBatch = 1000
+
+// reconciliation is what --reconcile-server found.
+type reconciliation struct {
+	Server       string `json:"server"`
+	ServerBlobs  int    `json:"serverBlobs"`
+	ServerBytes  int64  `json:"serverBytes"`
+	OnlyOnServer int    `json:"onlyOnServer"` // listed by the server, but not found
+	OnlyOnDisk   int    `json:"onlyOnDisk"`   // found, but not listed by the server
+	Problem      bool   `json:"problem"`      // more of either than --reconcile-tolerance allows
+}
+
+// reconcileWithServer lists the blobs that the server serves from /bs/,
+// compares them with the ones in s, reports the differences to found, and
+// records the results in s.
+func reconcileWithServer(ctx context.Context, s *Summary, found *findings) error {
+	if *reconcileServer == "" {
+		return nil
+	}
+	fmt.Printf("listing the blobs on %v to compare with the store\n", *reconcileServer)
+	listed, err := enumerateServer(ctx, *reconcileServer)
+	if err != nil {
+		return fmt.Errorf("failed to list the blobs on %v: %w", *reconcileServer, err)
+	}
+	rec := &reconciliation{Server: *reconcileServer}
+	seen := make(map[blob.Ref]bool, len(s.seen))
+	for _, sr := range s.seen {
+		seen[sr.Ref] = true
+	}
+	onServer := make(map[blob.Ref]bool, len(listed))
+	for _, sr := range listed {
+		if !s.Shard.contains(sr.Ref) {
+			continue
+		}
+		onServer[sr.Ref] = true
+		rec.ServerBlobs++
+		rec.ServerBytes += int64(sr.Size)
+		if !seen[sr.Ref] {
+			rec.OnlyOnServer++
+			found.report("blob listed by the server, but not found in the store: %v", sr.Ref)
+		}
+	}
+	for _, sr := range s.seen {
+		if !onServer[sr.Ref] {
+			rec.OnlyOnDisk++
+			found.report("blob found in the store, but not listed by the server: %v", sr.Ref)
+		}
+	}
+	allowed := int(*reconcileTolerance * float64(len(s.seen)))
+	rec.Problem = rec.OnlyOnServer > allowed || rec.OnlyOnDisk > allowed
+	s.Reconciliation = rec
+
+	fmt.Printf("the server lists %v blob%v (%v); %v of them %v not found in the store, and %v blob%v found in the store %v not listed by the server\n",
+		rec.ServerBlobs, plural(rec.ServerBlobs), humanBytes(rec.ServerBytes), rec.OnlyOnServer, wasWere(rec.OnlyOnServer), rec.OnlyOnDisk, plural(rec.OnlyOnDisk), wasWere(rec.OnlyOnDisk))
+	if rec.Problem {
+		fmt.Printf("SERVER AND STORE DISAGREE: more blobs differ than --reconcile-tolerance allows; they are listed %v. Is the server using this store?\n", found.where())
+	}
+	return nil
+}
+
+// enumerateServer lists all of the blobs that the Perkeep server at base
+// serves from /bs/, using the blob server protocol's enumerate-blobs call.
+func enumerateServer(ctx context.Context, base string) ([]blob.SizedRef, error) {
+	var (
+		all   []blob.SizedRef
+		after string
+	)
+	for {
+		u := fmt.Sprintf("%v/bs/camli/enumerate-blobs?limit=%d", strings.TrimSuffix(base, "/"), enumerateBatch)
+		if after != "" {
+			u += "&after=" + url.QueryEscape(after)
+		}
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		setAuth(req, *reconcileAuth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Blobs []struct {
+				Ref  blob.Ref `json:"blobRef"`
+				Size uint32   `json:"size"`
+			} `json:"blobs"`
+			ContinueAfter string `json:"continueAfter"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%v: %v", u, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", u, err)
+		}
+		for _, b := range page.Blobs {
+			all = append(all, blob.SizedRef{Ref: b.Ref, Size: b.Size})
+		}
+		if page.ContinueAfter == "" || len(page.Blobs) == 0 {
+			return all, nil
+		}
+		after = page.ContinueAfter
+	}
+}
+
+// setAuth gives req the "user:password" auth, if it isn't empty.
+func setAuth(req *http.Request, auth string) {
+	if auth == "" {
+		return
+	}
+	user, pass := auth, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		user, pass = user[:i], user[i+1:]
+	}
+	req.SetBasicAuth(user, pass)
+}
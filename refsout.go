@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	refsOut    = flag.String("refs-out", "", "write just the refs of the invalid and missing blobs (not the ones in --ignore-refs) to this file, or \"-\" for stdout, in a form that Perkeep's tools take as is; see --refs-format")
+	refsFormat = flag.String("refs-format", "lines", "the format of --refs-out: \"lines\" (one ref per line, like pk-get and pk blob take; e.g. xargs pk-get -o recovered/ < refs) or \"stat\" (the JSON of the blob server's stat call, {\"stat\": [{\"blobRef\": ..., \"size\": ...}]}, with the size known for each blob)")
+)
+
+// checkRefsOut checks the --refs-out flags before the run.
+func checkRefsOut() error {
+	if *refsOut == "" {
+		return nil
+	}
+	if *refsFormat != "lines" && *refsFormat != "stat" {
+		return fmt.Errorf("invalid --refs-format %q: must be \"lines\" or \"stat\"", *refsFormat)
+	}
+	if *redactRefs {
+		return fmt.Errorf("--refs-out can't be used with --redact-refs, since it is nothing but refs")
+	}
+	return nil
+}
+
+// writeRefsOut writes the refs of the invalid and missing blobs in s to
+// --refs-out. expected is the --expect manifest, if any, for the sizes of
+// the missing blobs. It must be called after s.checkManifest.
+func writeRefsOut(s *Summary, expected []blob.SizedRef) error {
+	sizes := make(map[blob.Ref]uint32)
+	for _, sr := range expected {
+		sizes[sr.Ref] = sr.Size
+	}
+	for _, sr := range s.seen {
+		sizes[sr.Ref] = sr.Size
+	}
+	var refs []blob.SizedRef
+	for _, list := range [][]blob.Ref{s.InvalidRefs, s.Missing} {
+		for _, br := range list {
+			if !s.ignore[br] {
+				refs = append(refs, blob.SizedRef{Ref: br, Size: sizes[br]})
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Ref.Less(refs[j].Ref) })
+
+	var buf bytes.Buffer
+	if *refsFormat == "stat" {
+		type statEntry struct {
+			Ref  blob.Ref `json:"blobRef"`
+			Size uint32   `json:"size"`
+		}
+		resp := struct {
+			Stat []statEntry `json:"stat"`
+		}{Stat: []statEntry{}}
+		for _, sr := range refs {
+			resp.Stat = append(resp.Stat, statEntry{sr.Ref, sr.Size})
+		}
+		data, err := json.MarshalIndent(resp, "", "\t")
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	} else {
+		for _, sr := range refs {
+			fmt.Fprintln(&buf, sr.Ref)
+		}
+	}
+	if *refsOut == "-" {
+		_, err := dataOut.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(*refsOut, buf.Bytes(), 0644)
+}
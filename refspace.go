@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"perkeep.org/pkg/blob"
+)
+
+// A refSpace estimates how far along a run is from the refs of the blobs
+// being verified, for storages that produce blobs in ref order.
+//
+// Localdisk storage is read one hash function at a time (all the sha1 blobs,
+// then all the sha224 blobs), each in digest order, whether streamed or
+// walked. Digests are uniformly distributed, so the position of the latest
+// ref in that order is a good estimate of the fraction of the work done, and
+// it's available right away, without counting every blob first.
+type refSpace struct {
+	hashes []string // hash names in the store, in the order they are read
+}
+
+// newRefSpace returns a refSpace for the storage at prefix, or nil if that
+// storage doesn't produce blobs in a predictable order.
+func newRefSpace(conf *LowLevelConfig, prefix string) *refSpace {
+	sc := conf.Prefixes[prefix]
+	if sc.StorageHandler != "filesystem" {
+		return nil
+	}
+	root, _ := sc.StorageHandlerArgs["path"].(string)
+	dirs, err := subdirs(root, hashDirRE)
+	if err != nil || len(dirs) == 0 {
+		return nil
+	}
+	rs := &refSpace{}
+	for _, dir := range dirs {
+		rs.hashes = append(rs.hashes, dir[strings.LastIndexAny(dir, `/\`)+1:])
+	}
+	sort.Strings(rs.hashes)
+	return rs
+}
+
+// position returns the estimated fraction of the store that comes before br,
+// between 0 and 1.
+func (rs *refSpace) position(br blob.Ref) float64 {
+	s := br.String()
+	dash := strings.Index(s, "-")
+	if dash < 0 {
+		return 0
+	}
+	i := sort.SearchStrings(rs.hashes, s[:dash])
+	if i == len(rs.hashes) || rs.hashes[i] != s[:dash] {
+		return 0
+	}
+	digest := s[dash+1:]
+	if len(digest) > 6 {
+		digest = digest[:6]
+	}
+	n, err := strconv.ParseUint(digest, 16, 32)
+	if err != nil {
+		return 0
+	}
+	f := float64(n) / float64(uint64(1)<<(4*uint(len(digest))))
+	return (float64(i) + f) / float64(len(rs.hashes))
+}
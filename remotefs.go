@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var remoteFS = flag.String("remote-fs", "", "verify the local blob directories as a copy on a remote filesystem mount of this kind, with timeouts, retries, and workers tuned for it: \"rclone\" (an rclone mount), \"smb\", or \"webdav\". Network mounts are recognized and read gently anyway, but a FUSE mount (like rclone's) doesn't say what's behind it")
+
+// A remoteFSTuning is how to read blobs from one kind of remote filesystem
+// mount. Each setting only applies if the corresponding flag wasn't given.
+type remoteFSTuning struct {
+	workers       int
+	retries       int
+	fetchTimeout  time.Duration
+	streamTimeout time.Duration
+}
+
+// remoteFSTunings are the tunings for --remote-fs.
+//
+// An rclone mount is a cloud storage underneath, so it takes many reads at
+// once, but the first read of a file may download all of it into rclone's
+// cache first, and the cloud behind it has its own bad moments. SMB and
+// WebDAV servers are usually a single machine, often a NAS, that falls over
+// under too many reads at once; WebDAV goes through HTTP, which has more
+// ways to fail transiently.
+var remoteFSTunings = map[string]remoteFSTuning{
+	"rclone": {workers: 16, retries: 8, fetchTimeout: 30 * time.Minute, streamTimeout: 15 * time.Minute},
+	"smb":    {workers: 4, retries: 5, fetchTimeout: 10 * time.Minute, streamTimeout: 10 * time.Minute},
+	"webdav": {workers: 4, retries: 8, fetchTimeout: 20 * time.Minute, streamTimeout: 10 * time.Minute},
+}
+
+// checkRemoteFS checks --remote-fs.
+func checkRemoteFS() error {
+	if _, ok := remoteFSTunings[*remoteFS]; *remoteFS != "" && !ok {
+		var kinds []string
+		for kind := range remoteFSTunings {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		return fmt.Errorf("unknown --remote-fs %q (options are: %v)", *remoteFS, strings.Join(kinds, ", "))
+	}
+	return nil
+}
+
+// remoteFSProfile returns the tuning profile for a local storage on a mount
+// of the given kind (see mountKind).
+func remoteFSProfile(kind string) profile {
+	if t, ok := remoteFSTunings[kind]; ok {
+		return profile{name: kind, workers: t.workers}
+	}
+	return profiles["network"]
+}
+
+// remoteFSLimits returns the timeouts and retries for reading a local
+// storage on a mount of the given kind (see mountKind): the tuning for it,
+// where the corresponding flag wasn't given. It returns nil if there's no
+// tuning for that kind of mount.
+func remoteFSLimits(kind string) *readLimits {
+	t, ok := remoteFSTunings[kind]
+	if !ok {
+		return nil
+	}
+	lim := flagReadLimits()
+	if !flagWasSet("retries") {
+		lim.retries = t.retries
+	}
+	if !flagWasSet("fetch-timeout") {
+		lim.fetchTimeout = t.fetchTimeout
+	}
+	if !flagWasSet("stream-timeout") {
+		lim.streamTimeout = t.streamTimeout
+	}
+	return &lim
+}
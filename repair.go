@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// A resolution records how "pk-verify repair" dealt with a problem blob.
+type resolution struct {
+	Ref    blob.Ref  `json:"ref"`
+	Action string    `json:"action"`           // "restored", "quarantined", "ignored", or "rechecked"
+	Source string    `json:"source,omitempty"` // where a restored blob came from
+	Time   time.Time `json:"time"`
+}
+
+// A repairFinding is a problem blob from a previous run.
+type repairFinding struct {
+	ref     blob.Ref
+	prefix  string // the storage it is in, or should be in
+	missing bool   // missing, rather than invalid
+}
+
+// A repairOption is one thing the user can do about a repairFinding.
+type repairOption struct {
+	key   string
+	label string
+
+	// action and source describe the repair for the journal; see
+	// journalEntry.
+	action string
+	source string
+
+	// do carries out the repair. If it removes the bad copy from its
+	// storage, it keeps it at aside.
+	do func(ctx context.Context, aside string) (resolution, error)
+}
+
+// repairMain implements "pk-verify repair", which goes through the problems
+// found by a previous run (as recorded in its --summary-out file) one by one,
+// and offers to fix each of them:
+//
+//   - restore it from another storage in the config that has a valid copy
+//     (like the other side of a replica or a sync),
+//   - restore it from a duplicate blob file in --from,
+//   - quarantine it: move the bad copy to --quarantine-dir, so that it stops
+//     failing verification but isn't lost, or
+//   - ignore it, by adding it to --ignore-refs.
+//
+// Each restored or quarantined blob is checked again afterwards, and only
+// marked resolved in the summary file if the check passes.
+//
+// Every repair is written to a journal (see journalEntry) before it starts
+// and after it ends, so that one interrupted by a crash can be finished, or
+// undone, with --resume.
+func repairMain(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	fromDir := fs.String("from", "", "a directory of duplicate blob files to restore from: either a copy of a filesystem storage, or just files named after their refs")
+	quarantineDir := fs.String("quarantine-dir", filepath.Join(*stateDir, "quarantine"), "where to move quarantined blobs")
+	ignoreFile := fs.String("ignore-refs", "", "the --ignore-refs file to add ignored blobs to")
+	journalPath := fs.String("journal", "", "the journal of repairs, to finish interrupted ones from (default: the summary file's path plus \".journal\")")
+	resume := fs.Bool("resume", false, "first finish the repairs that were interrupted, as recorded in the journal, then carry on")
+	rollback := fs.Bool("rollback", false, "with --resume, undo the interrupted repairs instead of finishing them, as far as that is safe: a bad copy that was moved aside is put back, but a valid restored copy is kept")
+	fs.Usage = func() {
+		stderrf("Usage: %v repair [flags] <path to perkeep server config file> <summary file>\n", os.Args[0])
+		stderrln()
+		stderrln("Walks through the problems recorded in a --summary-out file, and offers to restore, quarantine, or ignore each one.")
+		stderrln()
+		stderrln("Flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	conf := loadConfig(fs.Arg(0))
+	summaryPath := fs.Arg(1)
+
+	data, err := ioutil.ReadFile(summaryPath)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	s, err := parseSummary(summaryPath, data)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	prefixes, err := chooseTargets(conf)
+	if err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+	if *journalPath == "" {
+		*journalPath = summaryPath + ".journal"
+	}
+	journal, done, unfinished, err := openRepairJournal(*journalPath)
+	if err != nil {
+		stderrf("pk-verify: failed to open the repair journal: %v\n", err)
+		os.Exit(1)
+	}
+	defer journal.close()
+	if n := len(unfinished); n > 0 && !*resume {
+		stderrf("pk-verify: %v repair%v recorded in %v %v interrupted; run again with --resume to finish %v, or with --resume --rollback to undo %v\n", n, plural(n), *journalPath, wasWere(n), itThey(n), itThey(n))
+		os.Exit(1)
+	}
+
+	r := &repairer{
+		conf:          conf,
+		ld:            NewLoader(conf),
+		fromDir:       *fromDir,
+		quarantineDir: *quarantineDir,
+		ignoreFile:    *ignoreFile,
+	}
+	ctx := context.Background()
+
+	// Catch the summary up with the journal: repairs that were done, but
+	// not saved to the summary before a crash, and interrupted ones.
+	resolved := map[blob.Ref]bool{}
+	for _, res := range s.Resolved {
+		resolved[res.Ref] = true
+	}
+	for _, e := range done {
+		if !resolved[e.Ref] {
+			resolved[e.Ref] = true
+			s.Resolved = append(s.Resolved, resolution{Ref: e.Ref, Action: resolutionActions[e.Action], Source: e.Source, Time: e.Time})
+			fmt.Printf("%v: %v (recorded in %v)\n", e.Ref, resolutionActions[e.Action], *journalPath)
+		}
+	}
+	verb := "finish"
+	if *rollback {
+		verb = "undo"
+	}
+	for _, e := range unfinished {
+		phase, err := r.resume(ctx, e, *rollback)
+		if err != nil {
+			stderrf("pk-verify: %v: failed to %v the interrupted %v: %v\n", e.Ref, verb, e.Action, err)
+			phase = "failed"
+		}
+		if err := journal.end(e, phase, err); err != nil {
+			stderrf("pk-verify: failed to write the repair journal: %v\n", err)
+			os.Exit(1)
+		}
+		switch phase {
+		case "done":
+			s.Resolved = append(s.Resolved, resolution{Ref: e.Ref, Action: resolutionActions[e.Action], Source: e.Source, Time: time.Now()})
+			fmt.Printf("%v: %v (finished the interrupted repair)\n", e.Ref, resolutionActions[e.Action])
+		case "rolledBack":
+			fmt.Printf("%v: undid the interrupted %v\n", e.Ref, e.Action)
+		}
+	}
+	if len(done)+len(unfinished) > 0 {
+		saveRepairs(s, summaryPath)
+	}
+
+	findings := repairFindings(s, prefixes[0])
+	if len(findings) == 0 {
+		fmt.Println("nothing to repair")
+		return
+	}
+
+	if err := repairPreflight(conf, findings, *quarantineDir, *ignoreFile); err != nil {
+		stderrf("pk-verify: %v\n", err)
+		os.Exit(1)
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	for i, f := range findings {
+		what := "invalid"
+		if f.missing {
+			what = "missing"
+		}
+		fmt.Printf("\n[%v/%v] %v blob %v in %v (%v)\n", i+1, len(findings), what, f.ref, f.prefix, conf.describe(f.prefix))
+		opts, err := r.options(ctx, f)
+		if err != nil {
+			stderrf("pk-verify: %v\n", err)
+			continue
+		}
+		for _, o := range opts {
+			fmt.Printf("  %v) %v\n", o.key, o.label)
+		}
+		fmt.Printf("  s) skip\n")
+		var chosen *repairOption
+		for chosen == nil {
+			fmt.Print("choice? ")
+			if !in.Scan() {
+				fmt.Println()
+				saveRepairs(s, summaryPath)
+				return
+			}
+			answer := strings.TrimSpace(in.Text())
+			if answer == "s" {
+				break
+			}
+			for j := range opts {
+				if opts[j].key == answer {
+					chosen = &opts[j]
+				}
+			}
+		}
+		if chosen == nil {
+			continue
+		}
+		e := journalEntry{Ref: f.ref, Prefix: f.prefix, Action: chosen.action, Source: chosen.source}
+		switch {
+		case chosen.action == "ignore":
+			e.IgnoreRefs = r.ignoreFile
+		case !f.missing:
+			e.Aside = r.asidePath(f.ref)
+		}
+		if e, err = journal.begin(e); err != nil {
+			stderrf("pk-verify: failed to write the repair journal: %v\n", err)
+			saveRepairs(s, summaryPath)
+			os.Exit(1)
+		}
+		res, err := chosen.do(ctx, e.Aside)
+		phase := "done"
+		if err != nil {
+			phase = "failed"
+		}
+		if err := journal.end(e, phase, err); err != nil {
+			stderrf("pk-verify: failed to write the repair journal: %v\n", err)
+			saveRepairs(s, summaryPath)
+			os.Exit(1)
+		}
+		if err != nil {
+			stderrf("pk-verify: %v: %v\n", f.ref, err)
+			continue
+		}
+		res.Ref, res.Time = f.ref, time.Now()
+		s.Resolved = append(s.Resolved, res)
+		fmt.Printf("%v: %v\n", f.ref, res.Action)
+	}
+	saveRepairs(s, summaryPath)
+}
+
+// repairPreflight checks, before asking about anything, that every repair
+// that might be chosen for findings has somewhere to write: room in the
+// quarantine directory for the blobs moved there, the --ignore-refs file's
+// directory, and the localdisk storages that blobs would be restored to.
+func repairPreflight(conf *LowLevelConfig, findings []repairFinding, quarantineDir, ignoreFile string) error {
+	if err := checkWritable(quarantineDir, pkverify.MaxBlobSize); err != nil {
+		return fmt.Errorf("can't quarantine blobs in %v: %w", quarantineDir, err)
+	}
+	if free, ok := freeSpace(quarantineDir); ok && free < int64(len(findings))*pkverify.MaxBlobSize {
+		fmt.Printf("warning: %v has %v free, which might not be enough to quarantine all %v blob%v\n", quarantineDir, humanBytes(free), len(findings), plural(len(findings)))
+	}
+	if ignoreFile != "" {
+		if err := checkWritable(filepath.Dir(ignoreFile), 0); err != nil {
+			return fmt.Errorf("can't add to %v: %w", ignoreFile, err)
+		}
+	}
+	var prefixes []string
+	seen := map[string]bool{}
+	for _, f := range findings {
+		if !seen[f.prefix] {
+			seen[f.prefix] = true
+			prefixes = append(prefixes, f.prefix)
+		}
+	}
+	for _, leaf := range conf.leafPrefixes(prefixes) {
+		if root, ok := localdiskRoot(conf, leaf); ok {
+			if err := checkWritable(root, pkverify.MaxBlobSize); err != nil {
+				return fmt.Errorf("can't restore blobs to %v: %w", leaf, err)
+			}
+		}
+	}
+	return nil
+}
+
+// repairFindings returns the problems in s that haven't been resolved yet.
+// Missing blobs aren't attributed to a storage, so they are put back in
+// defaultPrefix.
+func repairFindings(s *Summary, defaultPrefix string) []repairFinding {
+	resolved := make(map[blob.Ref]bool)
+	for _, res := range s.Resolved {
+		resolved[res.Ref] = true
+	}
+	var findings []repairFinding
+	var prefixes []string
+	for prefix := range s.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		for _, br := range s.Prefixes[prefix].InvalidRefs {
+			if !resolved[br] {
+				findings = append(findings, repairFinding{ref: br, prefix: prefix})
+			}
+		}
+	}
+	for _, br := range s.Missing {
+		if !resolved[br] {
+			findings = append(findings, repairFinding{ref: br, prefix: defaultPrefix, missing: true})
+		}
+	}
+	return findings
+}
+
+// A repairer carries out the repairs.
+type repairer struct {
+	conf          *LowLevelConfig
+	ld            *Loader
+	fromDir       string
+	quarantineDir string
+	ignoreFile    string
+}
+
+// options returns what can be done about f.
+func (r *repairer) options(ctx context.Context, f repairFinding) ([]repairOption, error) {
+	sto, err := r.ld.GetStorage(f.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var opts []repairOption
+	for _, src := range r.sources(f.prefix) {
+		srcSto, err := r.ld.GetStorage(src)
+		if err != nil {
+			continue
+		}
+		data, err := fetchVerified(ctx, srcSto, f.ref)
+		if err != nil {
+			continue
+		}
+		src := src
+		opts = append(opts, repairOption{
+			key:    fmt.Sprintf("r%d", len(opts)+1),
+			label:  fmt.Sprintf("restore from %v (%v), which has a valid copy", src, r.conf.describe(src)),
+			action: "restore",
+			source: src,
+			do: func(ctx context.Context, aside string) (resolution, error) {
+				return r.restore(ctx, sto, f, data, src, aside)
+			},
+		})
+	}
+	if len(opts) == 1 {
+		opts[0].key = "r"
+	}
+	if path, data := r.duplicate(f.ref); data != nil {
+		opts = append(opts, repairOption{
+			key:    "d",
+			label:  fmt.Sprintf("restore from the duplicate %v", path),
+			action: "restore",
+			source: path,
+			do: func(ctx context.Context, aside string) (resolution, error) {
+				return r.restore(ctx, sto, f, data, path, aside)
+			},
+		})
+	}
+	if !f.missing {
+		opts = append(opts, repairOption{
+			key:    "q",
+			label:  fmt.Sprintf("quarantine: move it to %v and remove it from %v", r.quarantineDir, f.prefix),
+			action: "quarantine",
+			do: func(ctx context.Context, aside string) (resolution, error) {
+				return r.quarantine(ctx, sto, f, aside)
+			},
+		})
+	}
+	if r.ignoreFile != "" {
+		opts = append(opts, repairOption{
+			key:    "i",
+			label:  fmt.Sprintf("ignore: add it to %v", r.ignoreFile),
+			action: "ignore",
+			do: func(ctx context.Context, aside string) (resolution, error) {
+				return r.ignore(f)
+			},
+		})
+	}
+	return opts, nil
+}
+
+// sources returns the storages that might have another copy of the blobs in
+// prefix: every storage in the config except prefix itself, the storages it
+// is built from, and the storages built from it (which would just read the
+// same copy back).
+func (r *repairer) sources(prefix string) []string {
+	same := map[string]bool{prefix: true}
+	var down func(p string)
+	down = func(p string) {
+		for _, ref := range r.conf.referencedPrefixes(p) {
+			if !same[ref] {
+				same[ref] = true
+				down(ref)
+			}
+		}
+	}
+	down(prefix)
+	var srcs []string
+	for _, p := range sortedConfigPrefixes(r.conf) {
+		if same[p] {
+			continue
+		}
+		wraps := false
+		for _, ref := range r.conf.referencedPrefixes(p) {
+			if same[ref] {
+				wraps = true
+			}
+		}
+		// A wrapper around prefix may also read from elsewhere (like
+		// a replica), but which copy it returns is up to it. Go to
+		// the other storages directly instead.
+		if !wraps {
+			srcs = append(srcs, p)
+		}
+	}
+	return srcs
+}
+
+// duplicate looks for a valid copy of br in r.fromDir, and returns its path
+// and contents.
+func (r *repairer) duplicate(br blob.Ref) (string, []byte) {
+	if r.fromDir == "" {
+		return "", nil
+	}
+	name := br.String()
+	paths := []string{
+		filepath.Join(r.fromDir, name),
+		filepath.Join(r.fromDir, name+".dat"),
+	}
+	if path := localdiskPath(r.fromDir, br); path != "" {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if h := br.Hash(); h != nil {
+			h.Write(data)
+			if br.HashMatches(h) {
+				return path, data
+			}
+		}
+	}
+	return "", nil
+}
+
+// restore replaces the bad or missing copy of f's blob in sto with data,
+// which came from source, and checks the result. The bad copy is kept at
+// aside.
+func (r *repairer) restore(ctx context.Context, sto blobserver.Storage, f repairFinding, data []byte, source, aside string) (resolution, error) {
+	if !f.missing {
+		// Storages don't overwrite a blob they think they already
+		// have, so the bad copy has to go first. Keep it, though.
+		if err := r.moveAside(ctx, sto, f.ref, aside); err != nil {
+			return resolution{}, err
+		}
+	}
+	if _, err := blobserver.Receive(ctx, sto, f.ref, bytes.NewReader(data)); err != nil {
+		return resolution{}, fmt.Errorf("failed to write the restored copy: %w", err)
+	}
+	v := &verifier{sto: sto}
+	if err := v.verifyFetch(ctx, f.ref); err != nil {
+		return resolution{}, fmt.Errorf("the restored copy failed verification: %w", err)
+	}
+	return resolution{Action: "restored", Source: source}, nil
+}
+
+// quarantine moves the bad copy of f's blob out of sto to aside, and checks
+// that it is gone.
+func (r *repairer) quarantine(ctx context.Context, sto blobserver.Storage, f repairFinding, aside string) (resolution, error) {
+	if err := r.moveAside(ctx, sto, f.ref, aside); err != nil {
+		return resolution{}, err
+	}
+	if _, err := blobserver.StatBlob(ctx, sto, f.ref); err != os.ErrNotExist {
+		return resolution{}, fmt.Errorf("the blob is still there after removing it (%v)", err)
+	}
+	return resolution{Action: "quarantined"}, nil
+}
+
+// asidePath returns a new path in r.quarantineDir to keep the bad copy of br
+// at.
+func (r *repairer) asidePath(br blob.Ref) string {
+	return filepath.Join(r.quarantineDir, fmt.Sprintf("%v.%v.dat", br, time.Now().Unix()))
+}
+
+// moveAside saves whatever sto returns for br to path, in r.quarantineDir,
+// and then removes br from sto.
+func (r *repairer) moveAside(ctx context.Context, sto blobserver.Storage, br blob.Ref, path string) error {
+	rc, _, err := sto.Fetch(ctx, br)
+	if err != nil && err != os.ErrNotExist {
+		return fmt.Errorf("failed to read the bad copy: %w", err)
+	}
+	if err == nil {
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read the bad copy: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := writeFileSynced(path, data, 0600); err != nil {
+			return err
+		}
+	}
+	if err := sto.RemoveBlobs(ctx, []blob.Ref{br}); err != nil {
+		return fmt.Errorf("failed to remove the bad copy: %w", err)
+	}
+	return nil
+}
+
+// ignore adds f's blob to the --ignore-refs file.
+func (r *repairer) ignore(f repairFinding) (resolution, error) {
+	file, err := os.OpenFile(r.ignoreFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return resolution{}, err
+	}
+	if _, err := fmt.Fprintln(file, f.ref); err != nil {
+		file.Close()
+		return resolution{}, err
+	}
+	if err := file.Close(); err != nil {
+		return resolution{}, err
+	}
+	return resolution{Action: "ignored"}, nil
+}
+
+// saveRepairs writes s, with its new resolutions, back to path.
+func saveRepairs(s *Summary, path string) {
+	if err := s.writeFile(path); err != nil {
+		stderrf("pk-verify: failed to record the repairs in %v: %v\n", path, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// A journalEntry is one line of the repair journal.
+//
+// Every repair is journaled twice: once, as an "intent", before anything is
+// touched, saying what is about to happen and where the bad copy will be
+// kept; and once more when it is over, as "done", "failed", or (after a
+// "repair --resume --rollback") "rolledBack". An intent without an ending is
+// a repair that was interrupted partway, and the journal says enough to
+// finish it or undo it.
+type journalEntry struct {
+	SchemaVersion int `json:"schemaVersion"`
+
+	Seq    int       `json:"seq"`
+	Phase  string    `json:"phase"`
+	Time   time.Time `json:"time"`
+	Ref    blob.Ref  `json:"ref"`
+	Prefix string    `json:"prefix"`
+	Action string    `json:"action"` // "restore", "quarantine", or "ignore"
+
+	// Source is where a restored blob comes from: another storage prefix
+	// in the config, or a duplicate file.
+	Source string `json:"source,omitempty"`
+
+	// Aside is where the bad copy is kept when it is removed from the
+	// storage (see moveAside).
+	Aside string `json:"aside,omitempty"`
+
+	// IgnoreRefs is the --ignore-refs file that an ignored blob is added
+	// to.
+	IgnoreRefs string `json:"ignoreRefs,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// resolutionActions maps journaled actions to the resolutions they end in.
+var resolutionActions = map[string]string{
+	"restore":    "restored",
+	"quarantine": "quarantined",
+	"ignore":     "ignored",
+}
+
+// A repairJournal is the append-only record of the repairs made with one
+// summary file. Each entry is synced to disk before going on.
+type repairJournal struct {
+	f    *os.File
+	next int
+}
+
+// openRepairJournal opens the journal at path, creating it if need be, and
+// returns what is already in it: the repairs that were done, and the ones
+// that were interrupted.
+func openRepairJournal(path string) (j *repairJournal, done, unfinished []journalEntry, err error) {
+	j = &repairJournal{next: 1}
+	pending := map[int]journalEntry{}
+	var order []int
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		for line := 1; sc.Scan(); line++ {
+			var e journalEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				f.Close()
+				return nil, nil, nil, fmt.Errorf("%v:%v: %v", path, line, err)
+			}
+			if err := checkSchema("repair journal", fmt.Sprintf("%v:%v", path, line), e.SchemaVersion, journalSchema); err != nil {
+				f.Close()
+				return nil, nil, nil, err
+			}
+			if e.Seq >= j.next {
+				j.next = e.Seq + 1
+			}
+			switch e.Phase {
+			case "intent":
+				pending[e.Seq] = e
+				order = append(order, e.Seq)
+			case "done":
+				done = append(done, e)
+				delete(pending, e.Seq)
+			default:
+				delete(pending, e.Seq)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, nil, err
+	}
+	for _, seq := range order {
+		if e, ok := pending[seq]; ok {
+			unfinished = append(unfinished, e)
+		}
+	}
+	if j.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, nil, nil, err
+	}
+	return j, done, unfinished, nil
+}
+
+func (j *repairJournal) write(e journalEntry) error {
+	e.SchemaVersion, e.Time = journalSchema, time.Now()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// begin journals the intent to carry out e, and returns it numbered.
+func (j *repairJournal) begin(e journalEntry) (journalEntry, error) {
+	e.Seq, e.Phase = j.next, "intent"
+	j.next++
+	return e, j.write(e)
+}
+
+// end journals how the repair e ended: phase "done", "failed" (with err),
+// or "rolledBack".
+func (j *repairJournal) end(e journalEntry, phase string, err error) error {
+	e.Phase, e.Error = phase, ""
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return j.write(e)
+}
+
+func (j *repairJournal) close() error {
+	return j.f.Close()
+}
+
+// resume finishes the interrupted repair e, or with rollback, undoes as
+// much of it as is safe to. It returns the phase to journal it as.
+//
+// Restored copies are never rolled back, once they're in place and valid:
+// that would only bring the bad copy back.
+func (r *repairer) resume(ctx context.Context, e journalEntry, rollback bool) (string, error) {
+	if e.Action == "ignore" {
+		if rollback {
+			return "rolledBack", removeLine(e.IgnoreRefs, e.Ref.String())
+		}
+		ignored, err := hasLine(e.IgnoreRefs, e.Ref.String())
+		if err != nil || ignored {
+			return "done", err
+		}
+		_, err = (&repairer{ignoreFile: e.IgnoreRefs}).ignore(repairFinding{ref: e.Ref})
+		return "done", err
+	}
+
+	sto, err := r.ld.GetStorage(e.Prefix)
+	if err != nil {
+		return "", err
+	}
+	_, statErr := blobserver.StatBlob(ctx, sto, e.Ref)
+	present := statErr == nil
+	valid := present && (&verifier{sto: sto}).verifyFetch(ctx, e.Ref) == nil
+	aside := e.Aside != "" && fileExists(e.Aside)
+
+	if e.Action == "restore" && valid {
+		return "done", nil
+	}
+	if rollback {
+		if !present && aside {
+			return "rolledBack", r.putBack(e)
+		}
+		return "rolledBack", nil
+	}
+	switch e.Action {
+	case "quarantine":
+		f := repairFinding{ref: e.Ref, prefix: e.Prefix}
+		if !present {
+			return "done", nil
+		}
+		if aside && r.asideHolds(ctx, sto, e.Ref, e.Aside) {
+			// Moved aside, but not removed yet.
+			if err := sto.RemoveBlobs(ctx, []blob.Ref{e.Ref}); err != nil {
+				return "", fmt.Errorf("failed to remove the bad copy: %w", err)
+			}
+			return "done", nil
+		}
+		_, err := r.quarantine(ctx, sto, f, e.Aside)
+		return "done", err
+	case "restore":
+		data, err := r.sourceData(ctx, e.Source, e.Ref)
+		if err != nil {
+			return "", fmt.Errorf("can't read it from %v any more: %w", e.Source, err)
+		}
+		f := repairFinding{ref: e.Ref, prefix: e.Prefix, missing: !present}
+		if present && aside && r.asideHolds(ctx, sto, e.Ref, e.Aside) {
+			if err := sto.RemoveBlobs(ctx, []blob.Ref{e.Ref}); err != nil {
+				return "", fmt.Errorf("failed to remove the bad copy: %w", err)
+			}
+			f.missing = true
+		}
+		_, err = r.restore(ctx, sto, f, data, e.Source, e.Aside)
+		return "done", err
+	}
+	return "", fmt.Errorf("unknown repair action %q", e.Action)
+}
+
+// sourceData reads a valid copy of br from source, which is either a
+// storage prefix in the config or a duplicate file.
+func (r *repairer) sourceData(ctx context.Context, source string, br blob.Ref) ([]byte, error) {
+	if _, ok := r.conf.Prefixes[source]; ok {
+		sto, err := r.ld.GetStorage(source)
+		if err != nil {
+			return nil, err
+		}
+		return fetchVerified(ctx, sto, br)
+	}
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	h := br.Hash()
+	if h == nil {
+		return nil, fmt.Errorf("unsupported hash function in blob ref %v", br)
+	}
+	h.Write(data)
+	if !br.HashMatches(h) {
+		return nil, fmt.Errorf("%v no longer matches %v", source, br)
+	}
+	return data, nil
+}
+
+// putBack returns the bad copy that e moved aside to the storage it came
+// from. Storages refuse blobs that don't match their refs, so this only
+// works for localdisk storages, whose files can be written directly.
+func (r *repairer) putBack(e journalEntry) error {
+	leaves := r.conf.leafPrefixes([]string{e.Prefix})
+	root, ok := "", false
+	if len(leaves) == 1 {
+		root, ok = localdiskRoot(r.conf, leaves[0])
+	}
+	path := localdiskPath(root, e.Ref)
+	if !ok || path == "" {
+		return fmt.Errorf("can't put the bad copy back into %v (%v); it stays in %v", e.Prefix, r.conf.describe(e.Prefix), e.Aside)
+	}
+	data, err := ioutil.ReadFile(e.Aside)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileSynced(path, data, 0600)
+}
+
+// asideHolds reports whether the file at path, where a bad copy of br was
+// being moved aside, holds all of what sto still has for br. Until it does,
+// the copy in sto is the only full one, and mustn't be removed: the repair
+// may have been interrupted partway through writing the file.
+func (r *repairer) asideHolds(ctx context.Context, sto blobserver.Storage, br blob.Ref, path string) bool {
+	kept, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	rc, _, err := sto.Fetch(ctx, br)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	return err == nil && bytes.Equal(data, kept)
+}
+
+// writeFileSynced writes data to path all at once: to a temporary file
+// first, which is synced to disk and then renamed into place, so that a
+// crash partway leaves either no file at path or the whole of it.
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// hasLine reports whether the file at path has a line that is just s.
+func hasLine(path, s string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == s {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeLine removes the lines that are just s from the file at path.
+func removeLine(path, s string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.TrimSpace(line) != s {
+			kept = append(kept, line)
+		}
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(kept, "")), 0644)
+}
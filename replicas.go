@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var compareReplicas = flag.Bool("compare-replicas", false, "when a storage being verified is a replica storage (like /bs/ in a config with replicas), read every blob from two of its replicas at once, rather than from whichever the replica handler picks, and compare them, to catch a replica that returns wrong contents (or none) while another has the right ones, and say which. Each pair of neighboring replicas gets its share of the blobs; blobs are fetched one by one rather than streamed")
+
+// A replicaCompare reads blobs from two replicas of a replica storage at
+// once, for --compare-replicas, and remembers which replicas returned
+// something other than the blob.
+//
+// A nil *replicaCompare does nothing.
+type replicaCompare struct {
+	prefixes []string // the replicas, in the order the config gives them
+	stos     []blobserver.Storage
+
+	mu          sync.Mutex
+	divergences []replicaDivergence
+}
+
+// A replicaDivergence is a replica that didn't return a blob that another
+// replica returned intact.
+type replicaDivergence struct {
+	Ref     blob.Ref `json:"ref"`
+	Replica string   `json:"replica"`
+	Problem string   `json:"problem"`
+}
+
+// newReplicaCompare returns a replicaCompare for the storage at prefix, or
+// nil if --compare-replicas isn't set or the storage isn't a replica storage
+// with at least two replicas.
+func newReplicaCompare(ld *Loader, conf *LowLevelConfig, prefix string) (*replicaCompare, error) {
+	sc := conf.Prefixes[prefix]
+	if !*compareReplicas || sc.StorageHandler != "replica" {
+		return nil, nil
+	}
+	c := &replicaCompare{}
+	list, _ := sc.StorageHandlerArgs["backends"].([]interface{})
+	for _, b := range list {
+		backend, ok := b.(string)
+		if !ok {
+			continue
+		}
+		sto, err := ld.GetStorage(backend)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the replica %v to compare it: %w", backend, err)
+		}
+		c.prefixes = append(c.prefixes, backend)
+		c.stos = append(c.stos, sto)
+	}
+	if len(c.stos) < 2 {
+		fmt.Printf("%v: only has %v replica%v, so there is nothing to compare\n", prefix, len(c.stos), plural(len(c.stos)))
+		return nil, nil
+	}
+	return c, nil
+}
+
+// pair returns the replicas to read br from: the one its digest picks, and
+// the next. That spreads the reads evenly, and compares every replica with
+// its neighbors.
+func (c *replicaCompare) pair(br blob.Ref) (int, int) {
+	n := 0
+	for _, ch := range br.Digest() {
+		n = (n*16 + int(ch)) % len(c.stos)
+	}
+	return n, (n + 1) % len(c.stos)
+}
+
+// fetch reads br from a pair of replicas at once, records the replicas that
+// didn't return it intact while the other did, and returns the intact
+// contents; or, if neither is intact, the contents of the first replica that
+// returned any, for verification to fail on.
+func (c *replicaCompare) fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	i, j := c.pair(br)
+	type read struct {
+		data []byte
+		err  error
+	}
+	var (
+		reads [2]read
+		wg    sync.WaitGroup
+	)
+	for k, r := range [2]int{i, j} {
+		wg.Add(1)
+		go func(k int, sto blobserver.Storage) {
+			defer wg.Done()
+			rc, _, err := sto.Fetch(ctx, br)
+			if err != nil {
+				reads[k].err = err
+				return
+			}
+			defer rc.Close()
+			reads[k].data, reads[k].err = ioutil.ReadAll(rc)
+		}(k, c.stos[r])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	contents := func(data []byte) (io.ReadCloser, uint32, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), uint32(len(data)), nil
+	}
+	a, b := reads[0], reads[1]
+	switch {
+	case a.err != nil && b.err != nil:
+		return nil, 0, a.err
+	case a.err == nil && b.err == nil && bytes.Equal(a.data, b.data):
+		return contents(a.data)
+	}
+
+	intact := func(r read) bool {
+		if r.err != nil {
+			return false
+		}
+		h := br.Hash()
+		if h == nil {
+			return false
+		}
+		h.Write(r.data)
+		return br.HashMatches(h)
+	}
+	good := -1
+	for k, r := range reads {
+		if intact(r) {
+			good = k
+		}
+	}
+	if good < 0 {
+		if a.err != nil {
+			return contents(b.data)
+		}
+		return contents(a.data)
+	}
+	bad, replica := reads[1-good], []int{i, j}[1-good]
+	var problem string
+	switch {
+	case os.IsNotExist(bad.err):
+		problem = "missing"
+	case bad.err != nil:
+		problem = fmt.Sprintf("failed to read it: %v", bad.err)
+	default:
+		h := br.Hash()
+		h.Write(bad.data)
+		problem = fmt.Sprintf("returned %v bytes that hash to %v", len(bad.data), blob.RefFromHash(h))
+	}
+	c.mu.Lock()
+	c.divergences = append(c.divergences, replicaDivergence{Ref: br, Replica: c.prefixes[replica], Problem: problem})
+	c.mu.Unlock()
+	return contents(reads[good].data)
+}
+
+// result returns what the replicas got wrong, by ref and replica.
+func (c *replicaCompare) result() []replicaDivergence {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := append([]replicaDivergence(nil), c.divergences...)
+	sort.Slice(d, func(i, j int) bool {
+		if d[i].Ref != d[j].Ref {
+			return d[i].Ref.Less(d[j].Ref)
+		}
+		return d[i].Replica < d[j].Replica
+	})
+	return d
+}
+
+// fetch fetches br from v.sto, or, with --compare-replicas, from two of its
+// replicas at once.
+func (v *verifier) fetch(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	if v.replicas == nil {
+		return v.sto.Fetch(ctx, br)
+	}
+	return v.replicas.fetch(ctx, br)
+}
+
+// reportReplicaDivergences reports what the replicas got wrong, and sums it
+// up by replica.
+func reportReplicaDivergences(divergences []replicaDivergence, found *findings) {
+	byReplica := map[string]int{}
+	for _, d := range divergences {
+		found.report("replica %v disagrees about blob %v, which another replica has intact: %v", d.Replica, d.Ref, d.Problem)
+		byReplica[d.Replica]++
+	}
+	var replicas []string
+	for r := range byReplica {
+		replicas = append(replicas, r)
+	}
+	sort.Strings(replicas)
+	for _, r := range replicas {
+		n := byReplica[r]
+		fmt.Printf("REPLICA DIVERGED: %v returned wrong or no contents for %v blob%v that another replica has intact, listed %v.\n", r, humanCount(n), plural(n), found.where())
+	}
+}
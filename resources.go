@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resourceUsage is what a run cost pk-verify itself. It's kept in the
+// history too, so that a version of pk-verify that got slower or hungrier
+// shows up next to the runs of the one before it.
+type resourceUsage struct {
+	// Version is pk-verify's module version, as built.
+	Version string `json:"version,omitempty"`
+
+	// PeakRSS is the most memory the process had resident at once, in
+	// bytes, and CPUSeconds the CPU time it used, user and system. Both
+	// are left out where the system doesn't say.
+	PeakRSS    int64   `json:"peakRSS,omitempty"`
+	CPUSeconds float64 `json:"cpuSeconds,omitempty"`
+
+	// GCs is how many garbage collections ran, GCPauseSeconds how long
+	// they stopped the world for in all, and AllocatedBytes how much was
+	// allocated over the run.
+	GCs            uint32  `json:"gcs"`
+	GCPauseSeconds float64 `json:"gcPauseSeconds"`
+	AllocatedBytes uint64  `json:"allocatedBytes"`
+
+	// BytesRead is how much was read from each storage handler (like
+	// "filesystem" or "s3"), over all of the prefixes that use it.
+	BytesRead map[string]int64 `json:"bytesRead,omitempty"`
+}
+
+// measureResources reports what the run described by s has cost so far.
+func measureResources(s *Summary) *resourceUsage {
+	u := &resourceUsage{BytesRead: map[string]int64{}}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		u.Version = info.Main.Version
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	u.GCs = ms.NumGC
+	u.GCPauseSeconds = time.Duration(ms.PauseTotalNs).Seconds()
+	u.AllocatedBytes = ms.TotalAlloc
+	if rss, cpu, ok := processUsage(); ok {
+		u.PeakRSS, u.CPUSeconds = rss, cpu.Seconds()
+	}
+	for _, ps := range s.Prefixes {
+		u.BytesRead[ps.Handler] += ps.Bytes
+	}
+	return u
+}
+
+func (u *resourceUsage) print() {
+	var parts []string
+	if u.PeakRSS > 0 {
+		parts = append(parts, fmt.Sprintf("peak memory %v", humanBytes(u.PeakRSS)))
+	}
+	if u.CPUSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("%v of CPU", humanDuration(time.Duration(u.CPUSeconds*float64(time.Second)))))
+	}
+	parts = append(parts, fmt.Sprintf("%v GC%v (%.2fs paused), %v allocated", u.GCs, plural(int(u.GCs)), u.GCPauseSeconds, humanBytes(int64(u.AllocatedBytes))))
+	fmt.Printf("resources: %v\n", strings.Join(parts, ", "))
+	var handlers []string
+	for handler := range u.BytesRead {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	for _, handler := range handlers {
+		fmt.Printf("  read %v from %v storage\n", humanBytes(u.BytesRead[handler]), handler)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var rootFlag = flag.String("root", "", "instead of verifying every blob, verify the tree at this permanode, directory, or file ref: every blob reachable from it through claims, file parts, and directory entries, found through the blobs alone (no index), and report whether the tree is complete")
+
+// A treeWalker finds the blobs that make up a tree of Perkeep objects, by
+// following schema blobs: the parts of files, the entries of directories,
+// the members of static sets, and (if it has a storage to find claims in)
+// the claims on permanodes and the blobs that they point to.
+type treeWalker struct {
+	f blob.Fetcher
+
+	// sto, if non-nil, is read for the claims on permanodes, the first
+	// time one is found. Without it, permanodes aren't followed.
+	sto    blobserver.Storage
+	claims claimIndex
+
+	// add is called with each blob found, and reports whether it is new,
+	// so that shared subtrees are only followed once.
+	add func(blob.Ref) bool
+
+	// unfollowed counts the schema blobs that couldn't be read, so that
+	// whatever is under them is unknown.
+	unfollowed int
+}
+
+// claimRefAttr reports whether the values of the permanode attribute attr
+// are blobs in the permanode's tree.
+func claimRefAttr(attr string) bool {
+	return attr == "camliContent" || attr == "camliMember" || strings.HasPrefix(attr, "camliPath:")
+}
+
+// walk adds br and everything under it. Schema blobs that can't be read are
+// still added, but not followed; verifying them says what's wrong.
+func (w *treeWalker) walk(ctx context.Context, br blob.Ref) error {
+	if !w.add(br) {
+		return nil
+	}
+	sb, err := fetchSchema(ctx, w.f, br)
+	if err != nil {
+		w.unfollowed++
+		return nil
+	}
+	if sb.Signer.Valid() {
+		w.add(sb.Signer)
+	}
+	var children []blob.Ref
+	for _, p := range sb.Parts {
+		w.add(p.BlobRef)
+		children = append(children, p.BytesRef)
+	}
+	switch sb.Type {
+	case "directory":
+		children = append(children, sb.Entries)
+	case "static-set":
+		children = append(children, sb.Members...)
+		children = append(children, sb.MergeSets...)
+	case "permanode":
+		if w.sto == nil {
+			break
+		}
+		if w.claims == nil {
+			fmt.Println("reading the claims in the store (this reads every small blob in it)...")
+			if w.claims, err = indexClaims(ctx, w.sto); err != nil {
+				return fmt.Errorf("failed to read the claims: %w", err)
+			}
+		}
+		for _, cl := range w.claims[br] {
+			w.add(cl.ref)
+			if cl.Signer.Valid() {
+				w.add(cl.Signer)
+			}
+			if !claimRefAttr(cl.Attribute) || cl.ClaimType == "del-attribute" {
+				continue
+			}
+			if ref, ok := blob.Parse(cl.Value); ok {
+				children = append(children, ref)
+			}
+		}
+	}
+	for _, c := range children {
+		if !c.Valid() {
+			continue
+		}
+		if err := w.walk(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyRoot verifies the tree at --root, read from sto, and prints what it
+// found. It reports whether the tree was complete and valid.
+func verifyRoot(ctx context.Context, sto blobserver.Storage, workers int) (bool, error) {
+	root, ok := blob.Parse(*rootFlag)
+	if !ok {
+		return false, fmt.Errorf("invalid --root ref %q", *rootFlag)
+	}
+	var refs []blob.Ref
+	seen := map[blob.Ref]bool{}
+	w := &treeWalker{f: sto, sto: sto, add: func(br blob.Ref) bool {
+		if !br.Valid() || seen[br] {
+			return false
+		}
+		seen[br] = true
+		refs = append(refs, br)
+		return true
+	}}
+	if err := w.walk(ctx, root); err != nil {
+		return false, err
+	}
+	fmt.Printf("found %v blob%v in the tree at %v\n", len(refs), plural(len(refs)), root)
+	res, err := verifyRefList(ctx, sto, refs, workers)
+	if err != nil {
+		return false, err
+	}
+	if w.unfollowed > 0 {
+		fmt.Printf("TREE INCOMPLETE: %v schema blob%v couldn't be read, so whatever is under %v is unknown\n", w.unfollowed, plural(w.unfollowed), itThey(w.unfollowed))
+		return false, nil
+	}
+	if !res.OK() {
+		fmt.Println("TREE INCOMPLETE: it has invalid or missing blobs")
+		return false, nil
+	}
+	fmt.Println("the tree is complete")
+	return true, nil
+}
+
+// verifyRefList verifies refs, read from f, and prints the results.
+func verifyRefList(ctx context.Context, f blob.Fetcher, refs []blob.Ref, workers int) (*pkverify.Result, error) {
+	res, err := pkverify.Refs(ctx, f, refs, &pkverify.Options{Workers: workers})
+	if err != nil {
+		return nil, err
+	}
+	for _, br := range res.InvalidRefs {
+		fmt.Printf("invalid blob: %v\n", br)
+	}
+	for _, br := range res.Missing {
+		fmt.Printf("missing blob: %v\n", br)
+	}
+	fmt.Printf("%v valid blob%v (%v), %v invalid, %v missing\n", res.Valid, plural(res.Valid), humanBytes(res.Bytes), res.Invalid, len(res.Missing))
+	return res, nil
+}
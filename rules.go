@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+)
+
+var rulesFile = flag.String("rules", "", "a JSON file of pk-verify's own settings, separate from the server config: which --checks run on which storages, how many workers each gets, the daemon's schedule, and who to notify when a run finds problems. Flags given on the command line win over it")
+
+// rulesConfig is the file given by --rules. For example:
+//
+//	{
+//		"rules": [
+//			{"handler": "s3", "workers": 2},
+//			{"prefix": "/bs/", "checks": ["hash", "size"]}
+//		],
+//		"schedule": {"full": "720h", "incremental": "24h", "recheck": "1h"},
+//		"notify": [
+//			{"command": "mail -s 'pk-verify: '$PK_VERIFY_STATUS me@example.com"},
+//			{"url": "https://hooks.example.com/pk-verify"}
+//		]
+//	}
+//
+// A nil *rulesConfig has no rules, so callers don't have to check whether
+// --rules was given.
+type rulesConfig struct {
+	// Rules apply settings to the storages they match. Every rule that
+	// matches a storage applies, in order, so later rules override
+	// earlier ones.
+	Rules []rule `json:"rules"`
+
+	// Schedule is the default schedule of "pk-verify daemon", as
+	// durations like "24h"; see its --full-every, --incremental-every,
+	// and --recheck-every.
+	Schedule struct {
+		Full        string `json:"full"`
+		Incremental string `json:"incremental"`
+		Recheck     string `json:"recheck"`
+	} `json:"schedule"`
+
+	// Notify lists who to tell when a run doesn't come out clean.
+	Notify []notifyTarget `json:"notify"`
+}
+
+// A rule applies settings to the storages at Prefix, or with the storage
+// handler Handler, or (with neither) to every storage.
+type rule struct {
+	Prefix  string   `json:"prefix"`
+	Handler string   `json:"handler"`
+	Checks  []string `json:"checks"`  // like --checks
+	Workers int      `json:"workers"` // like --workers
+}
+
+// A notifyTarget is told about a run that didn't come out clean. Command is
+// a shell command, run with PK_VERIFY_STATUS set to the run's status and
+// the JSON summary of the run on its standard input; URL gets the JSON
+// summary POSTed to it.
+type notifyTarget struct {
+	Command string `json:"command"`
+	URL     string `json:"url"`
+}
+
+// loadRules loads the file given by --rules, or returns nil if there is
+// none.
+func loadRules() (*rulesConfig, error) {
+	if *rulesFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(*rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	rc := new(rulesConfig)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(rc); err != nil {
+		return nil, fmt.Errorf("%v: %w", *rulesFile, err)
+	}
+	for i, r := range rc.Rules {
+		if r.Workers < 0 {
+			return nil, fmt.Errorf("%v: rule %d: workers must not be negative", *rulesFile, i+1)
+		}
+		for _, name := range r.Checks {
+			if _, err := pkverify.NewCheck(name); err != nil {
+				return nil, fmt.Errorf("%v: rule %d: %w", *rulesFile, i+1, err)
+			}
+		}
+	}
+	for _, n := range rc.Notify {
+		if (n.Command == "") == (n.URL == "") {
+			return nil, fmt.Errorf("%v: each notify target needs exactly one of \"command\" and \"url\"", *rulesFile)
+		}
+	}
+	for _, d := range []string{rc.Schedule.Full, rc.Schedule.Incremental, rc.Schedule.Recheck} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return nil, fmt.Errorf("%v: schedule: %w", *rulesFile, err)
+		}
+	}
+	return rc, nil
+}
+
+// matching returns the rules that apply to the storage at prefix, in order.
+func (rc *rulesConfig) matching(conf *LowLevelConfig, prefix string) []rule {
+	if rc == nil {
+		return nil
+	}
+	handler := conf.Prefixes[prefix].StorageHandler
+	var rules []rule
+	for _, r := range rc.Rules {
+		if (r.Prefix == "" || r.Prefix == prefix) && (r.Handler == "" || r.Handler == handler) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// checks returns the checks to run on the storage at prefix: the ones
+// --checks gives, unless it wasn't set and a rule says otherwise.
+func (rc *rulesConfig) checks(conf *LowLevelConfig, prefix string) ([]pkverify.Check, error) {
+	if flagWasSet("checks") {
+		return loadChecks(*checksFlag)
+	}
+	names := *checksFlag
+	for _, r := range rc.matching(conf, prefix) {
+		if len(r.Checks) > 0 {
+			names = strings.Join(r.Checks, ",")
+		}
+	}
+	return loadChecks(names)
+}
+
+// workers returns how many workers the rules give the storage at prefix,
+// or 0 if they don't (or --workers was set).
+func (rc *rulesConfig) workers(conf *LowLevelConfig, prefix string) int {
+	if flagWasSet("workers") {
+		return 0
+	}
+	n := 0
+	for _, r := range rc.matching(conf, prefix) {
+		if r.Workers > 0 {
+			n = r.Workers
+		}
+	}
+	return n
+}
+
+// schedule returns the daemon's schedule from the rules, with zero for
+// anything they don't give.
+func (rc *rulesConfig) schedule() (full, incremental, recheck time.Duration) {
+	if rc == nil {
+		return 0, 0, 0
+	}
+	// loadRules checked that these parse.
+	full, _ = time.ParseDuration(rc.Schedule.Full)
+	incremental, _ = time.ParseDuration(rc.Schedule.Incremental)
+	recheck, _ = time.ParseDuration(rc.Schedule.Recheck)
+	return full, incremental, recheck
+}
+
+// notify tells the notify targets about s, if the run didn't come out
+// clean. Failures to notify are reported, but don't change the outcome of
+// the run.
+func (rc *rulesConfig) notify(ctx context.Context, s *Summary) {
+	if rc == nil || len(rc.Notify) == 0 || s.Status == "clean" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		stderrf("pk-verify: failed to notify: %v\n", err)
+		return
+	}
+	data = s.redact.redact(append(data, '\n'))
+	for _, n := range rc.Notify {
+		var err error
+		if n.Command != "" {
+			c := shellCommand(ctx, n.Command)
+			c.Stdin = bytes.NewReader(data)
+			c.Stdout, c.Stderr = os.Stderr, os.Stderr
+			c.Env = append(os.Environ(), "PK_VERIFY_STATUS="+s.Status)
+			err = c.Run()
+		} else {
+			err = postSummary(ctx, n.URL, data)
+		}
+		if err != nil {
+			stderrf("pk-verify: failed to notify %v: %v\n", n.Command+n.URL, err)
+		}
+	}
+}
+
+// postSummary POSTs the JSON summary data to url.
+func postSummary(ctx context.Context, url string, data []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v", resp.Status)
+	}
+	return nil
+}
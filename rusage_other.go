@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+import "time"
+
+// processUsage returns the peak resident memory of the process and the CPU
+// time it has used. It's only supported on some systems.
+func processUsage() (peakRSS int64, cpu time.Duration, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// processUsage returns the peak resident memory of the process, in bytes,
+// and the CPU time it has used.
+func processUsage() (peakRSS int64, cpu time.Duration, ok bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0, false
+	}
+	peakRSS = int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		peakRSS *= 1024 // everywhere else, it's in kilobytes
+	}
+	cpu = time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	return peakRSS, cpu, true
+}
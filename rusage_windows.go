@@ -0,0 +1,47 @@
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var procGetProcessMemoryInfo = syscall.NewLazyDLL("psapi.dll").NewProc("GetProcessMemoryInfo")
+
+// processMemoryCounters is PROCESS_MEMORY_COUNTERS.
+type processMemoryCounters struct {
+	cb                         uint32
+	pageFaultCount             uint32
+	peakWorkingSetSize         uintptr
+	workingSetSize             uintptr
+	quotaPeakPagedPoolUsage    uintptr
+	quotaPagedPoolUsage        uintptr
+	quotaPeakNonPagedPoolUsage uintptr
+	quotaNonPagedPoolUsage     uintptr
+	pagefileUsage              uintptr
+	peakPagefileUsage          uintptr
+}
+
+// processUsage returns the peak working set of the process, in bytes, and
+// the CPU time it has used.
+func processUsage() (peakRSS int64, cpu time.Duration, ok bool) {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, 0, false
+	}
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return 0, 0, false
+	}
+	// Filetimes count 100ns intervals; these are durations, not dates.
+	ticks := func(ft syscall.Filetime) time.Duration {
+		return time.Duration(int64(ft.HighDateTime)<<32|int64(ft.LowDateTime)) * 100
+	}
+	cpu = ticks(kernel) + ticks(user)
+	var mc processMemoryCounters
+	mc.cb = uint32(unsafe.Sizeof(mc))
+	if r, _, _ := procGetProcessMemoryInfo.Call(uintptr(h), uintptr(unsafe.Pointer(&mc)), uintptr(mc.cb)); r != 0 {
+		peakRSS = int64(mc.peakWorkingSetSize)
+	}
+	return peakRSS, cpu, true
+}
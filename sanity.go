@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go4.org/jsonconfig"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var sanity = flag.Bool("sanity", false, "also look for things that are suspicious even though the hashes match: blobpacked zips whose metadata disagrees with the meta index or that have unexplained (especially zero-filled) gaps, and, for invalid loose blob files, whether they are a valid blob followed by garbage")
+
+// Zip record signatures and sizes, for finding the gaps between a zip's
+// members.
+const (
+	zipLocalHeaderSig   = 0x04034b50
+	zipDataDescSig      = 0x08074b50
+	zipLocalHeaderLen   = 30
+	zipEndOfCentralLen  = 22
+	maxZipCommentLength = 0xffff
+)
+
+// packedPos is where the meta index says a packed blob is.
+type packedPos struct {
+	size   uint32
+	zip    blob.Ref
+	offset int64
+}
+
+// sanityManifest is the part of a blobpacked zip manifest that the sanity
+// checks need: where each data blob is in the zip.
+type sanityManifest struct {
+	DataBlobs []struct {
+		Ref    blob.Ref `json:"blobRef"`
+		Size   uint32   `json:"size"`
+		Offset int64    `json:"offset"`
+	} `json:"dataBlobs"`
+}
+
+// checkSanity looks through the zips of every blobpacked storage in the
+// config for things that the hashes can't catch, and returns what it
+// found. Like checkBlobpacked, it must run before the blobpacked storages
+// are loaded.
+func checkSanity(ctx context.Context, ld *Loader) ([]string, error) {
+	var suspicions []string
+	for _, prefix := range sortedConfigPrefixes(ld.conf) {
+		sc := ld.conf.Prefixes[prefix]
+		if sc.StorageHandler != "blobpacked" {
+			continue
+		}
+		fmt.Printf("%v: looking for suspicious zips\n", prefix)
+		s, err := checkZipSanity(ctx, ld, sc.StorageHandlerArgs)
+		if err != nil {
+			return nil, fmt.Errorf("in %v: %w", prefix, err)
+		}
+		for _, msg := range s {
+			suspicions = append(suspicions, fmt.Sprintf("%v: %v", prefix, msg))
+		}
+	}
+	return suspicions, nil
+}
+
+// checkZipSanity checks the zips of one blobpacked storage, given its
+// handler arguments.
+func checkZipSanity(ctx context.Context, ld *Loader, args jsonconfig.Obj) ([]string, error) {
+	large, _ := args["largeBlobs"].(string)
+	metaConf, _ := args["metaIndex"].(map[string]interface{})
+	if large == "" || metaConf == nil {
+		return nil, fmt.Errorf("blobpacked needs \"largeBlobs\" and \"metaIndex\" arguments")
+	}
+	largeSto, err := ld.GetStorage(large)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := openSortedReadOnly(jsonconfig.Obj(metaConf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the meta index: %w", err)
+	}
+	positions := make(map[blob.Ref]packedPos)
+	it := meta.Find(packMetaPrefix, "b;")
+	for it.Next() {
+		br, ok := blob.Parse(strings.TrimPrefix(it.Key(), packMetaPrefix))
+		fields := strings.Fields(it.Value())
+		if !ok || len(fields) != 3 {
+			continue // checkBlobpacked reports these
+		}
+		size, err1 := strconv.ParseUint(fields[0], 10, 32)
+		zipRef, ok := blob.Parse(fields[1])
+		offset, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 == nil && ok && err2 == nil {
+			positions[br] = packedPos{uint32(size), zipRef, offset}
+		}
+	}
+	err = it.Close()
+	if cerr := meta.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the meta index: %w", err)
+	}
+
+	var suspicions []string
+	err = blobserver.EnumerateAll(ctx, largeSto, func(sb blob.SizedRef) error {
+		if sb.Size > maxPackedZipSize {
+			return nil
+		}
+		data, err := fetchVerified(ctx, largeSto, sb.Ref)
+		if err != nil {
+			return nil // verification reports it
+		}
+		for _, s := range zipSuspicions(data, positions) {
+			suspicions = append(suspicions, fmt.Sprintf("zip %v: %v", sb.Ref, s))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the zips in %v: %w", large, err)
+	}
+	return suspicions, nil
+}
+
+// zipSuspicions returns what is suspicious about one blobpacked zip, whose
+// blobs the meta index places at positions. The zip is valid as a blob;
+// these are the ways its contents can still be wrong:
+//
+//   - the zip's own metadata disagrees with itself, or with the manifest,
+//     about how big a member or blob is;
+//   - the manifest and the meta index disagree about where a blob is;
+//   - there are bytes that no member accounts for, which blobpacked never
+//     writes. Zero-filled ones look like data that went missing before the
+//     zip was hashed.
+func zipSuspicions(data []byte, positions map[blob.Ref]packedPos) []string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil // packedMembers reports it
+	}
+	var suspicions []string
+	type span struct{ start, end int64 } // of a member's data
+	var stored []span
+	var manifest *sanityManifest
+	for _, zf := range zr.File {
+		start, err := zf.DataOffset()
+		if err != nil {
+			suspicions = append(suspicions, fmt.Sprintf("member %v: %v", zf.Name, err))
+			continue
+		}
+		end := start + int64(zf.CompressedSize64)
+		if end > int64(len(data)) {
+			suspicions = append(suspicions, fmt.Sprintf("member %v claims %v bytes, which run past the end of the zip", zf.Name, zf.CompressedSize64))
+			continue
+		}
+		if zf.Method == zip.Store {
+			if zf.CompressedSize64 != zf.UncompressedSize64 {
+				suspicions = append(suspicions, fmt.Sprintf("member %v is stored uncompressed, but its sizes disagree (%v stored, %v uncompressed)", zf.Name, zf.CompressedSize64, zf.UncompressedSize64))
+			}
+			stored = append(stored, span{start, end})
+		}
+		if zf.Name == packManifestName {
+			rc, err := zf.Open()
+			if err != nil {
+				continue
+			}
+			m := new(sanityManifest)
+			if json.NewDecoder(rc).Decode(m) == nil {
+				manifest = m
+			}
+			rc.Close()
+		}
+	}
+
+	if manifest != nil {
+		for _, db := range manifest.DataBlobs {
+			end := db.Offset + int64(db.Size)
+			inside := false
+			for _, s := range stored {
+				if db.Offset >= s.start && end <= s.end {
+					inside = true
+					break
+				}
+			}
+			if !inside {
+				suspicions = append(suspicions, fmt.Sprintf("the manifest places blob %v at bytes %v-%v, which aren't inside any stored member", db.Ref, db.Offset, end))
+			}
+			pos, ok := positions[db.Ref]
+			switch {
+			case !ok:
+				// checkBlobpacked reports it
+			case pos.size != db.Size:
+				suspicions = append(suspicions, fmt.Sprintf("blob %v is %v bytes according to the manifest, but %v according to the meta index", db.Ref, db.Size, pos.size))
+			case pos.offset != db.Offset:
+				suspicions = append(suspicions, fmt.Sprintf("blob %v is at offset %v according to the manifest, but %v according to the meta index", db.Ref, db.Offset, pos.offset))
+			}
+		}
+	}
+
+	for _, gap := range zipGaps(data, zr) {
+		what := "holding data"
+		if allZero(data[gap[0]:gap[1]]) {
+			what = "all zeros, as if data is missing"
+		}
+		suspicions = append(suspicions, fmt.Sprintf("%v bytes at offset %v belong to no member (%v)", gap[1]-gap[0], gap[0], what))
+	}
+	return suspicions
+}
+
+// zipGaps returns the byte ranges of data, before the central directory,
+// that aren't a member's local header, data, or data descriptor.
+func zipGaps(data []byte, zr *zip.Reader) [][2]int64 {
+	type member struct{ dataStart, dataEnd int64 }
+	var members []member
+	for _, zf := range zr.File {
+		start, err := zf.DataOffset()
+		if err != nil {
+			return nil
+		}
+		members = append(members, member{start, start + int64(zf.CompressedSize64)})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].dataStart < members[j].dataStart })
+	le := binary.LittleEndian
+	var gaps [][2]int64
+	pos := int64(0)
+	for _, m := range members {
+		if pos+16 <= m.dataStart && le.Uint32(data[pos:]) == zipDataDescSig {
+			pos += 16 // the previous member's data descriptor
+		}
+		// The member's local header should start here, and end right
+		// where its data does.
+		hdr := pos
+		if hdr+zipLocalHeaderLen > m.dataStart || le.Uint32(data[hdr:]) != zipLocalHeaderSig {
+			i := bytes.Index(data[pos:m.dataStart], []byte("PK\x03\x04"))
+			if i < 0 {
+				return nil // not a layout this understands
+			}
+			hdr = pos + int64(i)
+			gaps = append(gaps, [2]int64{pos, hdr})
+		}
+		hdrEnd := hdr + zipLocalHeaderLen + int64(le.Uint16(data[hdr+26:])) + int64(le.Uint16(data[hdr+28:]))
+		if hdrEnd < m.dataStart {
+			gaps = append(gaps, [2]int64{hdrEnd, m.dataStart})
+		}
+		pos = m.dataEnd
+	}
+	if cd, ok := centralDirOffset(data); ok && pos < cd {
+		if cd-pos >= 16 && le.Uint32(data[pos:]) == zipDataDescSig {
+			pos += 16
+		}
+		if pos < cd {
+			gaps = append(gaps, [2]int64{pos, cd})
+		}
+	}
+	return gaps
+}
+
+// centralDirOffset returns where a zip's central directory starts, from its
+// end of central directory record. It isn't found for zip64 archives,
+// which blobpacked doesn't write.
+func centralDirOffset(data []byte) (int64, bool) {
+	from := len(data) - zipEndOfCentralLen - maxZipCommentLength
+	if from < 0 {
+		from = 0
+	}
+	i := bytes.LastIndex(data[from:], []byte("PK\x05\x06"))
+	if i < 0 || from+i+zipEndOfCentralLen > len(data) {
+		return 0, false
+	}
+	off := binary.LittleEndian.Uint32(data[from+i+16:])
+	if off == 0xffffffff || int64(off) > int64(len(data)) {
+		return 0, false
+	}
+	return int64(off), true
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// trailingGarbage looks at an invalid loose blob file for a valid blob
+// followed by something else: zeros (as a file extended by a crash or a
+// filesystem repair might be), or a repeat of its own contents. It returns
+// a description of what it found, or "".
+func trailingGarbage(f blobFile) string {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	matches := func(n int) bool {
+		h := f.ref.Hash()
+		if h == nil {
+			return false
+		}
+		h.Write(data[:n])
+		return f.ref.HashMatches(h)
+	}
+	n := len(data)
+	for n > 0 && data[n-1] == 0 {
+		n--
+	}
+	if n < len(data) && matches(n) {
+		return fmt.Sprintf("the first %v bytes are a valid blob, followed by %v zero bytes", n, len(data)-n)
+	}
+	if half := len(data) / 2; len(data)%2 == 0 && bytes.Equal(data[:half], data[half:]) && matches(half) {
+		return fmt.Sprintf("the file holds the valid blob twice over (%v bytes each)", half)
+	}
+	return ""
+}
+
+// withTrailingGarbage adds what trailingGarbage finds to the error of an
+// invalid loose blob file, with --sanity.
+func withTrailingGarbage(r *verifyResult, f blobFile) {
+	if !*sanity || r.err == nil || os.IsNotExist(r.err) {
+		return
+	}
+	if what := trailingGarbage(f); what != "" {
+		r.err = fmt.Errorf("%w (%v)", r.err, what)
+	}
+}
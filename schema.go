@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+// maxSchemaSize is the largest blob that pk-verify will try to parse as a
+// schema blob. Real schema blobs are much smaller than this.
+const maxSchemaSize = 1 << 20
+
+// schemaBlob is the part of a Perkeep schema blob that pk-verify cares
+// about. Different types of schema blobs use different fields; see
+// https://perkeep.org/doc/schema/
+type schemaBlob struct {
+	Version int      `json:"camliVersion"`
+	Type    string   `json:"camliType"`
+	Signer  blob.Ref `json:"camliSigner"` // of signed blobs: permanodes and claims
+
+	// file and bytes
+	FileName string      `json:"fileName"`
+	Parts    []bytesPart `json:"parts"`
+	WholeRef blob.Ref    `json:"wholeRef"`
+
+	// directory
+	Entries blob.Ref `json:"entries"`
+
+	// static-set
+	Members   []blob.Ref `json:"members"`
+	MergeSets []blob.Ref `json:"mergeSets"`
+
+	// claim
+	PermaNode blob.Ref `json:"permaNode"`
+	ClaimType string   `json:"claimType"`
+	ClaimDate string   `json:"claimDate"`
+	Attribute string   `json:"attribute"`
+	Value     string   `json:"value"`
+}
+
+// A bytesPart is one element of the "parts" of a file or bytes schema blob:
+// Size bytes, starting Offset bytes into either a blob (BlobRef) or another
+// bytes schema blob (BytesRef). If neither is set, the part is Size zero
+// bytes.
+type bytesPart struct {
+	BlobRef  blob.Ref `json:"blobRef"`
+	BytesRef blob.Ref `json:"bytesRef"`
+	Size     uint64   `json:"size"`
+	Offset   uint64   `json:"offset"`
+}
+
+// looksLikeSchema reports whether data might be a schema blob, without
+// parsing it. All schema blobs are JSON objects starting with camliVersion.
+func looksLikeSchema(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return bytes.HasPrefix(data, []byte("{")) && bytes.Contains(data[:min(len(data), 64)], []byte(`"camliVersion"`))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parseSchema parses data as a schema blob. It returns an error if data is
+// not one.
+func parseSchema(data []byte) (*schemaBlob, error) {
+	if !looksLikeSchema(data) {
+		return nil, fmt.Errorf("not a schema blob")
+	}
+	var sb schemaBlob
+	if err := json.Unmarshal(data, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Version != 1 || sb.Type == "" {
+		return nil, fmt.Errorf("not a schema blob")
+	}
+	return &sb, nil
+}
+
+// fetchVerified fetches br into memory and checks that its contents match
+// its hash.
+func fetchVerified(ctx context.Context, f blob.Fetcher, br blob.Ref) ([]byte, error) {
+	h := br.Hash()
+	if h == nil {
+		return nil, fmt.Errorf("unsupported hash function in blob ref %v", br)
+	}
+	rc, _, err := f.Fetch(ctx, br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(data)
+	if !br.HashMatches(h) {
+		return nil, blobserver.ErrCorruptBlob
+	}
+	return data, nil
+}
+
+// fetchSchema fetches br, checks it, and parses it as a schema blob.
+func fetchSchema(ctx context.Context, f blob.Fetcher, br blob.Ref) (*schemaBlob, error) {
+	data, err := fetchVerified(ctx, f, br)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSchemaSize {
+		return nil, fmt.Errorf("%v is too big to be a schema blob", br)
+	}
+	sb, err := parseSchema(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", br, err)
+	}
+	return sb, nil
+}
+
+// writeParts reconstructs the bytes described by parts (as in a file or bytes
+// schema blob) and writes them to w, checking every blob it reads along the
+// way. It returns the number of bytes written.
+func writeParts(ctx context.Context, f blob.Fetcher, parts []bytesPart, w io.Writer) (int64, error) {
+	var n int64
+	for _, p := range parts {
+		win := &window{w: w, skip: p.Offset, remain: p.Size}
+		switch {
+		case p.BlobRef.Valid():
+			data, err := fetchVerified(ctx, f, p.BlobRef)
+			if err != nil {
+				return n, fmt.Errorf("part %v: %w", p.BlobRef, err)
+			}
+			win.Write(data)
+		case p.BytesRef.Valid():
+			sb, err := fetchSchema(ctx, f, p.BytesRef)
+			if err != nil {
+				return n, fmt.Errorf("part %v: %w", p.BytesRef, err)
+			}
+			if _, err := writeParts(ctx, f, sb.Parts, win); err != nil && err != errWindowFull {
+				return n, fmt.Errorf("in %v: %w", p.BytesRef, err)
+			}
+		default:
+			zeros := make([]byte, 32<<10)
+			for win.remain > 0 && win.err == nil {
+				win.Write(zeros[:min(len(zeros), int(win.remain))])
+			}
+		}
+		if win.err != nil {
+			return n, win.err
+		}
+		if win.remain > 0 {
+			return n, fmt.Errorf("part is %d bytes shorter than its declared size of %d", win.remain, p.Size)
+		}
+		n += int64(p.Size)
+	}
+	return n, nil
+}
+
+var errWindowFull = fmt.Errorf("window full")
+
+// window is a writer that discards its first skip bytes, passes the next
+// remain bytes through to w, and then refuses to accept any more.
+type window struct {
+	w            io.Writer
+	skip, remain uint64
+	err          error
+}
+
+func (win *window) Write(p []byte) (int, error) {
+	n := len(p)
+	if win.err != nil {
+		return 0, win.err
+	}
+	if uint64(len(p)) <= win.skip {
+		win.skip -= uint64(len(p))
+		return n, nil
+	}
+	p = p[win.skip:]
+	win.skip = 0
+	if uint64(len(p)) > win.remain {
+		p = p[:win.remain]
+	}
+	if _, err := win.w.Write(p); err != nil {
+		win.err = err
+		return 0, err
+	}
+	win.remain -= uint64(len(p))
+	if win.remain == 0 {
+		return n, errWindowFull
+	}
+	return n, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"perkeep.org/pkg/blob"
+)
+
+var shardFlag = flag.String("shard", "", "verify only part of the store, given as k/n: split the ref space into n equal parts by digest, and verify the k'th (from 1). Run all n shards (on several machines, say) and combine their --summary-out and --manifest-out files with \"pk-verify merge\". With storages that are streamed rather than walked, every shard still reads the whole stream, so sharding saves hashing but not I/O")
+
+// A shard is one of Count equal parts of the ref space, split by blob digest.
+// Blobs with different hash functions but similar digests land in the same
+// shard, which is fine: digests are uniformly distributed either way.
+type shard struct {
+	Index int `json:"index"` // from 1
+	Count int `json:"count"`
+}
+
+// parseShard parses the value of --shard. It returns nil for "".
+func parseShard(s string) (*shard, error) {
+	if s == "" {
+		return nil, nil
+	}
+	slash := strings.Index(s, "/")
+	if slash < 0 {
+		return nil, fmt.Errorf("invalid --shard %q: want k/n, like 1/4", s)
+	}
+	k, err1 := strconv.Atoi(s[:slash])
+	n, err2 := strconv.Atoi(s[slash+1:])
+	if err1 != nil || err2 != nil || n < 1 || k < 1 || k > n {
+		return nil, fmt.Errorf("invalid --shard %q: want k/n with 1 <= k <= n, like 1/4", s)
+	}
+	return &shard{Index: k, Count: n}, nil
+}
+
+func (sh *shard) String() string {
+	return fmt.Sprintf("%d/%d", sh.Index, sh.Count)
+}
+
+// contains reports whether br belongs in the shard. A nil shard contains
+// every blob.
+func (sh *shard) contains(br blob.Ref) bool {
+	if sh == nil {
+		return true
+	}
+	digest := br.Digest()
+	if len(digest) > 8 {
+		digest = digest[:8]
+	}
+	n, err := strconv.ParseUint(digest, 16, 64)
+	if err != nil {
+		return sh.Index == 1 // put anything odd somewhere, but only once
+	}
+	n <<= 4 * uint(8-len(digest))
+	return int(n*uint64(sh.Count)>>32) == sh.Index-1
+}
+
+// filter returns the refs in the shard.
+func (sh *shard) filter(refs []blob.SizedRef) []blob.SizedRef {
+	if sh == nil {
+		return refs
+	}
+	var out []blob.SizedRef
+	for _, sr := range refs {
+		if sh.contains(sr.Ref) {
+			out = append(out, sr)
+		}
+	}
+	return out
+}
+
+// bounds returns the part of the ref space that the shard covers, as the
+// fraction [start/count, end/count).
+func (sh *shard) bounds() (start, end, count int) {
+	if sh == nil {
+		return 0, 1, 1
+	}
+	return sh.Index - 1, sh.Index, sh.Count
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"perkeep.org/pkg/blob"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *shard
+		ok   bool
+	}{
+		{"", nil, true},
+		{"1/1", &shard{1, 1}, true},
+		{"3/4", &shard{3, 4}, true},
+		{"4/4", &shard{4, 4}, true},
+		{"0/4", nil, false},
+		{"5/4", nil, false},
+		{"1/0", nil, false},
+		{"1", nil, false},
+		{"a/b", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseShard(tt.in)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseShard(%q) = %v, %v; want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestShardContains(t *testing.T) {
+	var brs []blob.Ref
+	for i := 0; i < 1000; i++ {
+		brs = append(brs, blob.RefFromString(fmt.Sprint(i)))
+	}
+	for _, br := range brs {
+		if !(*shard)(nil).contains(br) {
+			t.Fatalf("the nil shard doesn't contain %v", br)
+		}
+	}
+	for _, n := range []int{1, 2, 3, 7, 16} {
+		counts := make([]int, n)
+		for _, br := range brs {
+			in := 0
+			for k := 1; k <= n; k++ {
+				if (&shard{k, n}).contains(br) {
+					in++
+					counts[k-1]++
+				}
+			}
+			if in != 1 {
+				t.Errorf("%v is in %v of %v shards, want 1", br, in, n)
+			}
+		}
+		for k, c := range counts {
+			if c == 0 {
+				t.Errorf("shard %v/%v holds none of %v blobs", k+1, n, len(brs))
+			}
+		}
+	}
+}
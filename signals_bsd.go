@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// statusSignals are the signals that ask for a status dump. BSDs
+	// send SIGINFO on Ctrl-T.
+	statusSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGINFO}
+
+	// pauseSignals pause a run, and resume it again.
+	pauseSignals = []os.Signal{syscall.SIGUSR2}
+)
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// statusSignals are the signals that ask for a status dump.
+	statusSignals = []os.Signal{syscall.SIGUSR1}
+
+	// pauseSignals pause a run, and resume it again.
+	pauseSignals = []os.Signal{syscall.SIGUSR2}
+)
@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// statusSignals ask for a status dump, and pauseSignals pause and resume a
+// run. There are no such signals here.
+var statusSignals, pauseSignals []os.Signal
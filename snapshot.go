@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var (
+	snapshotCmd        = flag.String("snapshot-cmd", "", "a shell command that snapshots the filesystem of a local blob directory, given in PK_VERIFY_ROOT, and prints the path of that directory inside the snapshot (like \"zfs snapshot tank/pk@verify && echo /tank/pk/.zfs/snapshot/verify/blobs\"); blobs are then read from the snapshot, so that a Perkeep server writing during the run can't make blobs look like they changed mid-read")
+	snapshotReleaseCmd = flag.String("snapshot-release-cmd", "", "a shell command to run when the run is over, for each snapshot taken by --snapshot-cmd, with PK_VERIFY_ROOT and PK_VERIFY_SNAPSHOT (the path --snapshot-cmd printed) set; like \"zfs destroy tank/pk@verify\"")
+)
+
+// snapshotHandlers are the storage handlers whose blobs live in a local
+// directory, given by their "path" argument, that can be snapshotted.
+var snapshotHandlers = map[string]bool{
+	"filesystem": true,
+	"diskpacked": true,
+}
+
+// takeSnapshots runs --snapshot-cmd for the directory of each local storage
+// in conf, and returns a copy of conf that reads them from their snapshots
+// instead. The snapshots are released (see --snapshot-release-cmd) when
+// pk-verify exits.
+//
+// conf itself is left alone, since it still describes the store: the
+// snapshots are a different path every time.
+func takeSnapshots(ctx context.Context, conf *LowLevelConfig) (*LowLevelConfig, error) {
+	if *snapshotCmd == "" {
+		return conf, nil
+	}
+	snap := &LowLevelConfig{
+		Prefixes: make(map[string]StorageConfig, len(conf.Prefixes)),
+		Syncs:    conf.Syncs,
+	}
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		sc := conf.Prefixes[prefix]
+		root, _ := sc.StorageHandlerArgs["path"].(string)
+		if !snapshotHandlers[sc.StorageHandler] || root == "" {
+			snap.Prefixes[prefix] = sc
+			continue
+		}
+		out, err := runShell(ctx, *snapshotCmd, "PK_VERIFY_ROOT="+root)
+		if err != nil {
+			return nil, fmt.Errorf("--snapshot-cmd failed for %v: %w", root, err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		path := strings.TrimSpace(lines[len(lines)-1])
+		if path == "" {
+			return nil, fmt.Errorf("--snapshot-cmd didn't print the snapshot's path for %v", root)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("the snapshot of %v isn't readable: %w", root, err)
+		}
+		fmt.Printf("%v: reading from the snapshot at %v\n", prefix, path)
+		atExit(func() { releaseSnapshot(root, path) })
+
+		args := copyObj(sc.StorageHandlerArgs)
+		args["path"] = path
+		snap.Prefixes[prefix] = StorageConfig{StorageHandler: sc.StorageHandler, StorageHandlerArgs: args}
+	}
+	return snap, nil
+}
+
+// releaseSnapshot runs --snapshot-release-cmd for the snapshot at path of
+// the directory root.
+func releaseSnapshot(root, path string) {
+	if *snapshotReleaseCmd == "" {
+		return
+	}
+	if _, err := runShell(context.Background(), *snapshotReleaseCmd, "PK_VERIFY_ROOT="+root, "PK_VERIFY_SNAPSHOT="+path); err != nil {
+		stderrf("pk-verify: --snapshot-release-cmd failed for %v: %v\n", path, err)
+	}
+}
+
+// runShell runs the shell command cmd with the extra environment variables
+// env, and returns its standard output. Its standard error goes to
+// pk-verify's.
+func runShell(ctx context.Context, cmd string, env ...string) ([]byte, error) {
+	c := shellCommand(ctx, cmd)
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = os.Stderr
+	c.Env = append(os.Environ(), env...)
+	err := c.Run()
+	return out.Bytes(), err
+}
+
+// shellCommand returns a command that runs cmd with the system's shell.
+func shellCommand(ctx context.Context, cmd string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", cmd)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"perkeep.org/pkg/blob"
+)
+
+var softFail = flag.Bool("soft-fail", false, "when reading a storage fails partway through (like one unreadable packed zip stopping a blob stream), don't stop the run: note where it failed, verify the rest of that storage by listing its blobs and fetching them one by one, and carry on. Whatever still can't be read is reported in the summary")
+
+// A skippedRegion is a storage that a --soft-fail run could not read all the
+// way through the usual way.
+type skippedRegion struct {
+	Prefix string   `json:"prefix"`
+	Method string   `json:"method"`          // how the storage was being read; see chooseMethod
+	After  blob.Ref `json:"after,omitempty"` // the last blob verified before the failure
+	Error  string   `json:"error"`
+
+	// Recovered is set if the rest of the storage was then verified by
+	// fetching its blobs one by one. If that failed too, RecoveryError
+	// says why, and some blobs were not verified at all.
+	Recovered     bool   `json:"recovered"`
+	RecoveryError string `json:"recoveryError,omitempty"`
+}
+
+// recoverFrom verifies the blobs in v.sto that ps hasn't seen yet, after
+// reading the storage at prefix with method failed with err. It goes
+// through verifyEnumerate, whose per-blob fetches keep one unreadable region
+// from stopping the rest.
+func (v *verifier) recoverFrom(ctx context.Context, prefix, method string, ps *PrefixSummary, last blob.Ref, err error, fn func(verifyResult)) skippedRegion {
+	skip := skippedRegion{Prefix: prefix, Method: method, After: last, Error: err.Error()}
+	if ctx.Err() != nil {
+		skip.RecoveryError = ctx.Err().Error()
+		return skip
+	}
+	stderrf("pk-verify: WARNING: %v\n", err)
+	stderrf("pk-verify: verifying the rest of %v by fetching its blobs one by one\n", prefix)
+	seen := make(map[blob.Ref]bool, len(ps.seen))
+	for _, sr := range ps.seen {
+		seen[sr.Ref] = true
+	}
+	if v.limiter == nil {
+		v.limiter = newFetchLimiter()
+	}
+	if err := v.verifyEnumerate(ctx, seen, fn); err != nil {
+		skip.RecoveryError = err.Error()
+		stderrf("pk-verify: WARNING: that failed too, so some blobs in %v were not verified: %v\n", prefix, err)
+		return skip
+	}
+	skip.Recovered = true
+	return skip
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var spotCheck = flag.String("spot-check", "", "instead of verifying every blob, take this permanode, directory, or file ref, rebuild each file under it from its chunks, and check that the result matches the whole-file digest (wholeRef) recorded in the file's schema blob")
+
+// maxClaimSize is the largest blob that findContent will consider as a
+// possible claim. Claims are small; this just avoids reading file chunks.
+const maxClaimSize = 64 << 10
+
+// A spotChecker checks that the files in a tree rebuild correctly from their
+// chunks. Blob-level verification proves that each chunk is intact, but not
+// that the chunks add up to the file that was originally uploaded; this
+// checks the second part, for one tree at a time.
+type spotChecker struct {
+	sto blobserver.Storage
+
+	ok, mismatched, noWholeRef, failed int
+}
+
+// check walks the tree at root, checking every file in it, and prints the
+// results.
+func (c *spotChecker) check(ctx context.Context, root blob.Ref) {
+	c.walk(ctx, root, "", map[blob.Ref]bool{})
+	fmt.Printf("spot check of %v: %v file%v ok, %v mismatched, %v without a wholeRef, %v failed\n",
+		root, c.ok, plural(c.ok), c.mismatched, c.noWholeRef, c.failed)
+}
+
+// problems reports whether the spot check found anything wrong.
+func (c *spotChecker) problems() bool {
+	return c.mismatched > 0 || c.failed > 0
+}
+
+func (c *spotChecker) walk(ctx context.Context, br blob.Ref, name string, seen map[blob.Ref]bool) {
+	if seen[br] {
+		return
+	}
+	seen[br] = true
+	fail := func(err error) {
+		c.failed++
+		fmt.Printf("FAILED      %v (%v): %v\n", displayName(name), br, err)
+	}
+	sb, err := fetchSchema(ctx, c.sto, br)
+	if err != nil {
+		fail(err)
+		return
+	}
+	switch sb.Type {
+	case "permanode":
+		fmt.Printf("looking for the content of permanode %v (this reads every small blob in the store)...\n", br)
+		content, err := findContent(ctx, c.sto, br)
+		if err != nil {
+			fail(err)
+			return
+		}
+		c.walk(ctx, content, name, seen)
+	case "directory":
+		c.walk(ctx, sb.Entries, path.Join(name, sb.FileName), seen)
+	case "static-set":
+		for _, m := range append(sb.Members, sb.MergeSets...) {
+			c.walk(ctx, m, name, seen)
+		}
+	case "file":
+		c.checkFile(ctx, br, sb, path.Join(name, sb.FileName))
+	case "symlink":
+		// Nothing to rebuild.
+	default:
+		fail(fmt.Errorf("don't know how to walk a %q schema blob", sb.Type))
+	}
+}
+
+func (c *spotChecker) checkFile(ctx context.Context, br blob.Ref, sb *schemaBlob, name string) {
+	switch err := checkWholeRef(ctx, c.sto, sb); err {
+	case nil:
+		c.ok++
+		fmt.Printf("ok          %v\n", displayName(name))
+	case errNoWholeRef:
+		c.noWholeRef++
+		fmt.Printf("NO WHOLEREF %v (%v)\n", displayName(name), br)
+	case errWholeRefMismatch:
+		c.mismatched++
+		fmt.Printf("MISMATCH    %v (%v): the file rebuilt from its parts does not match its wholeRef %v\n", displayName(name), br, sb.WholeRef)
+	default:
+		c.failed++
+		fmt.Printf("FAILED      %v (%v): %v\n", displayName(name), br, err)
+	}
+}
+
+var (
+	errNoWholeRef       = errors.New("file schema has no wholeRef")
+	errWholeRefMismatch = errors.New("file rebuilt from its parts does not match its wholeRef")
+)
+
+// checkWholeRef rebuilds the file described by the file schema blob sb from
+// its parts, and checks that the result matches the file's wholeRef.
+func checkWholeRef(ctx context.Context, f blob.Fetcher, sb *schemaBlob) error {
+	if !sb.WholeRef.Valid() {
+		return errNoWholeRef
+	}
+	h := sb.WholeRef.Hash()
+	if h == nil {
+		return fmt.Errorf("unsupported hash function in wholeRef %v", sb.WholeRef)
+	}
+	if _, err := writeParts(ctx, f, sb.Parts, h); err != nil {
+		return err
+	}
+	if !sb.WholeRef.HashMatches(h) {
+		return errWholeRefMismatch
+	}
+	return nil
+}
+
+func displayName(name string) string {
+	if name == "" {
+		return "(unnamed)"
+	}
+	return name
+}
+
+// findContent finds the current camliContent of a permanode, without an
+// index, by reading every claim in the store.
+func findContent(ctx context.Context, sto blobserver.Storage, perma blob.Ref) (blob.Ref, error) {
+	claims, err := indexClaims(ctx, sto)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	content := claims.content(perma)
+	if !content.Valid() {
+		return blob.Ref{}, fmt.Errorf("permanode %v has no camliContent", perma)
+	}
+	return content, nil
+}
+
+// A claim is a claim schema blob, with its ref.
+type claim struct {
+	ref blob.Ref
+	*schemaBlob
+}
+
+// A claimIndex holds the claims on each permanode, oldest first.
+type claimIndex map[blob.Ref][]claim
+
+// indexClaims reads every claim in sto, which means reading every small blob
+// in it, since there's no index to say which ones are claims.
+func indexClaims(ctx context.Context, sto blobserver.Storage) (claimIndex, error) {
+	idx := claimIndex{}
+	err := blobserver.EnumerateAll(ctx, sto, func(sr blob.SizedRef) error {
+		if sr.Size > maxClaimSize {
+			return nil
+		}
+		sb, err := fetchSchema(ctx, sto, sr.Ref)
+		if err != nil {
+			return nil // not a schema blob, or a broken one; either way, not a claim we can use
+		}
+		if sb.Type == "claim" && sb.PermaNode.Valid() {
+			idx[sb.PermaNode] = append(idx[sb.PermaNode], claim{sr.Ref, sb})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, claims := range idx {
+		sort.SliceStable(claims, func(i, j int) bool { return claims[i].ClaimDate < claims[j].ClaimDate })
+	}
+	return idx, nil
+}
+
+// content returns the current camliContent of perma, or the zero ref if it
+// has none.
+func (idx claimIndex) content(perma blob.Ref) blob.Ref {
+	var content blob.Ref
+	for _, cl := range idx[perma] {
+		if cl.Attribute != "camliContent" {
+			continue
+		}
+		switch cl.ClaimType {
+		case "set-attribute", "add-attribute":
+			content, _ = blob.Parse(cl.Value)
+		case "del-attribute":
+			content = blob.Ref{}
+		}
+	}
+	return content
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+var stallWarning = flag.Duration("stall-warning", time.Minute, "if a blob stream produces nothing for this long, say so, with where the stream is and what its storage is doing, and again each time as long again passes; 0 means never. (Whether to restart the stream is up to --stream-timeout.)")
+
+// statProbeTimeout is how long stallDiagnostics waits for a directory to
+// answer a stat before calling it hung.
+const statProbeTimeout = 10 * time.Second
+
+// stallDiagnostics returns a function that describes what the storages
+// under prefix are doing, for the warning about a stalled stream: whether
+// each local directory still answers (a hung network mount doesn't), and
+// what each other storage is.
+func stallDiagnostics(conf *LowLevelConfig, prefix string) func() []string {
+	return func() []string {
+		var lines []string
+		for _, leaf := range conf.leafPrefixes([]string{prefix}) {
+			sc := conf.Prefixes[leaf]
+			root, _ := sc.StorageHandlerArgs["path"].(string)
+			if !snapshotHandlers[sc.StorageHandler] || root == "" {
+				lines = append(lines, fmt.Sprintf("%v: %v", leaf, conf.describe(leaf)))
+				continue
+			}
+			mount := ""
+			if kind := conf.mountKind(leaf); kind != "" {
+				mount = fmt.Sprintf(", on a %v mount", kind)
+			}
+			lines = append(lines, fmt.Sprintf("%v: %v%v: %v", leaf, conf.describe(leaf), mount, probeDir(root)))
+		}
+		lines = append(lines, fmt.Sprintf("pk-verify has %v goroutines", runtime.NumGoroutine()))
+		return lines
+	}
+}
+
+// probeDir stats dir, and describes how that went. A stat that doesn't come
+// back is abandoned after statProbeTimeout.
+func probeDir(dir string) string {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(dir)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Sprintf("stat failed: %v", err)
+		}
+		return fmt.Sprintf("answered a stat in %v", time.Since(start).Round(time.Millisecond))
+	case <-time.After(statProbeTimeout):
+		return fmt.Sprintf("did not answer a stat within %v; the mount may be hung", statProbeTimeout)
+	}
+}
+
+// warnStalled prints the warning that a stream has produced nothing for
+// quiet. last is the last blob it produced and token where it would resume,
+// streamTimeout when it will be restarted; diagnose, if non-nil, describes
+// the storage.
+func warnStalled(quiet time.Duration, last blob.Ref, token string, streamTimeout time.Duration, diagnose func() []string) {
+	where := "before the first blob"
+	if last.Valid() {
+		where = fmt.Sprintf("after %v (resume token %q)", last, token)
+	}
+	next := "it will be restarted after --stream-timeout=" + streamTimeout.String()
+	if streamTimeout <= 0 {
+		next = "it won't be restarted, since --stream-timeout=0"
+	}
+	stderrf("pk-verify: WARNING: the blob stream has produced nothing for %v, %v; %v\n", quiet.Round(time.Second), where, next)
+	if diagnose == nil {
+		return
+	}
+	for _, line := range diagnose() {
+		stderrf("pk-verify:   %v\n", line)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go4.org/jsonconfig"
+	"go4.org/syncutil"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var (
+	statOnly  = flag.Bool("stat-only", false, "don't read any blob contents: just check that every blob in the --expect manifest (or, without one, every blob the index knows about) is in the store, with the right size. That takes minutes where a full run takes hours, so it's good for between full runs; but it says nothing about whether the blobs are intact")
+	statBatch = flag.Int("stat-batch", 1000, "with --stat-only, how many blobs to ask the storage about at once")
+)
+
+// statOnlyRefs returns the blobs for --stat-only to look for: the --expect
+// manifest, or else every blob in the config's indexes. It also describes
+// where they came from.
+func statOnlyRefs(conf *LowLevelConfig) ([]blob.SizedRef, string, error) {
+	if *expectFile != "" {
+		refs, err := readManifest(*expectFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read --expect manifest: %w", err)
+		}
+		return refs, *expectFile, nil
+	}
+	var (
+		refs    []blob.SizedRef
+		indexes []string
+	)
+	for _, prefix := range sortedConfigPrefixes(conf) {
+		sc := conf.Prefixes[prefix]
+		if sc.StorageHandler != "index" {
+			continue
+		}
+		kvConf, _ := sc.StorageHandlerArgs["storage"].(map[string]interface{})
+		if kvConf == nil {
+			return nil, "", fmt.Errorf("the index at %v needs a \"storage\" argument", prefix)
+		}
+		r, err := indexedBlobs(jsonconfig.Obj(kvConf))
+		if err != nil {
+			return nil, "", fmt.Errorf("in the index at %v: %w", prefix, err)
+		}
+		refs = append(refs, r...)
+		indexes = append(indexes, prefix)
+	}
+	if indexes == nil {
+		return nil, "", fmt.Errorf("--stat-only needs a list of blobs to look for: an --expect manifest, or an index in the config")
+	}
+	return sortRefs(refs), "the index at " + strings.Join(indexes, " and "), nil
+}
+
+// indexedBlobs returns the blobs that the index in kvConf knows about, from
+// its meta rows.
+func indexedBlobs(kvConf jsonconfig.Obj) ([]blob.SizedRef, error) {
+	kv, err := openSortedReadOnly(kvConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the index: %w", err)
+	}
+	defer kv.Close()
+	var refs []blob.SizedRef
+	// ';' is the byte after ':', so this finds just the meta: rows.
+	it := kv.Find(indexMetaPrefix, strings.TrimSuffix(indexMetaPrefix, ":")+";")
+	for it.Next() {
+		br, ok := blob.Parse(strings.TrimPrefix(it.Key(), indexMetaPrefix))
+		size, err := strconv.ParseUint(strings.SplitN(it.Value(), "|", 2)[0], 10, 32)
+		if ok && err == nil {
+			refs = append(refs, blob.SizedRef{Ref: br, Size: uint32(size)})
+		}
+	}
+	return refs, it.Close()
+}
+
+// statMismatch is a blob that --stat-only didn't find as expected.
+type statMismatch struct {
+	want blob.SizedRef
+	got  uint32 // the size found, or 0 if the blob is missing
+}
+
+// statAll looks for refs in sto, asking about --stat-batch blobs at a time,
+// workers batches at once, and returns the ones that are missing or have
+// the wrong size, in order.
+func statAll(ctx context.Context, sto blobserver.BlobStatter, refs []blob.SizedRef, workers int) ([]statMismatch, error) {
+	batch := *statBatch
+	if batch < 1 {
+		batch = 1
+	}
+	var (
+		mu         sync.Mutex
+		mismatches = make([][]statMismatch, (len(refs)+batch-1)/batch)
+		gate       = syncutil.NewGate(workers)
+		g          syncutil.Group
+	)
+	for i := 0; i < len(refs); i += batch {
+		chunk := refs[i:min(i+batch, len(refs))]
+		n := i / batch
+		gate.Start()
+		g.Go(func() error {
+			defer gate.Done()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			want := make(map[blob.Ref]uint32, len(chunk))
+			brs := make([]blob.Ref, len(chunk))
+			for j, sr := range chunk {
+				want[sr.Ref], brs[j] = sr.Size, sr.Ref
+			}
+			got := make(map[blob.Ref]uint32, len(chunk))
+			err := sto.StatBlobs(ctx, brs, func(sr blob.SizedRef) error {
+				got[sr.Ref] = sr.Size
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			var bad []statMismatch
+			for _, sr := range chunk {
+				if size, ok := got[sr.Ref]; !ok || size != sr.Size {
+					bad = append(bad, statMismatch{want: sr, got: size})
+				}
+			}
+			mu.Lock()
+			mismatches[n] = bad
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Err(); err != nil {
+		return nil, err
+	}
+	var all []statMismatch
+	for _, bad := range mismatches {
+		all = append(all, bad...)
+	}
+	return all, nil
+}
+
+// runStatOnly implements --stat-only for targets, and reports whether every
+// blob was found as expected.
+func runStatOnly(ctx context.Context, conf *LowLevelConfig, targets []target) (bool, error) {
+	refs, from, err := statOnlyRefs(conf)
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("looking for the %v blob%v listed in %v, without reading them\n", humanCount(len(refs)), plural(len(refs)), from)
+	ok := true
+	for _, t := range targets {
+		prof, err := chooseProfile(conf, t.prefix)
+		if err != nil {
+			return false, err
+		}
+		bad, err := statAll(ctx, t.sto, refs, prof.workers)
+		if err != nil {
+			return false, fmt.Errorf("in %v (%v): %w", t.prefix, conf.describe(t.prefix), err)
+		}
+		missing := 0
+		for _, m := range bad {
+			if m.got == 0 {
+				missing++
+				stderrf("missing blob: %v\n", m.want.Ref)
+			} else {
+				stderrf("blob has the wrong size: %v (%v bytes, expected %v)\n", m.want.Ref, m.got, m.want.Size)
+			}
+		}
+		if len(bad) == 0 {
+			fmt.Printf("%v: all %v blob%v found, with the right sizes\n", t.prefix, humanCount(len(refs)), plural(len(refs)))
+			continue
+		}
+		ok = false
+		fmt.Printf("%v: MISSING BLOBS: %v of %v blob%v missing, and %v with the wrong size\n", t.prefix, humanCount(missing), humanCount(len(refs)), plural(len(refs)), humanCount(len(bad)-missing))
+	}
+	return ok, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+// An activity is what a verifier's workers are doing right now, for the
+// status dump (see watchStatusSignal). A nil *activity tracks nothing.
+type activity struct {
+	mu       sync.Mutex
+	reading  map[blob.Ref]time.Time // blobs being read, and since when
+	token    string                 // where the blob stream would resume
+	lastRead blob.Ref               // the blob most recently started
+}
+
+func newActivity() *activity {
+	return &activity{reading: map[blob.Ref]time.Time{}}
+}
+
+// begin records that a worker started reading br.
+func (a *activity) begin(br blob.Ref) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.reading[br] = time.Now()
+	a.lastRead = br
+	a.mu.Unlock()
+}
+
+// end records that the worker reading br is done with it.
+func (a *activity) end(br blob.Ref) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	delete(a.reading, br)
+	a.mu.Unlock()
+}
+
+// at records the continuation token of the latest blob from the stream.
+func (a *activity) at(token string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.token = token
+	a.mu.Unlock()
+}
+
+// statusBoard is every prefix being verified, for the status dump.
+var statusBoard struct {
+	mu      sync.Mutex
+	start   time.Time
+	entries []statusEntry
+}
+
+type statusEntry struct {
+	prefix  string
+	workers int
+	prog    *progress
+	act     *activity
+}
+
+// showStatus adds prefix to the status dump.
+func showStatus(prefix string, workers int, prog *progress, act *activity) {
+	statusBoard.mu.Lock()
+	statusBoard.entries = append(statusBoard.entries, statusEntry{prefix, workers, prog, act})
+	statusBoard.mu.Unlock()
+}
+
+// watchStatusSignal prints a detailed status to stderr whenever the process
+// gets SIGUSR1 (or SIGINFO, from Ctrl-T, where there is one), without
+// otherwise disturbing the run. That way a long run that was started
+// without any verbose flags can still be checked on.
+func watchStatusSignal() {
+	statusBoard.start = time.Now()
+	if len(statusSignals) == 0 {
+		return
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, statusSignals...)
+	go func() {
+		for range sigc {
+			printStatus()
+		}
+	}()
+}
+
+func printStatus() {
+	for _, line := range statusLines() {
+		stderrf("pk-verify: %v\n", line)
+	}
+}
+
+// statusLines describes the run so far, for the status dump.
+func statusLines() []string {
+	statusBoard.mu.Lock()
+	entries := append([]statusEntry(nil), statusBoard.entries...)
+	statusBoard.mu.Unlock()
+
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	add("status after %v: %v goroutines, %v in use", humanDuration(time.Since(statusBoard.start)), runtime.NumGoroutine(), humanBytes(int64(ms.HeapInuse)))
+	if paused, since := runPause.paused(); paused {
+		add("  paused for %v", humanDuration(time.Since(since)))
+	}
+	if len(entries) == 0 {
+		add("  not verifying blobs yet")
+	}
+	for _, e := range entries {
+		p := e.prog
+		p.mu.Lock()
+		valid, invalid, bytes, rate, pct := p.valid, p.invalid, p.bytes, p.rate, p.percent()
+		p.mu.Unlock()
+		state := "verifying"
+		select {
+		case <-p.done:
+			state = "done"
+		default:
+		}
+		add("  %v: %v, %v valid blob%v, %v invalid blob%v, %v read (%v/s)%v", e.prefix, state, humanCount(valid), plural(valid), humanCount(invalid), plural(invalid), humanBytes(bytes), humanBytes(int64(rate)), pct)
+		if e.act == nil || state == "done" {
+			continue
+		}
+
+		a := e.act
+		a.mu.Lock()
+		type read struct {
+			ref   blob.Ref
+			since time.Time
+		}
+		var reading []read
+		for br, since := range a.reading {
+			reading = append(reading, read{br, since})
+		}
+		token, lastRead := a.token, a.lastRead
+		a.mu.Unlock()
+		sort.Slice(reading, func(i, j int) bool { return reading[i].since.Before(reading[j].since) })
+
+		switch {
+		case token != "":
+			add("    the stream would resume at token %q", token)
+		case lastRead.Valid():
+			add("    most recently started on %v", lastRead)
+		}
+		add("    %v of %v worker%v reading, %v idle", len(reading), e.workers, plural(e.workers), e.workers-len(reading))
+		for _, r := range reading {
+			add("    reading %v for %v", r.ref, time.Since(r.since).Round(time.Millisecond))
+		}
+	}
+	return lines
+}
+
+// readingNow returns how many blobs are being read, over all prefixes.
+func readingNow() int {
+	statusBoard.mu.Lock()
+	defer statusBoard.mu.Unlock()
+	n := 0
+	for _, e := range statusBoard.entries {
+		if a := e.act; a != nil {
+			a.mu.Lock()
+			n += len(a.reading)
+			a.mu.Unlock()
+		}
+	}
+	return n
+}
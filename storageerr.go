@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A storageError is an error from initializing a storage, along with the
+// chain of storage handlers that were being initialized when it happened.
+// An OS error like "permission denied" is pretty mysterious on its own when
+// it comes from three handlers deep; its Error method says where it came
+// from, like:
+//
+//	in /bs/ → largeBlobs /bs-packed/ (filesystem at /x/y): permission denied
+type storageError struct {
+	conf  *LowLevelConfig
+	chain []string // prefixes, outermost first
+	err   error
+}
+
+func (e *storageError) Error() string {
+	var b strings.Builder
+	b.WriteString("in ")
+	for i, prefix := range e.chain {
+		if i > 0 {
+			b.WriteString(" → ")
+			if role := e.conf.role(e.chain[i-1], prefix); role != "" {
+				b.WriteString(role + " ")
+			}
+		}
+		b.WriteString(prefix)
+	}
+	fmt.Fprintf(&b, " (%v): %v", e.conf.describe(e.chain[len(e.chain)-1]), e.err)
+	return b.String()
+}
+
+func (e *storageError) Unwrap() error {
+	return e.err
+}
+
+// role returns the name of the argument through which the storage at parent
+// refers to the storage at child (like "largeBlobs" for blobpacked), or "" if
+// there isn't a simple one.
+func (conf *LowLevelConfig) role(parent, child string) string {
+	for key, v := range conf.Prefixes[parent].StorageHandlerArgs {
+		switch v := v.(type) {
+		case string:
+			if v == child {
+				return key
+			}
+		case []interface{}:
+			for _, e := range v {
+				if e == child {
+					return key
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// describe returns a short description of the storage at prefix, like
+// "filesystem at /x/y".
+func (conf *LowLevelConfig) describe(prefix string) string {
+	sc := conf.Prefixes[prefix]
+	for _, key := range []string{"path", "bucket"} {
+		if where, ok := sc.StorageHandlerArgs[key].(string); ok && where != "" {
+			return fmt.Sprintf("%v at %v", sc.StorageHandler, where)
+		}
+	}
+	return sc.StorageHandler
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blobserver"
+)
+
+// storeIdentity returns a name for the store that prefixes are in that
+// doesn't depend on the config file: the locations of the storages at the
+// bottom of them (like "filesystem at /x/blobs"), or, for storages without a
+// location, their generations. It returns "" if some storage has neither.
+func storeIdentity(conf *LowLevelConfig, prefixes []string, gens map[string]generation) string {
+	var parts []string
+	for _, leaf := range conf.leafPrefixes(prefixes) {
+		switch desc := conf.describe(leaf); {
+		case desc != conf.Prefixes[leaf].StorageHandler:
+			parts = append(parts, desc)
+		case gens[leaf].Random != "":
+			parts = append(parts, fmt.Sprintf("%v generation %v", desc, gens[leaf].Random))
+		default:
+			return ""
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
+
+// leafPrefixes returns the storage prefixes that prefixes are built from,
+// all the way down: the ones that don't wrap any other storage. They are
+// returned in sorted order.
+func (conf *LowLevelConfig) leafPrefixes(prefixes []string) []string {
+	seen := map[string]bool{}
+	var leaves []string
+	var walk func(p string)
+	walk = func(p string) {
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		refs := conf.referencedPrefixes(p)
+		if len(refs) == 0 {
+			leaves = append(leaves, p)
+		}
+		for _, ref := range refs {
+			walk(ref)
+		}
+	}
+	for _, p := range prefixes {
+		walk(p)
+	}
+	sort.Strings(leaves)
+	return leaves
+}
+
+var onStoreChange = flag.String("on-store-change", "warn", "what to do when the store doesn't look like the one the last run against it verified (a storage generation or the owner of a blob directory changed, as when the wrong backup disk is mounted): \"warn\" (loudly, and verify it anyway) or \"fail\" (before reading any blobs)")
+
+// storeOwners returns the owners of the local directories that the storages
+// at the bottom of prefixes keep their blobs in, by prefix. A different disk
+// mounted in the same place usually has a different owner, even when its
+// layout is the same.
+func storeOwners(conf *LowLevelConfig, prefixes []string) map[string]string {
+	owners := map[string]string{}
+	for _, leaf := range conf.leafPrefixes(prefixes) {
+		sc := conf.Prefixes[leaf]
+		path, _ := sc.StorageHandlerArgs["path"].(string)
+		if localPathArgs[sc.StorageHandler] == nil || path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if owner, ok := fileOwner(fi); ok {
+			owners[leaf] = owner
+		}
+	}
+	if len(owners) == 0 {
+		return nil
+	}
+	return owners
+}
+
+// checkStoreIdentity compares the generations and owners of the storages
+// with what the last run against the store (last, which may be nil) saw, and
+// returns what changed. Anything that did means this is most likely not the
+// store that was verified before, or that it was wiped since. Only the
+// storages loaded by both runs are compared: loaded holds the ones loaded by
+// this one, which may be fewer (see --tier, say, or --on-locked-index).
+func checkStoreIdentity(gens map[string]generation, loaded map[string]blobserver.Storage, owners map[string]string, last *runRecord) []string {
+	if last == nil {
+		return nil
+	}
+	var changes []string
+	for _, prefix := range sortedPrefixes(last.Generations) {
+		if _, ok := loaded[prefix]; !ok {
+			continue
+		}
+		old := last.Generations[prefix]
+		now, ok := gens[prefix]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%v had storage generation %v at the last run, and has none now", prefix, old.Random))
+		} else if old.Random != now.Random {
+			changes = append(changes, fmt.Sprintf("the generation of %v changed since the last run (it was initialized %v, and now %v): it has been reset or replaced since then",
+				prefix, old.Init.Format(time.RFC3339), now.Init.Format(time.RFC3339)))
+		}
+	}
+	var prefixes []string
+	for prefix := range owners {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		if old, ok := last.Owners[prefix]; ok && old != owners[prefix] {
+			changes = append(changes, fmt.Sprintf("the blob directory of %v was owned by %v at the last run, and is now owned by %v", prefix, old, owners[prefix]))
+		}
+	}
+	return changes
+}
+
+// warnStoreChanged prints changes, as found by checkStoreIdentity, so that
+// they can't be missed, and returns an error if --on-store-change says to
+// stop.
+func warnStoreChanged(changes []string, last *runRecord) error {
+	if *onStoreChange != "warn" && *onStoreChange != "fail" {
+		return fmt.Errorf("invalid --on-store-change %q: must be \"warn\" or \"fail\"", *onStoreChange)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	line := strings.Repeat("*", 72)
+	stderrln(line)
+	stderrf("STORE CHANGED: this doesn't look like the store that run %v verified on %v:\n", last.RunID, last.Start.Format(time.RFC3339))
+	for _, c := range changes {
+		stderrf("  - %v\n", c)
+	}
+	stderrln("If the wrong disk is mounted, or a backup was restored over the store, the results of this run say nothing about the store you meant.")
+	stderrln(line)
+	if *onStoreChange == "fail" {
+		return fmt.Errorf("stopping before reading any blobs, because of --on-store-change=fail")
+	}
+	return nil
+}
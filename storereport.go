@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+	"perkeep.org/pkg/jsonsign"
+	"perkeep.org/pkg/schema"
+)
+
+var (
+	storeReport           = flag.String("store-report", "", "after the run, upload its summary into this storage prefix of the config (like \"/bs/\", for the store that was verified) as a file, with a signed permanode for it, so that the history of the store's verifications is kept, searchable, and synced with the store itself. Into the store that was verified, it's only uploaded if the run was clean")
+	storeReportKeyID      = flag.String("store-report-key-id", "", "the GPG key ID to sign the --store-report permanode with; by default, the one of the config's jsonsign handler")
+	storeReportSecretRing = flag.String("store-report-secret-ring", "", "the GPG secret keyring that holds --store-report-key-id; by default, the one of the config's jsonsign handler")
+)
+
+// checkStoreReport checks --store-report before the run, so that a mistake
+// doesn't cost a whole run to find out about.
+func checkStoreReport(conf *LowLevelConfig) error {
+	if *storeReport == "" {
+		return nil
+	}
+	if _, ok := conf.Prefixes[*storeReport]; !ok {
+		return fmt.Errorf("--store-report=%v is not a storage prefix in the config", *storeReport)
+	}
+	_, _, err := reportSigning(conf)
+	return err
+}
+
+// reportSigning returns the key ID and secret keyring to sign the report
+// with.
+func reportSigning(conf *LowLevelConfig) (keyID, secretRing string, err error) {
+	if conf.Signing != nil {
+		keyID, secretRing = conf.Signing.KeyID, conf.Signing.SecretRing
+	}
+	if *storeReportKeyID != "" {
+		keyID = *storeReportKeyID
+	}
+	if *storeReportSecretRing != "" {
+		secretRing = *storeReportSecretRing
+	}
+	if keyID == "" || secretRing == "" {
+		return "", "", fmt.Errorf("--store-report needs a key to sign with: the config has no jsonsign handler with a keyId and secretRing, so give --store-report-key-id and --store-report-secret-ring")
+	}
+	return keyID, secretRing, nil
+}
+
+// writeStoreReport uploads the summary s into the --store-report storage,
+// as a file named after the run, and makes a permanode for it:
+//
+//	camliContent      the summary file
+//	title             "pk-verify report <run ID>"
+//	tag               "pk-verify"
+//	pkVerifyRunID     the run ID
+//	pkVerifyStatus    the summary's status ("clean", "corrupt", ...)
+//	pkVerifyHealth    the health grade
+//	pkVerifyStore     the prefixes that were verified, if not the same storage
+//
+// It returns the permanode. It must be called after s.grade, with a Loader
+// for the config as written: the one the run read through may point into
+// snapshots (see --snapshot-cmd) or read-only copies, where the report
+// would be lost.
+func writeStoreReport(ctx context.Context, ld *Loader, conf *LowLevelConfig, s *Summary) (blob.Ref, error) {
+	sto, err := ld.GetStorage(*storeReport)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	keyID, secretRing, err := reportSigning(conf)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	entity, err := jsonsign.EntityFromSecring(keyID, secretRing)
+	if err != nil {
+		return blob.Ref{}, fmt.Errorf("failed to load signing key %v from %v: %w", keyID, secretRing, err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(entity)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	pubKeyRef := blob.RefFromString(armored)
+	signer, err := schema.NewSigner(pubKeyRef, strings.NewReader(armored), entity)
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	// The public key has to be in the store for the signatures to be
+	// checked there.
+	if _, err := blobserver.Receive(ctx, sto, pubKeyRef, strings.NewReader(armored)); err != nil {
+		return blob.Ref{}, fmt.Errorf("failed to upload the public key: %w", err)
+	}
+
+	data, err := s.encode()
+	if err != nil {
+		return blob.Ref{}, err
+	}
+	fileRef, err := schema.WriteFileFromReader(ctx, sto, "pk-verify-"+s.RunID+".json", bytes.NewReader(data))
+	if err != nil {
+		return blob.Ref{}, fmt.Errorf("failed to upload the summary: %w", err)
+	}
+
+	now := time.Now()
+	put := func(b *schema.Builder) (blob.Ref, error) {
+		signed, err := b.SignAt(ctx, signer, now)
+		if err != nil {
+			return blob.Ref{}, err
+		}
+		br := blob.RefFromString(signed)
+		_, err = blobserver.Receive(ctx, sto, br, strings.NewReader(signed))
+		return br, err
+	}
+	pn, err := put(schema.NewUnsignedPermanode())
+	if err != nil {
+		return blob.Ref{}, fmt.Errorf("failed to make the permanode: %w", err)
+	}
+	claims := []*schema.Builder{
+		schema.NewSetAttributeClaim(pn, "camliContent", fileRef.String()),
+		schema.NewSetAttributeClaim(pn, "title", "pk-verify report "+s.RunID),
+		schema.NewAddAttributeClaim(pn, "tag", "pk-verify"),
+		schema.NewSetAttributeClaim(pn, "pkVerifyRunID", s.RunID),
+		schema.NewSetAttributeClaim(pn, "pkVerifyStatus", s.Status),
+	}
+	if s.Health != nil {
+		claims = append(claims, schema.NewSetAttributeClaim(pn, "pkVerifyHealth", s.Health.Grade))
+	}
+	if !sameStorage(conf, *storeReport, s.targets) {
+		claims = append(claims, schema.NewSetAttributeClaim(pn, "pkVerifyStore", strings.Join(s.targets, " ")))
+	}
+	for _, c := range claims {
+		if _, err := put(c); err != nil {
+			return blob.Ref{}, fmt.Errorf("failed to make a claim for the permanode: %w", err)
+		}
+	}
+	return pn, nil
+}
+
+// sameStorage reports whether prefix is, or is part of, the storage that
+// targets were verified in; that is, whether it shares a leaf storage with
+// them.
+func sameStorage(conf *LowLevelConfig, prefix string, targets []string) bool {
+	leaves := make(map[string]bool)
+	for _, leaf := range conf.leafPrefixes(targets) {
+		leaves[leaf] = true
+	}
+	for _, leaf := range conf.leafPrefixes([]string{prefix}) {
+		if leaves[leaf] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+var summaryOut = flag.String("summary-out", "", "write a JSON summary of the final results to this file, or \"-\" for stdout, for scripts that don't want to parse the human-readable output")
+
+// Summary is the final result of a verification run. It is what --summary-out
+// writes, so its JSON encoding is meant to be read by other programs.
+type Summary struct {
+	// SchemaVersion is the version of this format; see versions.go.
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Status is "clean" if every blob verified, "corrupt" if any blob
+	// failed verification, "missing" if every blob verified but some
+	// that were expected (see Missing) were not found, and "error" if
+	// the run could not complete (in which case the counts only cover
+	// the blobs that were seen). Blobs listed in --ignore-refs don't
+	// count against the status.
+	Status string `json:"status"`
+	// Error describes what went wrong, when Status is "error" (which,
+	// with --soft-fail, can also mean that the run finished but couldn't
+	// read everything).
+	Error string `json:"error,omitempty"`
+
+	// RunID uniquely identifies this run. It is included in every
+	// output of the run, so that they can be correlated.
+	RunID    string    `json:"runID"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"durationSeconds"`
+
+	Valid     int   `json:"valid"`
+	Invalid   int   `json:"invalid"`
+	Transient int   `json:"transient"`
+	Bytes     int64 `json:"bytes"`
+
+	// Cached is how many of the valid blobs were skipped by
+	// --verify-cache; see PrefixSummary.Cached.
+	Cached int `json:"cached,omitempty"`
+
+	InvalidRefs []blob.Ref `json:"invalidRefs"`
+
+	// Digest identifies the set of blobs that were seen; see storeDigest.
+	// It is only set when the run completed and covered the whole store,
+	// since a digest of part of a store isn't good for anything. (The
+	// digest of a sharded store comes from merging the shards' manifests.)
+	Digest string `json:"digest,omitempty"`
+
+	// Missing lists the blobs that the --expect manifest lists but that
+	// were not found, and Unlisted the blobs that were found but that the
+	// manifest does not list. Both are left out when the run didn't
+	// verify everything the manifest covers (see checkManifest).
+	Missing  []blob.Ref `json:"missing,omitempty"`
+	Unlisted []blob.Ref `json:"unlisted,omitempty"`
+
+	// WholeRefsChecked is how many files had their wholeRef checked
+	// (with --check-wholerefs), and WholeRefMismatches lists the file
+	// schema blobs whose parts did not add up to their wholeRef.
+	WholeRefsChecked   int        `json:"wholeRefsChecked,omitempty"`
+	WholeRefMismatches []blob.Ref `json:"wholeRefMismatches,omitempty"`
+
+	// ZipMembersChecked is how many blobs packed in blobpacked zips were
+	// hashed on their own (with --zip-members), and BadZipMembers lists
+	// the ones that didn't match their ref.
+	ZipMembersChecked int                `json:"zipMembersChecked,omitempty"`
+	BadZipMembers     []zipMemberProblem `json:"badZipMembers,omitempty"`
+
+	// Duplicates lists the blobs with the same contents under different
+	// refs, with --find-duplicates.
+	Duplicates *duplicates `json:"duplicates,omitempty"`
+
+	// Inventory counts the blobs that aren't schema blobs by content
+	// type, with --inventory.
+	Inventory []inventoryEntry `json:"inventory,omitempty"`
+
+	// HashCrossChecked is how many blobs --cross-check-hash hashed again
+	// independently, and HashCrossCheckFailures lists the ones whose
+	// contents didn't match their refs that time.
+	HashCrossChecked       int        `json:"hashCrossChecked,omitempty"`
+	HashCrossCheckFailures []blob.Ref `json:"hashCrossCheckFailures,omitempty"`
+
+	// CheckProblems are the problems that the store phases of the
+	// --checks found.
+	CheckProblems []string `json:"checkProblems,omitempty"`
+
+	// Reconciliation compares the blobs found with the ones the Perkeep
+	// server lists, with --reconcile-server.
+	Reconciliation *reconciliation `json:"reconciliation,omitempty"`
+
+	// PackingProblems lists the inconsistencies that --check-packing
+	// found in blobpacked's bookkeeping. They don't affect Status, since
+	// every blob may still be intact; but a zip that the meta index
+	// points at and that doesn't exist means blobs that can't be read.
+	PackingProblems []string `json:"packingProblems,omitempty"`
+
+	// Migration is how far along a hash migration is, with
+	// --check-migration.
+	Migration *migrationCoverage `json:"migration,omitempty"`
+
+	// Suspicions lists what the --sanity heuristics found suspicious,
+	// although the blobs involved are intact.
+	Suspicions []string `json:"suspicions,omitempty"`
+
+	// ReplicaDivergences lists the blobs that a replica got wrong (or
+	// didn't have) while another replica had them intact, with
+	// --compare-replicas.
+	ReplicaDivergences []replicaDivergence `json:"replicaDivergences,omitempty"`
+
+	// EncryptionProblems lists what is wrong with the keys of the
+	// "encrypt" storages: ways in which the store can't be read, even if
+	// every blob in it is intact.
+	EncryptionProblems []string `json:"encryptionProblems,omitempty"`
+
+	// Ignored lists the invalid and missing blobs that were listed in
+	// --ignore-refs. They are still counted and listed as usual, but they
+	// don't affect Status.
+	Ignored []blob.Ref `json:"ignored,omitempty"`
+
+	// Resolved lists the problems that "pk-verify repair" has since
+	// fixed or dismissed, and that "pk-verify recheck" has since found to
+	// verify. The rest of the summary still describes the run as it
+	// happened.
+	Resolved []resolution `json:"resolved,omitempty"`
+
+	// Latency summarizes how long blobs took to read and verify.
+	Latency *latencyStats `json:"latency,omitempty"`
+
+	// Shard is the part of the ref space that was verified (see
+	// --shard), or nil if it was all of it.
+	Shard *shard `json:"shard,omitempty"`
+
+	// SimulatedFaults is set when --simulate-faults made some of the blobs
+	// look bad: the run's findings aren't real.
+	SimulatedFaults *simulatedFaults `json:"simulatedFaults,omitempty"`
+
+	// ApproxExpect is what --approx-expect found.
+	ApproxExpect *approxManifest `json:"approxExpect,omitempty"`
+
+	// Confidence bounds how much of the whole store is corrupt, from the
+	// shard verified, when that was only one of several.
+	Confidence *confidence `json:"confidence,omitempty"`
+
+	// SkippedVerified is the --skip-verified manifest, if any: the blobs
+	// it lists were not verified again.
+	SkippedVerified string `json:"skippedVerified,omitempty"`
+
+	// Exclude describes the blobs that --exclude-ref-prefix and
+	// --exclude-size-over left out, if any; how many, by prefix, is in
+	// Prefixes.
+	Exclude string `json:"exclude,omitempty"`
+
+	// Generations are the generations of the storages involved, by
+	// prefix; see loadGenerations.
+	Generations map[string]generation `json:"generations,omitempty"`
+
+	// Owners are the owners of the local directories that the storages
+	// involved keep their blobs in, by prefix; see storeOwners.
+	Owners map[string]string `json:"owners,omitempty"`
+
+	// Skipped lists the storages that --soft-fail kept going past
+	// failures in.
+	Skipped []skippedRegion `json:"skipped,omitempty"`
+
+	// SkippedPrefixes lists the storages that --all couldn't initialize,
+	// and so didn't verify at all.
+	SkippedPrefixes []skippedPrefix `json:"skippedPrefixes,omitempty"`
+
+	// Throughput compares how fast this run read the store with the
+	// previous run; see --throughput-regression.
+	Throughput *throughputComparison `json:"throughput,omitempty"`
+
+	// Resources is what the run cost pk-verify itself.
+	Resources *resourceUsage `json:"resources,omitempty"`
+
+	// Health grades the store, taking all of the above into account.
+	Health *health `json:"health,omitempty"`
+
+	// Coverage says how much of the store the run verified.
+	Coverage *coverage `json:"coverage"`
+
+	// Prefixes breaks the results down by the storage prefix that was
+	// verified.
+	Prefixes map[string]*PrefixSummary `json:"prefixes"`
+
+	seen    []blob.SizedRef   // every distinct blob seen, sorted; set by finish
+	ignore  map[blob.Ref]bool // from --ignore-refs
+	targets []string          // the prefixes the run set out to verify
+	redact  *redactor         // for writeFile
+}
+
+// PrefixSummary is the part of a Summary for one storage prefix.
+type PrefixSummary struct {
+	Handler   string `json:"handler"`
+	Valid     int    `json:"valid"`
+	Invalid   int    `json:"invalid"`
+	Transient int    `json:"transient"`
+	Bytes     int64  `json:"bytes"`
+
+	// Cached is how many of the valid blobs weren't read, because they
+	// were unchanged since an earlier run verified them (see
+	// --verify-cache). Their bytes aren't counted in Bytes.
+	Cached int `json:"cached,omitempty"`
+
+	InvalidRefs   []blob.Ref `json:"invalidRefs"`
+	TransientRefs []blob.Ref `json:"transientRefs,omitempty"`
+
+	// Raced lists the blobs that failed because they changed while they
+	// were being read (see checkRaced). They were verified again at the
+	// end, and counted then, unless they were gone.
+	Raced []blob.Ref `json:"raced,omitempty"`
+
+	// Excluded is how many blobs (and ExcludedBytes how many bytes) were
+	// skipped by --exclude-ref-prefix and --exclude-size-over.
+	Excluded      int   `json:"excluded,omitempty"`
+	ExcludedBytes int64 `json:"excludedBytes,omitempty"`
+
+	// Deferred is how many blobs weren't verified because --deadline came
+	// first.
+	Deferred int `json:"deferred,omitempty"`
+
+	// Workers is how many workers --autoscale chose.
+	Workers int `json:"workers,omitempty"`
+
+	// CacheOf is set, to the prefix of the origin, for the cache of a
+	// proxycache that was verified along with its origin (see
+	// --proxycache=both). The cache only holds copies of the origin's
+	// blobs, so its valid blobs and bytes are counted here but not in
+	// the store's totals or digest; its invalid ones are.
+	CacheOf string `json:"cacheOf,omitempty"`
+
+	Latency *latencyStats `json:"latency,omitempty"`
+
+	// Heatmap breaks the latency and errors down by ref shard.
+	Heatmap *latencyHeatmap `json:"heatmap,omitempty"`
+
+	seen    []blob.SizedRef // every blob, for the digest
+	latency latencyTracker
+	done    bool // every blob in the prefix was verified
+}
+
+func newSummary() *Summary {
+	return &Summary{
+		RunID:       newRunID(),
+		Start:       time.Now(),
+		InvalidRefs: []blob.Ref{},
+		Prefixes:    map[string]*PrefixSummary{},
+	}
+}
+
+// prefix returns the summary for prefix, creating it if needed.
+func (s *Summary) prefix(prefix, handler string) *PrefixSummary {
+	ps, ok := s.Prefixes[prefix]
+	if !ok {
+		ps = &PrefixSummary{Handler: handler, InvalidRefs: []blob.Ref{}}
+		s.Prefixes[prefix] = ps
+	}
+	return ps
+}
+
+// sortedPrefixes returns the prefixes in s, in order.
+func (s *Summary) sortedPrefixes() []string {
+	var prefixes []string
+	for prefix := range s.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// add records the result of verifying one blob.
+func (ps *PrefixSummary) add(r verifyResult) {
+	ps.seen = append(ps.seen, blob.SizedRef{Ref: r.ref, Size: r.size})
+	if r.cached {
+		ps.Valid++
+		ps.Cached++
+		return
+	}
+	ps.Bytes += int64(r.size)
+	ps.latency.add(r.ref, r.size, r.duration)
+	if ps.Heatmap == nil {
+		ps.Heatmap = &latencyHeatmap{}
+	}
+	ps.Heatmap.add(r)
+	switch {
+	case r.err == nil:
+		ps.Valid++
+	case r.transient:
+		ps.Valid++
+		ps.Transient++
+		ps.TransientRefs = append(ps.TransientRefs, r.ref)
+	default:
+		ps.Invalid++
+		ps.InvalidRefs = append(ps.InvalidRefs, r.ref)
+	}
+}
+
+// finish adds up the per-prefix results and sets the final status. err is
+// the error that stopped the run early, if any.
+func (s *Summary) finish(err error) {
+	s.Duration = time.Since(s.Start).Seconds()
+	s.Valid, s.Invalid, s.Transient, s.Cached, s.Bytes = 0, 0, 0, 0, 0
+	s.InvalidRefs = s.InvalidRefs[:0]
+	s.seen = s.seen[:0]
+	var latency latencyTracker
+	deferred := 0
+	for _, ps := range s.Prefixes {
+		ps.Latency = ps.latency.stats()
+		latency.merge(&ps.latency)
+		s.Invalid += ps.Invalid
+		s.Transient += ps.Transient
+		s.InvalidRefs = append(s.InvalidRefs, ps.InvalidRefs...)
+		deferred += ps.Deferred
+		if ps.CacheOf != "" {
+			continue
+		}
+		s.seen = append(s.seen, ps.seen...)
+		s.Valid += ps.Valid
+		s.Cached += ps.Cached
+		s.Bytes += ps.Bytes
+	}
+	sort.Slice(s.InvalidRefs, func(i, j int) bool { return s.InvalidRefs[i].Less(s.InvalidRefs[j]) })
+	s.Latency = latency.stats()
+	s.seen = sortRefs(s.seen)
+	if err == nil && s.Shard == nil && s.SkippedVerified == "" && s.Exclude == "" && deferred == 0 {
+		s.Digest = storeDigest(s.seen)
+	}
+	s.computeCoverage(err)
+	s.Ignored = nil
+	corrupt := 0
+	for _, br := range s.InvalidRefs {
+		if s.ignore[br] {
+			s.Ignored = append(s.Ignored, br)
+		} else {
+			corrupt++
+		}
+	}
+	unread := 0
+	for _, skip := range s.Skipped {
+		if !skip.Recovered {
+			unread++
+		}
+	}
+	switch {
+	case err != nil:
+		s.Status = "error"
+		s.Error = err.Error()
+	case corrupt > 0:
+		s.Status = "corrupt"
+	case unread > 0:
+		s.Status = "error"
+		s.Error = fmt.Sprintf("%v storage%v could not be read all the way through (see skipped)", unread, plural(unread))
+	case len(s.SkippedPrefixes) > 0:
+		n := len(s.SkippedPrefixes)
+		s.Status = "error"
+		s.Error = fmt.Sprintf("%v storage%v could not be loaded (see skippedPrefixes)", n, plural(n))
+	default:
+		s.Status = "clean"
+	}
+}
+
+// writeFile writes the summary as indented JSON to path, or to stdout if
+// path is "-", with its refs redacted if s.redact is set.
+func (s *Summary) writeFile(path string) error {
+	data, err := s.encode()
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err := dataOut.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// encode returns the summary as indented JSON, with its refs redacted if
+// s.redact is set.
+func (s *Summary) encode() ([]byte, error) {
+	s.SchemaVersion = summarySchema
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return s.redact.redact(append(data, '\n')), nil
+}
+
+// parseSummary parses data, the summary file at path.
+func parseSummary(path string, data []byte) (*Summary, error) {
+	s := new(Summary)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := checkSchema("summary", path, s.SchemaVersion, summarySchema); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"perkeep.org/pkg/blobserver"
+)
+
+var tier = flag.String("tier", "both", "when /bs/ is blobpacked, which tier to verify: \"loose\" (only the blobs that aren't packed yet), \"packed\" (only the zip files, each verified as one blob, which covers everything packed in it), or \"both\" (every blob, through blobpacked)")
+
+var strategy = flag.String("strategy", "auto", "how to read the blobs: \"auto\" (the fastest way each storage supports, falling back from \"walk\" to \"stream\" to \"enumerate\", and saying why), or one of \"walk\" (read the blob files of a localdisk storage directly), \"stream\" (the storage's blob streaming), or \"enumerate\" (list the blobs, then fetch them one by one) to force it, failing if a storage can't be read that way")
+
+var proxycacheMode = flag.String("proxycache", "origin", "when /bs/ is a proxycache, which side of it to verify: \"origin\", \"cache\", or \"both\" (whose cache is reported on its own, rather than counted twice in the totals). pk-verify never reads through the proxycache itself, so it never fills the cache; proxycaches further down, like in front of blobpacked's largeBlobs, are always bypassed for their origin")
+
+// A target is a storage prefix to verify.
+type target struct {
+	prefix  string
+	handler string
+	sto     blobserver.Storage
+
+	// method is how the blobs are read: "walk", "stream", or
+	// "enumerate"; see chooseMethod.
+	method string
+
+	// walkRoot, if set, is the directory of a localdisk storage to read
+	// directly instead of streaming; see verifyWalk.
+	walkRoot string
+
+	// why explains the method, for the output.
+	why string
+}
+
+// chooseMethod decides how to read all of the blobs in t, picking the fastest
+// way that its storage supports: reading the files of a local disk directly,
+// streaming, or (which any storage can do) enumerating the blobs and fetching
+// each one. It depends only on what the storage can do, not on which handler
+// it is, so that any handler at /bs/ gets a chance. It records why in t.why.
+//
+// With --strategy, it uses that method instead, or fails if the storage
+// can't be read that way.
+func (t *target) chooseMethod(conf *LowLevelConfig) error {
+	root, walkable := localdiskRoot(conf, t.prefix)
+	_, streams := t.sto.(blobserver.BlobStreamer)
+	switch *strategy {
+	case "auto":
+	case "walk":
+		if *simulateFaults != "" {
+			return fmt.Errorf("--strategy=walk can't be combined with --simulate-faults, which needs to read through the storage")
+		}
+		if !walkable {
+			return fmt.Errorf("%v: --strategy=walk only works on a localdisk (\"filesystem\") storage with a blob directory layout pk-verify recognizes, and %v isn't one", t.prefix, conf.describe(t.prefix))
+		}
+		t.method, t.walkRoot, t.why = "walk", root, "forced by --strategy"
+		return nil
+	case "stream":
+		if !streams {
+			return fmt.Errorf("%v: --strategy=stream: the %q storage can't stream its blobs; use --strategy=enumerate", t.prefix, t.handler)
+		}
+		t.method, t.why = "stream", "forced by --strategy"
+		return nil
+	case "enumerate":
+		t.method, t.why = "enumerate", "forced by --strategy"
+		return nil
+	default:
+		return fmt.Errorf("invalid --strategy %q: must be \"auto\", \"walk\", \"stream\", or \"enumerate\"", *strategy)
+	}
+
+	// Each fallback says why the faster ways before it were passed over.
+	var passed string
+	switch {
+	case t.handler != "filesystem":
+	case !*walkFlag:
+		passed = "--walk isn't set, so its blob files aren't read directly; "
+	case *simulateFaults != "":
+		passed = "--simulate-faults needs to read through the storage, not its blob files; "
+	case !walkable:
+		passed = "pk-verify doesn't recognize its blob directory layout, so it can't read the files directly; "
+	default:
+		t.method, t.walkRoot, t.why = "walk", root, "its blob files are on a local disk, and reading them directly is fastest"
+		return nil
+	}
+	if streams {
+		t.method, t.why = "stream", passed+fmt.Sprintf("the %q storage can stream its blobs", t.handler)
+		return nil
+	}
+	t.method, t.why = "enumerate", passed+fmt.Sprintf("the %q storage can't stream its blobs, so they will be fetched one by one (slower)", t.handler)
+	return nil
+}
+
+// chooseTargets decides which storage prefixes to verify, starting from /bs/,
+// the main blob handler.
+//
+// Usually that's just /bs/. But some handlers at /bs/ are better verified by
+// going around them, like a proxycache: reading through it would fill the
+// cache with every blob in the origin (evicting what real clients put
+// there), and would verify a mix of cached and origin copies without telling
+// you which was which. So for those, verify the storage behind them directly.
+//
+// With --all, it's every storage that /bs/ is built from, each verified on
+// its own.
+func chooseTargets(conf *LowLevelConfig) ([]string, error) {
+	bs := conf.Prefixes["/bs/"]
+	if *allFlag {
+		if *tier != "both" || flagWasSet("proxycache") {
+			return nil, fmt.Errorf("--all can't be combined with --tier or --proxycache, since it verifies every storage behind /bs/")
+		}
+		return conf.leafPrefixes([]string{"/bs/"}), nil
+	}
+	if *tier != "both" {
+		return chooseTier(bs)
+	}
+	if _, ok := cacheHandlers[bs.StorageHandler]; !ok {
+		return []string{"/bs/"}, nil
+	}
+	origin, cache, err := cacheSides(bs)
+	if err != nil {
+		return nil, fmt.Errorf("in /bs/: %w", err)
+	}
+	switch *proxycacheMode {
+	case "origin":
+		return []string{origin}, nil
+	case "cache":
+		return []string{cache}, nil
+	case "both":
+		return []string{origin, cache}, nil
+	}
+	return nil, fmt.Errorf("invalid --proxycache %q: must be \"origin\", \"cache\", or \"both\"", *proxycacheMode)
+}
+
+// proxiedCache returns the prefix of the cache in front of /bs/, and that
+// of its origin, when --proxycache=both verifies them both; otherwise it
+// returns "".
+func proxiedCache(conf *LowLevelConfig) (cache, origin string) {
+	bs := conf.Prefixes["/bs/"]
+	if _, ok := cacheHandlers[bs.StorageHandler]; !ok || *allFlag || *tier != "both" || *proxycacheMode != "both" {
+		return "", ""
+	}
+	origin, cache, err := cacheSides(bs)
+	if err != nil {
+		return "", ""
+	}
+	return cache, origin
+}
+
+// cacheHandlers maps the storage handlers that put a cache in front of
+// another storage to the names of their origin and cache arguments.
+var cacheHandlers = map[string][2]string{
+	"proxycache": {"origin", "cache"},
+}
+
+// cacheSides returns the origin and cache prefixes of sc, which must be one
+// of cacheHandlers.
+func cacheSides(sc StorageConfig) (origin, cache string, err error) {
+	args := cacheHandlers[sc.StorageHandler]
+	origin, _ = sc.StorageHandlerArgs[args[0]].(string)
+	cache, _ = sc.StorageHandlerArgs[args[1]].(string)
+	if origin == "" || cache == "" {
+		return "", "", fmt.Errorf("the %v needs string %q and %q arguments", sc.StorageHandler, args[0], args[1])
+	}
+	return origin, cache, nil
+}
+
+// bypassCaches makes ld load the origin in place of every caching handler
+// that the targets are built on, so that verifying them doesn't read
+// through a cache (filling it, and evicting what real clients put there).
+// chooseTargets already takes care of a cache at /bs/ itself; this is for
+// caches further down, like a proxycache in front of blobpacked's
+// largeBlobs.
+func bypassCaches(ld *Loader, prefixes []string) error {
+	seen := map[string]bool{}
+	var walk func(p string) error
+	walk = func(p string) error {
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+		sc := ld.conf.Prefixes[p]
+		if _, ok := cacheHandlers[sc.StorageHandler]; ok {
+			origin, _, err := cacheSides(sc)
+			if err != nil {
+				return fmt.Errorf("in %v: %w", p, err)
+			}
+			fmt.Printf("%v: reading the %v's origin, %v, directly, to leave its cache alone\n", p, sc.StorageHandler, origin)
+			ld.redirect(p, origin)
+			return walk(origin)
+		}
+		for _, ref := range ld.conf.referencedPrefixes(p) {
+			if err := walk(ref); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, p := range prefixes {
+		seen[p] = true
+		for _, ref := range ld.conf.referencedPrefixes(p) {
+			if err := walk(ref); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// chooseTier picks the storage behind one tier of the blobpacked storage bs,
+// for --tier. Verifying the tiers of a blobpacked storage directly is also
+// the way to find out which tier a bad blob is in.
+func chooseTier(bs StorageConfig) ([]string, error) {
+	if bs.StorageHandler != "blobpacked" {
+		return nil, fmt.Errorf("--tier=%v only works when /bs/ is blobpacked, and it is %q", *tier, bs.StorageHandler)
+	}
+	var arg string
+	switch *tier {
+	case "loose":
+		arg = "smallBlobs"
+	case "packed":
+		arg = "largeBlobs"
+	default:
+		return nil, fmt.Errorf("invalid --tier %q: must be \"loose\", \"packed\", or \"both\"", *tier)
+	}
+	prefix, _ := bs.StorageHandlerArgs[arg].(string)
+	if prefix == "" {
+		return nil, fmt.Errorf("the blobpacked storage at /bs/ needs a string %q argument", arg)
+	}
+	return []string{prefix}, nil
+}
+
+// loadTargets initializes the storage for each of the given prefixes. (Note
+// that this may recursively initialize other handlers that they use.)
+//
+// With --all, a prefix whose storage fails to initialize (say, because a
+// cloud credential is missing) doesn't stop the others from being verified:
+// it is reported, returned in skipped, and left out of the targets. It's
+// only an error if none of them load.
+func loadTargets(ld *Loader, prefixes []string) (targets []target, skipped []skippedPrefix, err error) {
+	for _, prefix := range prefixes {
+		handler := ld.conf.Prefixes[prefix].StorageHandler
+		sto, err := ld.GetStorage(prefix)
+		if err != nil {
+			if !*allFlag {
+				return nil, nil, fmt.Errorf("failed to load blob storage: %w", err)
+			}
+			stderrf("pk-verify: WARNING: skipping %v (%v): failed to load blob storage: %v\n", prefix, handler, err)
+			skipped = append(skipped, skippedPrefix{Prefix: prefix, Handler: handler, Error: err.Error()})
+			continue
+		}
+		targets = append(targets, target{
+			prefix:  prefix,
+			handler: handler,
+			sto:     sto,
+		})
+	}
+	if len(targets) == 0 && len(skipped) > 0 {
+		return nil, skipped, fmt.Errorf("failed to load any of the %v blob storage%v", len(skipped), plural(len(skipped)))
+	}
+	return targets, skipped, nil
+}
+
+// A skippedPrefix is a storage that --all left out, because it failed to
+// initialize.
+type skippedPrefix struct {
+	Prefix  string `json:"prefix"`
+	Handler string `json:"handler"`
+	Error   string `json:"error"`
+}
+
+// targetPrefixes returns the prefixes of targets.
+func targetPrefixes(targets []target) []string {
+	var prefixes []string
+	for _, t := range targets {
+		prefixes = append(prefixes, t.prefix)
+	}
+	return prefixes
+}
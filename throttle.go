@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+)
+
+var autoThrottle = flag.Bool("auto-throttle", false, "watch read latency, and slow down when it rises well above its baseline (a sign that the storage is busy serving real traffic), speeding back up when it recovers")
+
+// Tuning for the auto-throttle.
+const (
+	throttleWarmup   = 20                    // samples before judging latency at all
+	throttleAlpha    = 0.1                   // weight of each new sample in the moving average
+	throttleBusy     = 2.0                   // back off above this multiple of the baseline
+	throttleIdle     = 1.3                   // speed up below this multiple of the baseline
+	throttleMinDelay = 10 * time.Millisecond // first step when backing off
+	throttleMaxDelay = 5 * time.Second       // never wait longer than this per read
+	throttleDrift    = 1.001                 // how fast the baseline forgets old lows
+	throttleSizeUnit = float64(1 << 20)      // reads are normalized to roughly this size
+)
+
+// A throttle slows verification down when the storage appears busy.
+//
+// It keeps a moving average of read latency, normalized for blob size, and
+// compares it to a baseline: the lowest average seen, allowed to drift
+// upwards slowly so that one lucky stretch doesn't set the bar forever. When
+// the average gets well above the baseline, it makes every read wait a
+// little before starting, doubling the wait for as long as latency stays
+// high, and halving it again once latency is back near the baseline.
+//
+// A nil *throttle never waits.
+type throttle struct {
+	mu       sync.Mutex
+	samples  int
+	avg      float64
+	baseline float64
+	delay    time.Duration
+}
+
+func newThrottle() *throttle {
+	if !*autoThrottle {
+		return nil
+	}
+	return &throttle{}
+}
+
+// wait blocks for the current delay, if any.
+func (t *throttle) wait(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	d := t.delay
+	t.mu.Unlock()
+	if d == 0 {
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+// observe records that reading and verifying size bytes took d.
+func (t *throttle) observe(d time.Duration, size uint32) {
+	if t == nil {
+		return
+	}
+	latency := d.Seconds() / (1 + float64(size)/throttleSizeUnit)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples++
+	if t.samples == 1 {
+		t.avg = latency
+	} else {
+		t.avg += throttleAlpha * (latency - t.avg)
+	}
+	if t.samples < throttleWarmup {
+		return
+	}
+	if t.baseline == 0 || t.avg < t.baseline {
+		t.baseline = t.avg
+	} else {
+		t.baseline *= throttleDrift
+	}
+
+	old := t.delay
+	switch {
+	case t.avg > throttleBusy*t.baseline:
+		t.delay *= 2
+		if t.delay < throttleMinDelay {
+			t.delay = throttleMinDelay
+		}
+		if t.delay > throttleMaxDelay {
+			t.delay = throttleMaxDelay
+		}
+	case t.avg < throttleIdle*t.baseline:
+		t.delay /= 2
+		if t.delay < throttleMinDelay {
+			t.delay = 0
+		}
+	}
+	if old == 0 && t.delay > 0 {
+		stderrf("pk-verify: read latency is %.1fx its baseline; the storage seems busy, so slowing down\n", t.avg/t.baseline)
+	} else if old > 0 && t.delay == 0 {
+		stderrln("pk-verify: read latency is back to normal; resuming full speed")
+	}
+}
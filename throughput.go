@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var throughputRegression = flag.Float64("throughput-regression", 0.3, "warn when this run read the store this much slower than the previous one (as a fraction: 0.3 means 30% slower), going by the history in --state-dir; a disk that still reads correctly but more and more slowly is often about to fail. 0 disables the comparison")
+
+// minThroughputBytes is how much a run has to read for its throughput to be
+// worth comparing. Small runs are dominated by setup and caches.
+const minThroughputBytes = 64 << 20
+
+// throughputComparison compares the read throughput of a run with the
+// previous one on the same store.
+type throughputComparison struct {
+	BytesPerSecond         float64 `json:"bytesPerSecond"`
+	PreviousBytesPerSecond float64 `json:"previousBytesPerSecond"`
+	PreviousRunID          string  `json:"previousRunID"`
+
+	// Change is the relative change from the previous run: -0.25 means
+	// 25% slower.
+	Change float64 `json:"change"`
+
+	// Regressed is set when the run was slower by more than
+	// --throughput-regression.
+	Regressed bool `json:"regressed"`
+}
+
+// compareThroughput compares the throughput of the finished run s with the
+// last run in h that read enough to compare with, prints how it went, and
+// records it in s.
+func compareThroughput(s *Summary, h *history) {
+	if *throughputRegression <= 0 || h == nil || s.Bytes < minThroughputBytes || s.Duration <= 0 {
+		return
+	}
+	var prev *runRecord
+	for i := len(h.Runs) - 1; i >= 0; i-- {
+		r := &h.Runs[i]
+		if r.Status != "error" && r.Bytes >= minThroughputBytes && r.Duration > 0 {
+			prev = r
+			break
+		}
+	}
+	if prev == nil {
+		return
+	}
+	c := &throughputComparison{
+		BytesPerSecond:         float64(s.Bytes) / s.Duration,
+		PreviousBytesPerSecond: float64(prev.Bytes) / prev.Duration,
+		PreviousRunID:          prev.RunID,
+	}
+	c.Change = c.BytesPerSecond/c.PreviousBytesPerSecond - 1
+	c.Regressed = c.Change < -*throughputRegression
+	s.Throughput = c
+
+	change := fmt.Sprintf("%.0f%% faster", 100*c.Change)
+	if c.Change < 0 {
+		change = fmt.Sprintf("%.0f%% slower", -100*c.Change)
+	}
+	fmt.Printf("read at %v/s, %v than the previous run (%v/s, %v)\n", humanBytes(int64(c.BytesPerSecond)), change, humanBytes(int64(c.PreviousBytesPerSecond)), prev.Start.Format(time.RFC3339))
+	if c.Regressed {
+		fmt.Println("THROUGHPUT REGRESSED: if nothing else changed (load, flags, network), the storage may be starting to fail; check its health (like SMART data) soon.")
+	}
+}
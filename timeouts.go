@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"go4.org/jsonconfig"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var (
+	setupTimeout  = flag.Duration("setup-timeout", 2*time.Minute, "give up on initializing a storage handler (like connecting to a cloud service) after this long; 0 means never")
+	fetchTimeout  = flag.Duration("fetch-timeout", 10*time.Minute, "give up on reading one blob after this long, and try again (see --retries); 0 means never")
+	streamTimeout = flag.Duration("stream-timeout", 5*time.Minute, "if a blob stream produces nothing for this long, abandon it and restart it from where it left off (see --retries); 0 means never")
+	retries       = flag.Int("retries", 3, "how many times to retry a blob read that timed out, and to restart a blob stream that failed or stalled")
+)
+
+// stopRun cancels the context from interruptContext, as if interrupted.
+var stopRun context.CancelFunc = func() {}
+
+// interruptContext returns a context that is canceled on the first
+// interrupt signal, so that a run can stop cleanly and still report what it
+// saw. A second interrupt exits right away, after the cleanups registered
+// with atExit.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopRun = cancel
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	go func() {
+		<-sigc
+		stderrln("pk-verify: interrupted; stopping (interrupt again to quit right away)")
+		cancel()
+		<-sigc
+		exit(130)
+	}()
+	return ctx
+}
+
+// createStorage is blobserver.CreateStorage, but gives up after
+// --setup-timeout.
+//
+// CreateStorage can't be canceled, so a handler that hangs is just
+// abandoned. It isn't retried either: handlers record which of their
+// arguments they used in the arguments themselves, so two attempts at once
+// would trip over each other.
+func createStorage(handler string, ld blobserver.Loader, args jsonconfig.Obj) (blobserver.Storage, error) {
+	if *setupTimeout <= 0 {
+		return blobserver.CreateStorage(handler, ld, args)
+	}
+	type result struct {
+		sto blobserver.Storage
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sto, err := blobserver.CreateStorage(handler, ld, args)
+		done <- result{sto, err}
+	}()
+	select {
+	case r := <-done:
+		return r.sto, r.err
+	case <-time.After(*setupTimeout):
+		return nil, fmt.Errorf("initializing the %q handler did not finish within --setup-timeout=%v", handler, *setupTimeout)
+	}
+}
+
+// readLimits are how long to wait on reads of a storage, and how many times
+// to retry them: --fetch-timeout, --stream-timeout, and --retries, unless
+// tuned for the remote filesystem the storage is on (see remoteFSLimits).
+type readLimits struct {
+	retries       int
+	fetchTimeout  time.Duration
+	streamTimeout time.Duration
+}
+
+// flagReadLimits returns the readLimits that the flags give.
+func flagReadLimits() readLimits {
+	return readLimits{retries: *retries, fetchTimeout: *fetchTimeout, streamTimeout: *streamTimeout}
+}
+
+// withRetries calls read with a context that times out after
+// lim.fetchTimeout, and tries again, up to lim.retries times, if it does
+// (or, with retryReadErrors, for storages on network mounts, if it fails to
+// read).
+func withRetries(ctx context.Context, lim readLimits, retryReadErrors bool, read func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		rctx, cancel := ctx, context.CancelFunc(func() {})
+		if lim.fetchTimeout > 0 {
+			rctx, cancel = context.WithTimeout(ctx, lim.fetchTimeout)
+		}
+		err := read(rctx)
+		timedOut := rctx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		if err == nil || !(timedOut || retryReadErrors && isReadError(err)) {
+			return err
+		}
+		if attempt >= lim.retries {
+			if !timedOut {
+				return fmt.Errorf("failed %v time%v: %w", attempt+1, plural(attempt+1), err)
+			}
+			return fmt.Errorf("timed out after %v, %v time%v: %w", lim.fetchTimeout, attempt+1, plural(attempt+1), err)
+		}
+	}
+}
+
+// errStalled is returned by streamOnce when the stream stops producing
+// blobs.
+var errStalled = errors.New("blob stream stalled")
+
+// streamBlobs is like streamer.StreamBlobs, streaming all blobs into dest
+// and closing it when done. But when the stream fails or stalls for
+// lim.streamTimeout, it restarts it from the last continuation token, up to
+// lim.retries times. While it is stalled, it warns every --stall-warning,
+// with the lines from diagnose (which may be nil).
+func streamBlobs(ctx context.Context, lim readLimits, streamer blobserver.BlobStreamer, dest chan<- blobserver.BlobAndToken, diagnose func() []string) error {
+	defer close(dest)
+	var (
+		token string
+		last  blob.Ref // the last blob sent to dest
+	)
+	send := func(b blobserver.BlobAndToken) error {
+		if b.Ref() == last {
+			return nil // resumed streams may start with the blob they stopped at
+		}
+		select {
+		case dest <- b:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		last, token = b.Ref(), b.Token
+		return nil
+	}
+	warn := func(quiet time.Duration) { warnStalled(quiet, last, token, lim.streamTimeout, diagnose) }
+	for attempt := 0; ; attempt++ {
+		err := streamOnce(ctx, lim.streamTimeout, streamer, token, send, warn)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= lim.retries {
+			return err
+		}
+		if token == "" && last.Valid() {
+			// No way to resume without starting over, which would
+			// send the blobs so far again.
+			return fmt.Errorf("%w (and the stream can't be resumed)", err)
+		}
+		stderrf("pk-verify: %v; restarting the stream where it left off (retry %v of %v)\n", err, attempt+1, lim.retries)
+	}
+}
+
+// streamOnce runs one attempt of streamBlobs, starting at token, and calls
+// send with each blob, and warn every --stall-warning that passes without
+// one. It gives up on the stream after streamTimeout without one.
+func streamOnce(ctx context.Context, streamTimeout time.Duration, streamer blobserver.BlobStreamer, token string, send func(blobserver.BlobAndToken) error, warn func(quiet time.Duration)) error {
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	blobs := make(chan blobserver.BlobAndToken)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- streamer.StreamBlobs(sctx, blobs, token)
+	}()
+	// abandon stops the stream and lets it wind down in the background.
+	abandon := func() {
+		cancel()
+		go func() {
+			for range blobs {
+			}
+		}()
+	}
+
+	var stalled <-chan time.Time
+	var timer *time.Timer
+	if streamTimeout > 0 {
+		timer = time.NewTimer(streamTimeout)
+		defer timer.Stop()
+		stalled = timer.C
+	}
+	var quiet <-chan time.Time
+	var warnTimer *time.Timer
+	quietSince := time.Now()
+	if *stallWarning > 0 {
+		warnTimer = time.NewTimer(*stallWarning)
+		defer warnTimer.Stop()
+		quiet = warnTimer.C
+	}
+	for {
+		select {
+		case b, ok := <-blobs:
+			if !ok {
+				return <-errc
+			}
+			if err := send(b); err != nil {
+				abandon()
+				return err
+			}
+			if timer != nil {
+				// Waiting for the verifiers to catch up is not the
+				// stream's fault, so only time the stream itself.
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(streamTimeout)
+			}
+			if warnTimer != nil {
+				if !warnTimer.Stop() {
+					<-warnTimer.C
+				}
+				warnTimer.Reset(*stallWarning)
+			}
+			quietSince = time.Now()
+		case <-quiet:
+			warn(time.Since(quietSince))
+			warnTimer.Reset(*stallWarning)
+		case <-stalled:
+			abandon()
+			return fmt.Errorf("%w: no blobs for --stream-timeout=%v", errStalled, streamTimeout)
+		}
+	}
+}
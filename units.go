@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	unitsFlag      = flag.String("units", "si", "how to print sizes and rates: \"si\" (1 GB = 1000 MB) or \"iec\" (1 GiB = 1024 MiB)")
+	countSeparator = flag.String("count-separator", ",", "the thousands separator in printed blob counts, like \",\" for 1,234,567 or \".\" for 1.234.567; empty for none")
+)
+
+// byteUnits maps the suffixes accepted by parseBytes to their multipliers.
+// Both SI ("MB") and binary ("MiB") suffixes are accepted, because people
+// write both and mean roughly the same thing.
+var byteUnits = []struct {
+	suffix string
+	mult   float64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseBytes parses a human-written size like "512", "64KB" or "1.5GiB".
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s = strings.TrimSpace(s[:len(s)-len(u.suffix)])
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * mult), nil
+}
+
+// parseRate parses a read rate like "50MB/s" or "50MB" (the "/s" is optional)
+// into bytes per second.
+func parseRate(s string) (float64, error) {
+	n, err := parseBytes(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("invalid rate %q: must be positive", s)
+	}
+	return float64(n), nil
+}
+
+// humanBytes formats n as a short human-readable size, like "1.5 GB", or
+// "1.4 GiB" with --units=iec.
+func humanBytes(n int64) string {
+	unit, prefixes, suffix := int64(1000), "kMGTPE", "B"
+	if *unitsFlag == "iec" {
+		unit, prefixes, suffix = 1024, "KMGTPE", "iB"
+	}
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %c%v", float64(n)/float64(div), prefixes[exp], suffix)
+}
+
+// checkUnits checks --units.
+func checkUnits() error {
+	switch *unitsFlag {
+	case "si", "iec":
+		return nil
+	}
+	return fmt.Errorf("invalid --units %q: must be \"si\" or \"iec\"", *unitsFlag)
+}
+
+// humanCount formats n with --count-separator between each group of three
+// digits, like "1,234,567".
+func humanCount(n int) string {
+	s := strconv.Itoa(n)
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	if *countSeparator != "" {
+		for i := len(s) - 3; i > 0; i -= 3 {
+			s = s[:i] + *countSeparator + s[i:]
+		}
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// humanDuration formats d to the second, or to the minute once it's over an
+// hour, like "42s", "3m7s", or "5h12m".
+func humanDuration(d time.Duration) string {
+	if d >= time.Hour {
+		d = d.Round(time.Minute)
+		return strings.TrimSuffix(d.String(), "0s")
+	}
+	return d.Round(time.Second).String()
+}
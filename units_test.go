@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{" 512 ", 512, true},
+		{"512B", 512, true},
+		{"64KB", 64000, true},
+		{"64kb", 64000, true},
+		{"64KiB", 64 << 10, true},
+		{"64K", 64 << 10, true},
+		{"1.5GiB", 3 << 29, true},
+		{"1.5 GB", 1500000000, true},
+		{"2T", 2 << 40, true},
+		{"", 0, false},
+		{"MB", 0, false},
+		{"-1MB", 0, false},
+		{"12 parsecs", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseBytes(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBytes(%q) = %v, %v; want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHumanCount(t *testing.T) {
+	defer func(sep string) { *countSeparator = sep }(*countSeparator)
+	tests := []struct {
+		n    int
+		sep  string
+		want string
+	}{
+		{0, ",", "0"},
+		{999, ",", "999"},
+		{1000, ",", "1,000"},
+		{1234567, ",", "1,234,567"},
+		{-1234567, ",", "-1,234,567"},
+		{-123, ",", "-123"},
+		{1234567, ".", "1.234.567"},
+		{1234567, "", "1234567"},
+	}
+	for _, tt := range tests {
+		*countSeparator = tt.sep
+		if got := humanCount(tt.n); got != tt.want {
+			t.Errorf("humanCount(%v) with separator %q = %q, want %q", tt.n, tt.sep, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"go4.org/syncutil"
+
+	"github.com/jeremyschlatter/pk-verify/pkverify"
+
+	"perkeep.org/pkg/blob"
+	"perkeep.org/pkg/blobserver"
+)
+
+var (
+	paranoid = flag.Bool("paranoid", false, "when a blob fails verification, read it again with a separate fetch before declaring it corrupt, to tell in-flight errors (like a RAM bit flip) apart from corruption at rest")
+	passes   = flag.Int("passes", 1, "read and verify every blob this many times, and report blobs that fail only some of the time (a sign of flaky hardware rather than corruption at rest)")
+)
+
+// verifyResult is the outcome of verifying one blob.
+type verifyResult struct {
+	ref  blob.Ref
+	size uint32
+	err  error // nil if the blob is valid
+
+	// duration is how long the first read and verification took.
+	duration time.Duration
+
+	// passes is how many times the blob was read, and failures how
+	// many of those reads failed verification.
+	passes, failures int
+
+	// transient is set when some reads of the blob failed verification
+	// but others were valid (see --paranoid and --passes). In that case
+	// err holds the first failure.
+	transient bool
+
+	// raced is set when the blob failed verification, but changed while
+	// it was being read; see checkRaced.
+	raced bool
+
+	// cached is set when the blob wasn't read at all, because it verified
+	// in an earlier run and hasn't changed since; see verifyCache.
+	cached bool
+
+	// interrupted is set when the run was stopped (by an interrupt, say,
+	// or "pk-verify ctl stop") before the blob could be verified. It says
+	// nothing about the blob, so it isn't counted either way.
+	interrupted bool
+}
+
+// A verifier verifies the blobs in one storage.
+type verifier struct {
+	sto      blobserver.Storage
+	workers  int
+	throttle *throttle         // may be nil
+	scale    *autoscaler       // for --autoscale; may be nil
+	shard    *shard            // if non-nil, blobs outside it are skipped
+	verified map[blob.Ref]bool // from --skip-verified; these are skipped too
+	exclude  *exclusion        // blobs to skip, counted in excluded
+	excluded excludedBlobs
+	limiter  *fetchLimiter // paces verifyEnumerate's fetches; may be nil
+	cache    *verifyCache  // skips unchanged blob files; may be nil
+
+	// inspect, if non-nil, is called with the contents of every valid
+	// blob no bigger than maxInspectSize, for checks that need to look
+	// inside blobs. It may be called concurrently.
+	inspect func(br blob.Ref, data []byte)
+
+	dups      *dupFinder       // for --find-duplicates; may be nil
+	migration *migrationCheck  // for --check-migration; may be nil
+	replicas  *replicaCompare  // for --compare-replicas; may be nil
+	members   *zipMemberHasher // for --zip-members; may be nil
+
+	// paranoid re-reads the blobs that fail, as --paranoid asks, and
+	// retryReadErrors retries reads that fail with an I/O error, not just
+	// ones that time out; both are set for storages on network mounts
+	// (see adjustForMount).
+	paranoid        bool
+	retryReadErrors bool
+
+	// tuned, if non-nil, replaces the flags' timeouts and retries, for a
+	// storage on a --remote-fs mount (see adjustForMount).
+	tuned *readLimits
+
+	// checks are the --checks to run on every blob; see blobChecks.
+	checks []pkverify.Check
+
+	// diagnose, if non-nil, describes what the storage is doing, for
+	// warnings about stalled streams.
+	diagnose func() []string
+
+	// activity tracks what the workers are reading, for the status dump;
+	// it may be nil.
+	activity *activity
+}
+
+// limits returns the timeouts and retries for reading v's blobs.
+func (v *verifier) limits() readLimits {
+	if v.tuned != nil {
+		return *v.tuned
+	}
+	return flagReadLimits()
+}
+
+// maxInspectSize is the biggest blob that verifier.inspect gets to see.
+const maxInspectSize = maxSchemaSize
+
+// verifyStream streams all of the blobs from streamer and verifies their
+// contents, using v.workers concurrent workers. fn is called with the result
+// for each blob, always from the calling goroutine, so it does not need to
+// worry about synchronization.
+func (v *verifier) verifyStream(ctx context.Context, streamer blobserver.BlobStreamer, fn func(verifyResult)) error {
+	blobs := make(chan blobserver.BlobAndToken)
+	results := make(chan verifyResult)
+
+	var stream syncutil.Group
+	stream.Go(func() error {
+		return streamBlobs(ctx, v.limits(), streamer, blobs, v.diagnose)
+	})
+
+	// Decouple the streamer from the verifiers with a bounded queue, so
+	// that the streamer can read ahead a little, but not so far that the
+	// blobs it read ahead pile up in memory.
+	queue := newBlobQueue(*queueDepth, queueBytes)
+	go func() {
+		for b := range blobs {
+			queue.push(b)
+		}
+		queue.close()
+	}()
+
+	var verifiers syncutil.Group
+	for i := 0; i < v.workers; i++ {
+		verifiers.Go(func() error {
+			for {
+				b, ok := queue.pop()
+				if !ok {
+					return nil
+				}
+				v.activity.at(b.Token)
+				if !v.wants(b.Ref(), b.Size()) {
+					continue
+				}
+				results <- v.verifyBlob(ctx, b.Blob)
+			}
+		})
+	}
+	go func() {
+		verifiers.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		fn(r)
+	}
+	return stream.Err()
+}
+
+// verifyBlob verifies one streamed blob.
+func (v *verifier) verifyBlob(ctx context.Context, b *blob.Blob) verifyResult {
+	r := v.verifyWith(ctx, b.Ref(), b.Size(), func(ctx context.Context) error {
+		switch {
+		case int64(b.Size()) > hugeBlobBytes:
+			return v.verifyRanges(ctx, b.Ref(), b.Size())
+		case v.inspect != nil && b.Size() <= maxInspectSize, v.members != nil, v.dups != nil, v.migration != nil, !v.onlyHash():
+			rd, err := b.ReadAll(ctx)
+			if err != nil {
+				return err
+			}
+			return v.verifyReader(b.Ref(), b.Size(), rd)
+		default:
+			return b.ValidContents(ctx)
+		}
+	})
+	v.checkRaced(ctx, &r, nil)
+	return r
+}
+
+// verifyWith verifies the blob br, using read to read and check it the
+// first time, and re-reading it as asked by --passes and --paranoid. Reads
+// that time out are retried; see withRetries.
+func (v *verifier) verifyWith(ctx context.Context, br blob.Ref, size uint32, read func(context.Context) error) verifyResult {
+	stopped := verifyResult{ref: br, size: size, interrupted: true}
+	runPause.wait(ctx)
+	if ctx.Err() != nil {
+		return stopped
+	}
+	v.scale.enter(ctx)
+	defer v.scale.leave()
+	if ctx.Err() != nil {
+		return stopped
+	}
+	v.throttle.wait(ctx)
+	if ctx.Err() != nil {
+		return stopped
+	}
+	v.activity.begin(br)
+	defer v.activity.end(br)
+	start := time.Now()
+	r := verifyResult{
+		ref:    br,
+		size:   size,
+		passes: 1,
+		err:    withRetries(ctx, v.limits(), v.retryReadErrors, read),
+	}
+	r.duration = time.Since(start)
+	if r.err != nil && ctx.Err() != nil {
+		return stopped
+	}
+	v.throttle.observe(r.duration, r.size)
+	if r.err != nil {
+		r.failures++
+	}
+	// The first read may have come from memory, so repeating it would
+	// prove nothing. Extra passes fetch the blob again from storage.
+	reread := func() {
+		r.passes++
+		if err := withRetries(ctx, v.limits(), v.retryReadErrors, func(ctx context.Context) error { return v.verifyFetch(ctx, r.ref) }); err != nil {
+			r.failures++
+			if r.err == nil {
+				r.err = err
+			}
+		}
+	}
+	for r.passes < *passes {
+		reread()
+	}
+	if v.paranoid && r.failures > 0 && r.failures == r.passes {
+		reread()
+	}
+	if r.failures > 0 && ctx.Err() != nil {
+		return stopped
+	}
+	r.transient = r.err != nil && r.failures < r.passes
+	v.scale.observe(r.size, r.failures > 0)
+	return r
+}
+
+// verifyReader reads the contents of the blob br from rd and runs the
+// checks on them, starting with matching its hash. If the blob is valid and
+// v.inspect wants to see it, it is passed along, and so is its fingerprint
+// to v.dups, its modern ref to v.migration, and, if it's a zip, its members
+// to v.members.
+func (v *verifier) verifyReader(br blob.Ref, size uint32, rd io.Reader) error {
+	bc := pkverify.Combine(br, size, v.blobChecks())
+	w := []io.Writer{bc}
+	fp := v.dups.hasher()
+	if fp != nil {
+		w = append(w, fp)
+	}
+	mh := v.migration.hasher(br)
+	if mh != nil {
+		w = append(w, mh)
+	}
+	inspect := v.inspect != nil && size <= maxInspectSize
+	if !inspect && (v.members == nil || size > maxPackedZipSize) {
+		if _, err := hashCopy(io.MultiWriter(w...), rd); err != nil {
+			return err
+		}
+		if err := bc.Result(); err != nil {
+			return err
+		}
+		v.dups.add(br, size, fp)
+		v.migration.add(br, mh)
+		return nil
+	}
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	if _, err := io.MultiWriter(w...).Write(data); err != nil {
+		return err
+	}
+	if err := bc.Result(); err != nil {
+		return err
+	}
+	v.dups.add(br, size, fp)
+	v.migration.add(br, mh)
+	if inspect {
+		v.inspect(br, data)
+	}
+	v.members.add(br, data)
+	return nil
+}
+
+// verifyFetch fetches br from storage with a fresh read and checks that its
+// contents match its hash.
+func (v *verifier) verifyFetch(ctx context.Context, br blob.Ref) error {
+	_, err := pkverify.Blob(ctx, v.sto, br)
+	return err
+}
+
+// copyBufs holds the buffers that blob contents are hashed through. They are
+// bigger than io.Copy's, so that reading a big blob takes fewer system calls.
+var copyBufs = sync.Pool{New: func() interface{} { return make([]byte, 256<<10) }}
+
+// hashCopy writes everything from r to h.
+func hashCopy(h io.Writer, r io.Reader) (int64, error) {
+	buf := copyBufs.Get().([]byte)
+	defer copyBufs.Put(buf)
+	return io.CopyBuffer(h, r, buf)
+}
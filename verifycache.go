@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"perkeep.org/pkg/blob"
+)
+
+var (
+	verifyCacheFile   = flag.String("verify-cache", "", "for blob files read directly (see --walk), remember in this file which ones verified, by path, ref, size, and modification time, and don't read them again in later runs until they change or the entry gets older than --verify-cache-max-age. The skipped blobs count as valid, but checks beyond the hash (like --inventory) don't see them")
+	verifyCacheMaxAge = flag.Duration("verify-cache-max-age", 30*24*time.Hour, "how long a --verify-cache entry is good for. Bit rot doesn't change a file's size or modification time, so files have to be read again eventually to catch it")
+)
+
+// A verifyCache remembers which blob files verified, so that a later run can
+// skip the ones that haven't been touched since. A file is identified by its
+// path, ref, size, and modification time: restoring, rewriting, or
+// truncating it changes at least one of the last three. It takes the path
+// too because a copy of the same blob elsewhere, such as in a replica made
+// with rsync -a, is a different file that can go bad on its own.
+//
+// A nil *verifyCache never skips anything.
+type verifyCache struct {
+	path string
+
+	mu  sync.Mutex
+	old map[string]cacheEntry // by file path, as loaded
+	new map[string]cacheEntry // verified, or skipped, in this run
+}
+
+type cacheEntry struct {
+	ref      blob.Ref
+	size     uint32
+	mtime    int64 // UnixNano
+	verified int64 // Unix
+}
+
+// loadVerifyCache loads the --verify-cache file, returning nil if there
+// isn't one. A cache that doesn't exist yet is empty.
+func loadVerifyCache() (*verifyCache, error) {
+	if *verifyCacheFile == "" {
+		return nil, nil
+	}
+	c := &verifyCache{path: *verifyCacheFile, old: map[string]cacheEntry{}, new: map[string]cacheEntry{}}
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	version := 1
+	for line := 1; sc.Scan(); line++ {
+		if v, ok := parseSchemaLine(sc.Text()); ok {
+			if err := checkSchema("verify cache", c.path, v, verifyCacheSchema); err != nil {
+				return nil, err
+			}
+			version = v
+			continue
+		}
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if version < 2 {
+			// Version 1 didn't record paths, so there's no
+			// telling which copy of a blob verified. Its
+			// files are all read again, once.
+			continue
+		}
+		var (
+			ref string
+			e   cacheEntry
+		)
+		fields := strings.SplitN(text, " ", 5)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%v:%v: expected <ref> <size> <mtime> <verified> <path>", c.path, line)
+		}
+		if _, err := fmt.Sscan(strings.Join(fields[:4], " "), &ref, &e.size, &e.mtime, &e.verified); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", c.path, line, err)
+		}
+		br, ok := blob.Parse(ref)
+		if !ok {
+			return nil, fmt.Errorf("%v:%v: invalid blob ref %q", c.path, line, ref)
+		}
+		e.ref = br
+		c.old[fields[4]] = e
+	}
+	return c, sc.Err()
+}
+
+// fresh reports whether f verified in an earlier run, is unchanged since,
+// and was verified recently enough to trust.
+func (c *verifyCache) fresh(f blobFile) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.old[f.path]
+	if !ok || e.ref != f.ref || e.size != f.size || e.mtime != f.info.ModTime().UnixNano() {
+		return false
+	}
+	if time.Since(time.Unix(e.verified, 0)) > *verifyCacheMaxAge {
+		return false
+	}
+	c.new[f.path] = e
+	return true
+}
+
+// lastVerified returns when f last verified (as Unix time) according to
+// the cache as loaded, or 0 if it doesn't know.
+func (c *verifyCache) lastVerified(f blobFile) int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.old[f.path]; e.ref == f.ref {
+		return e.verified
+	}
+	return 0
+}
+
+// record remembers that f just verified.
+func (c *verifyCache) record(f blobFile) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.new[f.path] = cacheEntry{ref: f.ref, size: f.size, mtime: f.info.ModTime().UnixNano(), verified: time.Now().Unix()}
+}
+
+// save writes the cache back. If the run covered the whole store
+// (complete), only the files it saw are kept, which drops the ones that
+// were deleted; otherwise the earlier entries are kept too.
+func (c *verifyCache) save(complete bool) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := c.new
+	if !complete {
+		entries = make(map[string]cacheEntry, len(c.old)+len(c.new))
+		for path, e := range c.old {
+			entries[path] = e
+		}
+		for path, e := range c.new {
+			entries[path] = e
+		}
+	}
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".verify-cache-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintln(w, schemaLine(verifyCacheSchema))
+	fmt.Fprintln(w, "# pk-verify verify cache: <ref> <size> <mtime ns> <verified unix time> <path>")
+	for _, path := range paths {
+		e := entries[path]
+		fmt.Fprintf(w, "%v %d %d %d %v\n", e.ref, e.size, e.mtime, e.verified, path)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// verifyFileCached is verifyFile, except that it skips the files that
+// v.cache says are unchanged since they last verified.
+func (v *verifier) verifyFileCached(ctx context.Context, f blobFile) verifyResult {
+	if v.cache.fresh(f) {
+		return verifyResult{ref: f.ref, size: f.size, cached: true}
+	}
+	r := v.verifyFile(ctx, f)
+	if r.err == nil && !r.raced && !r.interrupted {
+		v.cache.record(f)
+	}
+	return r
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The schema versions of what pk-verify writes for other programs, and for
+// its own later runs, to read.
+//
+// Every JSON output and state file has a "schemaVersion" field, and the text
+// formats (manifests and the verify cache) a "# schemaVersion N" line at the
+// top. The policy is:
+//
+//   - Within a version, changes are only additions: new fields (or
+//     statuses, grades, and so on) may appear, so readers must ignore the
+//     ones they don't know; but the existing ones keep their names, types,
+//     and meanings. Anything else gets a new version.
+//   - pk-verify always writes the current version, and reads every older
+//     one, upgrading it as it's loaded (see checkSchema). Files from before
+//     versions were recorded count as version 1.
+//   - pk-verify refuses files from a newer version, rather than misread
+//     them and, for state files, write them back with what it didn't
+//     understand left out.
+const (
+	summarySchema     = 1 // --summary-out, which merge, repair, and recheck read back
+	historySchema     = 1 // the history of runs in --state-dir
+	scheduleSchema    = 1 // the daemon's schedule in --state-dir
+	journalSchema     = 1 // each line of a repair journal
+	fingerprintSchema = 1 // --fingerprint-out
+	diagnosisSchema   = 1 // --diagnose
+	manifestSchema    = 1 // --manifest-out
+	verifyCacheSchema = 2 // --verify-cache
+	bloomSchema       = 1 // --bloom-out
+)
+
+// checkSchema checks that the file at path, a kind of file written in
+// schema version v (0 if it doesn't say), is one that this pk-verify can
+// read, where current is the version it writes.
+//
+// This is where an old version would be upgraded. Version 1 is what there
+// was before versions were recorded; the only later one so far is the
+// verify cache's version 2, whose loader does its own upgrading.
+func checkSchema(kind, path string, v, current int) error {
+	if v > current {
+		return fmt.Errorf("%v is a %v in schema version %v, written by a newer pk-verify; this one only understands versions up to %v", path, kind, v, current)
+	}
+	return nil
+}
+
+// schemaLinePrefix starts the line that gives the schema version of a text
+// format.
+const schemaLinePrefix = "# schemaVersion "
+
+// schemaLine returns the line that gives the schema version v of a text
+// format.
+func schemaLine(v int) string {
+	return schemaLinePrefix + strconv.Itoa(v)
+}
+
+// parseSchemaLine returns the schema version that line gives, if it's the
+// line that does.
+func parseSchemaLine(line string) (int, bool) {
+	if !strings.HasPrefix(line, schemaLinePrefix) {
+		return 0, false
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, schemaLinePrefix)))
+	return v, err == nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"go4.org/syncutil"
+
+	"perkeep.org/pkg/blob"
+)
+
+var walkOrder = flag.String("walk-order", "ref", "the order to verify walked blob files in (see --walk): \"ref\" (the fastest, in directory order), \"oldest\" (oldest files first, since old data has had the most time to rot, and is the most valuable to check early in a run that might be cut short), or \"newest\". The other orders list every file before verifying any")
+
+var walkFlag = flag.Bool("walk", false, "for storage on a local filesystem (the \"filesystem\" handler), read the blob files directly with --workers concurrent readers, instead of going through the storage's blob streaming; this is much faster on SSDs. pk-verify falls back to streaming if it doesn't recognize the directory layout")
+
+// The directory layout of a localdisk ("filesystem") storage is:
+//
+//	<root>/<hash name>/<2 hex digits>/<2 hex digits>/<blob ref>.dat
+//
+// like sha224/ab/cd/sha224-abcd1234....dat. Other things may live in the
+// root too (like a GENERATION.dat file, or a "packed" directory belonging to
+// blobpacked), and are ignored.
+var (
+	hashDirRE  = regexp.MustCompile(`^sha[0-9]+$`)
+	shardDirRE = regexp.MustCompile(`^[0-9a-f]{2}$`)
+)
+
+// localdiskRoot returns the root directory of the storage at prefix, if it is
+// a localdisk storage whose layout pk-verify recognizes and can walk.
+func localdiskRoot(conf *LowLevelConfig, prefix string) (string, bool) {
+	sc := conf.Prefixes[prefix]
+	if sc.StorageHandler != "filesystem" {
+		return "", false
+	}
+	root, _ := sc.StorageHandlerArgs["path"].(string)
+	if root == "" {
+		return "", false
+	}
+	dirs, err := shardDirs(root)
+	if err != nil || len(dirs) == 0 {
+		return "", false
+	}
+	return root, true
+}
+
+// shardDirs returns the leaf directories of the localdisk layout under root,
+// in order.
+func shardDirs(root string) ([]string, error) {
+	var leaves []string
+	hashDirs, err := subdirs(root, hashDirRE)
+	if err != nil {
+		return nil, err
+	}
+	for _, hd := range hashDirs {
+		firsts, err := subdirs(hd, shardDirRE)
+		if err != nil {
+			return nil, err
+		}
+		for _, first := range firsts {
+			seconds, err := subdirs(first, shardDirRE)
+			if err != nil {
+				return nil, err
+			}
+			leaves = append(leaves, seconds...)
+		}
+	}
+	return leaves, nil
+}
+
+// subdirs returns the paths of the directories in dir whose names match re,
+// in order.
+func subdirs(dir string, re *regexp.Regexp) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, fi := range infos {
+		if fi.IsDir() && re.MatchString(fi.Name()) {
+			dirs = append(dirs, filepath.Join(dir, fi.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+// localdiskPath returns the path of the file that br is stored in under the
+// localdisk root, or "" if br's digest is too short to say.
+func localdiskPath(root string, br blob.Ref) string {
+	digest := br.Digest()
+	if len(digest) < 4 {
+		return ""
+	}
+	return filepath.Join(root, br.HashName(), digest[0:2], digest[2:4], br.String()+".dat")
+}
+
+// A blobFile is a blob stored as a file, as found by walking a localdisk
+// storage.
+type blobFile struct {
+	path string
+	ref  blob.Ref
+	size uint32
+	info os.FileInfo
+
+	// tooBig is set for a file too big for its size to fit in size, which
+	// is far too big to be a blob.
+	tooBig bool
+}
+
+// listBlobFiles returns the blob files in one leaf directory of a localdisk
+// storage, in order.
+func listBlobFiles(dir string) ([]blobFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []blobFile
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		br, ok := blob.Parse(strings.TrimSuffix(name, ".dat"))
+		if !ok {
+			continue // probably a temp file from a write in progress
+		}
+		f := blobFile{
+			path: filepath.Join(dir, name),
+			ref:  br,
+			size: uint32(fi.Size()),
+			info: fi,
+		}
+		if fi.Size() > math.MaxUint32 {
+			f.size, f.tooBig = math.MaxUint32, true
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ref.Less(files[j].ref) })
+	return files, nil
+}
+
+// verifyWalk verifies all of the blobs in the localdisk storage at root by
+// reading the files directly, with v.workers directories being read at once.
+// Like verifyStream, it calls fn with each result from the calling
+// goroutine.
+func (v *verifier) verifyWalk(ctx context.Context, root string, fn func(verifyResult)) error {
+	dirs, err := shardDirs(root)
+	if err != nil {
+		return err
+	}
+	if *walkOrder != "ref" {
+		return v.verifyWalkByAge(ctx, dirs, *walkOrder == "newest", fn)
+	}
+	work := make(chan string)
+	results := make(chan verifyResult)
+	done := make(chan struct{}) // closed once the walkers have all returned
+	go func() {
+		defer close(work)
+		for _, dir := range dirs {
+			select {
+			case work <- dir:
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var walkers syncutil.Group
+	for i := 0; i < v.workers; i++ {
+		walkers.Go(func() error {
+			for dir := range work {
+				files, err := listBlobFiles(dir)
+				if err != nil {
+					return err
+				}
+				for _, f := range files {
+					if !v.wants(f.ref, f.size) {
+						continue
+					}
+					results <- v.verifyFileCached(ctx, f)
+				}
+			}
+			return nil
+		})
+	}
+	go func() {
+		walkers.Wait()
+		close(done)
+		close(results)
+	}()
+
+	for r := range results {
+		fn(r)
+	}
+	return walkers.Err()
+}
+
+// verifyWalkByAge is verifyWalk for the "oldest" and "newest" orders: it
+// lists all of the blob files in dirs, sorts them by modification time, and
+// then verifies them in that order with v.workers concurrent readers.
+func (v *verifier) verifyWalkByAge(ctx context.Context, dirs []string, newestFirst bool, fn func(verifyResult)) error {
+	files, err := listAllBlobFiles(dirs, v.workers)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		ti, tj := files[i].info.ModTime(), files[j].info.ModTime()
+		if newestFirst {
+			return ti.After(tj)
+		}
+		return ti.Before(tj)
+	})
+
+	queue := make(chan blobFile)
+	results := make(chan verifyResult)
+	go func() {
+		defer close(queue)
+		for _, f := range files {
+			if !v.wants(f.ref, f.size) {
+				continue
+			}
+			select {
+			case queue <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var readers syncutil.Group
+	for i := 0; i < v.workers; i++ {
+		readers.Go(func() error {
+			for f := range queue {
+				results <- v.verifyFileCached(ctx, f)
+			}
+			return nil
+		})
+	}
+	go func() {
+		readers.Wait()
+		close(results)
+	}()
+	for r := range results {
+		fn(r)
+	}
+	return ctx.Err()
+}
+
+// listAllBlobFiles lists the blob files in all of dirs, with workers
+// directories being listed at once, in no particular order.
+func listAllBlobFiles(dirs []string, workers int) ([]blobFile, error) {
+	var (
+		mu      sync.Mutex
+		files   []blobFile
+		listErr error
+		work    = make(chan string)
+		listers sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		listers.Add(1)
+		go func() {
+			defer listers.Done()
+			for dir := range work {
+				fs, err := listBlobFiles(dir)
+				mu.Lock()
+				if err != nil && listErr == nil {
+					listErr = err
+				}
+				files = append(files, fs...)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, dir := range dirs {
+		work <- dir
+	}
+	close(work)
+	listers.Wait()
+	return files, listErr
+}
+
+// verifyFile verifies one blob file.
+func (v *verifier) verifyFile(ctx context.Context, f blobFile) verifyResult {
+	r := v.verifyWith(ctx, f.ref, f.size, func(ctx context.Context) error {
+		if f.tooBig {
+			return fmt.Errorf("%v is %v, far too big to be a blob", f.path, humanBytes(f.info.Size()))
+		}
+		file, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if useMmap() {
+			if mapped, err := v.verifyMapped(file, f); mapped {
+				return err
+			}
+		}
+		return v.verifyReader(f.ref, f.size, file)
+	})
+	v.checkRaced(ctx, &r, &f)
+	withTrailingGarbage(&r, f)
+	return r
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+)
+
+var checkWholeRefs = flag.Bool("check-wholerefs", false, "for every file schema blob that records a wholeRef (a digest of the whole file), rebuild the file from its parts and check that it matches; this catches files whose chunks are all intact but assembled wrong")
+
+// A wholeRefChecker collects the file schema blobs seen during verification,
+// and then checks that each one's parts add up to its wholeRef.
+type wholeRefChecker struct {
+	mu    sync.Mutex
+	files []wholeRefFile
+}
+
+type wholeRefFile struct {
+	ref blob.Ref
+	sb  *schemaBlob
+	f   blob.Fetcher // where to read the parts from
+}
+
+// inspector returns a function suitable for verifier.inspect, for blobs read
+// from f.
+func (c *wholeRefChecker) inspector(f blob.Fetcher) func(blob.Ref, []byte) {
+	return func(br blob.Ref, data []byte) {
+		if !looksLikeSchema(data) {
+			return
+		}
+		sb, err := parseSchema(data)
+		if err != nil || sb.Type != "file" || !sb.WholeRef.Valid() {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.files = append(c.files, wholeRefFile{ref: br, sb: sb, f: f})
+	}
+}
+
+// check checks all of the files collected so far, records the results in s,
+// and reports any problems to found.
+func (c *wholeRefChecker) check(ctx context.Context, s *Summary, found *findings) {
+	n := len(c.files)
+	if n == 0 {
+		return
+	}
+	fmt.Printf("checking the wholeRefs of %v file%v...\n", n, plural(n))
+	s.WholeRefsChecked = n
+	s.WholeRefMismatches = []blob.Ref{}
+	for _, file := range c.files {
+		switch err := checkWholeRef(ctx, file.f, file.sb); err {
+		case nil:
+		case errWholeRefMismatch:
+			s.WholeRefMismatches = append(s.WholeRefMismatches, file.ref)
+			found.report("file %v (%q) does not match its wholeRef %v when rebuilt from its parts", file.ref, file.sb.FileName, file.sb.WholeRef)
+		default:
+			s.WholeRefMismatches = append(s.WholeRefMismatches, file.ref)
+			found.report("file %v (%q) could not be rebuilt from its parts: %v", file.ref, file.sb.FileName, err)
+		}
+	}
+	if m := len(s.WholeRefMismatches); m > 0 {
+		fmt.Printf("BAD FILES: %v of %v file%v did not match their wholeRef. Their refs are listed %v.\n", m, n, plural(n), found.where())
+		if s.Status == "clean" || s.Status == "missing" {
+			s.Status = "corrupt"
+		}
+	} else {
+		fmt.Printf("all %v file%v matched their wholeRef\n", n, plural(n))
+	}
+}
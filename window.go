@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A readWindow is the time of day, in local time, that the daemon may read
+// during (see its --window). It may run across midnight.
+//
+// A nil *readWindow is always open.
+type readWindow struct {
+	start, end time.Duration // since midnight
+	text       string
+}
+
+// parseWindow parses a window like "01:00-06:00".
+func parseWindow(s string) (*readWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid window %q: must look like \"01:00-06:00\"", s)
+	}
+	w := &readWindow{text: s}
+	for i, dst := range []*time.Duration{&w.start, &w.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %q is not a time of day like \"01:00\"", s, parts[i])
+		}
+		*dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid window %q: it starts when it ends", s)
+	}
+	return w, nil
+}
+
+func (w *readWindow) String() string {
+	return w.text
+}
+
+// timeOfDay returns the time offset since midnight on the day of t.
+func timeOfDay(t time.Time, offset time.Duration) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, t.Location())
+}
+
+// open reports whether the window is open at t.
+func (w *readWindow) open(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	start, end := timeOfDay(t, w.start), timeOfDay(t, w.end)
+	if w.start < w.end {
+		return !t.Before(start) && t.Before(end)
+	}
+	return !t.Before(start) || t.Before(end)
+}
+
+// nextOpen returns when the window is next open, from t on: t itself, if it
+// is open then.
+func (w *readWindow) nextOpen(t time.Time) time.Time {
+	if w.open(t) {
+		return t
+	}
+	start := timeOfDay(t, w.start)
+	if start.Before(t) {
+		start = timeOfDay(t.AddDate(0, 0, 1), w.start)
+	}
+	return start
+}
+
+// nextClose returns when the window, open at t, next closes.
+func (w *readWindow) nextClose(t time.Time) time.Time {
+	end := timeOfDay(t, w.end)
+	if !end.After(t) {
+		end = timeOfDay(t.AddDate(0, 0, 1), w.end)
+	}
+	return end
+}
+
+// keepInWindow pauses the run listening on the control socket whenever the
+// window closes, and resumes it when it opens again, until done is closed or
+// ctx is canceled. The paused run keeps all of its progress.
+func keepInWindow(ctx context.Context, w *readWindow, socket string, done <-chan struct{}) {
+	if w == nil {
+		return
+	}
+	sleep := func(until time.Time) bool {
+		select {
+		case <-time.After(time.Until(until)):
+			return true
+		case <-done:
+		case <-ctx.Done():
+		}
+		return false
+	}
+	for {
+		if !sleep(w.nextClose(time.Now())) {
+			return
+		}
+		open := w.nextOpen(time.Now())
+		fmt.Printf("%v: the --window %v has closed; pausing the run until %v\n", time.Now().Format(time.RFC3339), w, open.Format(time.RFC3339))
+		if _, err := sendControl(socket, "pause"); err != nil {
+			stderrf("pk-verify: failed to pause the run: %v\n", err)
+		}
+		if !sleep(open) {
+			return
+		}
+		fmt.Printf("%v: the --window %v is open; resuming the run\n", time.Now().Format(time.RFC3339), w)
+		if _, err := sendControl(socket, "resume"); err != nil {
+			stderrf("pk-verify: failed to resume the run: %v\n", err)
+		}
+	}
+}
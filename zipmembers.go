@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"perkeep.org/pkg/blob"
+)
+
+var zipMembers = flag.Bool("zip-members", false, "when verifying the zips of a blobpacked storage's largeBlobs as blobs (with --tier=packed or --all), also hash every blob packed in each zip, so that a zip that was hashed after its contents went bad is caught too. Each zip is still read once, in order; its members are hashed in parallel, on every CPU, while the next zip is read, which keeps the CPUs busy on stores of mostly big packs without adding any random reads")
+
+// A zipMemberHasher checks the blobs packed in blobpacked zips, for
+// --zip-members. The verifiers read each zip once and hand its contents over
+// (see add); a pool of hashers, one per CPU, then checks its members while
+// the verifiers go on reading.
+//
+// A nil *zipMemberHasher does nothing.
+type zipMemberHasher struct {
+	work chan zipMember
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	zips    int
+	members int
+	bad     []zipMemberProblem
+}
+
+// A zipMember is one blob packed in a zip, waiting to be hashed.
+type zipMember struct {
+	zip  blob.Ref
+	ref  blob.Ref
+	data []byte    // the blob, for data blobs, which are stored as is
+	file *zip.File // or the member holding it, for schema blobs
+}
+
+// A zipMemberProblem is a blob packed in a zip that didn't hash to its ref,
+// even though the zip as a whole did.
+type zipMemberProblem struct {
+	Zip     blob.Ref `json:"zip"`
+	Ref     blob.Ref `json:"ref"`
+	Problem string   `json:"problem"`
+}
+
+// newZipMemberHasher starts the hashers.
+func newZipMemberHasher() *zipMemberHasher {
+	n := runtime.NumCPU()
+	h := &zipMemberHasher{work: make(chan zipMember, 4*n)}
+	for i := 0; i < n; i++ {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for m := range h.work {
+				h.check(m)
+			}
+		}()
+	}
+	return h
+}
+
+// add queues the members of the valid zip br, whose contents are data, to
+// be hashed. It only blocks while the hashers are far behind, which bounds
+// how many zips are in memory at once. Blobs that aren't blobpacked zips are
+// ignored.
+func (h *zipMemberHasher) add(br blob.Ref, data []byte) {
+	if h == nil || !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return
+	}
+	var manifest *sanityManifest
+	var members []zipMember
+	for _, zf := range zr.File {
+		if zf.Name == packManifestName {
+			// A zip without a readable manifest is reported
+			// by checkBlobpacked.
+			rc, err := zf.Open()
+			if err != nil {
+				return
+			}
+			manifest = new(sanityManifest)
+			err = json.NewDecoder(rc).Decode(manifest)
+			rc.Close()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if dir, name := path.Split(zf.Name); dir == packMemberDir && strings.HasSuffix(name, packMemberSuffix) {
+			if ref, ok := blob.Parse(strings.TrimSuffix(name, packMemberSuffix)); ok {
+				members = append(members, zipMember{zip: br, ref: ref, file: zf})
+			}
+		}
+	}
+	if manifest == nil {
+		return // not a blobpacked zip
+	}
+	for _, db := range manifest.DataBlobs {
+		m := zipMember{zip: br, ref: db.Ref}
+		if end := db.Offset + int64(db.Size); db.Offset >= 0 && end <= int64(len(data)) {
+			m.data = data[db.Offset:end]
+		}
+		members = append(members, m)
+	}
+
+	h.mu.Lock()
+	h.zips++
+	h.members += len(members)
+	h.mu.Unlock()
+	for _, m := range members {
+		h.work <- m
+	}
+}
+
+// check hashes one member.
+func (h *zipMemberHasher) check(m zipMember) {
+	data := m.data
+	if m.file != nil {
+		rc, err := m.file.Open()
+		if err != nil {
+			h.problem(m.zip, m.ref, fmt.Sprintf("can't read it: %v", err))
+			return
+		}
+		data, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			h.problem(m.zip, m.ref, fmt.Sprintf("can't read it: %v", err))
+			return
+		}
+	} else if data == nil {
+		h.problem(m.zip, m.ref, "the manifest places it past the end of the zip")
+		return
+	}
+	hash := m.ref.Hash()
+	if hash == nil {
+		return // an unsupported hash; verifying the zip is all that can be done
+	}
+	hash.Write(data)
+	if !m.ref.HashMatches(hash) {
+		h.problem(m.zip, m.ref, fmt.Sprintf("its %v bytes hash to %v", len(data), blob.RefFromHash(hash)))
+	}
+}
+
+func (h *zipMemberHasher) problem(zip, ref blob.Ref, problem string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bad = append(h.bad, zipMemberProblem{Zip: zip, Ref: ref, Problem: problem})
+}
+
+// finish waits for the hashers to check every member queued, records the
+// results in s, and reports any problems to found. No more zips may be added
+// after it is called.
+func (h *zipMemberHasher) finish(s *Summary, found *findings) {
+	if h == nil {
+		return
+	}
+	close(h.work)
+	h.wg.Wait()
+	if h.zips == 0 {
+		return
+	}
+	s.ZipMembersChecked = h.members
+	s.BadZipMembers = h.bad
+	for _, p := range h.bad {
+		found.report("blob %v, packed in zip %v, is corrupt: %v", p.Ref, p.Zip, p.Problem)
+	}
+	if n := len(h.bad); n > 0 {
+		fmt.Printf("BAD PACKED BLOBS: %v of the %v blob%v packed in %v zip%v %v corrupt, though the zips themselves are intact. They are listed %v.\n", n, humanCount(h.members), plural(h.members), humanCount(h.zips), plural(h.zips), isAre(n), found.where())
+		if s.Status == "clean" || s.Status == "missing" {
+			s.Status = "corrupt"
+		}
+	} else {
+		fmt.Printf("all %v blob%v packed in %v zip%v hashed correctly\n", humanCount(h.members), plural(h.members), humanCount(h.zips), plural(h.zips))
+	}
+}
+
+// largeBlobsPrefixes returns the prefixes of the largeBlobs storages of the
+// blobpacked storages in conf, which hold their zips.
+func largeBlobsPrefixes(conf *LowLevelConfig) map[string]bool {
+	large := map[string]bool{}
+	for _, sc := range conf.Prefixes {
+		if sc.StorageHandler != "blobpacked" {
+			continue
+		}
+		if prefix, _ := sc.StorageHandlerArgs["largeBlobs"].(string); prefix != "" {
+			large[prefix] = true
+		}
+	}
+	return large
+}